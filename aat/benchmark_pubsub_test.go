@@ -1,7 +1,10 @@
 package aat
 
 import (
+	"fmt"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/gammazero/nexus/client"
@@ -103,3 +106,80 @@ func connectSubscriber(fn client.EventHandler) *client.Client {
 	}
 	return subscriber
 }
+
+// The parallel benchmarks publish to a different topic from each goroutine,
+// to measure how routing scales with the number of cores.  Run with the -cpu
+// flag to compare, for example: go test -bench Parallel -cpu 1,2,4,8,16
+func BenchmarkParallelPub1Sub(b *testing.B) {
+	benchParallelPubSub(1, b)
+}
+
+func BenchmarkParallelPub8Sub(b *testing.B) {
+	benchParallelPubSub(8, b)
+}
+
+func BenchmarkParallelPub64Sub(b *testing.B) {
+	benchParallelPubSub(64, b)
+}
+
+// pubSubLane is a publisher and the subscribers to its topic.
+type pubSubLane struct {
+	topic     string
+	publisher *client.Client
+	subs      []*client.Client
+	done      sync.WaitGroup
+}
+
+func benchParallelPubSub(subCount int, b *testing.B) {
+	lanes := make([]*pubSubLane, runtime.GOMAXPROCS(0))
+	for i := range lanes {
+		lane := &pubSubLane{topic: fmt.Sprint(testTopic, ".", i)}
+		evtHandler := func(args wamp.List, kwargs wamp.Dict, details wamp.Dict) {
+			lane.done.Done()
+		}
+		for j := 0; j < subCount; j++ {
+			subscriber, err := connectClient()
+			if err != nil {
+				panic("Failed to connect client: " + err.Error())
+			}
+			if err = subscriber.Subscribe(lane.topic, evtHandler, nil); err != nil {
+				panic("subscribe error: " + err.Error())
+			}
+			lane.subs = append(lane.subs, subscriber)
+		}
+		publisher, err := connectClient()
+		if err != nil {
+			panic("Failed to connect client: " + err.Error())
+		}
+		lane.publisher = publisher
+		lanes[i] = lane
+	}
+
+	args := wamp.List{"hello world"}
+	var nextLane int32
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		lane := lanes[int(atomic.AddInt32(&nextLane, 1)-1)%len(lanes)]
+		for pb.Next() {
+			lane.done.Add(subCount * benchMsgCount)
+			for j := 0; j < benchMsgCount; j++ {
+				err := lane.publisher.Publish(lane.topic, nil, args, nil)
+				if err != nil {
+					panic("Error publishing: " + err.Error())
+				}
+			}
+			// Wait until all subscribers got the messages.
+			lane.done.Wait()
+		}
+	})
+
+	b.StopTimer()
+	for _, lane := range lanes {
+		lane.publisher.Close()
+		for _, subscriber := range lane.subs {
+			subscriber.Close()
+		}
+	}
+}
@@ -76,6 +76,11 @@ type Config struct {
 
 	// Websocket transport configuration.
 	WsCfg transport.WebsocketConfig
+
+	// KeyProvider supplies the keys for end-to-end encryption of payloads,
+	// using payload passthru mode.  It is only needed to use the encrypted
+	// payload functions, such as PublishEncrypted and DecryptPayload.
+	KeyProvider KeyProvider
 }
 
 // Define serialization consts in client package so that client code does not
@@ -92,30 +97,36 @@ var clientRoles = wamp.Dict{
 		"features": wamp.Dict{
 			"subscriber_blackwhite_listing": true,
 			"publisher_exclusion":           true,
+			"payload_passthru_mode":         true,
 		},
 	},
 	"subscriber": wamp.Dict{
 		"features": wamp.Dict{
 			"pattern_based_subscription": true,
 			"publisher_identification":   true,
+			"payload_passthru_mode":      true,
 		},
 	},
 	"callee": wamp.Dict{
 		"features": wamp.Dict{
-			"pattern_based_registration": true,
-			"shared_registration":        true,
-			"call_canceling":             true,
-			"call_timeout":               true,
-			"caller_identification":      true,
-			"progressive_call_results":   true,
+			"pattern_based_registration":   true,
+			"shared_registration":          true,
+			"call_canceling":               true,
+			"call_timeout":                 true,
+			"caller_identification":        true,
+			"progressive_call_invocations": true,
+			"progressive_call_results":     true,
+			"payload_passthru_mode":        true,
 		},
 	},
 	"caller": wamp.Dict{
 		"features": wamp.Dict{
-			"call_canceling":           true,
-			"call_timeout":             true,
-			"caller_identification":    true,
-			"progressive_call_results": true,
+			"call_canceling":               true,
+			"call_timeout":                 true,
+			"caller_identification":        true,
+			"progressive_call_invocations": true,
+			"progressive_call_results":     true,
+			"payload_passthru_mode":        true,
 		},
 	},
 }
@@ -125,6 +136,10 @@ type InvokeResult struct {
 	Args   wamp.List
 	Kwargs wamp.Dict
 	Err    wamp.URI
+
+	// Options sent with a result that is not an error, such as the payload
+	// passthru options of an encrypted result.
+	Options wamp.Dict
 }
 
 // A Client routes messages to/from a WAMP router.
@@ -140,6 +155,8 @@ type Client struct {
 	topicSubID    map[string]wamp.ID
 
 	invHandlers    map[wamp.ID]InvocationHandler
+	streamHandlers map[wamp.ID]StreamInvocationHandler
+	invStreams     map[wamp.ID]*invocationStream
 	nameProcID     map[string]wamp.ID
 	invHandlerKill map[wamp.ID]context.CancelFunc
 	progGate       map[context.Context]wamp.ID
@@ -153,6 +170,9 @@ type Client struct {
 	log   stdlog.StdLog
 	debug bool
 
+	keyProvider   KeyProvider
+	serialization serialize.Serialization
+
 	closed        int32
 	done          chan struct{}
 	routerGoodbye *wamp.Goodbye
@@ -190,6 +210,8 @@ func NewClient(p wamp.Peer, cfg Config) (*Client, error) {
 		topicSubID:    map[string]wamp.ID{},
 
 		invHandlers:    map[wamp.ID]InvocationHandler{},
+		streamHandlers: map[wamp.ID]StreamInvocationHandler{},
+		invStreams:     map[wamp.ID]*invocationStream{},
 		nameProcID:     map[string]wamp.ID{},
 		invHandlerKill: map[wamp.ID]context.CancelFunc{},
 		progGate:       map[context.Context]wamp.ID{},
@@ -201,6 +223,9 @@ func NewClient(p wamp.Peer, cfg Config) (*Client, error) {
 		log:   cfg.Logger,
 		debug: cfg.Debug,
 		idGen: new(wamp.SyncIDGen),
+
+		keyProvider:   cfg.KeyProvider,
+		serialization: cfg.Serialization,
 	}
 	go c.run() // start the core goroutine
 	return c, nil
@@ -255,6 +280,30 @@ type EventHandler func(args wamp.List, kwargs, details wamp.Dict)
 // To request a pattern-based subscription set:
 //   options["match"] = "prefix" or "wildcard"
 //
+// To only receive events from publishers that have one of the listed
+// authroles, authids, or session IDs, set any of the following.  Other session
+// attributes can be listed using options named "from_" followed by the
+// attribute name.
+//   options["from_authrole"] = wamp.List{"device"}
+//   options["from_authid"] = wamp.List{"sensor1", "sensor2"}
+//   options["from_session"] = wamp.List{sessionID}
+//
+// To receive the most recent event, of each matching topic, that was published
+// with the retain option before subscribing, set the following.  These events
+// have details["retained"] set to true.
+//   options["get_retained"] = true
+//
+// To receive only the events whose payload matches a filter expression, set
+// the filter option.  The expression refers to the event arguments as args
+// and kwargs, and supports comparisons, &&, ||, and !.
+//   options["filter"] = `kwargs.temperature > 30 && kwargs.site == "A"`
+//
+// To have the router keep each event until it is acknowledged, and send it
+// again if it is not acknowledged in time, set the following.  Each event has
+// a sequence number in details["seq"], and events sent again have
+// details["redelivered"] set to true.  Acknowledge events using AckEvents.
+//   options["reliable"] = true
+//
 // NOTE: Use consts defined in wamp/options.go instead of raw strings.
 func (c *Client) Subscribe(topic string, fn EventHandler, options wamp.Dict) error {
 	if options == nil {
@@ -353,6 +402,20 @@ func (c *Client) Unsubscribe(topic string) error {
 	return unexpectedMsgError(msg, wamp.UNSUBSCRIBED)
 }
 
+// AckEvents acknowledges the events, up to and including the sequence number,
+// received using a reliable subscription to the topic.  The router does not
+// send acknowledged events again.  Since acknowledgement is cumulative, a
+// subscriber can acknowledge a batch of events using the sequence number of
+// the last event processed.
+func (c *Client) AckEvents(ctx context.Context, topic string, seq uint64) error {
+	subID, ok := c.SubscriptionID(topic)
+	if !ok {
+		return errors.New("not subscribed to: " + topic)
+	}
+	_, err := c.Call(ctx, string(wamp.MetaProcSubAck), nil, wamp.List{subID, seq}, nil, "")
+	return err
+}
+
 // Publish publishes an EVENT to all subscribed clients.
 //
 // Publish Options
@@ -385,6 +448,10 @@ func (c *Client) Unsubscribe(topic string) error {
 // To request that this publisher's identity is disclosed to subscribers, set:
 //   options["disclose_me"] = true
 //
+// To request that the router keep this event, as the most recent event of the
+// topic, to send to clients that subscribe to the topic later, set:
+//   options["retain"] = true
+//
 // NOTE: Use consts defined in wamp/options.go instead of raw strings.
 func (c *Client) Publish(topic string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) error {
 	if options == nil {
@@ -452,8 +519,73 @@ type InvocationHandler func(context.Context, wamp.List, wamp.Dict, wamp.Dict) (r
 // To request that caller identification is disclosed to this callee, set:
 //   options["disclose_caller"] = true
 //
+// To request that calls to an idempotent procedure fail over to another
+// callee of a shared registration, if a call cannot be delivered to a callee,
+// or a callee leaves before answering a call, set:
+//   options["failover"] = true
+//   options["max_attempts"] = 3 // optional limit of callees to try
+//
+// To limit the number of invocations that the router sends to this callee at
+// once, set the following.  Calls in excess of the limit are queued by the
+// router, up to the queue limit of the registration.
+//   options["concurrency"] = 1
+//   options["queue_limit"] = 100 // optional, same for all callees
+//
+// To refuse calls from callers that the router assigned a trust level lower
+// than required, set:
+//   options["min_trustlevel"] = 2
+//
+// To only allow calls from callers that have one of the listed authroles,
+// authids, or session IDs, set any of the following.  Other session attributes
+// can be listed using options named "allow_" followed by the attribute name.
+//   options["allow_authrole"] = wamp.List{"admin", "service"}
+//   options["allow_authid"] = wamp.List{"alice"}
+//   options["allow_session"] = wamp.List{sessionID}
+//
+// To allow the router to answer a call with the result of an identical earlier
+// call, instead of invoking a callee, set the number of milliseconds to cache
+// results for.  Only use this for procedures whose result depends only on the
+// procedure and arguments of the call.
+//   options["cache_ttl"] = 5000
+//
+// To describe the procedure to callers that use the wamp.reflection meta
+// procedures, set a schema with JSON Schemas for the arguments and result:
+//   options["schema"] = wamp.Dict{
+//       "description": "Adds two numbers",
+//       "args": wamp.Dict{"type": "array", "items": wamp.Dict{"type": "number"}},
+//       "result": wamp.Dict{"args": wamp.Dict{"type": "array"}},
+//   }
+//
 // NOTE: Use consts defined in wamp/options.go instead of raw strings.
 func (c *Client) Register(procedure string, fn InvocationHandler, options wamp.Dict) error {
+	return c.register(procedure, fn, nil, options)
+}
+
+// StreamInvocationHandler handles a remote procedure call whose caller sends
+// its input as a series of progressive invocations.
+//
+// Each INVOCATION for the call, starting with the first, is received on the
+// inputs channel.  The channel is closed after the last INVOCATION, which is
+// the one that does not have details["progress"] set.  A handler may return a
+// result before all input is received.
+//
+// The Context and progressive results are handled the same as for an
+// InvocationHandler.
+type StreamInvocationHandler func(ctx context.Context, inputs <-chan *wamp.Invocation) (result *InvokeResult)
+
+// RegisterStream registers the client to handle invocations of the specified
+// procedure, where callers may send their input as progressive invocations.
+// The StreamInvocationHandler is called once for each call, and receives
+// all of the call's invocations.
+//
+// Register options are the same as for Register.
+func (c *Client) RegisterStream(procedure string, fn StreamInvocationHandler, options wamp.Dict) error {
+	return c.register(procedure, nil, fn, options)
+}
+
+// register registers either an InvocationHandler or a StreamInvocationHandler
+// for a procedure.
+func (c *Client) register(procedure string, fn InvocationHandler, sfn StreamInvocationHandler, options wamp.Dict) error {
 	id := c.idGen.Next()
 	c.expectReply(id)
 	if options == nil {
@@ -475,7 +607,11 @@ func (c *Client) Register(procedure string, fn InvocationHandler, options wamp.D
 		// Register the event handler for this registration.
 		sync := make(chan struct{})
 		c.actionChan <- func() {
-			c.invHandlers[msg.Registration] = fn
+			if sfn != nil {
+				c.streamHandlers[msg.Registration] = sfn
+			} else {
+				c.invHandlers[msg.Registration] = fn
+			}
 			c.nameProcID[procedure] = msg.Registration
 			close(sync)
 		}
@@ -523,6 +659,7 @@ func (c *Client) Unregister(procedure string) error {
 			// more invocations for the procedure, and may not expect any.
 			delete(c.nameProcID, procedure)
 			delete(c.invHandlers, procID)
+			delete(c.streamHandlers, procID)
 		}
 		close(sync)
 	}
@@ -619,11 +756,36 @@ func (c *Client) Unregister(procedure string) error {
 // To request that this caller's identity disclosed to callees, set:
 //   options["disclose_me"] = true
 //
+// Failover
+//
+// A caller may enable or disable failover to another callee, overriding the
+// failover setting of the registration:
+//   options["failover"] = true
+//   options["max_attempts"] = 3 // optional limit of callees to try
+//
+// Fan-out Calls
+//
+// A caller may call every callee of a shared registration.  The result
+// contains the response of each callee in ArgumentsKw, keyed by the callee's
+// session ID.  Each response is a dict with the callee's "args" and "kwargs",
+// and "error" if the callee returned an error.
+//
+// To call all callees, and optionally return after the first N responses or
+// with the responses received when the timeout expires, set:
+//   options["fanout"] = true
+//   options["quorum"] = N
+//   options["timeout"] = 5000
+//
 // NOTE: Use consts defined in wamp/options.go instead of raw strings.
 //
 // Progressive Call Results
 //
 // To request progressive call results, use the CallProgress function.
+//
+// Progressive Call Invocations
+//
+// To send the call input as a series of progressive invocations, use the
+// CallStream function.
 func (c *Client) Call(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, cancelMode string) (*wamp.Result, error) {
 	return c.CallProgress(ctx, procedure, options, args, kwargs, cancelMode, nil)
 }
@@ -648,6 +810,101 @@ type ProgressCallback func(*wamp.Result)
 // IMPORTANT: If the context has a timeout, then this needs to be sufficient to
 // receive all progressive results as well as the final result.
 func (c *Client) CallProgress(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, cancelMode string, progcb ProgressCallback) (*wamp.Result, error) {
+	return c.call(ctx, procedure, options, cancelMode, progcb,
+		func(id wamp.ID, options wamp.Dict) {
+			c.sess.Send(&wamp.Call{
+				Request:     id,
+				Procedure:   wamp.URI(procedure),
+				Options:     options,
+				Arguments:   args,
+				ArgumentsKw: kwargs,
+			})
+		})
+}
+
+// CallInput is the input sent in one of the CALL messages of a call made
+// with CallStream.
+type CallInput struct {
+	Args   wamp.List
+	Kwargs wamp.Dict
+}
+
+// CallStream is the same as CallProgress, except that the caller's input is
+// read from the inputs channel and sent as a series of progressive call
+// invocations, instead of in a single CALL message.
+//
+// A CALL message is sent for each input, with options["progress"] set on all
+// but the last.  The last input is sent when the inputs channel is closed, so
+// the caller must close inputs to complete the call.  If inputs is closed
+// without sending any input, then a final CALL without arguments is sent.
+//
+// The callee must support progressive call invocations.  The nexus client
+// does for procedures registered using RegisterStream.
+//
+// If a result is received, or the call is canceled, before all input is sent,
+// then no more input is read from the inputs channel.
+func (c *Client) CallStream(ctx context.Context, procedure string, options wamp.Dict, inputs <-chan CallInput, cancelMode string, progcb ProgressCallback) (*wamp.Result, error) {
+	// Stop sending input when the call is finished.
+	sendCtx, stopSend := context.WithCancel(ctx)
+	defer stopSend()
+	return c.call(ctx, procedure, options, cancelMode, progcb,
+		func(id wamp.ID, options wamp.Dict) {
+			go c.sendCallInputs(sendCtx, id, procedure, options, inputs)
+		})
+}
+
+// sendCallInputs sends a CALL message for each input read from inputs.  The
+// options are sent with the first CALL only.  Each input is held until the
+// next is read, so that the last input is sent without progress set.
+func (c *Client) sendCallInputs(ctx context.Context, id wamp.ID, procedure string, options wamp.Dict, inputs <-chan CallInput) {
+	var pending *CallInput
+	send := func(progress bool) error {
+		opts := wamp.Dict{}
+		if options != nil {
+			for k, v := range options {
+				opts[k] = v
+			}
+			options = nil
+		}
+		if progress {
+			opts[wamp.OptProgress] = true
+		} else {
+			delete(opts, wamp.OptProgress)
+		}
+		msg := &wamp.Call{
+			Request:   id,
+			Procedure: wamp.URI(procedure),
+			Options:   opts,
+		}
+		if pending != nil {
+			msg.Arguments = pending.Args
+			msg.ArgumentsKw = pending.Kwargs
+		}
+		return c.sess.SendCtx(ctx, msg)
+	}
+
+	for {
+		select {
+		case input, ok := <-inputs:
+			if !ok {
+				send(false)
+				return
+			}
+			if pending != nil {
+				if err := send(true); err != nil {
+					return
+				}
+			}
+			pending = &input
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// call makes a call, using the send function to send the CALL message(s), and
+// waits for the result.
+func (c *Client) call(ctx context.Context, procedure string, options wamp.Dict, cancelMode string, progcb ProgressCallback, send func(wamp.ID, wamp.Dict)) (*wamp.Result, error) {
 	switch cancelMode {
 	case wamp.CancelModeKill, wamp.CancelModeKillNoWait, wamp.CancelModeSkip:
 	case "":
@@ -681,13 +938,7 @@ func (c *Client) CallProgress(ctx context.Context, procedure string, options wam
 
 	id := c.idGen.Next()
 	c.expectReply(id)
-	c.sess.Send(&wamp.Call{
-		Request:     id,
-		Procedure:   wamp.URI(procedure),
-		Options:     options,
-		Arguments:   args,
-		ArgumentsKw: kwargs,
-	})
+	send(id, options)
 
 	// Wait to receive RESULT message.
 	var msg wamp.Message
@@ -1217,8 +1468,22 @@ func (c *Client) runHandleEvent(msg *wamp.Event) {
 // runHandleInvocation processes an INVOCATION message from the router
 // requesting a call to a registered RPC procedure.
 func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
+	progress, _ := msg.Details[wamp.OptProgress].(bool)
+
+	// An INVOCATION that continues a progressive call is input for the stream
+	// handler already running for the call.
+	if stream, ok := c.invStreams[msg.Request]; ok {
+		stream.send(msg)
+		if !progress {
+			delete(c.invStreams, msg.Request)
+			close(stream.in)
+		}
+		return
+	}
+
 	handler, ok := c.invHandlers[msg.Registration]
-	if !ok {
+	sfn, isStream := c.streamHandlers[msg.Registration]
+	if !ok && !isStream {
 		errMsg := fmt.Sprintf("Client has no handler for registration %v",
 			msg.Registration)
 		// The dealer has a procedure registered to this client, but this
@@ -1236,6 +1501,18 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 		c.log.Print(errMsg)
 		return
 	}
+	if progress && !isStream {
+		// The handler for this registration only handles calls that send
+		// all input in a single invocation.
+		c.sess.Send(&wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrFeatureNotSupported,
+			Arguments: wamp.List{"procedure not registered for progressive call invocations"},
+		})
+		return
+	}
 
 	// Create a kill switch so that invocation can be canceled.
 	var cancel context.CancelFunc
@@ -1251,6 +1528,20 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 	c.invHandlerKill[msg.Request] = cancel
 	c.activeInvHandlers.Add(1)
 
+	// Give a stream handler a stream that delivers this and any following
+	// invocations for the call.
+	if isStream {
+		stream := newInvocationStream(ctx, msg)
+		if progress {
+			c.invStreams[msg.Request] = stream
+		} else {
+			close(stream.in)
+		}
+		handler = func(ctx context.Context, _ wamp.List, _, _ wamp.Dict) *InvokeResult {
+			return sfn(ctx, stream.out)
+		}
+	}
+
 	// If caller is accepting progressive results, create map entry to
 	// allow progress to be sent.
 	if ok, _ = msg.Details[wamp.OptReceiveProgress].(bool); ok {
@@ -1283,6 +1574,10 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 
 			c.actionChan <- func() {
 				delete(c.invHandlerKill, msg.Request)
+				if stream, ok := c.invStreams[msg.Request]; ok {
+					delete(c.invStreams, msg.Request)
+					close(stream.in)
+				}
 				c.activeInvHandlers.Done()
 			}
 		}()
@@ -1326,9 +1621,13 @@ func (c *Client) runHandleInvocation(msg *wamp.Invocation) {
 			})
 			return
 		}
+		options := result.Options
+		if options == nil {
+			options = wamp.Dict{}
+		}
 		c.sess.Send(&wamp.Yield{
 			Request:     msg.Request,
-			Options:     wamp.Dict{},
+			Options:     options,
 			Arguments:   result.Args,
 			ArgumentsKw: result.Kwargs,
 		})
@@ -1365,3 +1664,58 @@ func (c *Client) runSignalReply(msg wamp.Message, requestID wamp.ID) {
 	}
 	w <- msg
 }
+
+// invocationStream delivers the invocations of a progressive call to a
+// StreamInvocationHandler, in the order received.  Invocations are queued so
+// that the run() goroutine never waits for the handler to read them.
+type invocationStream struct {
+	in   chan *wamp.Invocation
+	out  chan *wamp.Invocation
+	done <-chan struct{}
+}
+
+// newInvocationStream creates an invocationStream holding the first
+// invocation of a call.  The stream stops when ctx is done.
+func newInvocationStream(ctx context.Context, first *wamp.Invocation) *invocationStream {
+	s := &invocationStream{
+		in:   make(chan *wamp.Invocation),
+		out:  make(chan *wamp.Invocation),
+		done: ctx.Done(),
+	}
+	go s.run([]*wamp.Invocation{first})
+	return s
+}
+
+// send puts an invocation on the stream, unless the stream has stopped.
+func (s *invocationStream) send(msg *wamp.Invocation) {
+	select {
+	case s.in <- msg:
+	case <-s.done:
+	}
+}
+
+func (s *invocationStream) run(queue []*wamp.Invocation) {
+	defer close(s.out)
+	in := s.in
+	for in != nil || len(queue) != 0 {
+		var out chan *wamp.Invocation
+		var next *wamp.Invocation
+		if len(queue) != 0 {
+			out = s.out
+			next = queue[0]
+		}
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, msg)
+		case out <- next:
+			queue[0] = nil
+			queue = queue[1:]
+		case <-s.done:
+			return
+		}
+	}
+}
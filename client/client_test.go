@@ -440,6 +440,102 @@ func TestProgressiveCall(t *testing.T) {
 	r.Close()
 }
 
+func TestProgressiveCallInvocations(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Connect two clients to the same server
+	callee, caller, r, err := connectedTestClients()
+	if err != nil {
+		t.Fatal("failed to connect test clients:", err)
+	}
+
+	// Handler sums the input from all invocations of the call.
+	handler := func(ctx context.Context, inputs <-chan *wamp.Invocation) *InvokeResult {
+		var sum, count int64
+		for inv := range inputs {
+			for i := range inv.Arguments {
+				n, ok := wamp.AsInt64(inv.Arguments[i])
+				if ok {
+					sum += n
+				}
+			}
+			count++
+		}
+		return &InvokeResult{Args: wamp.List{sum, count}}
+	}
+
+	procName := "nexus.test.streamproc"
+
+	// Register procedure
+	if err = callee.RegisterStream(procName, handler, nil); err != nil {
+		t.Fatal("Failed to register procedure:", err)
+	}
+
+	// Test calling the procedure with input sent in multiple CALL messages.
+	inputs := make(chan CallInput)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			inputs <- CallInput{Args: wamp.List{i}}
+		}
+		close(inputs)
+	}()
+	ctx := context.Background()
+	result, err := caller.CallStream(ctx, procName, nil, inputs, "", nil)
+	if err != nil {
+		t.Fatal("Failed to call procedure:", err)
+	}
+	sum, _ := wamp.AsInt64(result.Arguments[0])
+	if sum != 55 {
+		t.Fatal("Wrong result:", sum)
+	}
+	count, _ := wamp.AsInt64(result.Arguments[1])
+	if count != 10 {
+		t.Fatal("Expected 10 invocations, got", count)
+	}
+
+	// Test calling the stream handler with a single CALL.
+	result, err = caller.Call(ctx, procName, nil, wamp.List{5}, nil, "")
+	if err != nil {
+		t.Fatal("Failed to call procedure:", err)
+	}
+	if sum, _ = wamp.AsInt64(result.Arguments[0]); sum != 5 {
+		t.Fatal("Wrong result:", sum)
+	}
+
+	// Test that a handler registered with Register rejects streamed input.
+	plainName := "nexus.test.plainproc"
+	plain := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		return &InvokeResult{}
+	}
+	if err = callee.Register(plainName, plain, nil); err != nil {
+		t.Fatal("Failed to register procedure:", err)
+	}
+	inputs = make(chan CallInput, 2)
+	inputs <- CallInput{Args: wamp.List{1}}
+	inputs <- CallInput{Args: wamp.List{2}}
+	close(inputs)
+	_, err = caller.CallStream(ctx, plainName, nil, inputs, "", nil)
+	rpcErr, ok := err.(RPCError)
+	if !ok {
+		t.Fatal("Expected RPCError, got:", err)
+	}
+	if rpcErr.Err.Error != wamp.ErrFeatureNotSupported {
+		t.Fatal("Wrong error:", rpcErr.Err.Error)
+	}
+
+	// Test unregister.
+	if err = callee.Unregister(procName); err != nil {
+		t.Fatal("Failed to unregister procedure:", err)
+	}
+	if err = callee.Unregister(plainName); err != nil {
+		t.Fatal("Failed to unregister procedure:", err)
+	}
+
+	caller.Close()
+	callee.Close()
+	r.Close()
+}
+
 func TestTimeoutCancelRemoteProcedureCall(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -614,6 +710,120 @@ func TestTimeoutRemoteProcedureCall(t *testing.T) {
 
 // ---- authentication test stuff ------
 
+func TestEncryptedPayload(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	realmConfig := &router.RealmConfig{
+		URI:           wamp.URI(testRealm),
+		StrictURI:     true,
+		AnonymousAuth: true,
+	}
+	r, err := getTestRouter(realmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &StaticKeyProvider{KeyID: "key1"}
+	copy(keys.Key[:], "0123456789abcdef0123456789abcdef")
+	cfg := Config{
+		Realm:           testRealm,
+		ResponseTimeout: 500 * time.Millisecond,
+		Logger:          logger,
+		KeyProvider:     keys,
+	}
+	callee, err := ConnectLocal(r, cfg)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+	caller, err := ConnectLocal(r, cfg)
+	if err != nil {
+		t.Fatal("failed to connect client:", err)
+	}
+
+	// Test encrypting and decrypting payload.
+	opts, payload, err := caller.EncryptPayload("some.uri", wamp.List{"hello"}, wamp.Dict{"n": 7})
+	if err != nil {
+		t.Fatal("failed to encrypt payload:", err)
+	}
+	if opts[wamp.OptPPTKeyID] != "key1" || len(payload) != 1 {
+		t.Fatal("wrong encrypted payload:", opts, payload)
+	}
+	args, kwargs, err := callee.DecryptPayload(opts, payload, nil)
+	if err != nil {
+		t.Fatal("failed to decrypt payload:", err)
+	}
+	if len(args) != 1 || args[0] != "hello" {
+		t.Fatal("wrong decrypted args:", args)
+	}
+	if n, _ := wamp.AsInt64(kwargs["n"]); n != 7 {
+		t.Fatal("wrong decrypted kwargs:", kwargs)
+	}
+
+	// Test that payload with other key cannot be decrypted.
+	opts[wamp.OptPPTKeyID] = "key2"
+	if _, _, err = callee.DecryptPayload(opts, payload, nil); err == nil {
+		t.Fatal("expected error decrypting with unknown key")
+	}
+
+	// Test calling procedure with encrypted payload.
+	handler := func(ctx context.Context, args wamp.List, kwargs, details wamp.Dict) *InvokeResult {
+		if _, ok := details[wamp.OptPPTScheme]; !ok {
+			return &InvokeResult{Err: wamp.ErrInvalidArgument}
+		}
+		args, _, err := callee.DecryptPayload(details, args, kwargs)
+		if err != nil || len(args) != 1 {
+			return &InvokeResult{Err: wamp.ErrInvalidArgument}
+		}
+		n, _ := wamp.AsInt64(args[0])
+		return callee.EncryptResult("secret.proc", &InvokeResult{Args: wamp.List{n * 37}})
+	}
+	if err = callee.Register("secret.proc", handler, nil); err != nil {
+		t.Fatal("failed to register procedure:", err)
+	}
+	ctx := context.Background()
+	result, err := caller.CallEncrypted(ctx, "secret.proc", nil, wamp.List{73}, nil, "")
+	if err != nil {
+		t.Fatal("failed to call procedure:", err)
+	}
+	if n, _ := wamp.AsInt64(result.Arguments[0]); n != 2701 {
+		t.Fatal("wrong result:", result.Arguments)
+	}
+
+	// Test publishing event with encrypted payload.
+	events := make(chan wamp.List, 1)
+	evtHandler := func(args wamp.List, kwargs wamp.Dict, details wamp.Dict) {
+		args, _, err := callee.DecryptPayload(details, args, kwargs)
+		if err != nil {
+			t.Error("failed to decrypt event:", err)
+		}
+		events <- args
+	}
+	if err = callee.Subscribe("secret.topic", evtHandler, nil); err != nil {
+		t.Fatal("failed to subscribe:", err)
+	}
+	if err = caller.PublishEncrypted("secret.topic", nil, wamp.List{"hi"}, nil); err != nil {
+		t.Fatal("failed to publish:", err)
+	}
+	select {
+	case args = <-events:
+		if len(args) != 1 || args[0] != "hi" {
+			t.Fatal("wrong event args:", args)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive event")
+	}
+
+	if err = callee.Unsubscribe("secret.topic"); err != nil {
+		t.Fatal("failed to unsubscribe:", err)
+	}
+	if err = callee.Unregister("secret.proc"); err != nil {
+		t.Fatal("failed to unregister procedure:", err)
+	}
+	caller.Close()
+	callee.Close()
+	r.Close()
+}
+
 func clientAuthFunc(c *wamp.Challenge) (string, wamp.Dict) {
 	// If the client needed to lookup a user's key, this would require decoding
 	// the JSON-encoded ch string and getting the authid. For this example
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/gammazero/nexus/transport/serialize"
+	"github.com/gammazero/nexus/wamp"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// nonceSize is the size of the random nonce that precedes the ciphertext of
+// an encrypted payload.
+const nonceSize = 24
+
+// ErrNoKeyProvider is returned when encrypting or decrypting a payload using
+// a client that was not configured with a KeyProvider.
+var ErrNoKeyProvider = errors.New("client has no key provider")
+
+// KeyProvider supplies the keys that a client uses for end-to-end encryption
+// of payloads, using payload passthru mode.  The router forwards encrypted
+// payloads without being able to read them.
+//
+// Keys are 32-byte keys for NaCl secretbox (XSalsa20-Poly1305).  The key ID
+// is sent with each encrypted payload, so that the receiver can find the key
+// to decrypt it.
+type KeyProvider interface {
+	// EncryptionKey returns the key, and its ID, to encrypt the payload of a
+	// call to a procedure, the result of a call, or a publication to a topic.
+	EncryptionKey(uri string) (keyID string, key *[32]byte, err error)
+
+	// DecryptionKey returns the key that has the ID.
+	DecryptionKey(keyID string) (*[32]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider that has one key, used for all
+// procedures and topics.
+type StaticKeyProvider struct {
+	KeyID string
+	Key   [32]byte
+}
+
+// EncryptionKey returns the provider's key.
+func (p *StaticKeyProvider) EncryptionKey(uri string) (string, *[32]byte, error) {
+	return p.KeyID, &p.Key, nil
+}
+
+// DecryptionKey returns the provider's key, if it has the ID.
+func (p *StaticKeyProvider) DecryptionKey(keyID string) (*[32]byte, error) {
+	if keyID != p.KeyID {
+		return nil, fmt.Errorf("unknown key ID: %q", keyID)
+	}
+	return &p.Key, nil
+}
+
+// EncryptPayload encrypts the positional and keyword arguments of a call, a
+// result, or a publication, for the procedure or topic URI.  Returns the
+// payload passthru options to send in the CALL, YIELD, or PUBLISH options,
+// and the encrypted payload to send as the only positional argument.
+//
+// The arguments are encoded using CBOR and encrypted using NaCl secretbox,
+// with a random nonce preceding the ciphertext.  This is compatible with
+// Autobahn clients that use the "wamp" payload passthru scheme.
+func (c *Client) EncryptPayload(uri string, args wamp.List, kwargs wamp.Dict) (wamp.Dict, wamp.List, error) {
+	if c.keyProvider == nil {
+		return nil, nil, ErrNoKeyProvider
+	}
+	keyID, key, err := c.keyProvider.EncryptionKey(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload := map[string]interface{}{}
+	if len(args) != 0 {
+		payload["args"] = args
+	}
+	if len(kwargs) != 0 {
+		payload["kwargs"] = kwargs
+	}
+	plain, err := serialize.EncodeValue(serialize.CBOR, payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot encode payload: %s", err)
+	}
+	var nonce [nonceSize]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return nil, nil, err
+	}
+	box := secretbox.Seal(nonce[:], plain, &nonce, key)
+
+	options := wamp.Dict{
+		wamp.OptPPTScheme:     wamp.PPTSchemeWAMP,
+		wamp.OptPPTSerializer: wamp.PPTSerializerCBOR,
+		wamp.OptPPTCipher:     wamp.PPTCipherXSalsa20Poly1305,
+	}
+	if keyID != "" {
+		options[wamp.OptPPTKeyID] = keyID
+	}
+	return options, wamp.List{serialize.BinaryData(box)}, nil
+}
+
+// DecryptPayload decrypts the payload of an EVENT, INVOCATION, or RESULT,
+// given the message details and arguments, and returns the positional and
+// keyword arguments that were encrypted.  If the details do not have the
+// payload passthru options, the arguments are returned unchanged.
+func (c *Client) DecryptPayload(details wamp.Dict, args wamp.List, kwargs wamp.Dict) (wamp.List, wamp.Dict, error) {
+	scheme, ok := wamp.AsString(details[wamp.OptPPTScheme])
+	if !ok {
+		return args, kwargs, nil
+	}
+	if scheme != wamp.PPTSchemeWAMP {
+		return nil, nil, fmt.Errorf("unsupported %s: %q", wamp.OptPPTScheme, scheme)
+	}
+	if cipher, ok := wamp.AsString(details[wamp.OptPPTCipher]); ok && cipher != wamp.PPTCipherXSalsa20Poly1305 {
+		return nil, nil, fmt.Errorf("unsupported %s: %q", wamp.OptPPTCipher, cipher)
+	}
+	var serialization serialize.Serialization
+	ser, _ := wamp.AsString(details[wamp.OptPPTSerializer])
+	switch ser {
+	case wamp.PPTSerializerCBOR:
+		serialization = serialize.CBOR
+	case wamp.PPTSerializerMsgpack:
+		serialization = serialize.MSGPACK
+	case wamp.PPTSerializerJSON:
+		serialization = serialize.JSON
+	default:
+		return nil, nil, fmt.Errorf("unsupported %s: %q", wamp.OptPPTSerializer, ser)
+	}
+	if c.keyProvider == nil {
+		return nil, nil, ErrNoKeyProvider
+	}
+	keyID, _ := wamp.AsString(details[wamp.OptPPTKeyID])
+	key, err := c.keyProvider.DecryptionKey(keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(args) != 1 {
+		return nil, nil, errors.New("encrypted payload must be only argument")
+	}
+	box, ok := c.binaryArg(args[0])
+	if !ok || len(box) < nonceSize {
+		return nil, nil, errors.New("invalid encrypted payload")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], box)
+	plain, ok := secretbox.Open(nil, box[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, nil, errors.New("cannot decrypt payload")
+	}
+	v, err := serialize.DecodeValue(serialization, plain)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decode payload: %s", err)
+	}
+	payload, ok := wamp.AsDict(v)
+	if !ok {
+		return nil, nil, errors.New("decrypted payload is not a dictionary")
+	}
+	args, _ = wamp.AsList(payload["args"])
+	kwargs, _ = wamp.AsDict(payload["kwargs"])
+	return args, kwargs, nil
+}
+
+// binaryArg returns the bytes of a binary argument.  A binary argument
+// received using JSON serialization is a string holding the base64 encoding
+// of the bytes, preceded by a NUL character.  Using msgpack serialization, it
+// is a string holding the bytes.
+func (c *Client) binaryArg(arg interface{}) ([]byte, bool) {
+	switch arg := arg.(type) {
+	case []byte:
+		return arg, true
+	case serialize.BinaryData:
+		return []byte(arg), true
+	case string:
+		if c.serialization == serialize.JSON && len(arg) != 0 && arg[0] == 0 {
+			if b, err := base64.StdEncoding.DecodeString(arg[1:]); err == nil {
+				return b, true
+			}
+		}
+		return []byte(arg), true
+	}
+	return nil, false
+}
+
+// PublishEncrypted publishes an event with an end-to-end encrypted payload.
+// It is the same as Publish, except that the arguments are encrypted using
+// EncryptPayload.  Subscribers decrypt the event using DecryptPayload.
+func (c *Client) PublishEncrypted(topic string, options wamp.Dict, args wamp.List, kwargs wamp.Dict) error {
+	pptOpts, payload, err := c.EncryptPayload(topic, args, kwargs)
+	if err != nil {
+		return err
+	}
+	return c.Publish(topic, mergeOptions(options, pptOpts), payload, nil)
+}
+
+// CallEncrypted calls a procedure with an end-to-end encrypted payload.  It
+// is the same as Call, except that the arguments are encrypted using
+// EncryptPayload, and the arguments of the result are decrypted.  Callees
+// decrypt the call using DecryptPayload, and encrypt the result using
+// EncryptResult.
+func (c *Client) CallEncrypted(ctx context.Context, procedure string, options wamp.Dict, args wamp.List, kwargs wamp.Dict, cancelMode string) (*wamp.Result, error) {
+	pptOpts, payload, err := c.EncryptPayload(procedure, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.Call(ctx, procedure, mergeOptions(options, pptOpts), payload, nil, cancelMode)
+	if err != nil {
+		return result, err
+	}
+	result.Arguments, result.ArgumentsKw, err = c.DecryptPayload(
+		result.Details, result.Arguments, result.ArgumentsKw)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// EncryptResult encrypts the arguments of a result, to be returned by the
+// InvocationHandler for the procedure, using EncryptPayload.  A result that
+// is an error is returned unchanged.  If the result cannot be encrypted, an
+// error result is returned.
+func (c *Client) EncryptResult(procedure string, result *InvokeResult) *InvokeResult {
+	if result == nil || result.Err != "" {
+		return result
+	}
+	pptOpts, payload, err := c.EncryptPayload(procedure, result.Args, result.Kwargs)
+	if err != nil {
+		c.log.Println("Cannot encrypt result of", procedure, "-", err)
+		return &InvokeResult{
+			Args: wamp.List{"cannot encrypt result"},
+			Err:  wamp.ErrInvalidArgument,
+		}
+	}
+	return &InvokeResult{
+		Args:    payload,
+		Options: mergeOptions(result.Options, pptOpts),
+	}
+}
+
+// mergeOptions returns a copy of the options with the added options.
+func mergeOptions(options, added wamp.Dict) wamp.Dict {
+	merged := make(wamp.Dict, len(options)+len(added))
+	for k, v := range options {
+		merged[k] = v
+	}
+	for k, v := range added {
+		merged[k] = v
+	}
+	return merged
+}
@@ -1,5 +1,7 @@
 module github.com/gammazero/nexus
 
+go 1.27.1
+
 require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/fortytw2/leaktest v1.3.0
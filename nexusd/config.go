@@ -51,6 +51,19 @@ type Config struct {
 
 	// File to write log data to.  If not specified, log to stdout.
 	LogPath string `json:"log_path"`
+
+	// Span export configuration, for tracing calls and publications.  Spans
+	// are exported to each destination that is specified.
+	Trace struct {
+		// File to append spans to, as one JSON object per line.
+		JSONLFile string `json:"jsonl_file"`
+		// URL of OTLP/HTTP traces endpoint to send spans to, for example
+		// "http://localhost:4318/v1/traces".
+		OTLPEndpoint string `json:"otlp_endpoint"`
+		// Service name that spans sent to the OTLP endpoint come from.
+		// Default is "nexus".
+		ServiceName string `json:"service_name"`
+	}
 	// Router configuration parameters.
 	// See https://godoc.org/github.com/gammazero/nexus#RouterConfig
 	Router router.Config
@@ -21,6 +21,15 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "usage: %s [-c nexus.json]\n", os.Args[0])
 }
 
+// multiSpanRecorder records spans with multiple span recorders.
+type multiSpanRecorder []router.SpanRecorder
+
+func (m multiSpanRecorder) RecordSpan(span *router.Span) {
+	for _, r := range m {
+		r.RecordSpan(span)
+	}
+}
+
 func main() {
 	var cfgFile string
 	fs := flag.NewFlagSet("nexus", flag.ExitOnError)
@@ -48,6 +57,33 @@ func main() {
 		logger = log.New(f, "", log.LstdFlags)
 	}
 
+	// Create span exporters from config.
+	var spanRecorders multiSpanRecorder
+	if conf.Trace.JSONLFile != "" {
+		jsonl, err := router.NewJSONLFileExporter(conf.Trace.JSONLFile)
+		if err != nil {
+			logger.Print(err)
+			os.Exit(1)
+		}
+		defer jsonl.Close()
+		spanRecorders = append(spanRecorders, jsonl)
+		logger.Println("Exporting spans to file", conf.Trace.JSONLFile)
+	}
+	if conf.Trace.OTLPEndpoint != "" {
+		otlp := router.NewOTLPExporter(conf.Trace.OTLPEndpoint,
+			conf.Trace.ServiceName, logger)
+		defer otlp.Close()
+		spanRecorders = append(spanRecorders, otlp)
+		logger.Println("Exporting spans to", conf.Trace.OTLPEndpoint)
+	}
+	switch len(spanRecorders) {
+	case 0:
+	case 1:
+		conf.Router.SpanRecorder = spanRecorders[0]
+	default:
+		conf.Router.SpanRecorder = spanRecorders
+	}
+
 	// Create router and realms from config.
 	r, err := router.NewRouter(&conf.Router, logger)
 	if err != nil {
@@ -2,6 +2,10 @@ package router
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gammazero/nexus/stdlog"
 	"github.com/gammazero/nexus/wamp"
@@ -11,24 +15,46 @@ const (
 	rolePub = "publisher"
 	roleSub = "subscriber"
 
+	featureEventHistory         = "event_history"
+	featureEventRetention       = "event_retention"
 	featurePatternSub           = "pattern_based_subscription"
+	featurePayloadPassthru      = "payload_passthru_mode"
 	featurePubExclusion         = "publisher_exclusion"
 	featurePubIdent             = "publisher_identification"
+	featureReliableDelivery     = "reliable_delivery"
+	featurePubTrustLevels       = "publication_trustlevels"
 	featureSubBlackWhiteListing = "subscriber_blackwhite_listing"
 	featureSubMetaAPI           = "subscription_meta_api"
+	featureTopicReflection      = "topic_reflection"
 
-	detailTopic = "topic"
+	detailRetained   = "retained"
+	detailTopic      = "topic"
+	detailTrustLevel = "trustlevel"
+
+	// maxTopicSchemas is the maximum number of topic schemas that sessions
+	// can define using the topic define meta procedure.
+	maxTopicSchemas = 1000
+
+	// defaultRetainedLimit is the default maximum number of topics with a
+	// retained event.
+	defaultRetainedLimit = 1000
 )
 
 // Role information for this broker.
 var brokerRole = wamp.Dict{
 	"features": wamp.Dict{
+		featureEventHistory:         true,
+		featureEventRetention:       true,
 		featurePatternSub:           true,
+		featurePayloadPassthru:      true,
 		featurePubExclusion:         true,
 		featurePubIdent:             true,
+		featureReliableDelivery:     true,
+		featurePubTrustLevels:       true,
 		featureSessionMetaAPI:       true,
 		featureSubBlackWhiteListing: true,
 		featureSubMetaAPI:           true,
+		featureTopicReflection:      true,
 	},
 }
 
@@ -39,16 +65,71 @@ type subscription struct {
 	match       string   // match policy
 	created     string   // when subscription was created
 	subscribers map[*session]struct{}
+
+	// subscriber session -> minimum trust level required of publishers, for
+	// subscribers that require one.
+	minTrust map[*session]int
+
+	// subscriber session -> publishers the subscriber receives events from,
+	// for subscribers that restrict publishers.
+	fromFilter map[*session]*sessionFilter
+
+	// subscriber session -> filter of the event payloads the subscriber
+	// receives, for subscribers that set a filter expression.
+	eventFilter map[*session]*eventFilter
+
+	// subscriber session -> delivery state, for subscribers that subscribed
+	// with the reliable option.
+	reliable map[*session]*reliableDelivery
+}
+
+// retainedEvent is the most recent publication to a topic that was published
+// with the retain option.  It is sent to new subscribers that request
+// retained events, the same as it was sent to the subscribers at the time it
+// was published.
+//
+// The publisher is a detached copy of its session, and the publication keeps
+// only its topic, payload, and passthru options, so that a retained event
+// does not keep the publisher's session or the rest of the PUBLISH.
+type retainedEvent struct {
+	pub        *session
+	msg        *wamp.Publish
+	pubID      wamp.ID
+	excludePub bool
+	disclose   bool
+	filter     PublishFilter
+}
+
+// topicShardCount is the number of shards of topic state.  It is larger than
+// the number of cores of most machines, so that publications to different
+// topics seldom wait for each other.
+const topicShardCount = 64
+
+// topicShard is the state of the topics that hash to the shard.  Publications
+// run concurrently, and lock the shard of their topic while routing events.
+// So, publications to topics in different shards are routed in parallel, and
+// the publications to a topic are routed one at a time, so that every
+// subscriber receives the events of a topic in the same order.
+//
+// A publication locks the shard before taking the broker's read lock, and
+// releases the read lock before sending the events, keeping the shard locked.
+// So, sending to a subscriber whose slow-consumer policy is to block holds up
+// only the publications to the topics of the shard, and not subscribing or
+// the rest of the broker.  A publisher's events to a topic are received in the order
+// it published them, since a session's messages are handled one at a time.
+type topicShard struct {
+	sync.Mutex
+
+	// topic -> most recent event published to the topic with retain option
+	retained map[wamp.URI]*retainedEvent
 }
 
 // FilterFactory is a function which creates a PublishFilter from a publication
 type FilterFactory func(msg *wamp.Publish) PublishFilter
 
 type Broker struct {
-	// topic -> subscription
-	topicSubscription    map[wamp.URI]*subscription
-	pfxTopicSubscription map[wamp.URI]*subscription
-	wcTopicSubscription  map[wamp.URI]*subscription
+	// topic -> subscription, for the subscriptions of all match policies
+	topicMatcher *wamp.URIMatcher
 
 	// subscription ID -> subscription
 	subscriptions map[wamp.ID]*subscription
@@ -56,7 +137,46 @@ type Broker struct {
 	// Session -> subscription ID set
 	sessionSubIDSet map[*session]map[wamp.ID]struct{}
 
-	actionChan chan func()
+	// topic -> schema of the events published to the topic, defined by the
+	// realm configuration or by the topic define meta procedure.  These are
+	// read by Publish before it takes the read lock, so are protected by
+	// schemaLock.
+	confTopicSchemas  map[wamp.URI]*payloadSchema
+	topicSchemas      map[wamp.URI]*payloadSchema
+	topicSchemaOwners map[wamp.URI]wamp.ID // topic -> session that defined schema
+	validatePayloads  bool
+	schemaLock        sync.RWMutex
+
+	// Histories of the events published to the topics configured to keep
+	// event history, and the histories by their topic or pattern, for
+	// publications to find the histories that keep their events.
+	histories      []*eventHistory
+	historyMatcher *wamp.URIMatcher
+
+	// State of the topics, sharded by topic.
+	shards [topicShardCount]topicShard
+
+	// Guards the state that publications to topics of different shards
+	// share, the event histories, reliable delivery states, and count of
+	// retained events, while holding the read lock.
+	pubLock sync.Mutex
+
+	// Maximum and current number of topics with a retained event.
+	retainedLimit int
+	retainedCount int
+
+	// Limits of reliable delivery, and the delivery states of reliable
+	// subscribers whose sessions ended, waiting to be resumed.
+	reliableBufferSize    int
+	reliableAckTimeout    time.Duration
+	reliableResumeTimeout time.Duration
+	orphans               map[string]*reliableDelivery
+
+	// Guards the subscriptions and the rest of the broker's state.
+	// Publications hold the read lock while routing events, so that
+	// publications run concurrently.  Everything else holds the write lock.
+	lock   sync.RWMutex
+	closed bool
 
 	// Generate subscription IDs.
 	idGen *wamp.IDGen
@@ -67,6 +187,9 @@ type Broker struct {
 	log           stdlog.StdLog
 	debug         bool
 	filterFactory FilterFactory
+
+	// Records the spans of traced publications.
+	spanRecorder SpanRecorder
 }
 
 // NewBroker returns a new default broker implementation instance.
@@ -78,17 +201,19 @@ func NewBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publi
 		publishFilter = NewSimplePublishFilter
 	}
 	b := &Broker{
-		topicSubscription:    map[wamp.URI]*subscription{},
-		pfxTopicSubscription: map[wamp.URI]*subscription{},
-		wcTopicSubscription:  map[wamp.URI]*subscription{},
+		topicMatcher: wamp.NewURIMatcher(),
 
 		subscriptions:   map[wamp.ID]*subscription{},
 		sessionSubIDSet: map[*session]map[wamp.ID]struct{}{},
+		topicSchemas:    map[wamp.URI]*payloadSchema{},
+
+		topicSchemaOwners: map[wamp.URI]wamp.ID{},
 
-		// The action handler should be nearly always runable, since it is the
-		// critical section that does the only routing.  So, and unbuffered
-		// channel is appropriate.
-		actionChan: make(chan func()),
+		reliableBufferSize:    defaultReliableBufferSize,
+		reliableAckTimeout:    defaultReliableAckTimeout,
+		reliableResumeTimeout: defaultReliableResumeTimeout,
+		orphans:               map[string]*reliableDelivery{},
+		retainedLimit:         defaultRetainedLimit,
 
 		idGen: new(wamp.IDGen),
 
@@ -99,10 +224,115 @@ func NewBroker(logger stdlog.StdLog, strictURI, allowDisclose, debug bool, publi
 		debug:         debug,
 		filterFactory: publishFilter,
 	}
-	go b.run()
+	for i := range b.shards {
+		b.shards[i].retained = map[wamp.URI]*retainedEvent{}
+	}
 	return b
 }
 
+// SetSpanRecorder sets the SpanRecorder that records the span of each
+// publication.  When a span recorder is set, every publication is traced.
+// Otherwise, only publications that have a "trace_id" PUBLISH option are
+// traced.
+func (b *Broker) SetSpanRecorder(recorder SpanRecorder) {
+	b.lock.Lock()
+	b.spanRecorder = recorder
+	b.lock.Unlock()
+}
+
+// SetTopicSchemas sets the schemas of the events published to topics.  These
+// cannot be replaced using the topic define meta procedure.  Returns an error
+// if any schema is not valid.
+func (b *Broker) SetTopicSchemas(schemas map[wamp.URI]wamp.Dict) error {
+	compiled, err := loadSchemas(schemas, false)
+	if err != nil {
+		return err
+	}
+	b.schemaLock.Lock()
+	b.confTopicSchemas = compiled
+	b.schemaLock.Unlock()
+	return nil
+}
+
+// SetEventHistory configures the topics, or topic patterns, for which the
+// broker keeps a history of published events.  The events are available to
+// subscribers using the wamp.subscription.get_events meta procedure.
+func (b *Broker) SetEventHistory(configs []EventHistoryConfig) error {
+	histories := make([]*eventHistory, 0, len(configs))
+	matcher := wamp.NewURIMatcher()
+	for _, cfg := range configs {
+		h, err := newEventHistory(cfg)
+		if err != nil {
+			return err
+		}
+		histories = append(histories, h)
+		// More than one history may be configured for the same topic.
+		var same []*eventHistory
+		if v, ok := matcher.Get(h.topic, h.match); ok {
+			same = v.([]*eventHistory)
+		}
+		matcher.Add(h.topic, h.match, append(same, h))
+	}
+	b.lock.Lock()
+	b.histories = histories
+	b.historyMatcher = matcher
+	b.lock.Unlock()
+	return nil
+}
+
+// SetReliableDelivery sets the limits of reliable delivery to subscribers
+// that subscribe with the reliable option.  Zero values leave the defaults.
+func (b *Broker) SetReliableDelivery(cfg ReliableDeliveryConfig) error {
+	if cfg.BufferSize < 0 || cfg.AckTimeout < 0 || cfg.ResumeTimeout < 0 {
+		return fmt.Errorf("invalid reliable delivery config %+v (values must not be negative)", cfg)
+	}
+	b.lock.Lock()
+	if cfg.BufferSize != 0 {
+		b.reliableBufferSize = cfg.BufferSize
+	}
+	if cfg.AckTimeout != 0 {
+		b.reliableAckTimeout = time.Duration(cfg.AckTimeout) * time.Millisecond
+	}
+	if cfg.ResumeTimeout != 0 {
+		b.reliableResumeTimeout = time.Duration(cfg.ResumeTimeout) * time.Millisecond
+	}
+	b.lock.Unlock()
+	return nil
+}
+
+// SetRetainedLimit sets the maximum number of topics with a retained event.
+// Zero leaves the default.
+func (b *Broker) SetRetainedLimit(limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid retained limit %d (must not be negative)", limit)
+	}
+	if limit != 0 {
+		b.lock.Lock()
+		b.retainedLimit = limit
+		b.lock.Unlock()
+	}
+	return nil
+}
+
+// SetValidatePayloads enables or disables validation of publications against
+// the schemas of their topics.  When enabled, a publication whose arguments
+// do not match is not sent to subscribers, and the publisher is sent
+// wamp.error.invalid_argument if it requested acknowledgement.
+func (b *Broker) SetValidatePayloads(validate bool) {
+	b.schemaLock.Lock()
+	b.validatePayloads = validate
+	b.schemaLock.Unlock()
+}
+
+// topicSchema returns the schema of the topic, or nil if there is none.
+// Must be called with schemaLock held.
+func (b *Broker) topicSchema(topic wamp.URI) *payloadSchema {
+	if schema, ok := b.confTopicSchemas[topic]; ok {
+		return schema
+	}
+	return b.topicSchemas[topic]
+}
+
 // Role returns the role information for the "broker" role.  The data returned
 // is suitable for use as broker role info in a WELCOME message.
 func (b *Broker) Role() wamp.Dict {
@@ -171,14 +401,43 @@ func (b *Broker) Publish(pub *session, msg *wamp.Publish) {
 		}
 		disclose = true
 	}
+
+	// A publication in payload passthru mode has an opaque payload, so it is
+	// checked for the passthru options instead of being validated against
+	// the topic's schema.
+	var err error
+	ppt := isPassthru(msg.Options)
+	if ppt {
+		err = checkPassthru(msg.Options, msg.Arguments, msg.ArgumentsKw)
+	}
+
+	// Do not publish events whose arguments do not match the topic's schema.
+	b.schemaLock.RLock()
+	if b.validatePayloads && !ppt {
+		if schema := b.topicSchema(msg.Topic); schema != nil {
+			err = schema.validate(msg.Arguments, msg.ArgumentsKw)
+		}
+	}
+	b.schemaLock.RUnlock()
+	if err != nil {
+		if pubAck {
+			b.trySend(pub, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{err.Error()},
+			})
+		}
+		return
+	}
+
 	pubID := wamp.GlobalID()
 
 	// Get blacklists and whitelists, if any, from publish message.
 	filter := b.filterFactory(msg)
 
-	b.actionChan <- func() {
-		b.publish(pub, msg, pubID, excludePub, disclose, filter)
-	}
+	b.publish(pub, msg, pubID, excludePub, disclose, filter)
 
 	// Send PUBLISHED message if acknowledge is present and true.
 	if pubAck {
@@ -218,9 +477,56 @@ func (b *Broker) Subscribe(sub *session, msg *wamp.Subscribe) {
 		return
 	}
 
-	b.actionChan <- func() {
-		b.subscribe(sub, msg, match)
+	// A subscriber may refuse events from publishers with a trust level lower
+	// than the minimum it requires.
+	var minTrust int
+	if t, ok := msg.Options[wamp.OptMinTrustLevel]; ok {
+		n, ok := wamp.AsInt64(t)
+		if !ok {
+			errMsg := fmt.Sprintf("invalid %s %v (must be integer)",
+				wamp.OptMinTrustLevel, t)
+			b.trySend(sub, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{errMsg},
+			})
+			return
+		}
+		minTrust = int(n)
 	}
+
+	// A subscriber may only receive events from the listed publisher
+	// sessions, or from publishers whose sessions have one of the allowed
+	// values of an attribute, such as authrole or authid.
+	fromFilter, err := newSessionFilter(msg.Options, fromPrefix)
+	if err != nil {
+		b.trySend(sub, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{err.Error()},
+		})
+		return
+	}
+
+	// A subscriber may only receive events whose payload matches a filter
+	// expression.  The filter is compiled once here, and evaluated for each
+	// event published to the subscription.
+	evtFilter, err := getEventFilter(msg.Options)
+	if err != nil {
+		b.trySend(sub, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{err.Error()},
+		})
+		return
+	}
+
+	b.lock.Lock()
+	b.subscribe(sub, msg, match, minTrust, fromFilter, evtFilter)
+	b.lock.Unlock()
 }
 
 // Unsubscribe removes the requested subscription.
@@ -228,9 +534,9 @@ func (b *Broker) Unsubscribe(sub *session, msg *wamp.Unsubscribe) {
 	if sub == nil || msg == nil {
 		panic("broker.Unsubscribe with nil session or message")
 	}
-	b.actionChan <- func() {
-		b.unsubscribe(sub, msg)
-	}
+	b.lock.Lock()
+	b.unsubscribe(sub, msg)
+	b.lock.Unlock()
 }
 
 // RemoveSession removes all subscriptions of the subscriber.  This is called
@@ -241,44 +547,170 @@ func (b *Broker) RemoveSession(sess *session) {
 	if sess == nil {
 		return
 	}
-	b.actionChan <- func() {
-		b.removeSession(sess)
+	b.lock.Lock()
+	b.removeSession(sess)
+	b.lock.Unlock()
+
+	// Remove the topic schemas that the session defined.
+	b.schemaLock.Lock()
+	for topic, owner := range b.topicSchemaOwners {
+		if owner == sess.ID {
+			delete(b.topicSchemas, topic)
+			delete(b.topicSchemaOwners, topic)
+		}
 	}
+	b.schemaLock.Unlock()
 }
 
-// Close stops the broker, letting already queued actions finish.
+// Close stops the broker.  Timers that expire after the broker is closed do
+// nothing.
 func (b *Broker) Close() {
-	close(b.actionChan)
+	b.lock.Lock()
+	b.closed = true
+	b.lock.Unlock()
+	if b.debug {
+		b.log.Print("Broker stopped")
+	}
 }
 
-func (b *Broker) run() {
-	for action := range b.actionChan {
+// timerAction runs an action from a timer goroutine, holding the write lock.
+// The action is discarded if the broker has already been closed.
+func (b *Broker) timerAction(action func()) {
+	b.lock.Lock()
+	if !b.closed {
 		action()
 	}
-	if b.debug {
-		b.log.Print("Broker stopped")
-	}
+	b.lock.Unlock()
+}
+
+// shard returns the shard of the topic's state.
+func (b *Broker) shard(topic wamp.URI) *topicShard {
+	return &b.shards[shardHash(string(topic))%topicShardCount]
+}
+
+// eventDelivery is an event to send to a subscriber after the broker's read
+// lock is released.
+type eventDelivery struct {
+	subscriber *session
+	msg        wamp.Message
 }
 
 func (b *Broker) publish(pub *session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter PublishFilter) {
-	// Publish to subscribers with exact match.
-	if sub, ok := b.topicSubscription[msg.Topic]; ok {
-		b.pubEvent(pub, msg, pubID, sub, excludePub, false, disclose, filter)
+	var events int
+	var deliveries []eventDelivery
+
+	// The shard is locked before taking the read lock, and stays locked
+	// while sending the events after the read lock is released.
+	shard := b.shard(msg.Topic)
+	shard.Lock()
+	b.lock.RLock()
+	recorder := b.spanRecorder
+	span := newSpan(SpanKindPublish, msg.Topic, msg.Options, recorder)
+
+	// The payload is shared by the events sent to all subscribers, so that
+	// transports encode it once instead of once for each subscriber.
+	payload := wamp.NewSharedPayload(msg.Arguments, msg.ArgumentsKw)
+
+	// Publish to subscribers with exact, prefix, and wildcard matches.  The
+	// topic is sent to subscribers with pattern-based matches.
+	for _, m := range b.topicMatcher.Matches(msg.Topic) {
+		sub := m.Value.(*subscription)
+		var sent int
+		deliveries, sent = b.pubEvent(deliveries, pub, msg, pubID, payload, sub, excludePub, m.Match != wamp.MatchExact, disclose, filter, span)
+		events += sent
+	}
+
+	// Keep the event to send to future subscribers of the topic that request
+	// retained events.
+	if retain, _ := msg.Options[wamp.OptRetain].(bool); retain {
+		b.retain(shard, pub, msg, pubID, excludePub, disclose, filter)
 	}
 
-	// Publish to subscribers with prefix match.
-	for pfxTopic, sub := range b.pfxTopicSubscription {
-		if msg.Topic.PrefixMatch(pfxTopic) {
-			b.pubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
+	// Keep the event in the histories of the topic.  An event that the
+	// publisher restricted to some recipients is not kept, since it would be
+	// available to any subscriber.
+	if len(b.histories) != 0 && filter == nil {
+		b.pubLock.Lock()
+		var evt *historyEvent
+		for _, m := range b.historyMatcher.Matches(msg.Topic) {
+			if evt == nil {
+				evt = &historyEvent{
+					published:   time.Now(),
+					pub:         pub,
+					msg:         msg,
+					publication: pubID,
+					excludePub:  excludePub,
+					disclose:    disclose,
+				}
+			}
+			for _, h := range m.Value.([]*eventHistory) {
+				h.add(evt)
+			}
 		}
+		b.pubLock.Unlock()
 	}
+	b.lock.RUnlock()
 
-	// Publish to subscribers with wildcard match.
-	for wcTopic, sub := range b.wcTopicSubscription {
-		if msg.Topic.WildcardMatch(wcTopic) {
-			b.pubEvent(pub, msg, pubID, sub, excludePub, true, disclose, filter)
+	for _, d := range deliveries {
+		if b.trySend(d.subscriber, d.msg) {
+			events++
 		}
 	}
+	shard.Unlock()
+
+	if span != nil && recorder != nil {
+		span.End = time.Now()
+		span.Attributes["publisher"] = pub.ID
+		span.Attributes["publication"] = pubID
+		span.Attributes["events"] = events
+		recorder.RecordSpan(span)
+	}
+}
+
+// retain keeps the publication as the retained event of its topic, replacing
+// the previous one.  As in MQTT, a publication without arguments clears the
+// topic's retained event instead.  A topic without a retained event is not
+// retained if the broker already has retainedLimit retained events.  Must be
+// called with the topic's shard locked.
+func (b *Broker) retain(shard *topicShard, pub *session, msg *wamp.Publish, pubID wamp.ID, excludePub, disclose bool, filter PublishFilter) {
+	_, replace := shard.retained[msg.Topic]
+	if len(msg.Arguments) == 0 && len(msg.ArgumentsKw) == 0 {
+		if replace {
+			delete(shard.retained, msg.Topic)
+			b.pubLock.Lock()
+			b.retainedCount--
+			b.pubLock.Unlock()
+		}
+		return
+	}
+	if !replace {
+		b.pubLock.Lock()
+		full := b.retainedCount >= b.retainedLimit
+		if !full {
+			b.retainedCount++
+		}
+		b.pubLock.Unlock()
+		if full {
+			b.log.Printf("Retained event limit %d reached, not retaining event for topic %s",
+				b.retainedLimit, msg.Topic)
+			return
+		}
+	}
+	opts := wamp.Dict{}
+	addPassthruDetails(msg.Options, opts)
+	shard.retained[msg.Topic] = &retainedEvent{
+		pub: detachedSession(pub),
+		msg: &wamp.Publish{
+			Topic:       msg.Topic,
+			Options:     opts,
+			Arguments:   msg.Arguments,
+			ArgumentsKw: msg.ArgumentsKw,
+		},
+		pubID:      pubID,
+		excludePub: excludePub,
+		disclose:   disclose,
+		filter:     filter,
+	}
 }
 
 func (b *Broker) newSubscription(subscriber *session, topic wamp.URI, match string) *subscription {
@@ -288,38 +720,20 @@ func (b *Broker) newSubscription(subscriber *session, topic wamp.URI, match stri
 		match:       match,
 		created:     wamp.NowISO8601(),
 		subscribers: map[*session]struct{}{subscriber: struct{}{}},
+		minTrust:    map[*session]int{},
+		fromFilter:  map[*session]*sessionFilter{},
+		eventFilter: map[*session]*eventFilter{},
+		reliable:    map[*session]*reliableDelivery{},
 	}
 }
 
-func (b *Broker) subscribe(subscriber *session, msg *wamp.Subscribe, match string) {
-	var sub *subscription
-	var existingSub bool
-
-	switch match {
-	case wamp.MatchPrefix:
-		// Subscribe to any topic that matches by the given prefix URI
-		sub, existingSub = b.pfxTopicSubscription[msg.Topic]
-		if !existingSub {
-			// Create a new prefix subscription.
-			sub = b.newSubscription(subscriber, msg.Topic, match)
-			b.pfxTopicSubscription[msg.Topic] = sub
-		}
-	case wamp.MatchWildcard:
-		// Subscribe to any topic that matches by the given wildcard URI.
-		sub, existingSub = b.wcTopicSubscription[msg.Topic]
-		if !existingSub {
-			// Create a new wildcard subscription.
-			sub = b.newSubscription(subscriber, msg.Topic, match)
-			b.wcTopicSubscription[msg.Topic] = sub
-		}
-	default:
-		// Subscribe to the topic that exactly matches the given URI.
-		sub, existingSub = b.topicSubscription[msg.Topic]
-		if !existingSub {
-			// Create a new subscription.
-			sub = b.newSubscription(subscriber, msg.Topic, match)
-			b.topicSubscription[msg.Topic] = sub
-		}
+func (b *Broker) subscribe(subscriber *session, msg *wamp.Subscribe, match string, minTrust int, fromFilter *sessionFilter, evtFilter *eventFilter) {
+	sub, existingSub := b.topicSubscription(msg.Topic, match)
+	if !existingSub {
+		// Create a new subscription to the topics that match the URI by the
+		// match policy.
+		sub = b.newSubscription(subscriber, msg.Topic, match)
+		b.topicMatcher.Add(sub.topic, sub.match, sub)
 	}
 	b.subscriptions[sub.id] = sub
 
@@ -337,6 +751,20 @@ func (b *Broker) subscribe(subscriber *session, msg *wamp.Subscribe, match strin
 		// Add subscriber to existing subscription.
 		sub.subscribers[subscriber] = struct{}{}
 	}
+	if minTrust != 0 {
+		sub.minTrust[subscriber] = minTrust
+	}
+	if fromFilter != nil {
+		sub.fromFilter[subscriber] = fromFilter
+	}
+	if evtFilter != nil {
+		sub.eventFilter[subscriber] = evtFilter
+	}
+	var rd *reliableDelivery
+	if reliable, _ := msg.Options[wamp.OptReliable].(bool); reliable {
+		rd = b.newReliable(subscriber, sub)
+		sub.reliable[subscriber] = rd
+	}
 
 	// Add the subscription ID to the set of subscriptions for the subscriber.
 	subIdSet, ok := b.sessionSubIDSet[subscriber]
@@ -350,6 +778,16 @@ func (b *Broker) subscribe(subscriber *session, msg *wamp.Subscribe, match strin
 	// Tell sender the new subscription ID.
 	b.trySend(subscriber, &wamp.Subscribed{Request: msg.Request, Subscription: sub.id})
 
+	// Send the events that a previous session of a reliable subscriber did
+	// not acknowledge.
+	if rd != nil && len(rd.pending) != 0 {
+		b.redeliver(subscriber, sub, rd)
+	}
+
+	if getRetained, _ := msg.Options[wamp.OptGetRetained].(bool); getRetained {
+		b.sendRetained(subscriber, sub)
+	}
+
 	if !existingSub {
 		b.pubSubCreateMeta(msg.Topic, subscriber.ID, sub)
 	}
@@ -358,6 +796,45 @@ func (b *Broker) subscribe(subscriber *session, msg *wamp.Subscribe, match strin
 	b.pubSubMeta(wamp.MetaEventSubOnSubscribe, subscriber.ID, sub.id)
 }
 
+// sendRetained sends the retained events, of the topics that match the
+// subscription, to a new subscriber of the subscription.  The events have the
+// "retained" detail set, so that the subscriber can tell them from events
+// published after it subscribed.
+//
+// A pattern-based subscription is matched against every retained topic.  A
+// wamp.URIMatcher finds the patterns that match a topic, not the topics that
+// match a pattern, and this is only done when subscribing, not for each
+// publication.
+func (b *Broker) sendRetained(subscriber *session, sub *subscription) {
+	var retained []*retainedEvent
+	switch sub.match {
+	case wamp.MatchPrefix, wamp.MatchWildcard:
+		for i := range b.shards {
+			for topic, r := range b.shards[i].retained {
+				if topicMatches(topic, sub.topic, sub.match) {
+					retained = append(retained, r)
+				}
+			}
+		}
+		sort.Slice(retained, func(i, j int) bool {
+			return retained[i].msg.Topic < retained[j].msg.Topic
+		})
+	default:
+		if r, ok := b.shard(sub.topic).retained[sub.topic]; ok {
+			retained = append(retained, r)
+		}
+	}
+	sendTopic := sub.match == wamp.MatchPrefix || sub.match == wamp.MatchWildcard
+	for _, r := range retained {
+		evt := b.newEvent(r.pub, r.msg, r.pubID, sub, subscriber, r.excludePub, sendTopic, r.disclose, r.filter, nil)
+		if evt == nil {
+			continue
+		}
+		evt.Details[detailRetained] = true
+		b.sendEvent(subscriber, sub, evt)
+	}
+}
+
 // deleteSubscription removes the the ID->subscription mapping and removes the
 // topic->subscription mapping.
 func (b *Broker) delSubscription(sub *subscription) {
@@ -365,14 +842,16 @@ func (b *Broker) delSubscription(sub *subscription) {
 	delete(b.subscriptions, sub.id)
 
 	// Delete topic -> subscription
-	switch sub.match {
-	case wamp.MatchPrefix:
-		delete(b.pfxTopicSubscription, sub.topic)
-	case wamp.MatchWildcard:
-		delete(b.wcTopicSubscription, sub.topic)
-	default:
-		delete(b.topicSubscription, sub.topic)
+	b.topicMatcher.Remove(sub.topic, sub.match)
+}
+
+// topicSubscription returns the subscription to the topic URI with the match
+// policy, and false if there is none.
+func (b *Broker) topicSubscription(topic wamp.URI, match string) (*subscription, bool) {
+	if s, ok := b.topicMatcher.Get(topic, match); ok {
+		return s.(*subscription), true
 	}
+	return nil, false
 }
 
 // unsibsubscribe removes the subscriber from the specified subscription.
@@ -391,6 +870,13 @@ func (b *Broker) unsubscribe(subscriber *session, msg *wamp.Unsubscribe) {
 
 	// Remove subscribed session from subscription.
 	delete(sub.subscribers, subscriber)
+	delete(sub.minTrust, subscriber)
+	delete(sub.fromFilter, subscriber)
+	delete(sub.eventFilter, subscriber)
+	if rd, ok := sub.reliable[subscriber]; ok {
+		rd.stopTimer()
+		delete(sub.reliable, subscriber)
+	}
 
 	// If no more subscribers on this subscription, delete subscription and
 	// send on_delete meta event.
@@ -446,6 +932,13 @@ func (b *Broker) removeSession(subscriber *session) {
 		}
 		// Remove subscribed session from subscription.
 		delete(sub.subscribers, subscriber)
+		delete(sub.minTrust, subscriber)
+		delete(sub.fromFilter, subscriber)
+		delete(sub.eventFilter, subscriber)
+		if rd, ok := sub.reliable[subscriber]; ok {
+			delete(sub.reliable, subscriber)
+			b.orphanReliable(rd)
+		}
 
 		// If no more subscribers on this subscription.
 		if len(sub.subscribers) == 0 {
@@ -472,63 +965,219 @@ func allowPublish(sub *session, filter PublishFilter) bool {
 	return ok
 }
 
-// pubEvent sends an event to all subscribers that are not excluded from
-// receiving the event.
-func (b *Broker) pubEvent(pub *session, msg *wamp.Publish, pubID wamp.ID, sub *subscription, excludePublisher, sendTopic, disclose bool, filter PublishFilter) {
+// pubEvent creates the events that send a publication to the subscribers
+// that are not excluded from receiving it.  Events to reliable subscribers are
+// sent now, and the others are appended to deliveries, to send after the
+// read lock is released.  Returns the deliveries and the number of events
+// sent.
+func (b *Broker) pubEvent(deliveries []eventDelivery, pub *session, msg *wamp.Publish, pubID wamp.ID, payload *wamp.SharedPayload, sub *subscription, excludePublisher, sendTopic, disclose bool, filter PublishFilter, span *Span) ([]eventDelivery, int) {
+	var sent int
 	for subscriber, _ := range sub.subscribers {
-		// Do not send event to publisher.
-		if subscriber == pub && excludePublisher {
+		evt := b.newEvent(pub, msg, pubID, sub, subscriber, excludePublisher, sendTopic, disclose, filter, span)
+		if evt == nil {
 			continue
 		}
-
-		// Check if receiver is restricted.
-		if !allowPublish(subscriber, filter) {
+		evtMsg := eventMessage(subscriber, evt, payload)
+		if rd, ok := sub.reliable[subscriber]; ok {
+			if b.sendReliable(subscriber, sub, rd, evt, evtMsg) {
+				sent++
+			}
 			continue
 		}
+		deliveries = append(deliveries, eventDelivery{subscriber, evtMsg})
+	}
+	return deliveries, sent
+}
 
-		details := wamp.Dict{}
+// sendEvent sends the event to the subscriber.  Returns true if the event was
+// sent.
+func (b *Broker) sendEvent(subscriber *session, sub *subscription, evt *wamp.Event) bool {
+	if rd, ok := sub.reliable[subscriber]; ok {
+		return b.sendReliable(subscriber, sub, rd, evt, evt)
+	}
+	return b.trySend(subscriber, evt)
+}
 
-		// If a subscription was established with a pattern-based matching
-		// policy, a Broker MUST supply the original PUBLISH.Topic as provided
-		// by the Publisher in EVENT.Details.topic|uri.
-		if sendTopic {
-			details[detailTopic] = msg.Topic
-		}
+// eventMessage returns the message that sends the event to the subscriber.
+// If payload is not nil, it is the event's payload, shared with the events
+// sent to other subscribers, and the event is sent as a wamp.EncodedEvent to
+// subscribers whose peers encode them.
+func eventMessage(subscriber *session, evt *wamp.Event, payload *wamp.SharedPayload) wamp.Message {
+	if payload != nil && subscriber.encodesEvents() {
+		return &wamp.EncodedEvent{Event: evt, Payload: payload}
+	}
+	return evt
+}
 
-		if disclose && subscriber.HasFeature(roleSub, featurePubIdent) {
-			disclosePublisher(pub, details)
+// sendReliable sends the event, as msg, to a reliable subscriber.  The event
+// is given a sequence number and kept until the subscriber acknowledges it,
+// so that it is sent again even if it cannot be sent now.  Returns true if
+// the event was sent.
+func (b *Broker) sendReliable(subscriber *session, sub *subscription, rd *reliableDelivery, evt *wamp.Event, msg wamp.Message) bool {
+	// Events published to topics in different shards may be sent to the
+	// same reliable subscriber concurrently, so hold pubLock while sending
+	// to send the events in the order of their sequence numbers.  The event
+	// is sent without waiting for room in the subscriber's queue, so that
+	// pubLock is not held up, since it is sent again if not acknowledged.
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+	if !rd.add(evt, b.reliableBufferSize) {
+		b.log.Printf("Reliable delivery buffer full for subscriber %v of subscription %v, discarded oldest event",
+			subscriber, sub.id)
+	}
+	if rd.timer == nil {
+		b.startAckTimer(subscriber, sub, rd)
+	}
+	return b.trySendNoWait(subscriber, msg)
+}
+
+// newReliable returns the delivery state of a new reliable subscriber.  If a
+// previous session of the subscriber left unacknowledged events, then its
+// state is resumed.
+func (b *Broker) newReliable(subscriber *session, sub *subscription) *reliableDelivery {
+	key := reliableKey(subscriber, sub)
+	if key != "" {
+		if rd, ok := b.orphans[key]; ok {
+			delete(b.orphans, key)
+			rd.stopTimer()
+			return rd
 		}
+	}
+	return &reliableDelivery{key: key}
+}
 
-		// TODO: Handle publication trust levels
+// startAckTimer starts the timer that redelivers the subscriber's
+// unacknowledged events when the ack timeout expires.
+func (b *Broker) startAckTimer(subscriber *session, sub *subscription, rd *reliableDelivery) {
+	rd.timer = time.AfterFunc(b.reliableAckTimeout, func() {
+		b.timerAction(func() {
+			// Ignore the timer if the subscriber is no longer subscribed.
+			if sub.reliable[subscriber] == rd {
+				rd.timer = nil
+				b.redeliver(subscriber, sub, rd)
+			}
+		})
+	})
+}
+
+// redeliver sends the subscriber's unacknowledged events again, and restarts
+// the ack timer.  Sending stops if the subscriber's queue is full; the
+// remaining events are sent when the timer next expires.
+func (b *Broker) redeliver(subscriber *session, sub *subscription, rd *reliableDelivery) {
+	for _, p := range rd.pending {
+		if !b.trySendNoWait(subscriber, p.redeliveredEvent(sub.id)) {
+			break
+		}
+	}
+	if rd.timer == nil && len(rd.pending) != 0 {
+		b.startAckTimer(subscriber, sub, rd)
+	}
+}
 
-		b.trySend(subscriber, &wamp.Event{
-			Publication:  pubID,
-			Subscription: sub.id,
-			Arguments:    msg.Arguments,
-			ArgumentsKw:  msg.ArgumentsKw,
-			Details:      details,
+// orphanReliable keeps the delivery state of a reliable subscriber whose
+// session ended, so that a new session of the subscriber can resume it.  The
+// state is discarded if there are no unacknowledged events, the subscriber
+// cannot resume, or no new session resumes it before the resume timeout.
+func (b *Broker) orphanReliable(rd *reliableDelivery) {
+	rd.stopTimer()
+	if rd.key == "" || len(rd.pending) == 0 {
+		return
+	}
+	if old, ok := b.orphans[rd.key]; ok {
+		old.stopTimer()
+	}
+	b.orphans[rd.key] = rd
+	rd.timer = time.AfterFunc(b.reliableResumeTimeout, func() {
+		b.timerAction(func() {
+			if b.orphans[rd.key] == rd {
+				delete(b.orphans, rd.key)
+			}
 		})
+	})
+}
+
+// newEvent creates the EVENT that sends a publication to a subscriber, or
+// returns nil if the subscriber is excluded from receiving the event.
+func (b *Broker) newEvent(pub *session, msg *wamp.Publish, pubID wamp.ID, sub *subscription, subscriber *session, excludePublisher, sendTopic, disclose bool, filter PublishFilter, span *Span) *wamp.Event {
+	// Do not send event to publisher.  The publisher of a retained event is
+	// a detached copy of its session, so is compared by ID.
+	if subscriber.ID == pub.ID && excludePublisher {
+		return nil
+	}
+
+	// Do not send event to subscriber that requires a higher trust level
+	// than the publisher has.
+	trustLevel, hasTrustLevel := pub.TrustLevel()
+	if minTrust, ok := sub.minTrust[subscriber]; ok && trustLevel < minTrust {
+		return nil
+	}
+
+	// Do not send event to subscriber that does not receive events from the
+	// publisher.
+	if !sub.fromFilter[subscriber].allowed(pub) {
+		return nil
+	}
+
+	// Check if receiver is restricted.
+	if !allowPublish(subscriber, filter) {
+		return nil
+	}
+
+	// Do not send event to subscriber whose filter the payload does not
+	// match.
+	if !sub.eventFilter[subscriber].matches(msg.Arguments, msg.ArgumentsKw) {
+		return nil
+	}
+
+	// Do not send a payload passthru event to a subscriber that cannot
+	// recognize it.
+	ppt := isPassthru(msg.Options)
+	if ppt && !subscriber.HasFeature(roleSub, featurePayloadPassthru) {
+		return nil
+	}
+
+	details := wamp.Dict{}
+
+	// If a subscription was established with a pattern-based matching
+	// policy, a Broker MUST supply the original PUBLISH.Topic as provided by
+	// the Publisher in EVENT.Details.topic|uri.
+	if sendTopic {
+		details[detailTopic] = msg.Topic
+	}
+
+	if disclose && subscriber.HasFeature(roleSub, featurePubIdent) {
+		disclosePublisher(pub, details)
+	}
+
+	// The Broker supplies the trust level it assigned to the publisher, if
+	// the realm assigns trust levels.
+	if hasTrustLevel {
+		details[detailTrustLevel] = trustLevel
+	}
+
+	// If the publication is traced, then the subscriber is given the trace
+	// ID and the ID of the broker's span.
+	span.addDetails(details)
+
+	if ppt {
+		addPassthruDetails(msg.Options, details)
+	}
+
+	return &wamp.Event{
+		Publication:  pubID,
+		Subscription: sub.id,
+		Arguments:    msg.Arguments,
+		ArgumentsKw:  msg.ArgumentsKw,
+		Details:      details,
 	}
 }
 
 // pubMeta publishes the subscription meta event, using the supplied function,
 // to the matching subscribers.
 func (b *Broker) pubMeta(metaTopic wamp.URI, sendMeta func(metaSub *subscription, sendTopic bool)) {
-	// Publish to subscribers with exact match.
-	if metaSub, ok := b.topicSubscription[metaTopic]; ok {
-		sendMeta(metaSub, false)
-	}
-	// Publish to subscribers with prefix match.
-	for pfxTopic, metaSub := range b.pfxTopicSubscription {
-		if metaTopic.PrefixMatch(pfxTopic) {
-			sendMeta(metaSub, true)
-		}
-	}
-	// Publish to subscribers with wildcard match.
-	for wcTopic, metaSub := range b.wcTopicSubscription {
-		if metaTopic.WildcardMatch(wcTopic) {
-			sendMeta(metaSub, true)
-		}
+	// Publish to subscribers with exact, prefix, and wildcard matches.
+	for _, m := range b.topicMatcher.Matches(metaTopic) {
+		sendMeta(m.Value.(*subscription), m.Match != wamp.MatchExact)
 	}
 }
 
@@ -602,7 +1251,17 @@ func (b *Broker) pubSubCreateMeta(topic wamp.URI, subSessID wamp.ID, sub *subscr
 }
 
 func (b *Broker) trySend(sess *session, msg wamp.Message) bool {
-	if err := sess.Session.TrySend(msg); err != nil {
+	if err := sess.send(msg); err != nil {
+		b.log.Printf("!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
+		return false
+	}
+	return true
+}
+
+// trySendNoWait is the same as trySend, except that it does not wait for
+// room in the session's queue, even if its slow-consumer policy is to block.
+func (b *Broker) trySendNoWait(sess *session, msg wamp.Message) bool {
+	if err := sess.sendNoWait(msg); err != nil {
 		b.log.Printf("!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
 		return false
 	}
@@ -628,21 +1287,18 @@ func disclosePublisher(pub *session, details wamp.Dict) {
 // SubList retrieves subscription IDs listed according to match policies.
 func (b *Broker) SubList(msg *wamp.Invocation) wamp.Message {
 	var exactSubs, pfxSubs, wcSubs []wamp.ID
-	sync := make(chan struct{})
-	b.actionChan <- func() {
-		for subID, sub := range b.subscriptions {
-			switch sub.match {
-			case wamp.MatchPrefix:
-				pfxSubs = append(pfxSubs, subID)
-			case wamp.MatchWildcard:
-				wcSubs = append(wcSubs, subID)
-			default:
-				exactSubs = append(exactSubs, subID)
-			}
+	b.lock.RLock()
+	for subID, sub := range b.subscriptions {
+		switch sub.match {
+		case wamp.MatchPrefix:
+			pfxSubs = append(pfxSubs, subID)
+		case wamp.MatchWildcard:
+			wcSubs = append(wcSubs, subID)
+		default:
+			exactSubs = append(exactSubs, subID)
 		}
-		close(sync)
 	}
-	<-sync
+	b.lock.RUnlock()
 	dict := wamp.Dict{
 		wamp.MatchExact:    exactSubs,
 		wamp.MatchPrefix:   pfxSubs,
@@ -666,24 +1322,11 @@ func (b *Broker) SubLookup(msg *wamp.Invocation) wamp.Message {
 					match, _ = wamp.AsString(opts[wamp.OptMatch])
 				}
 			}
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				var sub *subscription
-				var ok bool
-				switch match {
-				default:
-					sub, ok = b.topicSubscription[topic]
-				case wamp.MatchPrefix:
-					sub, ok = b.pfxTopicSubscription[topic]
-				case wamp.MatchWildcard:
-					sub, ok = b.wcTopicSubscription[topic]
-				}
-				if ok {
-					subID = sub.id
-				}
-				close(sync)
+			b.lock.RLock()
+			if sub, ok := b.topicSubscription(topic, match); ok {
+				subID = sub.id
 			}
-			<-sync
+			b.lock.RUnlock()
 		}
 	}
 	return &wamp.Yield{
@@ -698,30 +1341,13 @@ func (b *Broker) SubMatch(msg *wamp.Invocation) wamp.Message {
 	var subIDs []wamp.ID
 	if len(msg.Arguments) != 0 {
 		if topic, ok := wamp.AsURI(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				if sub, ok := b.topicSubscription[topic]; ok {
-					for subscriber := range sub.subscribers {
-						subIDs = append(subIDs, subscriber.ID)
-					}
+			b.lock.RLock()
+			for _, m := range b.topicMatcher.Matches(topic) {
+				for subscriber := range m.Value.(*subscription).subscribers {
+					subIDs = append(subIDs, subscriber.ID)
 				}
-				for pfxTopic, sub := range b.pfxTopicSubscription {
-					if topic.PrefixMatch(pfxTopic) {
-						for subscriber := range sub.subscribers {
-							subIDs = append(subIDs, subscriber.ID)
-						}
-					}
-				}
-				for wcTopic, sub := range b.wcTopicSubscription {
-					if topic.WildcardMatch(wcTopic) {
-						for subscriber := range sub.subscribers {
-							subIDs = append(subIDs, subscriber.ID)
-						}
-					}
-				}
-				close(sync)
 			}
-			<-sync
+			b.lock.RUnlock()
 		}
 	}
 	return &wamp.Yield{
@@ -735,19 +1361,16 @@ func (b *Broker) SubGet(msg *wamp.Invocation) wamp.Message {
 	var dict wamp.Dict
 	if len(msg.Arguments) != 0 {
 		if subID, ok := wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				if sub, ok := b.subscriptions[subID]; ok {
-					dict = wamp.Dict{
-						"id":          subID,
-						"created":     sub.created,
-						"uri":         sub.topic,
-						wamp.OptMatch: sub.match,
-					}
+			b.lock.RLock()
+			if sub, ok := b.subscriptions[subID]; ok {
+				dict = wamp.Dict{
+					"id":          subID,
+					"created":     sub.created,
+					"uri":         sub.topic,
+					wamp.OptMatch: sub.match,
 				}
-				close(sync)
 			}
-			<-sync
+			b.lock.RUnlock()
 		}
 	}
 	if dict == nil {
@@ -764,25 +1387,151 @@ func (b *Broker) SubGet(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// SubGetEvents retrieves the events, kept in the broker's event history, that
+// were published to topics matching a subscription.  The optional second
+// argument limits the number of events to the most recent ones.  The events
+// are returned oldest first.
+//
+// The caller must be a subscriber of the subscription, and gets only the
+// events that the broker would have sent it, with the same details.
+func (b *Broker) SubGetEvents(msg *wamp.Invocation) wamp.Message {
+	var events wamp.List
+	caller, ok := wamp.AsID(msg.Details["caller"])
+	if ok && len(msg.Arguments) != 0 {
+		var subID wamp.ID
+		if subID, ok = wamp.AsID(msg.Arguments[0]); ok {
+			var limit int64
+			if len(msg.Arguments) > 1 {
+				if limit, ok = wamp.AsInt64(msg.Arguments[1]); !ok || limit < 0 {
+					return &wamp.Error{
+						Type:      msg.MessageType(),
+						Request:   msg.Request,
+						Details:   wamp.Dict{},
+						Error:     wamp.ErrInvalidArgument,
+						Arguments: wamp.List{"limit must be a non-negative integer"},
+					}
+				}
+			}
+			b.lock.Lock()
+			var subscriber *session
+			sub, found := b.subscriptions[subID]
+			if found {
+				for s := range sub.subscribers {
+					if s.ID == caller {
+						subscriber = s
+						break
+					}
+				}
+			}
+			if subscriber != nil {
+				events = b.historyEventDicts(sub, subscriber, int(limit))
+			} else {
+				ok = false
+			}
+			b.lock.Unlock()
+		}
+	}
+	if !ok {
+		return &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchSubscription,
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{events},
+	}
+}
+
+// historyEventDicts returns the events, kept in the event histories, that the
+// broker would have sent to the subscriber of the subscription, oldest first.
+// The events are created by newEvent, so the subscriber's trust level, from_*,
+// and payload filters apply, the same as to published events.  If limit is
+// positive, then only the most recent limit events are returned.
+func (b *Broker) historyEventDicts(sub *subscription, subscriber *session, limit int) wamp.List {
+	events := wamp.List{}
+	sendTopic := sub.match == wamp.MatchPrefix || sub.match == wamp.MatchWildcard
+	for _, h := range historyEvents(b.histories, sub, time.Now()) {
+		evt := b.newEvent(h.pub, h.msg, h.publication, sub, subscriber, h.excludePub, sendTopic, h.disclose, nil, nil)
+		if evt != nil {
+			events = append(events, h.dict(evt))
+		}
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+// SubAck acknowledges the events, up to and including the sequence number,
+// that were sent to the caller using its reliable subscription.  The
+// arguments are the subscription ID and the sequence number, from the "seq"
+// detail of the last event processed.  Acknowledged events are not sent
+// again.
+func (b *Broker) SubAck(msg *wamp.Invocation) wamp.Message {
+	caller, ok := wamp.AsID(msg.Details["caller"])
+	if !ok || len(msg.Arguments) < 2 {
+		return makeError(msg.Request, wamp.ErrInvalidArgument)
+	}
+	subID, ok := wamp.AsID(msg.Arguments[0])
+	if !ok {
+		return makeError(msg.Request, wamp.ErrInvalidArgument)
+	}
+	seq, ok := wamp.AsInt64(msg.Arguments[1])
+	if !ok || seq < 0 {
+		return &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{"seq must be a non-negative integer"},
+		}
+	}
+	b.lock.Lock()
+	ok = false
+	if sub, found := b.subscriptions[subID]; found {
+		for subscriber, rd := range sub.reliable {
+			if subscriber.ID != caller {
+				continue
+			}
+			rd.ack(uint64(seq))
+			if len(rd.pending) == 0 {
+				rd.stopTimer()
+			}
+			ok = true
+			break
+		}
+	}
+	b.lock.Unlock()
+	if !ok {
+		return &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchSubscription,
+		}
+	}
+	return &wamp.Yield{Request: msg.Request}
+}
+
 // SubListSubscribers retrieves a list of session IDs for sessions currently
 // attached to the subscription.
 func (b *Broker) SubListSubscribers(msg *wamp.Invocation) wamp.Message {
 	var subscriberIDs []wamp.ID
 	if len(msg.Arguments) != 0 {
 		if subID, ok := wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				if sub, ok := b.subscriptions[subID]; ok {
-					subscriberIDs = make([]wamp.ID, len(sub.subscribers))
-					var i int
-					for subscriber := range sub.subscribers {
-						subscriberIDs[i] = subscriber.ID
-						i++
-					}
+			b.lock.RLock()
+			if sub, ok := b.subscriptions[subID]; ok {
+				subscriberIDs = make([]wamp.ID, len(sub.subscribers))
+				var i int
+				for subscriber := range sub.subscribers {
+					subscriberIDs[i] = subscriber.ID
+					i++
 				}
-				close(sync)
 			}
-			<-sync
+			b.lock.RUnlock()
 		}
 	}
 	if len(subscriberIDs) == 0 {
@@ -807,16 +1556,13 @@ func (b *Broker) SubCountSubscribers(msg *wamp.Invocation) wamp.Message {
 	if len(msg.Arguments) != 0 {
 		var subID wamp.ID
 		if subID, ok = wamp.AsID(msg.Arguments[0]); ok {
-			sync := make(chan struct{})
-			b.actionChan <- func() {
-				if sub, found := b.subscriptions[subID]; found {
-					count = len(sub.subscribers)
-				} else {
-					ok = false
-				}
-				close(sync)
+			b.lock.RLock()
+			if sub, found := b.subscriptions[subID]; found {
+				count = len(sub.subscribers)
+			} else {
+				ok = false
 			}
-			<-sync
+			b.lock.RUnlock()
 		}
 	}
 	if !ok {
@@ -832,3 +1578,129 @@ func (b *Broker) SubCountSubscribers(msg *wamp.Invocation) wamp.Message {
 		Arguments: wamp.List{count},
 	}
 }
+
+// ----- Reflection Meta Procedure Handlers -----
+
+// TopicList retrieves a sorted list of the URIs of topics that have
+// subscriptions, including pattern-based subscriptions, or a defined schema.
+// The router's own "wamp." meta event topics are not listed.
+func (b *Broker) TopicList(msg *wamp.Invocation) wamp.Message {
+	uris := map[wamp.URI]struct{}{}
+	b.lock.RLock()
+	for _, sub := range b.subscriptions {
+		uris[sub.topic] = struct{}{}
+	}
+	b.lock.RUnlock()
+	b.schemaLock.RLock()
+	for topic := range b.confTopicSchemas {
+		uris[topic] = struct{}{}
+	}
+	for topic := range b.topicSchemas {
+		uris[topic] = struct{}{}
+	}
+	b.schemaLock.RUnlock()
+	for topic := range uris {
+		if strings.HasPrefix(string(topic), "wamp.") {
+			delete(uris, topic)
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{sortedURIs(uris)},
+	}
+}
+
+// TopicDescribe retrieves the IDs of the subscriptions matching a topic URI,
+// and the schema defined for the topic, if any.  A topic with neither
+// matching subscriptions nor a schema is unknown.
+func (b *Broker) TopicDescribe(msg *wamp.Invocation) wamp.Message {
+	if len(msg.Arguments) == 0 {
+		return makeError(msg.Request, wamp.ErrInvalidArgument)
+	}
+	topic, ok := wamp.AsURI(msg.Arguments[0])
+	if !ok {
+		return makeError(msg.Request, wamp.ErrInvalidArgument)
+	}
+	var subIDs []wamp.ID
+	b.lock.RLock()
+	for _, m := range b.topicMatcher.Matches(topic) {
+		subIDs = append(subIDs, m.Value.(*subscription).id)
+	}
+	b.lock.RUnlock()
+	b.schemaLock.RLock()
+	schema := b.topicSchema(topic)
+	b.schemaLock.RUnlock()
+	if len(subIDs) == 0 && schema == nil {
+		errMsg := makeError(msg.Request, wamp.ErrInvalidArgument)
+		errMsg.Arguments = wamp.List{fmt.Sprintf("no such topic: %v", topic)}
+		return errMsg
+	}
+	dict := wamp.Dict{
+		"uri":           topic,
+		"subscriptions": subIDs,
+	}
+	if schema != nil {
+		dict[wamp.OptSchema] = schema.desc
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
+// TopicDefine defines the schema of the events published to a topic, for
+// topic reflection.  This is a non-standard reflection meta procedure.
+//
+// The arguments are the topic URI and the schema, which has "description",
+// "args", and "kwargs" keys.  If the schema is omitted or null, the topic's
+// schema is removed.  A schema defined by the realm configuration cannot be
+// replaced.
+//
+// Only the session that defined a topic's schema can replace or remove it,
+// and the schema is removed when that session leaves the realm.  At most
+// maxTopicSchemas schemas can be defined.
+func (b *Broker) TopicDefine(msg *wamp.Invocation) wamp.Message {
+	caller, ok := wamp.AsID(msg.Details["caller"])
+	if !ok || len(msg.Arguments) == 0 {
+		return makeError(msg.Request, wamp.ErrInvalidArgument)
+	}
+	topic, ok := wamp.AsURI(msg.Arguments[0])
+	if !ok || !topic.ValidURI(b.strictURI, "") {
+		return makeError(msg.Request, wamp.ErrInvalidURI)
+	}
+	var schema *payloadSchema
+	if len(msg.Arguments) > 1 && msg.Arguments[1] != nil {
+		var err error
+		if schema, err = newPayloadSchema(msg.Arguments[1], false); err != nil {
+			errMsg := makeError(msg.Request, wamp.ErrInvalidArgument)
+			errMsg.Arguments = wamp.List{err.Error()}
+			return errMsg
+		}
+	}
+	b.schemaLock.Lock()
+	defer b.schemaLock.Unlock()
+	if _, ok := b.confTopicSchemas[topic]; ok {
+		errMsg := makeError(msg.Request, wamp.ErrNotAuthorized)
+		errMsg.Arguments = wamp.List{"topic schema defined by realm configuration"}
+		return errMsg
+	}
+	owner, defined := b.topicSchemaOwners[topic]
+	if defined && owner != caller {
+		errMsg := makeError(msg.Request, wamp.ErrNotAuthorized)
+		errMsg.Arguments = wamp.List{"topic schema defined by another session"}
+		return errMsg
+	}
+	if schema == nil {
+		delete(b.topicSchemas, topic)
+		delete(b.topicSchemaOwners, topic)
+		return &wamp.Yield{Request: msg.Request}
+	}
+	if !defined && len(b.topicSchemas) >= maxTopicSchemas {
+		errMsg := makeError(msg.Request, wamp.ErrNotAuthorized)
+		errMsg.Arguments = wamp.List{"too many topic schemas defined"}
+		return errMsg
+	}
+	b.topicSchemas[topic] = schema
+	b.topicSchemaOwners[topic] = caller
+	return &wamp.Yield{Request: msg.Request}
+}
@@ -2,6 +2,9 @@ package router
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -61,7 +64,7 @@ func TestBasicSubscribe(t *testing.T) {
 	if sub.topic != testTopic {
 		t.Fatal("subscription to wrong topic")
 	}
-	sub2, ok := broker.topicSubscription[testTopic]
+	sub2, ok := broker.topicSubscription(testTopic, "")
 	if !ok {
 		t.Fatal("broker missing subscribers for topic")
 	}
@@ -92,7 +95,7 @@ func TestBasicSubscribe(t *testing.T) {
 	if len(broker.subscriptions) != 1 {
 		t.Fatal("broker has too many subscriptions")
 	}
-	if sub, ok = broker.topicSubscription[testTopic]; !ok {
+	if sub, ok = broker.topicSubscription(testTopic, ""); !ok {
 		t.Fatal("broker missing topic->subscription")
 	}
 	if len(sub.subscribers) != 1 {
@@ -122,14 +125,14 @@ func TestBasicSubscribe(t *testing.T) {
 		t.Fatal("wrong number of subscriptions")
 	}
 
-	if sub, ok = broker.topicSubscription[testTopic]; !ok {
+	if sub, ok = broker.topicSubscription(testTopic, ""); !ok {
 		t.Fatal("broker missing topic->subscription for topic", testTopic)
 	}
 	if len(sub.subscribers) != 1 {
 		t.Fatal("too many subscribers to", testTopic)
 	}
 
-	if sub, ok = broker.topicSubscription[testTopic2]; !ok {
+	if sub, ok = broker.topicSubscription(testTopic2, ""); !ok {
 		t.Fatal("broker missing topic->subscription for topic", testTopic2)
 	}
 	if len(sub.subscribers) != 1 {
@@ -214,7 +217,7 @@ func TestUnsubscribe(t *testing.T) {
 		t.Fatal("subscription missing session 2")
 	}
 	// Check that topic->subscription remains
-	if _, ok = broker.topicSubscription[testTopic]; !ok {
+	if _, ok = broker.topicSubscription(testTopic, ""); !ok {
 		t.Fatal("topic subscription was deleted but subscription exists")
 	}
 	if _, ok = broker.sessionSubIDSet[sess1]; ok {
@@ -237,7 +240,7 @@ func TestUnsubscribe(t *testing.T) {
 	if _, ok = broker.subscriptions[subID]; ok {
 		t.Fatal("subscription still exists")
 	}
-	if _, ok = broker.topicSubscription[testTopic]; ok {
+	if _, ok = broker.topicSubscription(testTopic, ""); ok {
 		t.Fatal("topic subscription still exists")
 	}
 	if _, ok = broker.sessionSubIDSet[sess1]; ok {
@@ -277,13 +280,13 @@ func TestRemove(t *testing.T) {
 	if ok {
 		t.Fatal("subscription still exists")
 	}
-	if _, ok = broker.topicSubscription[testTopic]; ok {
+	if _, ok = broker.topicSubscription(testTopic, ""); ok {
 		t.Fatal("topic subscriber still exists")
 	}
 	if _, ok = broker.subscriptions[subID2]; ok {
 		t.Fatal("subscription still exists")
 	}
-	if _, ok = broker.topicSubscription[testTopic2]; ok {
+	if _, ok = broker.topicSubscription(testTopic2, ""); ok {
 		t.Fatal("topic subscriber still exists")
 	}
 	if _, ok = broker.sessionSubIDSet[sess]; ok {
@@ -365,7 +368,7 @@ func TestPrefxPatternBasedSubscription(t *testing.T) {
 	if sub.topic != testTopicPfx {
 		t.Fatal("subscription to wrong topic")
 	}
-	_, ok = broker.pfxTopicSubscription[testTopicPfx]
+	_, ok = broker.topicSubscription(testTopicPfx, wamp.MatchPrefix)
 	if !ok {
 		t.Fatal("broker missing subscribers for topic")
 	}
@@ -434,7 +437,7 @@ func TestWildcardPatternBasedSubscription(t *testing.T) {
 	if sub.match != "wildcard" {
 		t.Fatal("subscription has wrong match policy")
 	}
-	sub2, ok := broker.wcTopicSubscription[testTopicWc]
+	sub2, ok := broker.topicSubscription(testTopicWc, wamp.MatchWildcard)
 	if !ok {
 		t.Fatal("broker missing subscription for topic")
 	}
@@ -691,3 +694,1203 @@ func TestPublisherIdentification(t *testing.T) {
 		t.Fatal("incorrect publisher ID disclosed")
 	}
 }
+
+func TestPublicationTrustLevels(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscriber that accepts events from any publisher.
+	sess := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	rsp := <-sess.Recv()
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Subscriber that requires a minimum trust level.
+	trustedSess := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(trustedSess, &wamp.Subscribe{
+		Request: 124,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptMinTrustLevel: 2},
+	})
+	rsp = <-trustedSess.Recv()
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Publish from a session with a trust level below the minimum.
+	pubSess := newSession(newTestPeer(), 0, nil)
+	pubSess.trustLevel, pubSess.hasTrustLevel = 1, true
+	broker.Publish(pubSess, &wamp.Publish{Request: 125, Topic: testTopic})
+
+	rsp = <-sess.Recv()
+	evt, ok := rsp.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if level, _ := wamp.AsInt64(evt.Details["trustlevel"]); level != 1 {
+		t.Fatal("expected trustlevel 1, got:", evt.Details["trustlevel"])
+	}
+	select {
+	case rsp = <-trustedSess.Recv():
+		t.Fatal("subscriber received event from low trust publisher")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Publish from a session with a trust level that meets the minimum.
+	pubSess.trustLevel = 2
+	broker.Publish(pubSess, &wamp.Publish{Request: 126, Topic: testTopic})
+
+	for _, s := range []*session{sess, trustedSess} {
+		rsp = <-s.Recv()
+		if evt, ok = rsp.(*wamp.Event); !ok {
+			t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+		}
+		if level, _ := wamp.AsInt64(evt.Details["trustlevel"]); level != 2 {
+			t.Fatal("expected trustlevel 2, got:", evt.Details["trustlevel"])
+		}
+	}
+
+	// Publish from a session that has no trust level assigned.
+	noTrustSess := newSession(newTestPeer(), 0, nil)
+	broker.Publish(noTrustSess, &wamp.Publish{Request: 127, Topic: testTopic})
+	rsp = <-sess.Recv()
+	if evt, ok = rsp.(*wamp.Event); !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if _, ok = evt.Details["trustlevel"]; ok {
+		t.Fatal("event should not have trustlevel")
+	}
+}
+
+func TestPublishTracing(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	sess := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(sess, &wamp.Subscribe{Request: 123, Topic: testTopic})
+	rsp := <-sess.Recv()
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Publication with trace ID is traced even without a span recorder.
+	traceID := newTraceID()
+	pubSess := newSession(newTestPeer(), 0, nil)
+	broker.Publish(pubSess, &wamp.Publish{
+		Request: 124,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptTraceID: traceID},
+	})
+	rsp = <-sess.Recv()
+	evt, ok := rsp.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if evt.Details[wamp.OptTraceID] != traceID {
+		t.Fatal("wrong trace_id in EVENT:", evt.Details[wamp.OptTraceID])
+	}
+	if _, ok = evt.Details[wamp.OptSpanID]; !ok {
+		t.Fatal("missing span_id in EVENT")
+	}
+
+	// Publication without trace ID is not traced.
+	broker.Publish(pubSess, &wamp.Publish{Request: 125, Topic: testTopic})
+	rsp = <-sess.Recv()
+	if evt, ok = rsp.(*wamp.Event); !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if _, ok = evt.Details[wamp.OptTraceID]; ok {
+		t.Fatal("untraced EVENT should not have trace_id")
+	}
+
+	// With a span recorder, every publication is traced and recorded.
+	recorder := newTestSpanRecorder()
+	broker.SetSpanRecorder(recorder)
+	broker.Publish(pubSess, &wamp.Publish{Request: 126, Topic: testTopic})
+	rsp = <-sess.Recv()
+	if evt, ok = rsp.(*wamp.Event); !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	span := recorder.recv(t)
+	if evt.Details[wamp.OptTraceID] != span.TraceID ||
+		evt.Details[wamp.OptSpanID] != span.SpanID {
+		t.Fatal("EVENT trace details do not match span")
+	}
+	if span.Kind != SpanKindPublish || span.Name != string(testTopic) {
+		t.Fatal("wrong span kind or name:", span.Kind, span.Name)
+	}
+	if span.Attributes["publication"] != evt.Publication {
+		t.Fatal("wrong publication attribute:", span.Attributes["publication"])
+	}
+	if span.Attributes["events"] != 1 {
+		t.Fatal("wrong events attribute:", span.Attributes["events"])
+	}
+}
+
+func TestTopicReflection(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	sess := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(sess, &wamp.Subscribe{
+		Request: 123,
+		Topic:   wamp.URI("nexus.test"),
+		Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	rsp := <-sess.Recv()
+	subMsg, ok := rsp.(*wamp.Subscribed)
+	if !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+
+	// Define schema that is not valid.  Topic schema cannot have a result.
+	rsp = broker.TopicDefine(&wamp.Invocation{
+		Request:   1,
+		Details:   wamp.Dict{"caller": sess.ID},
+		Arguments: wamp.List{testTopic, wamp.Dict{"result": wamp.Dict{}}},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+
+	// Define schemas for two topics, and then remove one.
+	schema := wamp.Dict{
+		"description": "test topic",
+		"kwargs":      wamp.Dict{"type": "object"},
+	}
+	for _, args := range []wamp.List{
+		{testTopic, schema},
+		{wamp.URI("nexus.other"), schema},
+		{wamp.URI("nexus.other")},
+	} {
+		rsp = broker.TopicDefine(&wamp.Invocation{
+			Request:   2,
+			Details:   wamp.Dict{"caller": sess.ID},
+			Arguments: args,
+		})
+		if _, ok = rsp.(*wamp.Yield); !ok {
+			t.Fatal("expected YIELD, got:", rsp)
+		}
+	}
+
+	// Another session cannot replace or remove the schema.
+	other := newSession(newTestPeer(), 0, nil)
+	for _, args := range []wamp.List{{testTopic, schema}, {testTopic}} {
+		rsp = broker.TopicDefine(&wamp.Invocation{
+			Request:   2,
+			Details:   wamp.Dict{"caller": other.ID},
+			Arguments: args,
+		})
+		if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+			t.Fatal("expected", wamp.ErrNotAuthorized, "got:", rsp)
+		}
+	}
+
+	// List topics.
+	rsp = broker.TopicList(&wamp.Invocation{Request: 3})
+	list, _ := wamp.AsList(rsp.(*wamp.Yield).Arguments[0])
+	if len(list) != 2 || list[0] != wamp.URI("nexus.test") || list[1] != testTopic {
+		t.Fatal("wrong topic list:", list)
+	}
+
+	// Describe topic with schema and matching subscription.
+	rsp = broker.TopicDescribe(&wamp.Invocation{
+		Request:   4,
+		Arguments: wamp.List{testTopic},
+	})
+	dict, _ := wamp.AsDict(rsp.(*wamp.Yield).Arguments[0])
+	subIDs, _ := dict["subscriptions"].([]wamp.ID)
+	if len(subIDs) != 1 || subIDs[0] != subMsg.Subscription {
+		t.Fatal("wrong topic subscriptions:", dict["subscriptions"])
+	}
+	sch, _ := wamp.AsDict(dict[wamp.OptSchema])
+	if sch["description"] != "test topic" {
+		t.Fatal("wrong topic schema:", dict[wamp.OptSchema])
+	}
+
+	// Describe topic that has neither subscriptions nor a schema.
+	rsp = broker.TopicDescribe(&wamp.Invocation{
+		Request:   5,
+		Arguments: wamp.List{wamp.URI("nexus.other")},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+
+	// Schemas are removed when the defining session leaves.
+	broker.RemoveSession(sess)
+	rsp = broker.TopicDescribe(&wamp.Invocation{
+		Request:   6,
+		Arguments: wamp.List{testTopic},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+
+	// The number of schemas that sessions can define is limited.
+	for i := 0; i <= maxTopicSchemas; i++ {
+		rsp = broker.TopicDefine(&wamp.Invocation{
+			Request:   7,
+			Details:   wamp.Dict{"caller": other.ID},
+			Arguments: wamp.List{wamp.URI(fmt.Sprint("nexus.test.topic", i)), schema},
+		})
+	}
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected", wamp.ErrNotAuthorized, "got:", rsp)
+	}
+}
+
+func TestPublishPayloadValidation(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	broker.SetValidatePayloads(true)
+	testTopic := wamp.URI("nexus.test.topic")
+	confTopic := wamp.URI("nexus.test.conf")
+	err := broker.SetTopicSchemas(map[wamp.URI]wamp.Dict{
+		confTopic: {"args": wamp.Dict{"maxItems": 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Schema from configuration cannot be replaced.
+	rsp := broker.TopicDefine(&wamp.Invocation{
+		Request:   1,
+		Details:   wamp.Dict{"caller": wamp.ID(1)},
+		Arguments: wamp.List{confTopic, wamp.Dict{}},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected", wamp.ErrNotAuthorized, "got:", rsp)
+	}
+	rsp = broker.TopicDefine(&wamp.Invocation{
+		Request: 2,
+		Details: wamp.Dict{"caller": wamp.ID(1)},
+		Arguments: wamp.List{testTopic, wamp.Dict{
+			"kwargs": wamp.Dict{
+				"properties": wamp.Dict{"level": wamp.Dict{"type": "integer"}},
+			},
+		}},
+	})
+	if _, ok := rsp.(*wamp.Yield); !ok {
+		t.Fatal("expected YIELD, got:", rsp)
+	}
+
+	sess := newSession(newTestPeer(), 0, nil)
+	for i, topic := range []wamp.URI{testTopic, confTopic} {
+		broker.Subscribe(sess, &wamp.Subscribe{Request: wamp.ID(123 + i), Topic: topic})
+		rsp := <-sess.Recv()
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	// Publications that do not match the schemas are not sent.
+	pub := newTestPeer()
+	pubSess := newSession(pub, 0, nil)
+	broker.Publish(pubSess, &wamp.Publish{
+		Request:     125,
+		Topic:       testTopic,
+		Options:     wamp.Dict{wamp.OptAcknowledge: true},
+		ArgumentsKw: wamp.Dict{"level": "high"},
+	})
+	rsp = <-pub.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+	if len(errMsg.Arguments) == 0 || errMsg.Arguments[0] != "kwargs.level: expected integer, got string" {
+		t.Fatal("wrong validation message:", errMsg.Arguments)
+	}
+	broker.Publish(pubSess, &wamp.Publish{
+		Request:   126,
+		Topic:     confTopic,
+		Arguments: wamp.List{1},
+	})
+	select {
+	case rsp = <-sess.Recv():
+		t.Fatal("subscriber received event that does not match schema")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Publication that matches the schema is sent.
+	broker.Publish(pubSess, &wamp.Publish{
+		Request:     127,
+		Topic:       testTopic,
+		ArgumentsKw: wamp.Dict{"level": 2},
+	})
+	rsp = <-sess.Recv()
+	if _, ok = rsp.(*wamp.Event); !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+}
+
+func TestPublishPayloadPassthru(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	broker.SetValidatePayloads(true)
+	testTopic := wamp.URI("nexus.test.topic")
+	err := broker.SetTopicSchemas(map[wamp.URI]wamp.Dict{
+		testTopic: {"args": wamp.Dict{"maxItems": 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	details := wamp.Dict{
+		"roles": wamp.Dict{
+			"subscriber": wamp.Dict{
+				"features": wamp.Dict{
+					"payload_passthru_mode": true,
+				},
+			},
+		},
+	}
+	sess := newSession(newTestPeer(), 0, details)
+	// Subscriber that does not support passthru mode.
+	sess2 := newSession(newTestPeer(), 0, nil)
+	for i, s := range []*session{sess, sess2} {
+		broker.Subscribe(s, &wamp.Subscribe{Request: wamp.ID(123 + i), Topic: testTopic})
+		rsp := <-s.Recv()
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	pub := newTestPeer()
+	pubSess := newSession(pub, 0, nil)
+
+	// Publication with invalid passthru options is rejected.
+	broker.Publish(pubSess, &wamp.Publish{
+		Request:   125,
+		Topic:     testTopic,
+		Options:   wamp.Dict{wamp.OptAcknowledge: true, wamp.OptPPTScheme: "custom"},
+		Arguments: wamp.List{[]byte{1, 2, 3}},
+	})
+	rsp := <-pub.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+
+	// Passthru publication is not validated against the schema, and is only
+	// sent to the subscriber that supports passthru mode.
+	broker.Publish(pubSess, &wamp.Publish{
+		Request: 126,
+		Topic:   testTopic,
+		Options: wamp.Dict{
+			wamp.OptPPTScheme: "x_custom",
+			wamp.OptPPTKeyID:  "key1",
+		},
+		Arguments: wamp.List{[]byte{1, 2, 3}},
+	})
+	rsp = <-sess.Recv()
+	evt, ok := rsp.(*wamp.Event)
+	if !ok {
+		t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+	}
+	if evt.Details[wamp.OptPPTScheme] != "x_custom" || evt.Details[wamp.OptPPTKeyID] != "key1" {
+		t.Fatal("EVENT details missing passthru options:", evt.Details)
+	}
+	select {
+	case rsp = <-sess2.Recv():
+		t.Fatal("subscriber without passthru mode received event")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSubscriberPublisherFiltering(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Test that invalid publisher filters are rejected.
+	sess := newSession(newTestPeer(), 0, nil)
+	for i, opts := range []wamp.Dict{
+		{wamp.OptFromAuthRole: "device"},
+		{wamp.OptFromAuthID: wamp.List{""}},
+		{wamp.OptFromSession: wamp.List{"abc"}},
+	} {
+		broker.Subscribe(sess, &wamp.Subscribe{
+			Request: wamp.ID(100 + i),
+			Topic:   testTopic,
+			Options: opts,
+		})
+		rsp := <-sess.Recv()
+		if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+			t.Fatal("expected", wamp.ErrInvalidArgument, "for options", opts, "got:", rsp)
+		}
+	}
+
+	devicePub := newSession(newTestPeer(), 0, wamp.Dict{"authrole": "device"})
+	userPub := newSession(newTestPeer(), 0, wamp.Dict{"authrole": "user"})
+
+	// Subscriber to wildcard topic that only receives events from devices.
+	deviceSub := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(deviceSub, &wamp.Subscribe{
+		Request: 123,
+		Topic:   wamp.URI("nexus..topic"),
+		Options: wamp.Dict{
+			wamp.OptMatch:        wamp.MatchWildcard,
+			wamp.OptFromAuthRole: wamp.List{"device"},
+		},
+	})
+	// Subscriber that only receives events from the user session.
+	sessionSub := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(sessionSub, &wamp.Subscribe{
+		Request: 124,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptFromSession: wamp.List{userPub.ID}},
+	})
+	// Subscriber that receives all events.
+	allSub := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(allSub, &wamp.Subscribe{Request: 125, Topic: testTopic})
+	for _, s := range []*session{deviceSub, sessionSub, allSub} {
+		rsp := <-s.Recv()
+		if _, ok := rsp.(*wamp.Subscribed); !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	checkEvent := func(s *session, expect bool) {
+		select {
+		case rsp := <-s.Recv():
+			if _, ok := rsp.(*wamp.Event); !ok {
+				t.Fatal("expected", wamp.EVENT, "got:", rsp.MessageType())
+			}
+			if !expect {
+				t.Fatal("subscriber received event from filtered publisher")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if expect {
+				t.Fatal("subscriber did not receive event")
+			}
+		}
+	}
+
+	broker.Publish(devicePub, &wamp.Publish{Request: 126, Topic: testTopic})
+	checkEvent(deviceSub, true)
+	checkEvent(sessionSub, false)
+	checkEvent(allSub, true)
+
+	broker.Publish(userPub, &wamp.Publish{Request: 127, Topic: testTopic})
+	checkEvent(deviceSub, false)
+	checkEvent(sessionSub, true)
+	checkEvent(allSub, true)
+}
+
+func TestEventHistory(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	for _, cfg := range []EventHistoryConfig{
+		{Topic: testTopic, Limit: 0},
+		{Topic: testTopic, Match: "regex", Limit: 1},
+		{Topic: wamp.URI("nexus..topic"), Limit: 1},
+		{Topic: testTopic, Limit: 1, MaxAge: -1},
+	} {
+		if err := broker.SetEventHistory([]EventHistoryConfig{cfg}); err == nil {
+			t.Fatal("expected error for event history config:", cfg)
+		}
+	}
+	err := broker.SetEventHistory([]EventHistoryConfig{
+		{Topic: testTopic, Limit: 2},
+		{Topic: wamp.URI("nexus.test"), Match: wamp.MatchPrefix, Limit: 10},
+		{Topic: testTopic, Limit: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubSess := newSession(newTestPeer(), 0, nil)
+	for i := 1; i <= 3; i++ {
+		broker.Publish(pubSess, &wamp.Publish{
+			Request:   wamp.ID(i),
+			Topic:     testTopic,
+			Arguments: wamp.List{i},
+		})
+	}
+	broker.Publish(pubSess, &wamp.Publish{
+		Request:   4,
+		Topic:     wamp.URI("nexus.test.other"),
+		Arguments: wamp.List{4},
+	})
+	// Publication restricted to some recipients is not kept.
+	broker.Publish(pubSess, &wamp.Publish{
+		Request:   5,
+		Topic:     testTopic,
+		Options:   wamp.Dict{"eligible_authrole": wamp.List{"admin"}},
+		Arguments: wamp.List{5},
+	})
+	// Each history configured for the same topic keeps the events.
+	if len(broker.histories[0].events) != 2 || len(broker.histories[2].events) != 1 {
+		t.Fatal("wrong number of events in histories of same topic")
+	}
+
+	sess := newSession(newTestPeer(), 0, nil)
+	getEvents := func(caller *session, sub wamp.ID, args ...interface{}) []int {
+		args = append([]interface{}{sub}, args...)
+		rsp := broker.SubGetEvents(&wamp.Invocation{
+			Request:   1,
+			Details:   wamp.Dict{"caller": caller.ID},
+			Arguments: args,
+		})
+		yield, ok := rsp.(*wamp.Yield)
+		if !ok {
+			t.Fatal("expected YIELD, got:", rsp)
+		}
+		events, _ := wamp.AsList(yield.Arguments[0])
+		nums := make([]int, len(events))
+		for i := range events {
+			evt, _ := wamp.AsDict(events[i])
+			if evt["subscription"] != sub {
+				t.Fatal("wrong subscription in event:", evt)
+			}
+			args, _ := wamp.AsList(evt["args"])
+			nums[i] = args[0].(int)
+		}
+		return nums
+	}
+	subscribe := func(sess *session, req wamp.ID, topic wamp.URI, options wamp.Dict) wamp.ID {
+		broker.Subscribe(sess, &wamp.Subscribe{
+			Request: req,
+			Topic:   topic,
+			Options: options,
+		})
+		rsp := <-sess.Recv()
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		return subMsg.Subscription
+	}
+
+	// Exact subscription gets events kept by both histories, oldest first.
+	subID := subscribe(sess, 10, testTopic, nil)
+	if got := getEvents(sess, subID); fmt.Sprint(got) != "[1 2 3]" {
+		t.Fatal("wrong events:", got)
+	}
+	if got := getEvents(sess, subID, 2); fmt.Sprint(got) != "[2 3]" {
+		t.Fatal("wrong limited events:", got)
+	}
+
+	// Prefix subscription gets events published to all matching topics.
+	pfxSubID := subscribe(sess, 11, wamp.URI("nexus.test"),
+		wamp.Dict{wamp.OptMatch: wamp.MatchPrefix})
+	if got := getEvents(sess, pfxSubID); fmt.Sprint(got) != "[1 2 3 4]" {
+		t.Fatal("wrong events:", got)
+	}
+
+	// Subscriber gets only the events that its subscribe options allow it to
+	// receive.
+	for _, test := range []struct {
+		options wamp.Dict
+		events  string
+	}{
+		{wamp.Dict{wamp.OptFilter: "args[0] > 1"}, "[2 3]"},
+		{wamp.Dict{wamp.OptMinTrustLevel: 1}, "[]"},
+		{wamp.Dict{wamp.OptFromSession: wamp.List{sess.ID}}, "[]"},
+		{wamp.Dict{wamp.OptFromSession: wamp.List{pubSess.ID}}, "[1 2 3]"},
+	} {
+		filterSess := newSession(newTestPeer(), 0, nil)
+		if id := subscribe(filterSess, 12, testTopic, test.options); id != subID {
+			t.Fatal("expected subscriber to join subscription")
+		}
+		if got := getEvents(filterSess, subID); fmt.Sprint(got) != test.events {
+			t.Fatal("wrong events for options", test.options, "got:", got)
+		}
+		broker.RemoveSession(filterSess)
+	}
+
+	// Session that is not a subscriber cannot get the events.
+	rsp := broker.SubGetEvents(&wamp.Invocation{
+		Request:   2,
+		Details:   wamp.Dict{"caller": pubSess.ID},
+		Arguments: wamp.List{subID},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchSubscription {
+		t.Fatal("expected", wamp.ErrNoSuchSubscription, "got:", rsp)
+	}
+
+	rsp = broker.SubGetEvents(&wamp.Invocation{
+		Request:   2,
+		Details:   wamp.Dict{"caller": sess.ID},
+		Arguments: wamp.List{subID, -1},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+	rsp = broker.SubGetEvents(&wamp.Invocation{
+		Request:   3,
+		Arguments: wamp.List{wamp.ID(1234)},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchSubscription {
+		t.Fatal("expected", wamp.ErrNoSuchSubscription, "got:", rsp)
+	}
+
+	// Events older than the maximum age are removed.
+	h, err := newEventHistory(EventHistoryConfig{Topic: testTopic, Limit: 10, MaxAge: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	h.add(&historyEvent{published: now.Add(-2 * time.Second), publication: 1})
+	h.add(&historyEvent{published: now.Add(-500 * time.Millisecond), publication: 2})
+	h.add(&historyEvent{published: now, publication: 3})
+	if len(h.events) != 2 || h.events[0].publication != 2 {
+		t.Fatal("expected oldest event to expire")
+	}
+	h.expire(now.Add(time.Second))
+	if len(h.events) != 1 || h.events[0].publication != 3 {
+		t.Fatal("expected events older than max age to expire")
+	}
+}
+
+func TestRetainedEvents(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	pubSess := newSession(newTestPeer(), 0, nil)
+	publish := func(req wamp.ID, topic wamp.URI, arg int, retain bool) {
+		opts := wamp.Dict{}
+		if retain {
+			opts[wamp.OptRetain] = true
+		}
+		broker.Publish(pubSess, &wamp.Publish{
+			Request:   req,
+			Topic:     topic,
+			Options:   opts,
+			Arguments: wamp.List{arg},
+		})
+	}
+	publish(1, testTopic, 1, true)
+	publish(2, testTopic, 2, true) // replaces first retained event
+	publish(3, testTopic, 3, false)
+	publish(4, wamp.URI("nexus.test.other"), 4, true)
+	publish(5, wamp.URI("nexus.other"), 5, true)
+
+	subscribe := func(req wamp.ID, topic wamp.URI, match string, getRetained bool) []string {
+		// Use a queue large enough to hold the SUBSCRIBED and retained events.
+		sess := newSession(&testPeer{in: make(chan wamp.Message, 10)}, 0, nil)
+		opts := wamp.Dict{wamp.OptMatch: match}
+		if getRetained {
+			opts[wamp.OptGetRetained] = true
+		}
+		broker.Subscribe(sess, &wamp.Subscribe{
+			Request: req,
+			Topic:   topic,
+			Options: opts,
+		})
+		rsp := <-sess.Recv()
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		var got []string
+		for {
+			select {
+			case msg := <-sess.Recv():
+				evt, ok := msg.(*wamp.Event)
+				if !ok {
+					t.Fatal("expected", wamp.EVENT, "got:", msg.MessageType())
+				}
+				if evt.Subscription != subMsg.Subscription {
+					t.Fatal("wrong subscription ID in event")
+				}
+				if retained, _ := evt.Details[detailRetained].(bool); !retained {
+					t.Fatal("event missing retained detail")
+				}
+				topic, _ := wamp.AsURI(evt.Details[detailTopic])
+				got = append(got, fmt.Sprint(topic, "=", evt.Arguments[0]))
+			case <-time.After(200 * time.Millisecond):
+				return got
+			}
+		}
+	}
+
+	if got := subscribe(10, testTopic, wamp.MatchExact, false); len(got) != 0 {
+		t.Fatal("should not get retained events unless requested:", got)
+	}
+	if got := subscribe(11, testTopic, wamp.MatchExact, true); fmt.Sprint(got) != "[=2]" {
+		t.Fatal("wrong retained events:", got)
+	}
+	got := subscribe(12, wamp.URI("nexus.test"), wamp.MatchPrefix, true)
+	if fmt.Sprint(got) != "[nexus.test.other=4 nexus.test.topic=2]" {
+		t.Fatal("wrong retained events:", got)
+	}
+	got = subscribe(13, wamp.URI("nexus..topic"), wamp.MatchWildcard, true)
+	if fmt.Sprint(got) != "[nexus.test.topic=2]" {
+		t.Fatal("wrong retained events:", got)
+	}
+
+	// The retained event does not keep the publisher's session.
+	if r := broker.shard(testTopic).retained[testTopic]; r.pub == pubSess || r.pub.Peer != nil {
+		t.Fatal("retained event keeps publisher session")
+	}
+
+	// Publishing with the retain option and no arguments clears the topic's
+	// retained event.
+	broker.Publish(pubSess, &wamp.Publish{
+		Request: 14,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptRetain: true},
+	})
+	if got = subscribe(15, testTopic, wamp.MatchExact, true); len(got) != 0 {
+		t.Fatal("expected retained event to be cleared, got:", got)
+	}
+
+	// Events to new topics are not retained over the limit.
+	if err := broker.SetRetainedLimit(-1); err == nil {
+		t.Fatal("expected error for negative retained limit")
+	}
+	if err := broker.SetRetainedLimit(2); err != nil {
+		t.Fatal(err)
+	}
+	publish(16, wamp.URI("nexus.test.new"), 16, true)
+	publish(17, wamp.URI("nexus.test.other"), 17, true)
+	got = subscribe(18, wamp.URI("nexus.test"), wamp.MatchPrefix, true)
+	if fmt.Sprint(got) != "[nexus.test.other=17]" {
+		t.Fatal("wrong retained events:", got)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	args := wamp.List{"on", 3, wamp.List{1.5, "x"}}
+	kwargs := wamp.Dict{
+		"temperature": 35,
+		"site":        "A",
+		"ok":          true,
+		"loc":         map[string]interface{}{"floor": uint64(2)},
+	}
+	for expr, want := range map[string]bool{
+		`kwargs.temperature > 30 && kwargs.site == "A"`:  true,
+		`kwargs.temperature > 40 || kwargs.site == 'B'`:  false,
+		`kwargs["temperature"] >= 35.0`:                  true,
+		`args[0] == "on" && args[1] < 4`:                 true,
+		`args[2][0] == 1.5 && args[2][1] != "y"`:         true,
+		`kwargs.loc.floor == 2`:                          true,
+		`kwargs.ok`:                                      true,
+		`!kwargs.ok`:                                     false,
+		`!(kwargs.site == "A")`:                          false,
+		`kwargs.missing == null`:                         true,
+		`kwargs.missing > 0`:                             false,
+		`args[9] == null`:                                true,
+		`kwargs.site > 1`:                                false,
+		`kwargs.temperature`:                             false,
+		`kwargs.temperature == -35 || kwargs.site < "B"`: true,
+		`(kwargs.site == "B" || true) && 1e2 == 100`:     true,
+	} {
+		f, err := newEventFilter(expr)
+		if err != nil {
+			t.Fatalf("error compiling %s: %s", expr, err)
+		}
+		if got := f.matches(args, kwargs); got != want {
+			t.Errorf("%s: expected %v, got %v", expr, want, got)
+		}
+	}
+
+	for _, expr := range []string{
+		`kwargs.temperature >`,
+		`kwargs.site == "A`,
+		`temperature > 30`,
+		`kwargs.site = "A"`,
+		`args[-1] == 1`,
+		`(kwargs.ok`,
+		`kwargs.ok kwargs.ok`,
+		strings.Repeat("(", maxFilterDepth+1) + "true" + strings.Repeat(")", maxFilterDepth+1),
+		strings.Repeat("!", maxFilterDepth+1) + "true",
+		strings.Repeat(" ", maxFilterLength) + "true",
+	} {
+		if _, err := newEventFilter(expr); err == nil {
+			t.Errorf("expected error compiling %s", expr)
+		}
+	}
+
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.telemetry")
+
+	sess := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(sess, &wamp.Subscribe{
+		Request: 1,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptFilter: 42},
+	})
+	rsp := <-sess.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+	broker.Subscribe(sess, &wamp.Subscribe{
+		Request: 2,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptFilter: "kwargs.temperature >> 30"},
+	})
+	rsp = <-sess.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+
+	broker.Subscribe(sess, &wamp.Subscribe{
+		Request: 3,
+		Topic:   testTopic,
+		Options: wamp.Dict{wamp.OptFilter: `kwargs.temperature > 30 && kwargs.site == "A"`},
+	})
+	rsp = <-sess.Recv()
+	if _, ok := rsp.(*wamp.Subscribed); !ok {
+		t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+	}
+	// Subscriber without a filter gets all events.
+	allSess := newSession(newTestPeer(), 0, nil)
+	broker.Subscribe(allSess, &wamp.Subscribe{Request: 4, Topic: testTopic})
+	<-allSess.Recv()
+
+	pubSess := newSession(newTestPeer(), 0, nil)
+	for i, kw := range []wamp.Dict{
+		{"temperature": 25, "site": "A"},
+		{"temperature": 35, "site": "B"},
+		{"temperature": 35, "site": "A"},
+		{"site": "A"},
+	} {
+		broker.Publish(pubSess, &wamp.Publish{
+			Request:     wamp.ID(i + 1),
+			Topic:       testTopic,
+			ArgumentsKw: kw,
+		})
+		want := i == 2
+		select {
+		case <-sess.Recv():
+			if !want {
+				t.Fatal("filtered subscriber got event that does not match:", kw)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Fatal("filtered subscriber did not get matching event:", kw)
+			}
+		}
+		select {
+		case <-allSess.Recv():
+		case <-time.After(time.Second):
+			t.Fatal("subscriber without filter did not get event:", kw)
+		}
+	}
+}
+
+func TestReliableDelivery(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	defer broker.Close()
+	if err := broker.SetReliableDelivery(ReliableDeliveryConfig{AckTimeout: -1}); err == nil {
+		t.Fatal("expected error for negative ack timeout")
+	}
+	err := broker.SetReliableDelivery(ReliableDeliveryConfig{
+		BufferSize:    3,
+		AckTimeout:    100,
+		ResumeTimeout: 5000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTopic := wamp.URI("nexus.test.billing")
+	details := wamp.Dict{"authid": "billing"}
+
+	subscribe := func(req wamp.ID) (*session, wamp.ID) {
+		sess := newSession(&testPeer{in: make(chan wamp.Message, 10)}, 0, details)
+		broker.Subscribe(sess, &wamp.Subscribe{
+			Request: req,
+			Topic:   testTopic,
+			Options: wamp.Dict{wamp.OptReliable: true},
+		})
+		rsp := <-sess.Recv()
+		subMsg, ok := rsp.(*wamp.Subscribed)
+		if !ok {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+		return sess, subMsg.Subscription
+	}
+	pubSess := newSession(newTestPeer(), 0, nil)
+	publish := func(args ...int) {
+		for _, arg := range args {
+			broker.Publish(pubSess, &wamp.Publish{
+				Request:   wamp.ID(arg),
+				Topic:     testTopic,
+				Arguments: wamp.List{arg},
+			})
+		}
+	}
+	// recv returns the events received, as "seq=arg", with a "*" suffix if
+	// redelivered.
+	recv := func(sess *session, n int) string {
+		var got []string
+		for i := 0; i < n; i++ {
+			select {
+			case msg := <-sess.Recv():
+				evt, ok := msg.(*wamp.Event)
+				if !ok {
+					t.Fatal("expected", wamp.EVENT, "got:", msg.MessageType())
+				}
+				s := fmt.Sprint(evt.Details[detailSeq], "=", evt.Arguments[0])
+				if redelivered, _ := evt.Details[detailRedelivered].(bool); redelivered {
+					s += "*"
+				}
+				got = append(got, s)
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for event")
+			}
+		}
+		return fmt.Sprint(got)
+	}
+	ack := func(sess *session, subID wamp.ID, seq int) wamp.Message {
+		return broker.SubAck(&wamp.Invocation{
+			Request:   1,
+			Details:   wamp.Dict{"caller": sess.ID},
+			Arguments: wamp.List{subID, seq},
+		})
+	}
+
+	sess, subID := subscribe(1)
+	publish(1, 2)
+	if got := recv(sess, 2); got != "[1=1 2=2]" {
+		t.Fatal("wrong events:", got)
+	}
+	// Unacknowledged events are sent again after the ack timeout.
+	if got := recv(sess, 2); got != "[1=1* 2=2*]" {
+		t.Fatal("wrong redelivered events:", got)
+	}
+	if _, ok := ack(sess, subID, 1).(*wamp.Yield); !ok {
+		t.Fatal("expected YIELD from ack")
+	}
+	if got := recv(sess, 1); got != "[2=2*]" {
+		t.Fatal("wrong redelivered events:", got)
+	}
+	ack(sess, subID, 2)
+	select {
+	case msg := <-sess.Recv():
+		t.Fatal("unexpected message after all events acknowledged:", msg)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Only the most recent unacknowledged events, up to the buffer size, are
+	// kept.
+	publish(3, 4, 5, 6)
+	if got := recv(sess, 4); got != "[3=3 4=4 5=5 6=6]" {
+		t.Fatal("wrong events:", got)
+	}
+	if got := recv(sess, 3); got != "[4=4* 5=5* 6=6*]" {
+		t.Fatal("wrong redelivered events:", got)
+	}
+
+	// Only the reliable subscriber can acknowledge its events.
+	other := newSession(newTestPeer(), 0, details)
+	if errMsg, ok := ack(other, subID, 6).(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchSubscription {
+		t.Fatal("expected", wamp.ErrNoSuchSubscription)
+	}
+	if errMsg, ok := ack(sess, subID, -1).(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument)
+	}
+	ack(sess, subID, 5)
+
+	// A new session of the subscriber resumes the unacknowledged events, and
+	// continues the sequence.
+	broker.RemoveSession(sess)
+	sess, subID = subscribe(2)
+	if got := recv(sess, 1); got != "[6=6*]" {
+		t.Fatal("wrong resumed events:", got)
+	}
+	publish(7)
+	if got := recv(sess, 1); got != "[7=7]" {
+		t.Fatal("wrong events:", got)
+	}
+	ack(sess, subID, 7)
+}
+
+func TestConcurrentPublish(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	const (
+		pubCount   = 8
+		topicCount = 4
+		evtCount   = 100
+	)
+	total := pubCount * topicCount * evtCount
+
+	// Two subscribers get the events of all topics.
+	subs := make([]*session, 2)
+	for i := range subs {
+		subs[i] = newSession(&testPeer{in: make(chan wamp.Message, total+1)}, 0, nil)
+		broker.Subscribe(subs[i], &wamp.Subscribe{
+			Request: wamp.ID(i + 1),
+			Topic:   wamp.URI("nexus.test."),
+			Options: wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+		})
+		if rsp := <-subs[i].Recv(); rsp.MessageType() != wamp.SUBSCRIBED {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < pubCount; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			pubSess := newSession(newTestPeer(), 0, nil)
+			for n := 0; n < evtCount; n++ {
+				for tp := 0; tp < topicCount; tp++ {
+					broker.Publish(pubSess, &wamp.Publish{
+						Request:   wamp.GlobalID(),
+						Topic:     wamp.URI(fmt.Sprint("nexus.test.topic", tp)),
+						Arguments: wamp.List{p, n},
+					})
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// Every subscriber receives the events of a topic in the same order, and
+	// the events of each publisher to a topic in the order published.
+	var orders [2]map[string][]string
+	for i, sub := range subs {
+		orders[i] = map[string][]string{}
+		next := map[string]int{}
+		for j := 0; j < total; j++ {
+			evt := (<-sub.Recv()).(*wamp.Event)
+			topic, _ := wamp.AsString(evt.Details[detailTopic])
+			p, n := evt.Arguments[0].(int), evt.Arguments[1].(int)
+			key := fmt.Sprint(topic, " ", p)
+			if n != next[key] {
+				t.Fatalf("publisher %d event %d to %s received out of order", p, n, topic)
+			}
+			next[key]++
+			orders[i][topic] = append(orders[i][topic], fmt.Sprint(p, ":", n))
+		}
+	}
+	for topic, order := range orders[0] {
+		if fmt.Sprint(order) != fmt.Sprint(orders[1][topic]) {
+			t.Fatal("subscribers received events of", topic, "in different order")
+		}
+	}
+	broker.Close()
+}
+
+func TestPublishToBlockedSubscriber(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	topicA := wamp.URI("nexus.test.a")
+	topicB := wamp.URI("nexus.test.b")
+	for i := 0; broker.shard(topicB) == broker.shard(topicA); i++ {
+		topicB = wamp.URI(fmt.Sprint("nexus.test.b", i))
+	}
+	subscribe := func(sess *session, topic wamp.URI) {
+		broker.Subscribe(sess, &wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		if rsp := <-sess.Recv(); rsp.MessageType() != wamp.SUBSCRIBED {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	// The slow subscriber's policy is to block while its queue is full.
+	slowPeer := newTestPeer()
+	slow := newSession(slowPeer, 0, nil)
+	slow.out = newOutQueue(slowPeer, SlowConsumerPolicy{Policy: SlowConsumerBlock, BlockTimeout: 5000}, nil, nil)
+	subscribe(slow, topicA)
+	pubSess := newSession(newTestPeer(), 0, nil)
+	publish := func(topic wamp.URI, arg int) {
+		broker.Publish(pubSess, &wamp.Publish{
+			Request:   wamp.GlobalID(),
+			Topic:     topic,
+			Arguments: wamp.List{arg},
+		})
+	}
+	publish(topicA, 1)
+	blocked := make(chan struct{})
+	go func() {
+		publish(topicA, 2)
+		close(blocked)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Subscribing, and publishing to a topic in another shard, are not held
+	// up by the blocked publication.
+	done := make(chan struct{})
+	go func() {
+		sess := newSession(newTestPeer(), 0, nil)
+		subscribe(sess, topicB)
+		publish(topicB, 3)
+		<-sess.Recv()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("subscribe and publish held up by blocked subscriber")
+	}
+
+	// The blocked event is sent when the subscriber reads its queue.
+	for _, want := range []int{1, 2} {
+		select {
+		case msg := <-slowPeer.in:
+			if evt := msg.(*wamp.Event); evt.Arguments[0] != want {
+				t.Fatal("wrong event:", evt.Arguments)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event", want)
+		}
+	}
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("publication still blocked")
+	}
+	slow.closeOut()
+}
+
+// encodingPeer is a testPeer that can be sent wamp.EncodedEvent messages.
+type encodingPeer struct {
+	*testPeer
+}
+
+func (p encodingPeer) EncodesEvents() bool { return true }
+
+func TestEncodedEventFanout(t *testing.T) {
+	broker := NewBroker(logger, false, true, debug, nil)
+	testTopic := wamp.URI("nexus.test.topic")
+
+	// Subscribers with exact and prefix subscriptions, and a subscriber whose
+	// peer does not encode events.
+	subs := []*session{
+		newSession(encodingPeer{newTestPeer()}, 0, nil),
+		newSession(encodingPeer{newTestPeer()}, 0, nil),
+		newSession(newTestPeer(), 0, nil),
+	}
+	for i, sub := range subs {
+		topic, opts := testTopic, wamp.Dict{}
+		if i == 1 {
+			topic, opts[wamp.OptMatch] = "nexus.test.", wamp.MatchPrefix
+		}
+		broker.Subscribe(sub, &wamp.Subscribe{Request: wamp.ID(i + 1), Topic: topic, Options: opts})
+		if rsp := <-sub.Recv(); rsp.MessageType() != wamp.SUBSCRIBED {
+			t.Fatal("expected", wamp.SUBSCRIBED, "got:", rsp.MessageType())
+		}
+	}
+
+	pubSess := newSession(newTestPeer(), 0, nil)
+	broker.Publish(pubSess, &wamp.Publish{Request: 123, Topic: testTopic,
+		Arguments: wamp.List{"hello world"}})
+
+	var payload *wamp.SharedPayload
+	var subIDs []wamp.ID
+	for i, sub := range subs[:2] {
+		encoded, ok := (<-sub.Recv()).(*wamp.EncodedEvent)
+		if !ok {
+			t.Fatal("expected EncodedEvent for subscriber", i)
+		}
+		if payload == nil {
+			payload = encoded.Payload
+		} else if encoded.Payload != payload {
+			t.Fatal("events do not share payload")
+		}
+		if arg, _ := wamp.AsString(payload.Arguments[0]); arg != "hello world" {
+			t.Fatal("wrong payload:", payload.Arguments)
+		}
+		subIDs = append(subIDs, encoded.Event.Subscription)
+	}
+	if subIDs[0] == subIDs[1] {
+		t.Fatal("expected different subscription IDs")
+	}
+	if _, ok := (<-subs[2].Recv()).(*wamp.Event); !ok {
+		t.Fatal("expected Event for peer that does not encode events")
+	}
+	broker.Close()
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// latencyBounds are the upper bounds, in milliseconds, of the buckets of the
+// call latency histogram.  Latencies greater than the last bound are counted
+// in an additional bucket.
+var latencyBounds = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// callStats counts the outcomes of the invocations of a registration.  Each
+// invocation has one outcome: it succeeds when the callee sends the final
+// YIELD, fails when the callee or dealer sends ERROR, or is canceled or timed
+// out before the callee responds.
+//
+// Latency is measured from when the INVOCATION is sent to when the final
+// YIELD is received, so it only includes successful calls.
+//
+// The methods of a nil *callStats do nothing, so that an invocation whose
+// outcome is already recorded is not counted again.
+type callStats struct {
+	calls     uint64
+	successes uint64
+	errors    map[wamp.URI]uint64
+	canceled  uint64
+	timeouts  uint64
+
+	latencyCount   uint64
+	latencySum     time.Duration
+	latencyMin     time.Duration
+	latencyMax     time.Duration
+	latencyBuckets []uint64
+}
+
+func newCallStats() *callStats {
+	return &callStats{
+		errors:         map[wamp.URI]uint64{},
+		latencyBuckets: make([]uint64, len(latencyBounds)+1),
+	}
+}
+
+// called counts an invocation sent to a callee.
+func (s *callStats) called() {
+	if s != nil {
+		s.calls++
+	}
+}
+
+// succeeded counts an invocation that the callee answered with YIELD, and
+// adds its latency to the histogram.
+func (s *callStats) succeeded(latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.successes++
+	if s.latencyCount == 0 || latency < s.latencyMin {
+		s.latencyMin = latency
+	}
+	if latency > s.latencyMax {
+		s.latencyMax = latency
+	}
+	s.latencyCount++
+	s.latencySum += latency
+	ms := durationMillis(latency)
+	i := 0
+	for i < len(latencyBounds) && ms > latencyBounds[i] {
+		i++
+	}
+	s.latencyBuckets[i]++
+}
+
+// failed counts an invocation that ended with the error.
+func (s *callStats) failed(errURI wamp.URI) {
+	if s != nil {
+		s.errors[errURI]++
+	}
+}
+
+// wasCanceled counts an invocation that the caller canceled, or that was
+// abandoned because the caller left.
+func (s *callStats) wasCanceled() {
+	if s != nil {
+		s.canceled++
+	}
+}
+
+// timedOut counts an invocation canceled by its CALL timeout.
+func (s *callStats) timedOut() {
+	if s != nil {
+		s.timeouts++
+	}
+}
+
+// dict returns the statistics as returned by wamp.registration.get_stats.
+// Latencies are in milliseconds.  The histogram counts are not cumulative;
+// each count is the number of calls with latency greater than the previous
+// bound and not greater than the bound at the same index.  The last count is
+// for latencies greater than the last bound.
+func (s *callStats) dict() wamp.Dict {
+	errors := make(wamp.Dict, len(s.errors))
+	for uri, n := range s.errors {
+		errors[string(uri)] = n
+	}
+	latency := wamp.Dict{
+		"count": s.latencyCount,
+		"histogram": wamp.Dict{
+			"bounds": latencyBounds,
+			"counts": append([]uint64(nil), s.latencyBuckets...),
+		},
+	}
+	if s.latencyCount != 0 {
+		latency["min"] = durationMillis(s.latencyMin)
+		latency["max"] = durationMillis(s.latencyMax)
+		latency["mean"] = durationMillis(s.latencySum) / float64(s.latencyCount)
+	}
+	return wamp.Dict{
+		"calls":     s.calls,
+		"successes": s.successes,
+		"errors":    errors,
+		"canceled":  s.canceled,
+		"timeouts":  s.timeouts,
+		"latency":   latency,
+	}
+}
+
+// durationMillis returns the duration in milliseconds.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -1,9 +1,11 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gammazero/nexus/stdlog"
@@ -16,11 +18,15 @@ const (
 
 	featureCallCanceling    = "call_canceling"
 	featureCallTimeout      = "call_timeout"
+	featureCallTrustLevels  = "call_trustlevels"
 	featureCallerIdent      = "caller_identification"
 	featurePatternBasedReg  = "pattern_based_registration"
+	featureProcReflection   = "procedure_reflection"
+	featureProgCallInvs     = "progressive_call_invocations"
 	featureProgCallResults  = "progressive_call_results"
 	featureSessionMetaAPI   = "session_meta_api"
 	featureSharedReg        = "shared_registration"
+	featureShardedReg       = "sharded_registration"
 	featureRegMetaAPI       = "registration_meta_api"
 	featureTestamentMetaAPI = "testament_meta_api"
 
@@ -30,6 +36,22 @@ const (
 	sendResultDeadline = time.Minute
 	// yieldRetryDelay is the initial delay before reprocessin a blocked yield
 	yieldRetryDelay = 200 * time.Millisecond
+	// defaultFailoverAttempts is the maximum number of callees a call is sent
+	// to, when failover is enabled without specifying max_attempts.
+	defaultFailoverAttempts = 3
+	// defaultCallQueueLimit is the maximum number of calls queued for callees
+	// at their concurrency limit, when queue_limit is not specified.
+	defaultCallQueueLimit = 1000
+	// defaultMaxWaitCallee is the longest time a call waits for a callee to
+	// register the called procedure, when the realm does not set a maximum.
+	defaultMaxWaitCallee = time.Minute
+	// defaultMaxWaitingCalls is the maximum number of calls waiting for
+	// callees, when the realm does not set a maximum.
+	defaultMaxWaitingCalls = 1000
+	// maxCalleeWeight is the largest weight of a callee of a weighted
+	// registration.  This keeps the sum of the weights of all callees from
+	// overflowing.
+	maxCalleeWeight = 1 << 20
 )
 
 // Role information for this broker.
@@ -37,11 +59,16 @@ var dealerRole = wamp.Dict{
 	"features": wamp.Dict{
 		featureCallCanceling:    true,
 		featureCallTimeout:      true,
+		featureCallTrustLevels:  true,
 		featureCallerIdent:      true,
 		featurePatternBasedReg:  true,
+		featurePayloadPassthru:  true,
+		featureProcReflection:   true,
+		featureProgCallInvs:     true,
 		featureProgCallResults:  true,
 		featureSessionMetaAPI:   true,
 		featureSharedReg:        true,
+		featureShardedReg:       true,
 		featureRegMetaAPI:       true,
 		featureTestamentMetaAPI: true,
 	},
@@ -55,11 +82,75 @@ type registration struct {
 	match      string   // how procedure uri is matched to registration
 	policy     string   // how callee is selected if shared registration
 	disclose   bool     // callee requests disclosure of caller identity
+	failover   int      // max callees to try for a call, 0 if no failover
+	minTrust   int      // minimum trust level required of callers
 	nextCallee int      // choose callee for round-robin invocation.
 
+	// Callers that are allowed to call the registration, nil if any caller
+	// is allowed.
+	allow *sessionFilter
+
 	// Multiple sessions can register as callees depending on invocation policy
 	// resulting in multiple procedures for the same registration ID.
 	callees []*session
+
+	// callee session -> weight, for weighted invocation policy.
+	weights map[*session]int64
+
+	// Shard keys owned by each callee, for sharded invocation policy.
+	shards *shardRing
+
+	// callee session -> maximum number of pending invocations, for callees
+	// that registered with a concurrency limit.
+	concurrency map[*session]int
+
+	// callee session -> number of pending invocations for this registration.
+	running map[*session]int
+
+	// Calls waiting for a callee to be below its concurrency limit, in the
+	// order the calls were received.
+	queue      []*waitingCall
+	queueLimit int
+
+	// Results of calls, for a registration whose callees allow caching.
+	cache *resultCache
+
+	// Description of the procedure's arguments and result, supplied by a
+	// callee for procedure reflection and payload validation.
+	schema *payloadSchema
+
+	// Outcomes and latency of the registration's invocations.
+	stats *callStats
+}
+
+// cacheTTL returns the number of milliseconds that call results are cached
+// for the registration, or 0 if results are not cached.
+func (reg *registration) cacheTTL() int64 {
+	if reg.cache == nil {
+		return 0
+	}
+	return int64(reg.cache.ttl / time.Millisecond)
+}
+
+// belowLimit returns true if the callee can be sent another invocation
+// without exceeding its concurrency limit.
+func (reg *registration) belowLimit(callee *session) bool {
+	limit, ok := reg.concurrency[callee]
+	return !ok || reg.running[callee] < limit
+}
+
+// calleeOptions are the REGISTER options that are checked before the
+// registration is made.
+type calleeOptions struct {
+	weight      int64          // weight for weighted invocation policy
+	shards      []string       // shard keys for sharded invocation policy
+	failover    int            // max callees to try for a call, 0 if no failover
+	concurrency int            // max pending invocations for callee, 0 if no limit
+	queueLimit  int            // max calls queued for callees at concurrency limit
+	minTrust    int            // minimum trust level required of callers
+	allow       *sessionFilter // callers allowed to call the registration
+	cacheTTL    int64          // milliseconds to cache call results, 0 if none
+	schema      *payloadSchema // description of procedure
 }
 
 // invocation tracks in-progress invocation
@@ -68,6 +159,42 @@ type invocation struct {
 	callee     *session
 	canceled   bool
 	retryCount int
+	timer      *time.Timer // cancels the call when the CALL timeout expires
+	regID      wamp.ID     // registration the invocation is for
+	progress   bool        // caller is still sending progressive invocations
+
+	// Failover to another callee, if the call allows it.
+	call        *wamp.Call // call to send to another callee
+	maxAttempts int        // maximum number of callees to try
+	tried       []*session // callees the call was sent to
+
+	fanout *fanoutCall // fan-out call the invocation is part of
+
+	span *Span // traces the call, nil if the call is not traced
+
+	cacheKey string // key to cache the call result with, empty if not cached
+
+	sent  time.Time // when the INVOCATION was first sent
+	ended bool      // outcome is recorded in the registration's statistics
+}
+
+// fanoutCall collects the responses from all callees of a registration, for a
+// call that is sent to every callee.
+type fanoutCall struct {
+	caller  *session
+	callID  requestID
+	pending map[wamp.ID]*invocation // invocations not yet answered
+	results wamp.Dict               // callee session ID -> response
+	quorum  int                     // number of responses to wait for
+	timer   *time.Timer             // ends the call at the deadline
+	span    *Span                   // traces the call, nil if not traced
+}
+
+// stopTimer stops the invocation's call timeout timer, if there is one.
+func (invk *invocation) stopTimer() {
+	if invk.timer != nil {
+		invk.timer.Stop()
+	}
 }
 
 type requestID struct {
@@ -75,11 +202,49 @@ type requestID struct {
 	request wamp.ID
 }
 
+// waitingCall is a call that is waiting for a callee to register the called
+// procedure.
+type waitingCall struct {
+	caller *session
+	msg    *wamp.Call
+	timer  *time.Timer
+	since  time.Time // when the call started waiting
+}
+
+// stopTimer stops the waiting call's timer, if there is one.
+func (wc *waitingCall) stopTimer() {
+	if wc.timer != nil {
+		wc.timer.Stop()
+	}
+}
+
+// dispatchMsg returns the CALL to send to a callee when the call stops
+// waiting.  The CALL timeout runs from when the dealer received the call, so
+// the timeout of the returned CALL is reduced by the time the call waited.
+func (wc *waitingCall) dispatchMsg() *wamp.Call {
+	timeout, _ := wamp.AsInt64(wc.msg.Options[wamp.OptTimeout])
+	if timeout <= 0 {
+		return wc.msg
+	}
+	remaining := timeout - int64(time.Since(wc.since)/time.Millisecond)
+	if remaining < 1 {
+		// The timeout expired while dispatching, so let the call time out
+		// as soon as it is sent.
+		remaining = 1
+	}
+	msg := *wc.msg
+	msg.Options = make(wamp.Dict, len(wc.msg.Options))
+	for k, v := range wc.msg.Options {
+		msg.Options[k] = v
+	}
+	msg.Options[wamp.OptTimeout] = remaining
+	return &msg
+}
+
 type Dealer struct {
-	// procedure URI -> registration ID
-	procRegMap    map[wamp.URI]*registration
-	pfxProcRegMap map[wamp.URI]*registration
-	wcProcRegMap  map[wamp.URI]*registration
+	// Matches procedures to the registrations of all match policies.  This
+	// is the index of registrations by procedure URI and match policy.
+	procMatcher *wamp.URIMatcher
 
 	// registration ID -> registration
 	// Used to lookup registration by ID, needed for unregister.
@@ -94,12 +259,55 @@ type Dealer struct {
 	// call ID -> invocation ID (for cancel)
 	invocationByCall map[requestID]wamp.ID
 
+	// Progressive calls that ended before the caller sent the last CALL.
+	// Used to discard the remaining CALLs for these calls.
+	endedProgCalls map[requestID]struct{}
+
+	// callee session -> number of pending invocations.
+	// Used by the leastbusy invocation policy.
+	calleeLoad map[*session]int
+
+	// Calls waiting for a callee to register the called procedure, in the
+	// order the calls were received.
+	waitingCalls []*waitingCall
+
+	// Default and maximum time for calls to wait for a callee to register,
+	// and maximum number of waiting calls.
+	waitCallee      time.Duration
+	maxWaitCallee   time.Duration
+	maxWaitingCalls int
+
+	// Records the spans of traced calls.
+	spanRecorder SpanRecorder
+
+	// Procedure URI -> schema from the realm configuration, which takes
+	// precedence over a schema supplied by a callee.
+	procSchemas map[wamp.URI]*payloadSchema
+
+	// Validate call arguments against procedure schemas.
+	validatePayloads bool
+
+	// call ID -> registration, for calls queued until a callee is below its
+	// concurrency limit.
+	queuedCalls map[requestID]*registration
+
+	// Registrations that have queued calls, and may now be able to dispatch
+	// them.  These are dispatched after each action.
+	readyRegs map[*registration]struct{}
+
+	// call ID -> fan-out call waiting for responses from callees.
+	fanoutCalls map[requestID]*fanoutCall
+
 	// callee session -> registration ID set.
 	// Used to lookup registrations when removing a callee session.
 	calleeRegIDSet map[*session]map[wamp.ID]struct{}
 
 	actionChan chan func()
 
+	// Prevents timers from submitting actions after actionChan is closed.
+	closed    bool
+	closeLock sync.RWMutex
+
 	// Generate registration IDs.
 	idGen *wamp.IDGen
 
@@ -127,17 +335,23 @@ type Dealer struct {
 // typically the receiving client's send handler.
 func NewDealer(logger stdlog.StdLog, strictURI, allowDisclose, debug bool) *Dealer {
 	d := &Dealer{
-		procRegMap:    map[wamp.URI]*registration{},
-		pfxProcRegMap: map[wamp.URI]*registration{},
-		wcProcRegMap:  map[wamp.URI]*registration{},
+		procMatcher: wamp.NewURIMatcher(),
 
 		registrations: map[wamp.ID]*registration{},
 
 		calls:            map[requestID]*session{},
 		invocations:      map[wamp.ID]*invocation{},
 		invocationByCall: map[requestID]wamp.ID{},
+		endedProgCalls:   map[requestID]struct{}{},
+		queuedCalls:      map[requestID]*registration{},
+		readyRegs:        map[*registration]struct{}{},
+		fanoutCalls:      map[requestID]*fanoutCall{},
+		calleeLoad:       map[*session]int{},
 		calleeRegIDSet:   map[*session]map[wamp.ID]struct{}{},
 
+		maxWaitCallee:   defaultMaxWaitCallee,
+		maxWaitingCalls: defaultMaxWaitingCalls,
+
 		// The action handler should be nearly always runable, since it is the
 		// critical section that does the only routing.  So, and unbuffered
 		// channel is appropriate.
@@ -163,6 +377,68 @@ func (d *Dealer) SetMetaPeer(metaPeer wamp.Peer) {
 	}
 }
 
+// SetWaitCallee sets the default amount of time a call waits for a callee to
+// register the called procedure, when no callee is registered at the time of
+// the call.  A caller can specify a different time using the "wait_callee"
+// CALL option.  A value of 0 disables waiting.
+func (d *Dealer) SetWaitCallee(timeout time.Duration) {
+	d.actionChan <- func() {
+		d.waitCallee = timeout
+	}
+}
+
+// SetWaitCalleeLimits sets the longest time that a call waits for a callee to
+// register the called procedure, and the maximum number of calls that wait at
+// once.  A longer wait, whether the default or requested by a caller, is
+// shortened to the maximum.  A call that arrives when the maximum number of
+// calls are waiting does not wait.  Zero values use the defaults of one
+// minute and 1000 calls.
+func (d *Dealer) SetWaitCalleeLimits(maxWait time.Duration, maxCalls int) {
+	if maxWait <= 0 {
+		maxWait = defaultMaxWaitCallee
+	}
+	if maxCalls <= 0 {
+		maxCalls = defaultMaxWaitingCalls
+	}
+	d.actionChan <- func() {
+		d.maxWaitCallee = maxWait
+		d.maxWaitingCalls = maxCalls
+	}
+}
+
+// SetSpanRecorder sets the SpanRecorder that records the span of each call.
+// When a span recorder is set, every call is traced.  Otherwise, only calls
+// that have a "trace_id" CALL option are traced.
+func (d *Dealer) SetSpanRecorder(recorder SpanRecorder) {
+	d.actionChan <- func() {
+		d.spanRecorder = recorder
+	}
+}
+
+// SetProcedureSchemas sets the schemas of procedures, keyed by the URI of
+// their registration.  These take precedence over schemas supplied by
+// callees.  Returns an error if any schema is not valid.
+func (d *Dealer) SetProcedureSchemas(schemas map[wamp.URI]wamp.Dict) error {
+	compiled, err := loadSchemas(schemas, true)
+	if err != nil {
+		return err
+	}
+	d.actionChan <- func() {
+		d.procSchemas = compiled
+	}
+	return nil
+}
+
+// SetValidatePayloads enables or disables validation of call arguments
+// against the schemas of the called procedures.  When enabled, a call whose
+// arguments do not match is answered with wamp.error.invalid_argument instead
+// of being routed to a callee.
+func (d *Dealer) SetValidatePayloads(validate bool) {
+	d.actionChan <- func() {
+		d.validatePayloads = validate
+	}
+}
+
 // Role returns the role information for the "dealer" role.  The data returned
 // is suitable for use as broker role info in a WELCOME message.
 func (d *Dealer) Role() wamp.Dict {
@@ -247,8 +523,27 @@ func (d *Dealer) Register(callee *session, msg *wamp.Register) {
 	}
 
 	invoke, _ := wamp.AsString(msg.Options[wamp.OptInvoke])
+
+	copts, err := getCalleeOptions(callee, msg.Options, invoke)
+	if err == nil {
+		copts.failover, err = getFailover(msg.Options)
+		if err == nil && copts.failover != 0 && invoke == wamp.InvokeSharded {
+			err = errors.New("failover not allowed for sharded registration")
+		}
+	}
+	if err != nil {
+		d.trySend(callee, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{err.Error()},
+		})
+		return
+	}
+
 	d.actionChan <- func() {
-		d.register(callee, msg, match, invoke, disclose, wampURI)
+		d.register(callee, msg, match, invoke, disclose, wampURI, copts)
 	}
 }
 
@@ -384,27 +679,159 @@ func (d *Dealer) RemoveSession(sess *session) {
 
 // Close stops the dealer, letting already queued actions finish.
 func (d *Dealer) Close() {
+	d.closeLock.Lock()
+	d.closed = true
 	close(d.actionChan)
+	d.closeLock.Unlock()
+}
+
+// timerAction submits an action from a timer goroutine.  The action is
+// discarded if the dealer has already been closed.
+func (d *Dealer) timerAction(action func()) {
+	d.closeLock.RLock()
+	if !d.closed {
+		d.actionChan <- action
+	}
+	d.closeLock.RUnlock()
 }
 
 func (d *Dealer) run() {
 	for action := range d.actionChan {
 		action()
+		if len(d.readyRegs) != 0 {
+			d.dispatchQueuedCalls()
+		}
 	}
 	if d.debug {
 		d.log.Print("Dealer stopped")
 	}
 }
 
-func (d *Dealer) register(callee *session, msg *wamp.Register, match, invokePolicy string, disclose, wampURI bool) {
+// getCalleeOptions gets the per-callee options for the invocation policy.
+func getCalleeOptions(callee *session, options wamp.Dict, invokePolicy string) (calleeOptions, error) {
+	var copts calleeOptions
+
+	// A callee may limit the number of invocations that it is sent at once.
+	// Calls in excess of the limit are queued, up to the queue limit.
+	if c, ok := options[wamp.OptConcurrency]; ok {
+		n, ok := wamp.AsInt64(c)
+		if !ok || n < 1 {
+			return copts, fmt.Errorf(
+				"invalid %s %v (must be positive integer)",
+				wamp.OptConcurrency, c)
+		}
+		copts.concurrency = int(n)
+	}
+	copts.queueLimit = defaultCallQueueLimit
+	if q, ok := options[wamp.OptQueueLimit]; ok {
+		n, ok := wamp.AsInt64(q)
+		if !ok || n < 0 {
+			return copts, fmt.Errorf(
+				"invalid %s %v (must be non-negative integer)",
+				wamp.OptQueueLimit, q)
+		}
+		copts.queueLimit = int(n)
+	}
+
+	// A callee may refuse calls from callers with a trust level lower than
+	// the minimum it requires.
+	if t, ok := options[wamp.OptMinTrustLevel]; ok {
+		n, ok := wamp.AsInt64(t)
+		if !ok {
+			return copts, fmt.Errorf("invalid %s %v (must be integer)",
+				wamp.OptMinTrustLevel, t)
+		}
+		copts.minTrust = int(n)
+	}
+
+	// A callee may only allow calls from the listed sessions, or from
+	// callers whose sessions have one of the allowed values of an attribute,
+	// such as authrole or authid.
+	allow, err := newSessionFilter(options, allowPrefix)
+	if err != nil {
+		return copts, err
+	}
+	copts.allow = allow
+
+	// A callee may allow the dealer to answer a call with the result of an
+	// identical earlier call, for the specified number of milliseconds.
+	if ttl, ok := options[wamp.OptCacheTTL]; ok {
+		n, ok := wamp.AsInt64(ttl)
+		if !ok || n < 1 {
+			return copts, fmt.Errorf(
+				"invalid %s %v (must be positive integer)",
+				wamp.OptCacheTTL, ttl)
+		}
+		copts.cacheTTL = n
+	}
+
+	// A callee may describe the procedure's arguments and result, for
+	// callers that use procedure reflection.
+	if sch, ok := options[wamp.OptSchema]; ok {
+		schema, err := newPayloadSchema(sch, true)
+		if err != nil {
+			return copts, fmt.Errorf("invalid %s: %s", wamp.OptSchema, err)
+		}
+		copts.schema = schema
+	}
+
+	switch invokePolicy {
+	case wamp.InvokeWeighted:
+		// A callee registering with the weighted invocation policy may
+		// specify its weight relative to other callees.  The default weight
+		// is 1.
+		copts.weight = 1
+		if w, ok := options[wamp.OptWeight]; ok {
+			if copts.weight, ok = wamp.AsInt64(w); !ok || copts.weight < 1 || copts.weight > maxCalleeWeight {
+				return copts, fmt.Errorf(
+					"invalid weight %v (must be positive integer no greater than %d)",
+					w, maxCalleeWeight)
+			}
+		}
+	case wamp.InvokeSharded:
+		// A callee registering with the sharded invocation policy specifies
+		// the shard keys it owns.  If none are given, then the callee's
+		// session ID is its only shard key.
+		if s, ok := options[wamp.OptShards]; ok {
+			list, ok := wamp.AsList(s)
+			if !ok {
+				return copts, fmt.Errorf("invalid %s: %v", wamp.OptShards, s)
+			}
+			for i := range list {
+				key, ok := wamp.AsString(list[i])
+				if !ok || key == "" {
+					return copts, fmt.Errorf("invalid shard key: %v", list[i])
+				}
+				copts.shards = append(copts.shards, key)
+			}
+		}
+		if len(copts.shards) == 0 {
+			copts.shards = []string{callee.String()}
+		}
+	}
+	return copts, nil
+}
+
+// getFailover returns the maximum number of callees to try for a call, if the
+// options enable failover to another callee, or 0 if failover is not enabled.
+func getFailover(options wamp.Dict) (int, error) {
+	if enable, _ := options[wamp.OptFailover].(bool); !enable {
+		return 0, nil
+	}
+	attempts := int64(defaultFailoverAttempts)
+	if a, ok := options[wamp.OptMaxAttempts]; ok {
+		if attempts, ok = wamp.AsInt64(a); !ok || attempts < 1 {
+			return 0, fmt.Errorf("invalid %s %v (must be positive integer)",
+				wamp.OptMaxAttempts, a)
+		}
+	}
+	return int(attempts), nil
+}
+
+func (d *Dealer) register(callee *session, msg *wamp.Register, match, invokePolicy string, disclose, wampURI bool, copts calleeOptions) {
 	var reg *registration
-	switch match {
-	default:
-		reg = d.procRegMap[msg.Procedure]
-	case wamp.MatchPrefix:
-		reg = d.pfxProcRegMap[msg.Procedure]
-	case wamp.MatchWildcard:
-		reg = d.wcProcRegMap[msg.Procedure]
+	if r, ok := d.procMatcher.Get(msg.Procedure, match); ok {
+		reg = r.(*registration)
 	}
 
 	var created string
@@ -421,17 +848,29 @@ func (d *Dealer) register(callee *session, msg *wamp.Register, match, invokePoli
 			match:     match,
 			policy:    invokePolicy,
 			disclose:  disclose,
+			failover:  copts.failover,
+			minTrust:  copts.minTrust,
+			allow:     copts.allow,
+			schema:    copts.schema,
 			callees:   []*session{callee},
+
+			concurrency: map[*session]int{},
+			running:     map[*session]int{},
+			queueLimit:  copts.queueLimit,
+			stats:       newCallStats(),
 		}
-		d.registrations[regID] = reg
-		switch match {
-		default:
-			d.procRegMap[msg.Procedure] = reg
-		case wamp.MatchPrefix:
-			d.pfxProcRegMap[msg.Procedure] = reg
-		case wamp.MatchWildcard:
-			d.wcProcRegMap[msg.Procedure] = reg
+		if copts.cacheTTL != 0 {
+			reg.cache = newResultCache(time.Duration(copts.cacheTTL) * time.Millisecond)
 		}
+		switch invokePolicy {
+		case wamp.InvokeWeighted:
+			reg.weights = map[*session]int64{callee: copts.weight}
+		case wamp.InvokeSharded:
+			reg.shards = newShardRing()
+			reg.shards.add(callee, copts.shards)
+		}
+		d.registrations[regID] = reg
+		d.procMatcher.Add(msg.Procedure, match, reg)
 
 		if !wampURI && d.metaPeer != nil {
 			// wamp.registration.on_create is fired when a registration is
@@ -483,10 +922,102 @@ func (d *Dealer) register(callee *session, msg *wamp.Register, match, invokePoli
 			return
 		}
 
+		// A callee cannot join a registration that admits callers with a
+		// different trust level than the callee requires.
+		if reg.minTrust != copts.minTrust {
+			d.log.Printf("REGISTER for already registered procedure %v with "+
+				"conflicting %s (has %d and requested %d)", msg.Procedure,
+				wamp.OptMinTrustLevel, reg.minTrust, copts.minTrust)
+			d.trySend(callee, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: wamp.Dict{},
+				Error:   wamp.ErrProcedureAlreadyExists,
+			})
+			return
+		}
+
+		// A callee cannot join a registration that allows different callers
+		// than the callee allows.
+		if !reg.allow.equal(copts.allow) {
+			d.log.Printf("REGISTER for already registered procedure %v with "+
+				"conflicting %s options", msg.Procedure, allowPrefix)
+			d.trySend(callee, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: wamp.Dict{},
+				Error:   wamp.ErrProcedureAlreadyExists,
+			})
+			return
+		}
+
+		// A callee cannot join a registration that caches results for a
+		// different time than the callee allows.
+		if reg.cacheTTL() != copts.cacheTTL {
+			d.log.Printf("REGISTER for already registered procedure %v with "+
+				"conflicting %s (has %d and requested %d)", msg.Procedure,
+				wamp.OptCacheTTL, reg.cacheTTL(), copts.cacheTTL)
+			d.trySend(callee, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: wamp.Dict{},
+				Error:   wamp.ErrProcedureAlreadyExists,
+			})
+			return
+		}
+
+		// A callee cannot join a registration that queues a different
+		// number of calls than the callee allows.
+		if reg.queueLimit != copts.queueLimit {
+			d.log.Printf("REGISTER for already registered procedure %v with "+
+				"conflicting %s (has %d and requested %d)", msg.Procedure,
+				wamp.OptQueueLimit, reg.queueLimit, copts.queueLimit)
+			d.trySend(callee, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: wamp.Dict{},
+				Error:   wamp.ErrProcedureAlreadyExists,
+			})
+			return
+		}
+
+		// The shard keys requested by the callee must not already be owned
+		// by another callee.
+		if reg.shards != nil {
+			if err := reg.shards.add(callee, copts.shards); err != nil {
+				d.log.Println("REGISTER for sharded procedure", msg.Procedure,
+					"failed:", err)
+				d.trySend(callee, &wamp.Error{
+					Type:      msg.MessageType(),
+					Request:   msg.Request,
+					Details:   wamp.Dict{},
+					Error:     wamp.ErrInvalidArgument,
+					Arguments: wamp.List{err.Error()},
+				})
+				return
+			}
+		}
+
 		regID = reg.id
 
+		// Keep the schema of the first callee that supplied one.
+		if reg.schema == nil {
+			reg.schema = copts.schema
+		}
+
 		// Add callee for the registration.
 		reg.callees = append(reg.callees, callee)
+		if reg.weights != nil {
+			reg.weights[callee] = copts.weight
+		}
+
+		// The new callee may be able to handle queued calls.
+		if len(reg.queue) != 0 {
+			d.readyRegs[reg] = struct{}{}
+		}
+	}
+	if copts.concurrency != 0 {
+		reg.concurrency[callee] = copts.concurrency
 	}
 
 	// Add the registration ID to the callees set of registrations.
@@ -504,6 +1035,11 @@ func (d *Dealer) register(callee *session, msg *wamp.Register, match, invokePoli
 		Registration: regID,
 	})
 
+	// Dispatch any calls that were waiting for this registration.
+	if len(d.waitingCalls) != 0 {
+		d.dispatchWaitingCalls()
+	}
+
 	if !wampURI && d.metaPeer != nil {
 		// Publish wamp.registration.on_register meta event.  Fired when a
 		// session is added to a registration.  A wamp.registration.on_register
@@ -568,48 +1104,91 @@ func (d *Dealer) unregister(callee *session, msg *wamp.Unregister) {
 
 // matchProcedure finds the best matching registration given a procedure URI.
 //
-// If there are both matching prefix and wildcard registrations, then find the
-// one with the more specific match (longest matched pattern).
+// An exact match is preferred, then the longest prefix match, then the most
+// specific (longest) wildcard match.
 func (d *Dealer) matchProcedure(procedure wamp.URI) (*registration, bool) {
-	// Find registered procedures with exact match.
-	reg, ok := d.procRegMap[procedure]
+	// According to the spec, we have to prefer prefix match over wildcard
+	// match:
+	// https://wamp-proto.org/static/rfc/draft-oberstet-hybi-crossbar-wamp.html#rfc.section.14.3.8.1.4.2
+	m, ok := d.procMatcher.Best(procedure)
 	if !ok {
-		// No exact match was found.  So, search for a prefix or wildcard
-		// match, and prefer the most specific math (longest matched pattern).
-		// If there is a tie, then prefer the first longest prefix.
-		matchCount := -1 // initialize matchCount to -1 to catch an empty registration.
-		for pfxProc, pfxReg := range d.pfxProcRegMap {
-			if procedure.PrefixMatch(pfxProc) {
-				if len(pfxProc) > matchCount {
-					reg = pfxReg
-					matchCount = len(pfxProc)
-					ok = true
-				}
-			}
-		}
-		// According to the spec, we have to prefer prefix match over wildcard
-		// match:
-		// https://wamp-proto.org/static/rfc/draft-oberstet-hybi-crossbar-wamp.html#rfc.section.14.3.8.1.4.2
-		if ok {
-			return reg, ok
-		}
+		return nil, false
+	}
+	return m.Value.(*registration), true
+}
 
-		for wcProc, wcReg := range d.wcProcRegMap {
-			if procedure.WildcardMatch(wcProc) {
-				if len(wcProc) > matchCount {
-					reg = wcReg
-					matchCount = len(wcProc)
-					ok = true
-				}
-			}
-		}
+// schemaFor returns the schema of the registration's procedure, from the
+// realm configuration or else from a callee, or nil if there is none.
+func (d *Dealer) schemaFor(reg *registration) *payloadSchema {
+	if schema, ok := d.procSchemas[reg.procedure]; ok {
+		return schema
 	}
-	return reg, ok
+	return reg.schema
 }
 
 func (d *Dealer) call(caller *session, msg *wamp.Call) {
+	reqID := requestID{
+		session: caller.ID,
+		request: msg.Request,
+	}
+	progress, _ := msg.Options[wamp.OptProgress].(bool)
+
+	// A CALL with the same request ID as a progressive call that is still
+	// sending invocations continues that call.
+	if invocationID, ok := d.invocationByCall[reqID]; ok {
+		if invk := d.invocations[invocationID]; invk != nil && invk.progress {
+			d.continueCall(invk, invocationID, msg, progress)
+			return
+		}
+	}
+	if _, ok := d.endedProgCalls[reqID]; ok {
+		// Discard the rest of the input for a call that has already ended.
+		if !progress {
+			delete(d.endedProgCalls, reqID)
+		}
+		return
+	}
+
 	reg, ok := d.matchProcedure(msg.Procedure)
 	if !ok || len(reg.callees) == 0 {
+		// If the call can wait for a callee to register the procedure, then
+		// hold the call until a callee registers or the wait times out.  A
+		// progressive call is not held, since the invocations that continue
+		// it cannot be delivered until it is dispatched.
+		wait := d.waitCallee
+		if w, ok := msg.Options[wamp.OptWaitCallee]; ok {
+			ms, ok := wamp.AsInt64(w)
+			if !ok || ms < 0 {
+				d.trySend(caller, &wamp.Error{
+					Type:    msg.MessageType(),
+					Request: msg.Request,
+					Details: wamp.Dict{},
+					Error:   wamp.ErrInvalidArgument,
+					Arguments: wamp.List{fmt.Sprintf(
+						"invalid %s %v (must be non-negative integer)",
+						wamp.OptWaitCallee, w)},
+				})
+				return
+			}
+			wait = time.Duration(ms) * time.Millisecond
+		}
+		if wait > d.maxWaitCallee {
+			wait = d.maxWaitCallee
+		}
+		if wait > 0 && !progress {
+			if len(d.waitingCalls) < d.maxWaitingCalls {
+				d.waitForCallee(caller, msg, wait)
+				return
+			}
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrNoSuchProcedure,
+				Arguments: wamp.List{"too many calls waiting for callees"},
+			})
+			return
+		}
 		// If no registered procedure, send error.
 		d.trySend(caller, &wamp.Error{
 			Type:    msg.MessageType(),
@@ -620,8 +1199,133 @@ func (d *Dealer) call(caller *session, msg *wamp.Call) {
 		return
 	}
 
+	// Dealer MAY deny a Caller's request to disclose its identity.  Do not
+	// continue a call when discloseMe was disallowed.
+	if !reg.disclose && !d.allowDisclose {
+		if opt, _ := msg.Options[wamp.OptDiscloseMe].(bool); opt {
+			d.trySend(caller, &wamp.Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: wamp.Dict{},
+				Error:   wamp.ErrOptionDisallowedDiscloseMe,
+			})
+			return
+		}
+	}
+
+	// Do not route the call if the callee requires a higher trust level than
+	// the caller has.
+	if reg.minTrust != 0 {
+		if level, _ := caller.TrustLevel(); level < reg.minTrust {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrNotAuthorized,
+				Arguments: wamp.List{"caller trust level too low"},
+			})
+			return
+		}
+	}
+
+	// Do not route the call if the callee does not allow the caller.
+	if !reg.allow.allowed(caller) {
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrNotAuthorized,
+			Arguments: wamp.List{"caller not allowed by callee"},
+		})
+		return
+	}
+
+	// A call in payload passthru mode has an opaque payload, so it is checked
+	// for the passthru options instead of being validated against the
+	// procedure's schema.
+	ppt := isPassthru(msg.Options)
+	if ppt {
+		if err := checkPassthru(msg.Options, msg.Arguments, msg.ArgumentsKw); err != nil {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{err.Error()},
+			})
+			return
+		}
+	}
+
+	// Do not route a call whose arguments do not match the procedure's
+	// schema.  A progressive call is not validated, since its input is not
+	// all known yet.
+	if d.validatePayloads && !progress && !ppt {
+		if schema := d.schemaFor(reg); schema != nil {
+			if err := schema.validate(msg.Arguments, msg.ArgumentsKw); err != nil {
+				d.trySend(caller, &wamp.Error{
+					Type:      msg.MessageType(),
+					Request:   msg.Request,
+					Details:   wamp.Dict{},
+					Error:     wamp.ErrInvalidArgument,
+					Arguments: wamp.List{err.Error()},
+				})
+				return
+			}
+		}
+	}
+
+	// A fan-out call is sent to every callee of the registration.
+	if fanout, _ := msg.Options[wamp.OptFanout].(bool); fanout {
+		d.fanout(caller, msg, reg, reqID)
+		return
+	}
+
+	// A call to a registration that caches results is answered from the
+	// cache if there is an unexpired result of an identical call, from a
+	// caller that the callee sees the same.  This happens after the checks
+	// above, so a cached result is never sent to a caller that the callee
+	// does not allow.  A progressive call is not cached, since its input is
+	// not all known yet.
+	var cacheKey string
+	if reg.cache != nil && !progress {
+		disclose, _ := msg.Options[wamp.OptDiscloseMe].(bool)
+		if key, ok := resultCacheKey(caller, msg, reg.disclose || disclose); ok {
+			if res, ok := reg.cache.get(key, time.Now()); ok {
+				d.trySend(caller, &wamp.Result{
+					Request:     msg.Request,
+					Details:     res.details(),
+					Arguments:   res.args,
+					ArgumentsKw: res.kwargs,
+				})
+				return
+			}
+			cacheKey = key
+		}
+	}
+
 	var callee *session
 
+	// A sharded registration routes the call to the callee that owns the
+	// routing key supplied by the caller.
+	var rkey string
+	if reg.policy == wamp.InvokeSharded {
+		rk, ok := msg.Options[wamp.OptRKey]
+		if !ok || rk == nil {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{"sharded registration requires rkey"},
+			})
+			return
+		}
+		if rkey, ok = wamp.AsString(rk); !ok {
+			rkey = fmt.Sprint(rk)
+		}
+	}
+
 	// If there are multiple callees, then select a callee based invocation
 	// policy.
 	if len(reg.callees) > 1 {
@@ -638,6 +1342,12 @@ func (d *Dealer) call(caller *session, msg *wamp.Call) {
 			callee = reg.callees[d.prng.Int63n(int64(len(reg.callees)))]
 		case wamp.InvokeLast:
 			callee = reg.callees[len(reg.callees)-1]
+		case wamp.InvokeLeastBusy:
+			callee = d.leastBusyCallee(reg)
+		case wamp.InvokeWeighted:
+			callee = d.weightedCallee(reg)
+		case wamp.InvokeSharded:
+			callee = reg.shards.lookup(rkey)
 		default:
 			errMsg := fmt.Sprint("multiple callees registered for ",
 				msg.Procedure, " with '", wamp.InvokeSingle, "' policy")
@@ -648,11 +1358,324 @@ func (d *Dealer) call(caller *session, msg *wamp.Call) {
 	} else {
 		callee = reg.callees[0]
 	}
-	details := wamp.Dict{}
+
+	// If the callee is at its concurrency limit, then send the call to
+	// another callee that is below its limit.  If there is none, then queue
+	// the call until there is.
+	if !reg.belowLimit(callee) {
+		if reg.policy == wamp.InvokeSharded {
+			callee = nil
+		} else {
+			callee = d.availableCallee(reg)
+		}
+		if callee == nil {
+			d.queueCall(caller, msg, reg)
+			return
+		}
+	}
+
+	// A Caller sends its input as a series of progressive invocations by
+	// setting CALL.Options.progress|bool := true on all but the last CALL.
+	if progress && !callee.HasFeature(roleCallee, featureProgCallInvs) {
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrFeatureNotSupported,
+			Arguments: wamp.List{"callee does not support progressive call invocations"},
+		})
+		return
+	}
+	if ppt && !callee.HasFeature(roleCallee, featurePayloadPassthru) {
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrFeatureNotSupported,
+			Arguments: wamp.List{"callee does not support payload passthru mode"},
+		})
+		return
+	}
+
+	// A call may fail over to another callee if the INVOCATION cannot be
+	// delivered to the selected callee.  A CALL option overrides the option
+	// of the registration.
+	maxAttempts := reg.failover
+	if _, ok := msg.Options[wamp.OptFailover]; ok {
+		var err error
+		if maxAttempts, err = getFailover(msg.Options); err != nil {
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     wamp.ErrInvalidArgument,
+				Arguments: wamp.List{err.Error()},
+			})
+			return
+		}
+	}
+
+	d.calls[reqID] = caller
+	invocationID := d.idGen.Next()
+	invk := &invocation{
+		callID:   reqID,
+		callee:   callee,
+		regID:    reg.id,
+		progress: progress,
+		span:     d.newCallSpan(caller, msg, reg),
+		cacheKey: cacheKey,
+		sent:     time.Now(),
+	}
+	// A progressive call cannot fail over, since the callee already has some
+	// of the input, and a sharded call must go to the owner of its shard.
+	if maxAttempts > 1 && !progress && reg.policy != wamp.InvokeSharded {
+		invk.call = msg
+		invk.maxAttempts = maxAttempts
+		invk.tried = []*session{callee}
+	}
+	d.invocations[invocationID] = invk
+	d.invocationByCall[reqID] = invocationID
+	d.calleeLoad[callee]++
+	reg.running[callee]++
+	reg.stats.called()
 
 	// A Caller might want to issue a call providing a timeout for the call to
 	// finish.
 	//
+	// The dealer cancels the call when the timeout expires, whether or not the
+	// callee also handles the timeout.  This way a callee that ignores the
+	// timeout cannot leave the caller waiting forever.
+	timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout])
+	if timeout > 0 {
+		invk.timer = time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			d.timerAction(func() {
+				d.timeoutCall(caller, reqID, invocationID)
+			})
+		})
+	}
+
+	// Send INVOCATION to the endpoint that has registered the requested
+	// procedure.
+	if !d.trySend(callee, &wamp.Invocation{
+		Request:      invocationID,
+		Registration: reg.id,
+		Details:      d.invocationDetails(caller, msg, reg, callee, invk.span),
+		Arguments:    msg.Arguments,
+		ArgumentsKw:  msg.ArgumentsKw,
+	}) {
+		if d.failover(invocationID, invk) {
+			return
+		}
+		d.error(&wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   invocationID,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrNetworkFailure,
+			Arguments: wamp.List{"callee blocked - cannot call procedure"},
+		})
+	}
+}
+
+// fanout sends a call to every callee of the registration.  The caller is
+// sent a RESULT, with the response of each callee keyed by the callee's
+// session ID, when the quorum of responses is received, when all callees have
+// responded, or when the call timeout expires.
+//
+// Invocations of a fan-out call are counted toward each callee's concurrency
+// limit, but are not queued when a callee is at its limit.
+func (d *Dealer) fanout(caller *session, msg *wamp.Call, reg *registration, reqID requestID) {
+	sendError := func(errMsg string) {
+		d.trySend(caller, &wamp.Error{
+			Type:      msg.MessageType(),
+			Request:   msg.Request,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrInvalidArgument,
+			Arguments: wamp.List{errMsg},
+		})
+	}
+	if progress, _ := msg.Options[wamp.OptProgress].(bool); progress {
+		sendError("fanout call cannot send progressive call invocations")
+		return
+	}
+	quorum := len(reg.callees)
+	if q, ok := msg.Options[wamp.OptQuorum]; ok {
+		n, ok := wamp.AsInt64(q)
+		if !ok || n < 1 {
+			sendError(fmt.Sprintf("invalid %s %v (must be positive integer)",
+				wamp.OptQuorum, q))
+			return
+		}
+		if int(n) < quorum {
+			quorum = int(n)
+		}
+	}
+
+	fc := &fanoutCall{
+		caller:  caller,
+		callID:  reqID,
+		pending: map[wamp.ID]*invocation{},
+		results: wamp.Dict{},
+		quorum:  quorum,
+		span:    d.newCallSpan(caller, msg, reg),
+	}
+	d.fanoutCalls[reqID] = fc
+
+	// When the deadline expires, the caller is sent the responses received
+	// so far.
+	timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout])
+	if timeout > 0 {
+		fc.timer = time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			d.timerAction(func() {
+				if d.fanoutCalls[reqID] == fc {
+					for _, invk := range fc.pending {
+						d.invocationStats(invk).timedOut()
+					}
+					d.endFanout(fc, wamp.CancelModeKillNoWait, "")
+				}
+			})
+		})
+	}
+
+	callees := make([]*session, len(reg.callees))
+	copy(callees, reg.callees)
+	for _, callee := range callees {
+		invocationID := d.idGen.Next()
+		invk := &invocation{
+			callID: reqID,
+			callee: callee,
+			regID:  reg.id,
+			fanout: fc,
+			sent:   time.Now(),
+		}
+		d.invocations[invocationID] = invk
+		fc.pending[invocationID] = invk
+		d.calleeLoad[callee]++
+		reg.running[callee]++
+		reg.stats.called()
+
+		if isPassthru(msg.Options) && !callee.HasFeature(roleCallee, featurePayloadPassthru) {
+			d.fanoutResponse(invocationID, invk,
+				newFanoutResponse(wamp.ErrFeatureNotSupported,
+					wamp.List{"callee does not support payload passthru mode"}, nil, nil))
+			if d.fanoutCalls[reqID] != fc {
+				// Fan-out call already ended.
+				return
+			}
+			continue
+		}
+
+		details := d.invocationDetails(caller, msg, reg, callee, fc.span)
+		delete(details, wamp.OptReceiveProgress)
+		if !d.trySend(callee, &wamp.Invocation{
+			Request:      invocationID,
+			Registration: reg.id,
+			Details:      details,
+			Arguments:    msg.Arguments,
+			ArgumentsKw:  msg.ArgumentsKw,
+		}) {
+			d.fanoutResponse(invocationID, invk,
+				newFanoutResponse(wamp.ErrNetworkFailure,
+					wamp.List{"callee blocked - cannot call procedure"}, nil, nil))
+			if d.fanoutCalls[reqID] != fc {
+				// Fan-out call already ended.
+				return
+			}
+		}
+	}
+}
+
+// fanoutResponse records the response from the callee of an invocation that
+// is part of a fan-out call.  If enough responses are received, then the
+// fan-out call is ended and the result is sent to the caller.
+func (d *Dealer) fanoutResponse(invocationID wamp.ID, invk *invocation, response wamp.Dict) {
+	fc := invk.fanout
+	d.delInvocation(invocationID, invk)
+	delete(fc.pending, invocationID)
+	fc.results[invk.callee.String()] = response
+	if len(fc.results) >= fc.quorum || len(fc.pending) == 0 {
+		d.endFanout(fc, wamp.CancelModeKillNoWait, "")
+	}
+}
+
+// endFanout ends a fan-out call and interrupts any invocations that are still
+// pending, according to the cancel mode.  If reason is empty, then the caller
+// is sent a RESULT with the responses received.  Otherwise, the caller is sent
+// an ERROR with the reason.
+func (d *Dealer) endFanout(fc *fanoutCall, mode string, reason wamp.URI) {
+	if fc.timer != nil {
+		fc.timer.Stop()
+	}
+	delete(d.fanoutCalls, fc.callID)
+
+	for invocationID, invk := range fc.pending {
+		d.invocationStats(invk).wasCanceled()
+		d.delInvocation(invocationID, invk)
+		if mode == wamp.CancelModeSkip ||
+			!invk.callee.HasFeature(roleCallee, featureCallCanceling) {
+			continue
+		}
+		iReason := reason
+		if iReason == "" {
+			iReason = wamp.ErrCanceled
+		}
+		d.trySend(invk.callee, &wamp.Interrupt{
+			Request: invocationID,
+			Options: wamp.Dict{
+				wamp.OptReason: iReason,
+				wamp.OptMode:   mode,
+			},
+		})
+	}
+	fc.pending = nil
+
+	details := wamp.Dict{}
+	fc.span.addDetails(details)
+	if fc.span != nil {
+		fc.span.Error = reason
+		fc.span.Attributes["responses"] = len(fc.results)
+		d.endSpan(fc.span)
+	}
+
+	if reason != "" {
+		d.trySend(fc.caller, &wamp.Error{
+			Type:    wamp.CALL,
+			Request: fc.callID.request,
+			Error:   reason,
+			Details: details,
+		})
+		return
+	}
+	d.trySend(fc.caller, &wamp.Result{
+		Request:     fc.callID.request,
+		Details:     details,
+		ArgumentsKw: fc.results,
+	})
+}
+
+// newFanoutResponse creates the response, from one callee of a fan-out call,
+// that is included in the result sent to the caller.  The error is empty if
+// the callee responded with YIELD.  The payload passthru options, if any, of
+// the YIELD or ERROR are included in the response.
+func newFanoutResponse(errURI wamp.URI, args wamp.List, kwargs, options wamp.Dict) wamp.Dict {
+	response := wamp.Dict{}
+	addPassthruDetails(options, response)
+	if errURI != "" {
+		response[wamp.OptError] = errURI
+	}
+	if len(args) != 0 {
+		response["args"] = args
+	}
+	if len(kwargs) != 0 {
+		response["kwargs"] = kwargs
+	}
+	return response
+}
+
+// invocationDetails returns the details of the INVOCATION that sends the call
+// to the callee.
+func (d *Dealer) invocationDetails(caller *session, msg *wamp.Call, reg *registration, callee *session, span *Span) wamp.Dict {
+	details := wamp.Dict{}
+
 	// A timeout allows to automatically cancel a call after a specified time
 	// either at the Callee or at the Dealer.
 	timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout])
@@ -661,13 +1684,13 @@ func (d *Dealer) call(caller *session, msg *wamp.Call) {
 		if callee.HasFeature(roleCallee, featureCallTimeout) {
 			details[wamp.OptTimeout] = timeout
 		}
-
-		// TODO: Start a goroutine to cancel the pending call on timeout.
-		// Should be implemented like Cancel with mode=killnowait, and error
-		// message argument should say "call timeout"
 	}
 
-	// TODO: handle trust levels
+	// The Dealer supplies the trust level it assigned to the caller, if the
+	// realm assigns trust levels.
+	if level, ok := caller.TrustLevel(); ok {
+		details[detailTrustLevel] = level
+	}
 
 	// If the callee has requested disclosure of caller identity when the
 	// registration was created, and this was allowed by the dealer.
@@ -681,17 +1704,6 @@ func (d *Dealer) call(caller *session, msg *wamp.Call) {
 		// session ID) to endpoints of a routed call.  This is indicated by the
 		// "disclose_me" flag in the message options.
 		if opt, _ := msg.Options[wamp.OptDiscloseMe].(bool); opt {
-			// Dealer MAY deny a Caller's request to disclose its identity.
-			if !d.allowDisclose {
-				// Do not continue a call when discloseMe was disallowed.
-				d.trySend(caller, &wamp.Error{
-					Type:    msg.MessageType(),
-					Request: msg.Request,
-					Details: wamp.Dict{},
-					Error:   wamp.ErrOptionDisallowedDiscloseMe,
-				})
-				return
-			}
 			if callee.HasFeature(roleCallee, featureCallerIdent) {
 				discloseCaller(caller, details)
 			}
@@ -709,29 +1721,145 @@ func (d *Dealer) call(caller *session, msg *wamp.Call) {
 		}
 	}
 
+	if opt, _ := msg.Options[wamp.OptProgress].(bool); opt {
+		details[wamp.OptProgress] = true
+	}
+
 	if reg.match != wamp.MatchExact {
 		// According to the spec, a router must provide the actual
 		// procedure to the client.
 		details[wamp.OptProcedure] = msg.Procedure
 	}
 
-	reqID := requestID{
-		session: caller.ID,
-		request: msg.Request,
+	// If the call is traced, then the callee is given the trace ID and the
+	// ID of the dealer's span, which is the parent of the callee's span.
+	span.addDetails(details)
+
+	addPassthruDetails(msg.Options, details)
+	return details
+}
+
+// newCallSpan starts the span for a call, if the call is traced.
+func (d *Dealer) newCallSpan(caller *session, msg *wamp.Call, reg *registration) *Span {
+	span := newSpan(SpanKindCall, msg.Procedure, msg.Options, d.spanRecorder)
+	if span != nil {
+		span.Attributes["caller"] = caller.ID
+		span.Attributes["registration"] = reg.id
 	}
-	d.calls[reqID] = caller
-	invocationID := d.idGen.Next()
-	d.invocations[invocationID] = &invocation{
-		callID: reqID,
-		callee: callee,
+	return span
+}
+
+// endSpan ends the span of a traced call, and records it if there is a span
+// recorder.
+func (d *Dealer) endSpan(span *Span) {
+	if span == nil || d.spanRecorder == nil {
+		return
 	}
-	d.invocationByCall[reqID] = invocationID
+	span.End = time.Now()
+	d.spanRecorder.RecordSpan(span)
+}
 
-	// Send INVOCATION to the endpoint that has registered the requested
-	// procedure.
-	if !d.trySend(callee, &wamp.Invocation{
+// failover sends a pending invocation, that could not be delivered to its
+// callee, to another callee of the registration.  The invocation keeps its
+// ID, so that the caller's pending call is unchanged.
+//
+// Returns false if the call does not allow failover, has used all of its
+// attempts, or there is no other callee to try.
+func (d *Dealer) failover(invocationID wamp.ID, invk *invocation) bool {
+	if invk.call == nil || invk.canceled {
+		return false
+	}
+	caller, ok := d.calls[invk.callID]
+	if !ok {
+		return false
+	}
+	reg, ok := d.registrations[invk.regID]
+	if !ok {
+		return false
+	}
+	for len(invk.tried) < invk.maxAttempts {
+		callee := d.failoverCallee(reg, invk.tried)
+		if callee == nil {
+			return false
+		}
+		if d.debug {
+			d.log.Println("Failover of invocation", invocationID, "from callee",
+				invk.callee, "to", callee)
+		}
+		d.decCalleeLoad(invk.callee)
+		d.decRunning(reg, invk.callee)
+		invk.callee = callee
+		invk.tried = append(invk.tried, callee)
+		d.calleeLoad[callee]++
+		reg.running[callee]++
+
+		if d.trySend(callee, &wamp.Invocation{
+			Request:      invocationID,
+			Registration: reg.id,
+			Details:      d.invocationDetails(caller, invk.call, reg, callee, invk.span),
+			Arguments:    invk.call.Arguments,
+			ArgumentsKw:  invk.call.ArgumentsKw,
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverCallee selects a callee of the registration, that has not already
+// been tried, to fail over to.  Returns nil if all callees have been tried.
+func (d *Dealer) failoverCallee(reg *registration, tried []*session) *session {
+	var untried []*session
+CalleeLoop:
+	for _, callee := range reg.callees {
+		if !reg.belowLimit(callee) {
+			continue
+		}
+		for _, t := range tried {
+			if callee == t {
+				continue CalleeLoop
+			}
+		}
+		untried = append(untried, callee)
+	}
+	if len(untried) == 0 {
+		return nil
+	}
+	switch reg.policy {
+	case wamp.InvokeRandom, wamp.InvokeWeighted:
+		return untried[d.prng.Int63n(int64(len(untried)))]
+	case wamp.InvokeLast:
+		return untried[len(untried)-1]
+	case wamp.InvokeLeastBusy:
+		callee := untried[0]
+		for _, c := range untried[1:] {
+			if d.calleeLoad[c] < d.calleeLoad[callee] {
+				callee = c
+			}
+		}
+		return callee
+	}
+	return untried[0]
+}
+
+// continueCall forwards a CALL, that continues a progressive call, to the
+// callee as another INVOCATION with the same invocation ID.  The CALL that
+// does not set progress is the last one for the call.
+func (d *Dealer) continueCall(invk *invocation, invocationID wamp.ID, msg *wamp.Call, progress bool) {
+	invk.progress = progress
+	if invk.canceled {
+		// Callee was interrupted, so do not send it any more input.
+		return
+	}
+	details := wamp.Dict{}
+	if progress {
+		details[wamp.OptProgress] = true
+	}
+	invk.span.addDetails(details)
+	addPassthruDetails(msg.Options, details)
+	if !d.trySend(invk.callee, &wamp.Invocation{
 		Request:      invocationID,
-		Registration: reg.id,
+		Registration: invk.regID,
 		Details:      details,
 		Arguments:    msg.Arguments,
 		ArgumentsKw:  msg.ArgumentsKw,
@@ -746,6 +1874,260 @@ func (d *Dealer) call(caller *session, msg *wamp.Call) {
 	}
 }
 
+// waitForCallee holds a call, for a procedure that has no registered callee,
+// until a callee registers the procedure or the wait times out.  If the CALL
+// timeout expires first, then the call times out the same as a call sent to a
+// callee.
+func (d *Dealer) waitForCallee(caller *session, msg *wamp.Call, wait time.Duration) {
+	wc := &waitingCall{
+		caller: caller,
+		msg:    msg,
+		since:  time.Now(),
+	}
+	expire := wait
+	reason := wamp.ErrTimeout
+	args := wamp.List{fmt.Sprint("timed out waiting ", wait,
+		" for callee to register ", msg.Procedure)}
+	timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout])
+	if timeout > 0 && time.Duration(timeout)*time.Millisecond < wait {
+		expire = time.Duration(timeout) * time.Millisecond
+		reason = wamp.ErrCanceled
+		args = wamp.List{"call timeout"}
+	}
+	wc.timer = time.AfterFunc(expire, func() {
+		d.timerAction(func() {
+			if !d.delWaitingCall(wc) {
+				// Call already dispatched or canceled.
+				return
+			}
+			d.trySend(caller, &wamp.Error{
+				Type:      msg.MessageType(),
+				Request:   msg.Request,
+				Details:   wamp.Dict{},
+				Error:     reason,
+				Arguments: args,
+			})
+		})
+	})
+	d.waitingCalls = append(d.waitingCalls, wc)
+	if d.debug {
+		d.log.Println("Call", msg.Request, "from", caller, "waiting", wait,
+			"for callee to register", msg.Procedure)
+	}
+}
+
+// dispatchWaitingCalls sends any waiting calls, for which there is now a
+// registered callee, to the callee.
+func (d *Dealer) dispatchWaitingCalls() {
+	var ready []*waitingCall
+	waiting := d.waitingCalls[:0]
+	for _, wc := range d.waitingCalls {
+		if reg, ok := d.matchProcedure(wc.msg.Procedure); ok && len(reg.callees) != 0 {
+			wc.timer.Stop()
+			ready = append(ready, wc)
+			continue
+		}
+		waiting = append(waiting, wc)
+	}
+	for i := len(waiting); i < len(d.waitingCalls); i++ {
+		d.waitingCalls[i] = nil
+	}
+	d.waitingCalls = waiting
+	for _, wc := range ready {
+		d.call(wc.caller, wc.dispatchMsg())
+	}
+}
+
+// delWaitingCall removes the call from the waiting calls.  Returns false if
+// the call was not waiting.
+func (d *Dealer) delWaitingCall(wc *waitingCall) bool {
+	for i := range d.waitingCalls {
+		if d.waitingCalls[i] == wc {
+			wc.timer.Stop()
+			copy(d.waitingCalls[i:], d.waitingCalls[i+1:])
+			d.waitingCalls[len(d.waitingCalls)-1] = nil
+			d.waitingCalls = d.waitingCalls[:len(d.waitingCalls)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// availableCallee returns a callee of the registration that is below its
+// concurrency limit, or nil if there is none.
+func (d *Dealer) availableCallee(reg *registration) *session {
+	for _, callee := range reg.callees {
+		if reg.belowLimit(callee) {
+			return callee
+		}
+	}
+	return nil
+}
+
+// queueCall queues a call until a callee of the registration is below its
+// concurrency limit.  If the queue is full, then ERROR is sent to the caller.
+//
+// A progressive call is not queued, since the CALLs that continue it cannot
+// be held with it.
+func (d *Dealer) queueCall(caller *session, msg *wamp.Call, reg *registration) {
+	if progress, _ := msg.Options[wamp.OptProgress].(bool); progress {
+		d.trySend(caller, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrCalleesBusy,
+			Arguments: wamp.List{fmt.Sprint("callees of ", msg.Procedure,
+				" are busy and progressive call cannot be queued")},
+		})
+		return
+	}
+	if len(reg.queue) >= reg.queueLimit {
+		d.trySend(caller, &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrCallQueueFull,
+			Arguments: wamp.List{fmt.Sprint("callees of ", msg.Procedure,
+				" are busy and call cannot be queued")},
+		})
+		return
+	}
+	reqID := requestID{
+		session: caller.ID,
+		request: msg.Request,
+	}
+	qc := &waitingCall{
+		caller: caller,
+		msg:    msg,
+		since:  time.Now(),
+	}
+	// The CALL timeout applies while the call is queued.
+	if timeout, _ := wamp.AsInt64(msg.Options[wamp.OptTimeout]); timeout > 0 {
+		qc.timer = time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			d.timerAction(func() {
+				if !d.delQueuedCall(reqID, qc) {
+					// Call already dispatched or canceled.
+					return
+				}
+				d.trySend(caller, &wamp.Error{
+					Type:      msg.MessageType(),
+					Request:   msg.Request,
+					Details:   wamp.Dict{},
+					Error:     wamp.ErrCanceled,
+					Arguments: wamp.List{"call timeout"},
+				})
+			})
+		})
+	}
+	reg.queue = append(reg.queue, qc)
+	d.queuedCalls[reqID] = reg
+	if d.debug {
+		d.log.Println("Queued call", msg.Request, "from", caller, "for",
+			msg.Procedure, "- callees at concurrency limit")
+	}
+}
+
+// delQueuedCall removes the call from its registration's queue.  Returns
+// false if the call was not queued.
+func (d *Dealer) delQueuedCall(reqID requestID, qc *waitingCall) bool {
+	reg, ok := d.queuedCalls[reqID]
+	if !ok {
+		return false
+	}
+	for i := range reg.queue {
+		if reg.queue[i] == qc {
+			qc.stopTimer()
+			copy(reg.queue[i:], reg.queue[i+1:])
+			reg.queue[len(reg.queue)-1] = nil
+			reg.queue = reg.queue[:len(reg.queue)-1]
+			delete(d.queuedCalls, reqID)
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchQueuedCalls sends the queued calls of each ready registration to
+// callees that are below their concurrency limit.  Calls queued for a
+// registration that has been deleted are handled again as new calls.
+func (d *Dealer) dispatchQueuedCalls() {
+	for len(d.readyRegs) != 0 {
+		for reg := range d.readyRegs {
+			delete(d.readyRegs, reg)
+			active := d.registrations[reg.id] == reg
+			for len(reg.queue) != 0 {
+				qc := reg.queue[0]
+				if active && !d.canDispatch(reg, qc.msg) {
+					break
+				}
+				qc.stopTimer()
+				reg.queue[0] = nil
+				reg.queue = reg.queue[1:]
+				delete(d.queuedCalls, requestID{
+					session: qc.caller.ID,
+					request: qc.msg.Request,
+				})
+				d.call(qc.caller, qc.dispatchMsg())
+			}
+		}
+	}
+}
+
+// canDispatch returns true if the queued call can be sent to a callee that is
+// below its concurrency limit.
+func (d *Dealer) canDispatch(reg *registration, msg *wamp.Call) bool {
+	if reg.policy != wamp.InvokeSharded {
+		return d.availableCallee(reg) != nil
+	}
+	rk := msg.Options[wamp.OptRKey]
+	rkey, ok := wamp.AsString(rk)
+	if !ok {
+		rkey = fmt.Sprint(rk)
+	}
+	callee := reg.shards.lookup(rkey)
+	return callee != nil && reg.belowLimit(callee)
+}
+
+// leastBusyCallee selects the callee with the fewest pending invocations.
+//
+// The search starts at the callee following the one last selected, so that
+// calls are distributed round-robin among callees that are equally busy.
+func (d *Dealer) leastBusyCallee(reg *registration) *session {
+	if reg.nextCallee >= len(reg.callees) {
+		reg.nextCallee = 0
+	}
+	var callee *session
+	least := -1
+	for i := range reg.callees {
+		c := reg.callees[(reg.nextCallee+i)%len(reg.callees)]
+		if load := d.calleeLoad[c]; least == -1 || load < least {
+			callee = c
+			least = load
+			if load == 0 {
+				break
+			}
+		}
+	}
+	reg.nextCallee++
+	return callee
+}
+
+// weightedCallee randomly selects a callee, where the probability of selecting
+// each callee is proportional to its weight.
+func (d *Dealer) weightedCallee(reg *registration) *session {
+	var total int64
+	for _, c := range reg.callees {
+		total += reg.weights[c]
+	}
+	n := d.prng.Int63n(total)
+	for _, c := range reg.callees {
+		if n -= reg.weights[c]; n < 0 {
+			return c
+		}
+	}
+	return reg.callees[len(reg.callees)-1]
+}
+
 func (d *Dealer) cancel(caller *session, msg *wamp.Cancel, mode string, reason wamp.URI) {
 	reqID := requestID{
 		session: caller.ID,
@@ -753,6 +2135,45 @@ func (d *Dealer) cancel(caller *session, msg *wamp.Cancel, mode string, reason w
 	}
 	procCaller, ok := d.calls[reqID]
 	if !ok {
+		// If the call is a fan-out call, then cancel the invocations sent to
+		// all callees.
+		if fc, ok := d.fanoutCalls[reqID]; ok {
+			if fc.caller == caller {
+				d.endFanout(fc, mode, reason)
+			}
+			return
+		}
+		// If the call is queued for a callee at its concurrency limit, then
+		// remove it from the queue and send ERROR to the caller.
+		if reg, ok := d.queuedCalls[reqID]; ok {
+			for _, qc := range reg.queue {
+				if qc.caller == caller && qc.msg.Request == msg.Request &&
+					d.delQueuedCall(reqID, qc) {
+					d.trySend(caller, &wamp.Error{
+						Type:    wamp.CALL,
+						Request: msg.Request,
+						Error:   reason,
+						Details: wamp.Dict{},
+					})
+					break
+				}
+			}
+			return
+		}
+		// If the call is waiting for a callee, then stop waiting and send
+		// ERROR to the caller.
+		for _, wc := range d.waitingCalls {
+			if wc.caller == caller && wc.msg.Request == msg.Request {
+				d.delWaitingCall(wc)
+				d.trySend(caller, &wamp.Error{
+					Type:    wamp.CALL,
+					Request: msg.Request,
+					Error:   reason,
+					Details: wamp.Dict{},
+				})
+				break
+			}
+		}
 		// There is no pending call to cancel.
 		return
 	}
@@ -782,6 +2203,40 @@ func (d *Dealer) cancel(caller *session, msg *wamp.Cancel, mode string, reason w
 	if invk.canceled {
 		return
 	}
+	d.invocationStats(invk).wasCanceled()
+	d.cancelInvocation(caller, reqID, invocationID, invk, mode, reason, nil)
+}
+
+// timeoutCall cancels a call whose CALL timeout has expired.  This behaves
+// like a cancel with mode "killnowait", except that an INTERRUPT is not sent
+// again if the call was already canceled with mode "kill".
+func (d *Dealer) timeoutCall(caller *session, reqID requestID, invocationID wamp.ID) {
+	// If the call has already finished, or the caller reused the request ID
+	// for a different call, then there is nothing to time out.
+	if invkID, ok := d.invocationByCall[reqID]; !ok || invkID != invocationID {
+		return
+	}
+	invk, ok := d.invocations[invocationID]
+	if !ok {
+		d.log.Print("CRITICAL: missing caller for pending invocation")
+		return
+	}
+	mode := wamp.CancelModeKillNoWait
+	if invk.canceled {
+		mode = wamp.CancelModeSkip
+	}
+	d.invocationStats(invk).timedOut()
+	if d.debug {
+		d.log.Println("Call timeout for invocation", invocationID, "for call",
+			reqID.request)
+	}
+	d.cancelInvocation(caller, reqID, invocationID, invk, mode,
+		wamp.ErrCanceled, wamp.List{"call timeout"})
+}
+
+// cancelInvocation cancels the pending invocation for a call according to the
+// cancel mode, and unless waiting for the callee, sends ERROR to the caller.
+func (d *Dealer) cancelInvocation(caller *session, reqID requestID, invocationID wamp.ID, invk *invocation, mode string, reason wamp.URI, args wamp.List) {
 	invk.canceled = true
 
 	// If mode is "kill" or "killnowait", then send INTERRUPT.
@@ -798,7 +2253,7 @@ func (d *Dealer) cancel(caller *session, msg *wamp.Cancel, mode string, reason w
 				Options: wamp.Dict{wamp.OptReason: reason, wamp.OptMode: mode},
 			}) {
 				d.log.Println("Dealer sent INTERRUPT to cancel invocation",
-					invocationID, "for call", msg.Request, "mode:", mode)
+					invocationID, "for call", reqID.request, "mode:", mode)
 
 				// If mode is "kill" then let error from callee trigger the
 				// response to the caller.  This is how the caller waits for
@@ -818,14 +2273,20 @@ func (d *Dealer) cancel(caller *session, msg *wamp.Cancel, mode string, reason w
 	// This also stops repeated CANCEL messages.
 	delete(d.calls, reqID)
 	delete(d.invocationByCall, reqID)
-	delete(d.invocations, invocationID)
+	if invk.span != nil {
+		invk.span.Error = reason
+	}
+	d.delInvocation(invocationID, invk)
 
 	// Send error to the caller.
+	details := wamp.Dict{}
+	invk.span.addDetails(details)
 	d.trySend(caller, &wamp.Error{
-		Type:    wamp.CALL,
-		Request: msg.Request,
-		Error:   reason,
-		Details: wamp.Dict{},
+		Type:      wamp.CALL,
+		Request:   reqID.request,
+		Error:     reason,
+		Details:   details,
+		Arguments: args,
 	})
 }
 
@@ -866,23 +2327,38 @@ func (d *Dealer) yield(callee *session, msg *wamp.Yield, canRetry bool) bool {
 		return false
 	}
 
+	// The final YIELD from each callee of a fan-out call is collected into
+	// the result.  Progressive results are not sent for a fan-out call.
+	if invk.fanout != nil {
+		if !progress {
+			d.invocationStats(invk).succeeded(time.Since(invk.sent))
+			d.fanoutResponse(msg.Request, invk,
+				newFanoutResponse("", msg.Arguments, msg.ArgumentsKw, msg.Options))
+		}
+		return false
+	}
+
 	callID := invk.callID
 	// Find caller for this result.
 	caller, ok := d.calls[callID]
 
 	details := wamp.Dict{}
+	invk.span.addDetails(details)
+	addPassthruDetails(msg.Options, details)
 
 	var keepInvocation bool
 	if progress {
 		// If this is a progressive response, then set progress=true.
 		details[wamp.OptProgress] = true
 	} else {
+		d.invocationStats(invk).succeeded(time.Since(invk.sent))
+
 		// Clean up the invocation, unless need to retry.
 		defer func() {
 			if keepInvocation {
 				return
 			}
-			delete(d.invocations, msg.Request)
+			d.delInvocation(msg.Request, invk)
 			// Delete callID -> invocation.
 			delete(d.invocationByCall, callID)
 			// Delete pending call since it is finished.
@@ -890,6 +2366,13 @@ func (d *Dealer) yield(callee *session, msg *wamp.Yield, canRetry bool) bool {
 		}()
 	}
 
+	// Cache the final result, if the call is cacheable.
+	if !progress && invk.cacheKey != "" {
+		if reg, found := d.registrations[invk.regID]; found && reg.cache != nil {
+			reg.cache.put(invk.cacheKey, msg.Arguments, msg.ArgumentsKw, msg.Options, time.Now())
+		}
+	}
+
 	// Did not find caller.
 	if !ok {
 		// Found invocation id that does not have any call id.
@@ -929,7 +2412,16 @@ func (d *Dealer) error(msg *wamp.Error) {
 			msg.Request, "(response to canceled call)")
 		return
 	}
-	delete(d.invocations, msg.Request)
+	d.invocationStats(invk).failed(msg.Error)
+	if invk.fanout != nil {
+		d.fanoutResponse(msg.Request, invk,
+			newFanoutResponse(msg.Error, msg.Arguments, msg.ArgumentsKw, msg.Details))
+		return
+	}
+	if invk.span != nil {
+		invk.span.Error = msg.Error
+	}
+	d.delInvocation(msg.Request, invk)
 	callID := invk.callID
 
 	// Delete invocationsByCall entry.  This will already be deleted if the
@@ -947,11 +2439,18 @@ func (d *Dealer) error(msg *wamp.Error) {
 	delete(d.calls, callID)
 
 	// Send error to the caller.
+	details := msg.Details
+	if invk.span != nil {
+		if details == nil {
+			details = wamp.Dict{}
+		}
+		invk.span.addDetails(details)
+	}
 	d.trySend(caller, &wamp.Error{
 		Type:        wamp.CALL,
 		Request:     callID.request,
 		Error:       msg.Error,
-		Details:     msg.Details,
+		Details:     details,
 		Arguments:   msg.Arguments,
 		ArgumentsKw: msg.ArgumentsKw,
 	})
@@ -992,6 +2491,58 @@ func (d *Dealer) removeSession(sess *session) {
 	}
 	delete(d.calleeRegIDSet, sess)
 
+	// Fail over any invocations that the removed session has not answered
+	// to another callee.  If the call cannot fail over, then send ERROR to
+	// the caller.
+	for invkID, invk := range d.invocations {
+		if invk.callee != sess || d.failover(invkID, invk) {
+			continue
+		}
+		d.error(&wamp.Error{
+			Type:      wamp.INVOCATION,
+			Request:   invkID,
+			Details:   wamp.Dict{},
+			Error:     wamp.ErrCanceled,
+			Arguments: wamp.List{"callee left"},
+		})
+	}
+
+	// Remove any calls from the removed session that are waiting for a callee.
+	if len(d.waitingCalls) != 0 {
+		waiting := d.waitingCalls[:0]
+		for _, wc := range d.waitingCalls {
+			if wc.caller == sess {
+				wc.timer.Stop()
+				continue
+			}
+			waiting = append(waiting, wc)
+		}
+		for i := len(waiting); i < len(d.waitingCalls); i++ {
+			d.waitingCalls[i] = nil
+		}
+		d.waitingCalls = waiting
+	}
+
+	// Remove any queued calls from the removed session.
+	for req, reg := range d.queuedCalls {
+		if req.session != sess.ID {
+			continue
+		}
+		for _, qc := range reg.queue {
+			if qc.caller == sess && qc.msg.Request == req.request {
+				d.delQueuedCall(req, qc)
+				break
+			}
+		}
+	}
+
+	// Remove any fan-out calls from the removed session.
+	for _, fc := range d.fanoutCalls {
+		if fc.caller == sess {
+			d.endFanout(fc, wamp.CancelModeKillNoWait, wamp.ErrCanceled)
+		}
+	}
+
 	// Remove any pending calls for the removed session.
 	for req, caller := range d.calls {
 		if caller != sess {
@@ -1003,9 +2554,76 @@ func (d *Dealer) removeSession(sess *session) {
 		// If there is a pending invocation for the call, remove it.
 		if invkID, ok := d.invocationByCall[req]; ok {
 			delete(d.invocationByCall, req)
-			delete(d.invocations, invkID)
+			if invk, ok := d.invocations[invkID]; ok {
+				if invk.span != nil {
+					invk.span.Error = wamp.ErrCanceled
+				}
+				d.invocationStats(invk).wasCanceled()
+				d.delInvocation(invkID, invk)
+			}
 		}
 	}
+	for req := range d.endedProgCalls {
+		if req.session == sess.ID {
+			delete(d.endedProgCalls, req)
+		}
+	}
+}
+
+// delInvocation removes a pending invocation, stops its call timeout timer,
+// and updates the number of pending invocations for the callee.  If the call
+// is traced, then its span is ended.
+func (d *Dealer) delInvocation(invocationID wamp.ID, invk *invocation) {
+	invk.stopTimer()
+	if invk.span != nil {
+		invk.span.Attributes["callee"] = invk.callee.ID
+		d.endSpan(invk.span)
+	}
+	delete(d.invocations, invocationID)
+	if invk.progress {
+		d.endedProgCalls[invk.callID] = struct{}{}
+	}
+	d.decCalleeLoad(invk.callee)
+	if reg, ok := d.registrations[invk.regID]; ok {
+		d.decRunning(reg, invk.callee)
+	}
+}
+
+// invocationStats returns the statistics of the invocation's registration, to
+// record the outcome of the invocation.  Returns nil if the outcome is already
+// recorded, or the registration no longer exists.
+func (d *Dealer) invocationStats(invk *invocation) *callStats {
+	if invk.ended {
+		return nil
+	}
+	invk.ended = true
+	if reg, ok := d.registrations[invk.regID]; ok {
+		return reg.stats
+	}
+	return nil
+}
+
+// decRunning decrements the number of pending invocations of the registration
+// for the callee.  If there are queued calls for the registration, then the
+// registration is marked as ready to dispatch them.
+func (d *Dealer) decRunning(reg *registration, callee *session) {
+	if n := reg.running[callee]; n > 1 {
+		reg.running[callee] = n - 1
+	} else {
+		delete(reg.running, callee)
+	}
+	if len(reg.queue) != 0 {
+		d.readyRegs[reg] = struct{}{}
+	}
+}
+
+// decCalleeLoad decrements the number of pending invocations for the callee.
+func (d *Dealer) decCalleeLoad(callee *session) {
+	if n := d.calleeLoad[callee]; n > 1 {
+		d.calleeLoad[callee] = n - 1
+	} else {
+		delete(d.calleeLoad, callee)
+	}
 }
 
 // delCalleeReg deletes the the callee from the specified registration and
@@ -1034,22 +2652,26 @@ func (d *Dealer) delCalleeReg(callee *session, regID wamp.ID) (bool, error) {
 				// Delete preserving order.
 				reg.callees = append(reg.callees[:i], reg.callees[i+1:]...)
 			}
+			delete(reg.weights, callee)
+			delete(reg.concurrency, callee)
+			if reg.shards != nil {
+				reg.shards.remove(callee)
+			}
 			break
 		}
 	}
 
+	// Queued calls can be sent to a remaining callee, or if the registration
+	// is deleted, handled as calls to a procedure with no registration.
+	if len(reg.queue) != 0 {
+		d.readyRegs[reg] = struct{}{}
+	}
+
 	// If no more callees for this registration, then delete the registration
 	// according to what match type it is.
 	if len(reg.callees) == 0 {
 		delete(d.registrations, regID)
-		switch reg.match {
-		default:
-			delete(d.procRegMap, reg.procedure)
-		case wamp.MatchPrefix:
-			delete(d.pfxProcRegMap, reg.procedure)
-		case wamp.MatchWildcard:
-			delete(d.wcProcRegMap, reg.procedure)
-		}
+		d.procMatcher.Remove(reg.procedure, reg.match)
 		if d.debug {
 			d.log.Printf("Deleted registration %v for procedure %v", regID,
 				reg.procedure)
@@ -1066,14 +2688,15 @@ func (d *Dealer) RegList(msg *wamp.Invocation) wamp.Message {
 	var exactRegs, pfxRegs, wcRegs []wamp.ID
 	sync := make(chan struct{})
 	d.actionChan <- func() {
-		for _, reg := range d.procRegMap {
-			exactRegs = append(exactRegs, reg.id)
-		}
-		for _, reg := range d.pfxProcRegMap {
-			pfxRegs = append(pfxRegs, reg.id)
-		}
-		for _, reg := range d.wcProcRegMap {
-			wcRegs = append(wcRegs, reg.id)
+		for _, reg := range d.registrations {
+			switch reg.match {
+			default:
+				exactRegs = append(exactRegs, reg.id)
+			case wamp.MatchPrefix:
+				pfxRegs = append(pfxRegs, reg.id)
+			case wamp.MatchWildcard:
+				wcRegs = append(wcRegs, reg.id)
+			}
 		}
 		close(sync)
 	}
@@ -1104,18 +2727,8 @@ func (d *Dealer) RegLookup(msg *wamp.Invocation) wamp.Message {
 			sync := make(chan wamp.ID)
 			d.actionChan <- func() {
 				var r wamp.ID
-				var reg *registration
-				var ok bool
-				switch match {
-				default:
-					reg, ok = d.procRegMap[procedure]
-				case wamp.MatchPrefix:
-					reg, ok = d.pfxProcRegMap[procedure]
-				case wamp.MatchWildcard:
-					reg, ok = d.wcProcRegMap[procedure]
-				}
-				if ok {
-					r = reg.id
+				if reg, ok := d.procMatcher.Get(procedure, match); ok {
+					r = reg.(*registration).id
 				}
 				sync <- r
 			}
@@ -1165,6 +2778,57 @@ func (d *Dealer) RegGet(msg *wamp.Invocation) wamp.Message {
 						wamp.OptMatch:  reg.match,
 						wamp.OptInvoke: reg.policy,
 					}
+					// Include the per-callee information used to select
+					// callees with the leastbusy, weighted, and sharded
+					// policies.
+					switch reg.policy {
+					case wamp.InvokeLeastBusy:
+						callees := make([]wamp.Dict, len(reg.callees))
+						for i, c := range reg.callees {
+							callees[i] = wamp.Dict{
+								"session":     c.ID,
+								"invocations": d.calleeLoad[c],
+							}
+						}
+						dict["callees"] = callees
+					case wamp.InvokeWeighted:
+						callees := make([]wamp.Dict, len(reg.callees))
+						for i, c := range reg.callees {
+							callees[i] = wamp.Dict{
+								"session":      c.ID,
+								wamp.OptWeight: reg.weights[c],
+							}
+						}
+						dict["callees"] = callees
+					case wamp.InvokeSharded:
+						callees := make([]wamp.Dict, len(reg.callees))
+						for i, c := range reg.callees {
+							callees[i] = wamp.Dict{
+								"session":      c.ID,
+								wamp.OptShards: reg.shards.keys(c),
+							}
+						}
+						dict["callees"] = callees
+					}
+					// Include the number of calls waiting for callees that
+					// are at their concurrency limit.
+					if len(reg.concurrency) != 0 {
+						dict["queued"] = len(reg.queue)
+					}
+					if reg.minTrust != 0 {
+						dict[wamp.OptMinTrustLevel] = reg.minTrust
+					}
+					reg.allow.addOptions(dict, allowPrefix)
+					// Include the cache statistics for a registration that
+					// caches results.
+					if reg.cache != nil {
+						dict["cache"] = wamp.Dict{
+							wamp.OptCacheTTL: reg.cacheTTL(),
+							"entries":        len(reg.cache.entries),
+							"hits":           reg.cache.hits,
+							"misses":         reg.cache.misses,
+						}
+					}
 				}
 				close(sync)
 			}
@@ -1252,8 +2916,148 @@ func (d *Dealer) RegCountCallees(msg *wamp.Invocation) wamp.Message {
 	}
 }
 
+// RegInvalidateCache removes all cached call results for a registration.
+// This is a non-standard registration meta procedure.  The number of results
+// removed is returned.
+func (d *Dealer) RegInvalidateCache(msg *wamp.Invocation) wamp.Message {
+	var count int
+	var ok bool
+	if len(msg.Arguments) != 0 {
+		var regID wamp.ID
+		if regID, ok = wamp.AsID(msg.Arguments[0]); ok {
+			sync := make(chan struct{})
+			d.actionChan <- func() {
+				if reg, found := d.registrations[regID]; found {
+					if reg.cache != nil {
+						count = reg.cache.invalidate()
+					}
+				} else {
+					ok = false
+				}
+				close(sync)
+			}
+			<-sync
+		}
+	}
+	if !ok {
+		return &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchRegistration,
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{count},
+	}
+}
+
+// RegGetStats retrieves the call statistics of a registration.  This is a
+// non-standard registration meta procedure.  The statistics count the
+// invocations sent to callees, and how each ended: successes, errors by error
+// URI, cancellations, and timeouts.  The latency, in milliseconds, of
+// successful invocations is given as a histogram.  Calls answered from the
+// result cache are not counted.
+func (d *Dealer) RegGetStats(msg *wamp.Invocation) wamp.Message {
+	var dict wamp.Dict
+	if len(msg.Arguments) != 0 {
+		if regID, ok := wamp.AsID(msg.Arguments[0]); ok {
+			sync := make(chan struct{})
+			d.actionChan <- func() {
+				if reg, ok := d.registrations[regID]; ok {
+					dict = reg.stats.dict()
+					dict["id"] = regID
+					dict["uri"] = reg.procedure
+					var pending int
+					for _, n := range reg.running {
+						pending += n
+					}
+					dict["pending"] = pending
+				}
+				close(sync)
+			}
+			<-sync
+		}
+	}
+	if dict == nil {
+		return &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchRegistration,
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
+// ----- Reflection Meta Procedure Handlers -----
+
+// ProcList retrieves a sorted list of the URIs of registered procedures,
+// including pattern-based registrations.  The router's own "wamp." meta
+// procedures are not listed.
+func (d *Dealer) ProcList(msg *wamp.Invocation) wamp.Message {
+	uris := map[wamp.URI]struct{}{}
+	sync := make(chan struct{})
+	d.actionChan <- func() {
+		for _, reg := range d.registrations {
+			if !strings.HasPrefix(string(reg.procedure), "wamp.") {
+				uris[reg.procedure] = struct{}{}
+			}
+		}
+		close(sync)
+	}
+	<-sync
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{sortedURIs(uris)},
+	}
+}
+
+// ProcDescribe retrieves the registration that a call to a procedure URI is
+// routed to, and the schema of the procedure if it has one.
+func (d *Dealer) ProcDescribe(msg *wamp.Invocation) wamp.Message {
+	var dict wamp.Dict
+	if len(msg.Arguments) != 0 {
+		if procedure, ok := wamp.AsURI(msg.Arguments[0]); ok {
+			sync := make(chan struct{})
+			d.actionChan <- func() {
+				if reg, ok := d.matchProcedure(procedure); ok {
+					dict = wamp.Dict{
+						"uri":          reg.procedure,
+						"registration": reg.id,
+						"callees":      len(reg.callees),
+						wamp.OptMatch:  reg.match,
+						wamp.OptInvoke: reg.policy,
+					}
+					if schema := d.schemaFor(reg); schema != nil {
+						dict[wamp.OptSchema] = schema.desc
+					}
+				}
+				close(sync)
+			}
+			<-sync
+		}
+	}
+	if dict == nil {
+		return &wamp.Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.ErrNoSuchProcedure,
+		}
+	}
+	return &wamp.Yield{
+		Request:   msg.Request,
+		Arguments: wamp.List{dict},
+	}
+}
+
 func (d *Dealer) trySend(sess *session, msg wamp.Message) bool {
-	if err := sess.TrySend(msg); err != nil {
+	if err := sess.send(msg); err != nil {
 		d.log.Printf("!!! Dropped %s to session %s: %s", msg.MessageType(), sess, err)
 		return false
 	}
@@ -3,6 +3,7 @@ package router
 import (
 	"errors"
 	"fmt"
+	"math"
 	"testing"
 	"time"
 
@@ -63,10 +64,11 @@ func TestBasicRegister(t *testing.T) {
 	}
 
 	// Check that dealer has the correct endpoint registered.
-	reg, ok := dealer.procRegMap[testProcedure]
+	r, ok := dealer.procMatcher.Get(testProcedure, wamp.MatchExact)
 	if !ok {
 		t.Fatal("registration not found")
 	}
+	reg := r.(*registration)
 	if len(reg.callees) != 1 {
 		t.Fatal("registration has wrong number of callees")
 	}
@@ -133,7 +135,7 @@ func TestUnregister(t *testing.T) {
 	}
 
 	// Check that dealer does not have registered endpoint
-	_, ok = dealer.procRegMap[testProcedure]
+	_, ok = dealer.procMatcher.Get(testProcedure, wamp.MatchExact)
 	if ok {
 		t.Fatal("dealer still has registeration")
 	}
@@ -235,6 +237,226 @@ func TestBasicCall(t *testing.T) {
 	}
 }
 
+func TestCallWaitCallee(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// Call procedure that is not yet registered, and wait for callee.
+	opts := wamp.SetOption(nil, wamp.OptWaitCallee, 2000)
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure, Options: opts})
+	select {
+	case rsp := <-caller.Recv():
+		t.Fatal("caller received unexpected message:", rsp.MessageType())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Register the procedure.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Test that callee received the waiting call.
+	select {
+	case rsp = <-callee.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for INVOCATION")
+	}
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	rslt, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 125 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+
+	// Test that call times out waiting for callee.
+	opts = wamp.SetOption(nil, wamp.OptWaitCallee, 100)
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 126, Procedure: "nexus.test.unregistered",
+			Options: opts})
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ERROR")
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 126 || errMsg.Error != wamp.ErrTimeout {
+		t.Fatal("expected", wamp.ErrTimeout, "for request 126")
+	}
+	if len(errMsg.Arguments) == 0 {
+		t.Fatal("expected error message argument")
+	}
+
+	// Test that a CALL timeout shorter than the wait times out the call.
+	opts = wamp.SetOption(nil, wamp.OptWaitCallee, 5000)
+	opts[wamp.OptTimeout] = 100
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 129, Procedure: "nexus.test.unregistered",
+			Options: opts})
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ERROR")
+	}
+	if errMsg, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 129 || errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("expected", wamp.ErrCanceled, "for request 129")
+	}
+
+	// Test that realm default wait applies and that caller can cancel.
+	dealer.SetWaitCallee(time.Minute)
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 127, Procedure: "nexus.test.unregistered"})
+	dealer.Cancel(callerSession, &wamp.Cancel{Request: 127})
+	rsp = <-caller.Recv()
+	if errMsg, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 127 || errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("expected", wamp.ErrCanceled, "for request 127")
+	}
+
+	// Test that waiting call is removed with caller session.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 128, Procedure: "nexus.test.unregistered"})
+	dealer.RemoveSession(callerSession)
+	sync := make(chan int)
+	dealer.actionChan <- func() {
+		sync <- len(dealer.waitingCalls)
+	}
+	if n := <-sync; n != 0 {
+		t.Fatal("waiting call not removed with caller session")
+	}
+}
+
+func TestCallWaitCalleeLimits(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+	recvError := func(req wamp.ID) *wamp.Error {
+		var rsp wamp.Message
+		select {
+		case rsp = <-caller.Recv():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for ERROR")
+		}
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Request != req {
+			t.Fatal("wrong request ID in ERROR")
+		}
+		return errMsg
+	}
+
+	// Test that invalid wait_callee is rejected.
+	for i, w := range []interface{}{-1, "abc"} {
+		req := wamp.ID(125 + i)
+		dealer.Call(callerSession, &wamp.Call{Request: req,
+			Procedure: testProcedure,
+			Options:   wamp.Dict{wamp.OptWaitCallee: w}})
+		if errMsg := recvError(req); errMsg.Error != wamp.ErrInvalidArgument {
+			t.Fatal("expected", wamp.ErrInvalidArgument, "for wait_callee", w)
+		}
+	}
+
+	// Test that the wait is limited to the maximum, and that the number of
+	// waiting calls is limited.
+	dealer.SetWaitCalleeLimits(100*time.Millisecond, 1)
+	start := time.Now()
+	opts := wamp.SetOption(nil, wamp.OptWaitCallee, 60000)
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 127, Procedure: testProcedure, Options: opts})
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 128, Procedure: testProcedure, Options: opts})
+	if errMsg := recvError(128); errMsg.Error != wamp.ErrNoSuchProcedure {
+		t.Fatal("expected", wamp.ErrNoSuchProcedure, "for request 128")
+	}
+	if errMsg := recvError(127); errMsg.Error != wamp.ErrTimeout {
+		t.Fatal("expected", wamp.ErrTimeout, "for request 127")
+	}
+	if time.Since(start) > 900*time.Millisecond {
+		t.Fatal("wait not limited to maximum")
+	}
+}
+
+func TestCallWaitCalleeRemainingTimeout(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// Call procedure that is not yet registered, with a CALL timeout.
+	opts := wamp.SetOption(nil, wamp.OptWaitCallee, 2000)
+	opts[wamp.OptTimeout] = 5000
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure, Options: opts})
+	time.Sleep(200 * time.Millisecond)
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_timeout": true,
+				},
+			},
+		},
+	}
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, calleeRoles)
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	// Test that the timeout sent to the callee excludes the time waited.
+	select {
+	case rsp = <-callee.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for INVOCATION")
+	}
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	timeout, _ := wamp.AsInt64(inv.Details[wamp.OptTimeout])
+	if timeout < 1 || timeout > 4800 {
+		t.Fatal("expected timeout reduced by time waited, got", timeout)
+	}
+	if opts[wamp.OptTimeout] != 5000 {
+		t.Fatal("CALL options were modified")
+	}
+}
+
 func TestRemovePeer(t *testing.T) {
 	dealer, metaClient := newTestDealer()
 
@@ -246,7 +468,7 @@ func TestRemovePeer(t *testing.T) {
 	rsp := <-callee.Recv()
 	regID := rsp.(*wamp.Registered).Registration
 
-	if _, ok := dealer.procRegMap[testProcedure]; !ok {
+	if _, ok := dealer.procMatcher.Get(testProcedure, wamp.MatchExact); !ok {
 		t.Fatal("dealer does not have registered procedure")
 	}
 	if _, ok := dealer.registrations[regID]; !ok {
@@ -269,7 +491,7 @@ func TestRemovePeer(t *testing.T) {
 		&wamp.Register{Request: 789, Procedure: wamp.URI("nexus.test.p2")})
 	rsp = <-callee.Recv()
 
-	if _, ok := dealer.procRegMap[testProcedure]; ok {
+	if _, ok := dealer.procMatcher.Get(testProcedure, wamp.MatchExact); ok {
 		t.Fatal("dealer still has registered procedure")
 	}
 	if _, ok := dealer.registrations[regID]; ok {
@@ -510,315 +732,281 @@ func TestCancelCallModeSkip(t *testing.T) {
 	}
 }
 
-func TestSharedRegistrationRoundRobin(t *testing.T) {
+func TestCallTimeout(t *testing.T) {
 	dealer, metaClient := newTestDealer()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
 			"callee": wamp.Dict{
 				"features": wamp.Dict{
-					"shared_registration": true,
+					"call_canceling": true,
 				},
 			},
 		},
 	}
 
-	// Register callee1 with roundrobin shared registration
-	callee1 := newTestPeer()
-	calleeSess1 := newSession(callee1, 0, calleeRoles)
-	dealer.Register(calleeSess1, &wamp.Register{
-		Request:   123,
-		Procedure: testProcedure,
-		Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
-	})
-	rsp := <-callee1.Recv()
-	regMsg, ok := rsp.(*wamp.Registered)
-	if !ok {
+	// Register a procedure.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, calleeRoles)
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
 		t.Fatal("did not receive REGISTERED response")
 	}
-	regID1 := regMsg.Registration
-	err := checkMetaReg(metaClient, calleeSess1.ID)
-	if err != nil {
-		t.Fatal("Registration meta event fail:", err)
-	}
-	if err = checkMetaReg(metaClient, calleeSess1.ID); err != nil {
-		t.Fatal("Registration meta event fail:", err)
-	}
 
-	// Register callee2 with roundrobin shared registration
-	callee2 := newTestPeer()
-	calleeSess2 := newSession(callee2, 0, calleeRoles)
-	dealer.Register(calleeSess2, &wamp.Register{
-		Request:   124,
-		Procedure: testProcedure,
-		Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
-	})
-	rsp = <-callee2.Recv()
-	regMsg, ok = rsp.(*wamp.Registered)
-	if !ok {
-		t.Fatal("did not receive REGISTERED response")
-	}
-	if err = checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
 		t.Fatal("Registration meta event fail:", err)
 	}
-	regID2 := regMsg.Registration
-
-	if regID1 != regID2 {
-		t.Fatal("procedures should have same registration")
-	}
 
-	// Test calling valid procedure
 	caller := newTestPeer()
 	callerSession := newSession(caller, 0, nil)
+
+	// Call procedure with a timeout.  The callee does not support
+	// call_timeout, so the dealer must time out the call.
+	opts := wamp.SetOption(nil, wamp.OptTimeout, 100)
 	dealer.Call(callerSession,
-		&wamp.Call{Request: 125, Procedure: testProcedure})
+		&wamp.Call{Request: 125, Procedure: testProcedure, Options: opts})
 
-	// Test that callee1 received an INVOCATION message.
-	var inv *wamp.Invocation
+	// Test that callee received an INVOCATION message without timeout.
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if _, ok = inv.Details[wamp.OptTimeout]; ok {
+		t.Fatal("timeout should not be sent to callee without call_timeout")
+	}
+
+	// callee should receive an INTERRUPT request when call times out.
 	select {
-	case rsp = <-callee1.Recv():
-		inv, ok = rsp.(*wamp.Invocation)
-		if !ok {
-			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
-		}
-	case rsp = <-callee2.Recv():
-		t.Fatal("should not have received from callee2")
+	case rsp = <-callee.Recv():
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for INVOCATION")
+		t.Fatal("timed out waiting for INTERRUPT")
 	}
-
-	// Callee responds with a YIELD message
-	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
-	// Check that caller received a RESULT message.
-	rsp = <-caller.Recv()
-	rslt, ok := rsp.(*wamp.Result)
+	interrupt, ok := rsp.(*wamp.Interrupt)
 	if !ok {
-		t.Fatal("expected RESULT, got:", rsp.MessageType())
+		t.Fatal("callee expected INTERRUPT, got:", rsp.MessageType())
 	}
-	if rslt.Request != 125 {
-		t.Fatal("wrong request ID in RESULT")
+	if interrupt.Request != inv.Request {
+		t.Fatal("INTERRUPT request ID does not match INVOCATION request ID")
 	}
 
-	// Test calling valid procedure
-	dealer.Call(callerSession,
-		&wamp.Call{Request: 126, Procedure: testProcedure})
-
-	// Test that callee2 received an INVOCATION message.
+	// Check that caller receives the ERROR message.
 	select {
-	case rsp = <-callee2.Recv():
-		inv, ok = rsp.(*wamp.Invocation)
-		if !ok {
-			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
-		}
-	case rsp = <-callee1.Recv():
-		t.Fatal("should not have received from callee1")
+	case rsp = <-caller.Recv():
 	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for INVOCATION")
+		t.Fatal("timed out waiting for ERROR")
 	}
-
-	// Callee responds with a YIELD message
-	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
-	// Check that caller received a RESULT message.
-	rsp = <-caller.Recv()
-	rslt, ok = rsp.(*wamp.Result)
+	errMsg, ok := rsp.(*wamp.Error)
 	if !ok {
-		t.Fatal("expected RESULT, got:", rsp.MessageType())
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
 	}
-	if rslt.Request != 126 {
-		t.Fatal("wrong request ID in RESULT")
+	if errMsg.Request != 125 {
+		t.Fatal("wrong request ID in ERROR, should match call ID")
+	}
+	if errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("wrong error, want", wamp.ErrCanceled, "got", errMsg.Error)
+	}
+	if len(errMsg.Arguments) == 0 || errMsg.Arguments[0] != "call timeout" {
+		t.Fatal("expected call timeout error message")
 	}
-}
 
-func TestSharedRegistrationFirst(t *testing.T) {
-	dealer, metaClient := newTestDealer()
+	// Response from callee after timeout is discarded.
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	select {
+	case msg := <-caller.Recv():
+		t.Fatal("caller received unexpected message:", msg.MessageType())
+	case <-time.After(200 * time.Millisecond):
+	}
 
-	calleeRoles := wamp.Dict{
-		"roles": wamp.Dict{
-			"callee": wamp.Dict{
-				"features": wamp.Dict{
-					"shared_registration": true,
-				},
-			},
-		},
+	sync := make(chan int)
+	dealer.actionChan <- func() {
+		sync <- len(dealer.calls) + len(dealer.invocations) + len(dealer.invocationByCall)
+	}
+	if n := <-sync; n != 0 {
+		t.Fatal("dealer did not clean up timed out call")
 	}
 
-	// Register callee1 with first shared registration
-	callee1 := newTestPeer()
-	calleeSess1 := newSession(callee1, 1111, calleeRoles)
-	dealer.Register(calleeSess1, &wamp.Register{
-		Request:   123,
-		Procedure: testProcedure,
-		Options:   wamp.SetOption(nil, "invoke", "first"),
-	})
-	rsp := <-callee1.Recv()
-	regMsg, ok := rsp.(*wamp.Registered)
-	if !ok {
-		t.Fatal("did not receive REGISTERED response")
-	}
-	regID1 := regMsg.Registration
-	err := checkMetaReg(metaClient, calleeSess1.ID)
-	if err != nil {
-		t.Fatal("Registration meta event fail:", err)
+	// Test that a call finishing before the timeout is not canceled.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 126, Procedure: testProcedure, Options: opts})
+	rsp = <-callee.Recv()
+	inv = rsp.(*wamp.Invocation)
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if _, ok = rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
 	}
-	if err = checkMetaReg(metaClient, calleeSess1.ID); err != nil {
-		t.Fatal("Registration meta event fail:", err)
+	select {
+	case msg := <-callee.Recv():
+		t.Fatal("callee received unexpected message:", msg.MessageType())
+	case msg := <-caller.Recv():
+		t.Fatal("caller received unexpected message:", msg.MessageType())
+	case <-time.After(200 * time.Millisecond):
 	}
+}
 
-	// Register callee2 with roundrobin shared registration
-	callee2 := newTestPeer()
-	calleeSess2 := newSession(callee2, 2222, calleeRoles)
-	dealer.Register(calleeSess2, &wamp.Register{
-		Request:   1233,
-		Procedure: testProcedure,
-		Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
-	})
-	rsp = <-callee2.Recv()
-	_, ok = rsp.(*wamp.Error)
-	if !ok {
-		t.Fatal("expected ERROR response")
-	}
+func TestProgressiveCallInvocations(t *testing.T) {
+	dealer, metaClient := newTestDealer()
 
-	// Register callee2 with "first" shared registration
-	dealer.Register(calleeSess2, &wamp.Register{
-		Request:   124,
-		Procedure: testProcedure,
-		Options:   wamp.SetOption(nil, "invoke", "first"),
-	})
-	select {
-	case rsp = <-callee2.Recv():
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for REGISTERED")
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"progressive_call_invocations": true,
+				},
+			},
+		},
 	}
 
-	if regMsg, ok = rsp.(*wamp.Registered); !ok {
+	// Register a procedure.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, calleeRoles)
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
 		t.Fatal("did not receive REGISTERED response")
 	}
-	regID2 := regMsg.Registration
-	if err = checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
 		t.Fatal("Registration meta event fail:", err)
 	}
-
-	if regID1 != regID2 {
-		t.Fatal("procedures should have same registration")
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
 	}
 
-	// Test calling valid procedure
 	caller := newTestPeer()
-	callerSession := newSession(caller, 333, nil)
-	dealer.Call(callerSession,
-		&wamp.Call{Request: 125, Procedure: testProcedure})
+	callerSession := newSession(caller, 0, nil)
 
-	// Test that callee1 received an INVOCATION message.
-	var inv *wamp.Invocation
-	select {
-	case rsp = <-callee1.Recv():
-		inv, ok = rsp.(*wamp.Invocation)
+	// Send the caller input as three CALL messages with the same request ID.
+	var invID wamp.ID
+	for i := 1; i <= 3; i++ {
+		opts := wamp.Dict{}
+		if i < 3 {
+			opts[wamp.OptProgress] = true
+		}
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   125,
+			Procedure: testProcedure,
+			Options:   opts,
+			Arguments: wamp.List{i},
+		})
+
+		// Test that callee received each as an INVOCATION for the same call.
+		rsp = <-callee.Recv()
+		inv, ok := rsp.(*wamp.Invocation)
 		if !ok {
 			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
 		}
-	case rsp = <-callee2.Recv():
-		t.Fatal("should not have received from callee2")
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for INVOCATION")
+		if i == 1 {
+			invID = inv.Request
+		} else if inv.Request != invID {
+			t.Fatal("progressive INVOCATION has wrong request ID")
+		}
+		if len(inv.Arguments) == 0 || inv.Arguments[0] != i {
+			t.Fatal("wrong arguments in INVOCATION:", inv.Arguments)
+		}
+		progress, _ := inv.Details[wamp.OptProgress].(bool)
+		if progress != (i < 3) {
+			t.Fatal("wrong progress in INVOCATION", i)
+		}
 	}
 
-	// Callee1 responds with a YIELD message
-	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
-
-	// Check that caller received a RESULT message.
-	select {
-	case rsp = <-caller.Recv():
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
-	}
-	rslt, ok := rsp.(*wamp.Result)
+	// Callee responds with a YIELD message.
+	dealer.Yield(calleeSess, &wamp.Yield{Request: invID})
+	rsp = <-caller.Recv()
+	result, ok := rsp.(*wamp.Result)
 	if !ok {
 		t.Fatal("expected RESULT, got:", rsp.MessageType())
 	}
-	if rslt.Request != 125 {
+	if result.Request != 125 {
 		t.Fatal("wrong request ID in RESULT")
 	}
 
-	// Test calling valid procedure
-	dealer.Call(callerSession,
-		&wamp.Call{Request: 126, Procedure: testProcedure})
-
-	// Test that callee1 received an INVOCATION message.
-	select {
-	case rsp = <-callee1.Recv():
-		inv, ok = rsp.(*wamp.Invocation)
-		if !ok {
-			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
-		}
-	case rsp = <-callee2.Recv():
-		t.Fatal("should not have received from callee2")
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for INVOCATION")
+	// Start another progressive call and have the callee yield before the
+	// caller has sent all of its input.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   126,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if _, ok = rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
 	}
 
-	// Callee responds with a YIELD message
-	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
-
-	// Check that caller received a RESULT message.
-	select {
-	case rsp = <-caller.Recv():
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
+	// Remaining input for the ended call must not start a new call.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   126,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   126,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{},
+	})
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   128,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{},
+	})
+	rsp = <-callee.Recv()
+	if inv, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
 	}
-	rslt, ok = rsp.(*wamp.Result)
-	if !ok {
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if result, ok = rsp.(*wamp.Result); !ok {
 		t.Fatal("expected RESULT, got:", rsp.MessageType())
 	}
-	if rslt.Request != 126 {
-		t.Fatal("wrong request ID in RESULT")
+	if result.Request != 128 {
+		t.Fatal("input for ended call was not discarded")
 	}
 
-	// Remove callee1
-	dealer.RemoveSession(calleeSess1)
-	if err = checkMetaReg(metaClient, calleeSess1.ID); err != nil {
-		t.Fatal("Registration meta event fail:", err)
-	}
-	if err = checkMetaReg(metaClient, calleeSess1.ID); err == nil {
-		t.Fatal("Expected error")
+	// A callee that does not support progressive call invocations cannot be
+	// sent a progressive call.
+	const plainProcedure = wamp.URI("nexus.test.plain")
+	plainCallee := newTestPeer()
+	plainSess := newSession(plainCallee, 0, nil)
+	dealer.Register(plainSess,
+		&wamp.Register{Request: 129, Procedure: plainProcedure})
+	rsp = <-plainCallee.Recv()
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
 	}
-
-	// Test calling valid procedure
-	dealer.Call(callerSession,
-		&wamp.Call{Request: 127, Procedure: testProcedure})
-
-	// Test that callee2 received an INVOCATION message.
-	select {
-	case rsp = <-callee2.Recv():
-		inv, ok = rsp.(*wamp.Invocation)
-		if !ok {
-			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
-		}
-	case rsp = <-callee1.Recv():
-		t.Fatal("should not have received from callee1")
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for INVOCATION")
+	if err := checkMetaReg(metaClient, plainSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
 	}
-
-	// Callee responds with a YIELD message
-	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
-
-	// Check that caller received a RESULT message.
-	select {
-	case rsp = <-caller.Recv():
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for RESULT")
+	if err := checkMetaReg(metaClient, plainSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
 	}
 
-	rslt, ok = rsp.(*wamp.Result)
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   130,
+		Procedure: plainProcedure,
+		Options:   wamp.Dict{wamp.OptProgress: true},
+	})
+	rsp = <-caller.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
 	if !ok {
-		t.Fatal("expected RESULT, got:", rsp.MessageType())
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
 	}
-	if rslt.Request != 127 {
-		t.Fatal("wrong request ID in RESULT")
+	if errMsg.Error != wamp.ErrFeatureNotSupported {
+		t.Fatal("wrong error, want", wamp.ErrFeatureNotSupported, "got",
+			errMsg.Error)
 	}
 }
 
-func TestSharedRegistrationLast(t *testing.T) {
+func TestSharedRegistrationRoundRobin(t *testing.T) {
 	dealer, metaClient := newTestDealer()
 
 	calleeRoles := wamp.Dict{
@@ -831,19 +1019,20 @@ func TestSharedRegistrationLast(t *testing.T) {
 		},
 	}
 
-	// Register callee1 with last shared registration
+	// Register callee1 with roundrobin shared registration
 	callee1 := newTestPeer()
 	calleeSess1 := newSession(callee1, 0, calleeRoles)
 	dealer.Register(calleeSess1, &wamp.Register{
 		Request:   123,
 		Procedure: testProcedure,
-		Options:   wamp.SetOption(nil, "invoke", "last"),
+		Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
 	})
 	rsp := <-callee1.Recv()
-	_, ok := rsp.(*wamp.Registered)
+	regMsg, ok := rsp.(*wamp.Registered)
 	if !ok {
 		t.Fatal("did not receive REGISTERED response")
 	}
+	regID1 := regMsg.Registration
 	err := checkMetaReg(metaClient, calleeSess1.ID)
 	if err != nil {
 		t.Fatal("Registration meta event fail:", err)
@@ -852,21 +1041,27 @@ func TestSharedRegistrationLast(t *testing.T) {
 		t.Fatal("Registration meta event fail:", err)
 	}
 
-	// Register callee2 with last shared registration
+	// Register callee2 with roundrobin shared registration
 	callee2 := newTestPeer()
 	calleeSess2 := newSession(callee2, 0, calleeRoles)
 	dealer.Register(calleeSess2, &wamp.Register{
 		Request:   124,
 		Procedure: testProcedure,
-		Options:   wamp.SetOption(nil, "invoke", "last"),
+		Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
 	})
 	rsp = <-callee2.Recv()
-	if _, ok = rsp.(*wamp.Registered); !ok {
+	regMsg, ok = rsp.(*wamp.Registered)
+	if !ok {
 		t.Fatal("did not receive REGISTERED response")
 	}
 	if err = checkMetaReg(metaClient, calleeSess2.ID); err != nil {
 		t.Fatal("Registration meta event fail:", err)
 	}
+	regID2 := regMsg.Registration
+
+	if regID1 != regID2 {
+		t.Fatal("procedures should have same registration")
+	}
 
 	// Test calling valid procedure
 	caller := newTestPeer()
@@ -874,22 +1069,22 @@ func TestSharedRegistrationLast(t *testing.T) {
 	dealer.Call(callerSession,
 		&wamp.Call{Request: 125, Procedure: testProcedure})
 
-	// Test that callee2 received an INVOCATION message.
+	// Test that callee1 received an INVOCATION message.
 	var inv *wamp.Invocation
 	select {
-	case rsp = <-callee2.Recv():
+	case rsp = <-callee1.Recv():
 		inv, ok = rsp.(*wamp.Invocation)
 		if !ok {
 			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
 		}
-	case rsp = <-callee1.Recv():
-		t.Fatal("should not have received from callee1")
+	case rsp = <-callee2.Recv():
+		t.Fatal("should not have received from callee2")
 	case <-time.After(time.Second):
 		t.Fatal("Timed out waiting for INVOCATION")
 	}
 
 	// Callee responds with a YIELD message
-	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
+	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
 	// Check that caller received a RESULT message.
 	rsp = <-caller.Recv()
 	rslt, ok := rsp.(*wamp.Result)
@@ -928,72 +1123,2177 @@ func TestSharedRegistrationLast(t *testing.T) {
 	if rslt.Request != 126 {
 		t.Fatal("wrong request ID in RESULT")
 	}
+}
 
-	// Remove callee2
-	dealer.RemoveSession(calleeSess2)
-	if err = checkMetaReg(metaClient, calleeSess2.ID); err != nil {
-		t.Fatal("Registration meta event fail:", err)
-	}
-	if err = checkMetaReg(metaClient, calleeSess1.ID); err == nil {
-		t.Fatal("Expected error")
-	}
+func TestSharedRegistrationLeastBusy(t *testing.T) {
+	dealer, metaClient := newTestDealer()
 
-	// Test calling valid procedure
-	dealer.Call(callerSession,
-		&wamp.Call{Request: 127, Procedure: testProcedure})
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
 
-	// Test that callee1 received an INVOCATION message.
-	select {
-	case rsp = <-callee1.Recv():
-		inv, ok = rsp.(*wamp.Invocation)
+	// Register callee1 with leastbusy shared registration
+	callee1 := newTestPeer()
+	calleeSess1 := newSession(callee1, 0, calleeRoles)
+	dealer.Register(calleeSess1, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "leastbusy"),
+	})
+	rsp := <-callee1.Recv()
+	regID := rsp.(*wamp.Registered).Registration
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Register callee2 with leastbusy shared registration
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, calleeRoles)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "leastbusy"),
+	})
+	rsp = <-callee2.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	recvInvocation := func(expect, other *testPeer) *wamp.Invocation {
+		select {
+		case rsp = <-expect.Recv():
+		case rsp = <-other.Recv():
+			t.Fatal("INVOCATION sent to wrong callee")
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for INVOCATION")
+		}
+		inv, ok := rsp.(*wamp.Invocation)
 		if !ok {
 			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
 		}
-	case rsp = <-callee2.Recv():
-		t.Fatal("should not have received from callee2")
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for INVOCATION")
+		return inv
+	}
+
+	// Both callees are idle, so calls are distributed to each.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure})
+	recvInvocation(callee1, callee2)
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 126, Procedure: testProcedure})
+	inv := recvInvocation(callee2, callee1)
+
+	// callee2 finishes its call, so is now less busy than callee1.
+	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if _, ok := rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+
+	// Next call must go to callee2 even though it is callee1's turn.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 127, Procedure: testProcedure})
+	recvInvocation(callee2, callee1)
+
+	// Check that registration meta info shows load of each callee.
+	metaRsp := dealer.RegGet(&wamp.Invocation{
+		Request: 1, Arguments: wamp.List{regID}})
+	dict := metaRsp.(*wamp.Yield).Arguments[0].(wamp.Dict)
+	if dict[wamp.OptInvoke] != wamp.InvokeLeastBusy {
+		t.Fatal("wrong invocation policy in registration info")
+	}
+	callees := dict["callees"].([]wamp.Dict)
+	if len(callees) != 2 {
+		t.Fatal("expected info for 2 callees")
+	}
+	for i := range callees {
+		if callees[i]["invocations"] != 1 {
+			t.Fatal("wrong number of invocations for callee",
+				callees[i]["session"])
+		}
+	}
+}
+
+func TestSharedRegistrationWeighted(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// Register callee1 with weighted shared registration
+	callee1 := newTestPeer()
+	calleeSess1 := newSession(callee1, 0, calleeRoles)
+	opts := wamp.Dict{"invoke": "weighted", "weight": 3}
+	dealer.Register(calleeSess1, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   opts,
+	})
+	rsp := <-callee1.Recv()
+	regID := rsp.(*wamp.Registered).Registration
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Test that invalid weights are rejected.
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, calleeRoles)
+	for _, weight := range []int64{0, maxCalleeWeight + 1, math.MaxInt64} {
+		opts = wamp.Dict{"invoke": "weighted", "weight": weight}
+		dealer.Register(calleeSess2, &wamp.Register{
+			Request:   124,
+			Procedure: testProcedure,
+			Options:   opts,
+		})
+		rsp = <-callee2.Recv()
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
+		if errMsg.Error != wamp.ErrInvalidArgument {
+			t.Fatal("wrong error for weight", weight, "want",
+				wamp.ErrInvalidArgument, "got", errMsg.Error)
+		}
+	}
+
+	// Register callee2 with default weight.
+	opts = wamp.Dict{"invoke": "weighted"}
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   125,
+		Procedure: testProcedure,
+		Options:   opts,
+	})
+	rsp = <-callee2.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// Make calls and count how many are sent to each callee.
+	var count1, count2 int
+	for i := 0; i < 200; i++ {
+		dealer.Call(callerSession,
+			&wamp.Call{Request: wamp.ID(200 + i), Procedure: testProcedure})
+		var inv *wamp.Invocation
+		select {
+		case rsp = <-callee1.Recv():
+			inv = rsp.(*wamp.Invocation)
+			dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
+			count1++
+		case rsp = <-callee2.Recv():
+			inv = rsp.(*wamp.Invocation)
+			dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
+			count2++
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for INVOCATION")
+		}
+		<-caller.Recv()
+	}
+	if count2 == 0 || count1 <= count2 {
+		t.Fatal("calls not distributed according to weight:", count1, count2)
+	}
+
+	// Check that registration meta info shows weight of each callee.
+	metaRsp := dealer.RegGet(&wamp.Invocation{
+		Request: 1, Arguments: wamp.List{regID}})
+	dict := metaRsp.(*wamp.Yield).Arguments[0].(wamp.Dict)
+	callees := dict["callees"].([]wamp.Dict)
+	if len(callees) != 2 {
+		t.Fatal("expected info for 2 callees")
+	}
+	if callees[0]["weight"] != int64(3) || callees[1]["weight"] != int64(1) {
+		t.Fatal("wrong callee weights in registration info")
+	}
+}
+
+func TestShardedRegistration(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register callee1 owning shards "a" and "b".
+	callee1 := newTestPeer()
+	calleeSess1 := newSession(callee1, 0, nil)
+	dealer.Register(calleeSess1, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			"invoke": "sharded",
+			"shards": wamp.List{"a", "b"},
+		},
+	})
+	rsp := <-callee1.Recv()
+	regID := rsp.(*wamp.Registered).Registration
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Register callee2 owning shard "c".
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			"invoke": "sharded",
+			"shards": wamp.List{"c"},
+		},
+	})
+	rsp = <-callee2.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Test that registering a shard that is already owned fails.
+	callee3 := newTestPeer()
+	calleeSess3 := newSession(callee3, 0, nil)
+	dealer.Register(calleeSess3, &wamp.Register{
+		Request:   125,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			"invoke": "sharded",
+			"shards": wamp.List{"c", "d"},
+		},
+	})
+	rsp = <-callee3.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error, want", wamp.ErrInvalidArgument, "got",
+			errMsg.Error)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// Test that call without rkey fails.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 126, Procedure: testProcedure})
+	rsp = <-caller.Recv()
+	if errMsg, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error, want", wamp.ErrInvalidArgument, "got",
+			errMsg.Error)
+	}
+
+	// callRKey calls the procedure and returns the session that was invoked.
+	reqID := wamp.ID(200)
+	callRKey := func(rkey interface{}) *session {
+		reqID++
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   reqID,
+			Procedure: testProcedure,
+			Options:   wamp.Dict{"rkey": rkey},
+		})
+		var calleeSess *session
+		select {
+		case rsp = <-callee1.Recv():
+			calleeSess = calleeSess1
+		case rsp = <-callee2.Recv():
+			calleeSess = calleeSess2
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for INVOCATION")
+		}
+		inv := rsp.(*wamp.Invocation)
+		dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+		<-caller.Recv()
+		return calleeSess
+	}
+
+	// Test that calls for owned shard keys go to the owning callee.
+	if callRKey("a") != calleeSess1 || callRKey("b") != calleeSess1 {
+		t.Fatal("call for shard a or b not routed to callee1")
+	}
+	if callRKey("c") != calleeSess2 {
+		t.Fatal("call for shard c not routed to callee2")
+	}
+
+	// Test that other keys are routed consistently to the same callee.
+	for i := 0; i < 20; i++ {
+		rkey := fmt.Sprint("customer-", i)
+		if callRKey(rkey) != callRKey(rkey) {
+			t.Fatal("call for", rkey, "not routed to same callee")
+		}
+	}
+	if callRKey(42) != callRKey("42") {
+		t.Fatal("numeric rkey not routed same as string rkey")
+	}
+
+	// Check that registration meta info shows shards of each callee.
+	metaRsp := dealer.RegGet(&wamp.Invocation{
+		Request: 1, Arguments: wamp.List{regID}})
+	dict := metaRsp.(*wamp.Yield).Arguments[0].(wamp.Dict)
+	callees := dict["callees"].([]wamp.Dict)
+	if len(callees) != 2 {
+		t.Fatal("expected info for 2 callees")
+	}
+	if keys := callees[0]["shards"].([]string); len(keys) != 2 {
+		t.Fatal("wrong shards for callee1:", keys)
+	}
+
+	// Remove callee2 and check that its shard is routed to callee1.
+	dealer.RemoveSession(calleeSess2)
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if callRKey("c") != calleeSess1 {
+		t.Fatal("call for shard c not routed to callee1")
+	}
+}
+
+func TestShardRing(t *testing.T) {
+	sess1 := newSession(nil, 0, nil)
+	sess2 := newSession(nil, 0, nil)
+	sess3 := newSession(nil, 0, nil)
+	ring := newShardRing()
+	if ring.lookup("x") != nil {
+		t.Fatal("empty ring should not have owner")
+	}
+	ring.add(sess1, []string{"s1"})
+	ring.add(sess2, []string{"s2"})
+	ring.add(sess3, []string{"s3"})
+
+	// Record owners of many keys.
+	owners := map[string]*session{}
+	counts := map[*session]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		owners[key] = ring.lookup(key)
+		counts[owners[key]]++
+	}
+	for _, sess := range []*session{sess1, sess2, sess3} {
+		if counts[sess] < 100 {
+			t.Fatal("keys not distributed to session", sess, counts[sess])
+		}
+	}
+
+	// Removing a callee must only move the keys it owned.
+	ring.remove(sess2)
+	for key, owner := range owners {
+		newOwner := ring.lookup(key)
+		if newOwner == sess2 {
+			t.Fatal("key routed to removed session")
+		}
+		if owner != sess2 && newOwner != owner {
+			t.Fatal("key", key, "moved from session that was not removed")
+		}
+	}
+}
+
+func TestSharedRegistrationFirst(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// Register callee1 with first shared registration
+	callee1 := newTestPeer()
+	calleeSess1 := newSession(callee1, 1111, calleeRoles)
+	dealer.Register(calleeSess1, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "first"),
+	})
+	rsp := <-callee1.Recv()
+	regMsg, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	regID1 := regMsg.Registration
+	err := checkMetaReg(metaClient, calleeSess1.ID)
+	if err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err = checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Register callee2 with roundrobin shared registration
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 2222, calleeRoles)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   1233,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "roundrobin"),
+	})
+	rsp = <-callee2.Recv()
+	_, ok = rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR response")
+	}
+
+	// Register callee2 with "first" shared registration
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "first"),
+	})
+	select {
+	case rsp = <-callee2.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for REGISTERED")
+	}
+
+	if regMsg, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	regID2 := regMsg.Registration
+	if err = checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	if regID1 != regID2 {
+		t.Fatal("procedures should have same registration")
+	}
+
+	// Test calling valid procedure
+	caller := newTestPeer()
+	callerSession := newSession(caller, 333, nil)
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure})
+
+	// Test that callee1 received an INVOCATION message.
+	var inv *wamp.Invocation
+	select {
+	case rsp = <-callee1.Recv():
+		inv, ok = rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	case rsp = <-callee2.Recv():
+		t.Fatal("should not have received from callee2")
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+
+	// Callee1 responds with a YIELD message
+	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
+
+	// Check that caller received a RESULT message.
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	rslt, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 125 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+
+	// Test calling valid procedure
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 126, Procedure: testProcedure})
+
+	// Test that callee1 received an INVOCATION message.
+	select {
+	case rsp = <-callee1.Recv():
+		inv, ok = rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	case rsp = <-callee2.Recv():
+		t.Fatal("should not have received from callee2")
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+
+	// Callee responds with a YIELD message
+	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
+
+	// Check that caller received a RESULT message.
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	}
+	rslt, ok = rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 126 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+
+	// Remove callee1
+	dealer.RemoveSession(calleeSess1)
+	if err = checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err = checkMetaReg(metaClient, calleeSess1.ID); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	// Test calling valid procedure
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 127, Procedure: testProcedure})
+
+	// Test that callee2 received an INVOCATION message.
+	select {
+	case rsp = <-callee2.Recv():
+		inv, ok = rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	case rsp = <-callee1.Recv():
+		t.Fatal("should not have received from callee1")
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+
+	// Callee responds with a YIELD message
+	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
+
+	// Check that caller received a RESULT message.
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for RESULT")
+	}
+
+	rslt, ok = rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 127 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+}
+
+func TestSharedRegistrationLast(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// Register callee1 with last shared registration
+	callee1 := newTestPeer()
+	calleeSess1 := newSession(callee1, 0, calleeRoles)
+	dealer.Register(calleeSess1, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "last"),
+	})
+	rsp := <-callee1.Recv()
+	_, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	err := checkMetaReg(metaClient, calleeSess1.ID)
+	if err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err = checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Register callee2 with last shared registration
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, calleeRoles)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.SetOption(nil, "invoke", "last"),
+	})
+	rsp = <-callee2.Recv()
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err = checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Test calling valid procedure
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure})
+
+	// Test that callee2 received an INVOCATION message.
+	var inv *wamp.Invocation
+	select {
+	case rsp = <-callee2.Recv():
+		inv, ok = rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	case rsp = <-callee1.Recv():
+		t.Fatal("should not have received from callee1")
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+
+	// Callee responds with a YIELD message
+	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
+	// Check that caller received a RESULT message.
+	rsp = <-caller.Recv()
+	rslt, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 125 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+
+	// Test calling valid procedure
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 126, Procedure: testProcedure})
+
+	// Test that callee2 received an INVOCATION message.
+	select {
+	case rsp = <-callee2.Recv():
+		inv, ok = rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	case rsp = <-callee1.Recv():
+		t.Fatal("should not have received from callee1")
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+
+	// Callee responds with a YIELD message
+	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
+	// Check that caller received a RESULT message.
+	rsp = <-caller.Recv()
+	rslt, ok = rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 126 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+
+	// Remove callee2
+	dealer.RemoveSession(calleeSess2)
+	if err = checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err = checkMetaReg(metaClient, calleeSess1.ID); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	// Test calling valid procedure
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 127, Procedure: testProcedure})
+
+	// Test that callee1 received an INVOCATION message.
+	select {
+	case rsp = <-callee1.Recv():
+		inv, ok = rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+	case rsp = <-callee2.Recv():
+		t.Fatal("should not have received from callee2")
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for INVOCATION")
+	}
+
+	// Callee responds with a YIELD message
+	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
+	// Check that caller received a RESULT message.
+	rsp = <-caller.Recv()
+	rslt, ok = rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 127 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+}
+
+func TestPatternBasedRegistration(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"shared_registration": true,
+				},
+			},
+		},
+	}
+
+	// Register a procedure with wildcard match.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, calleeRoles)
+	dealer.Register(calleeSess,
+		&wamp.Register{
+			Request:   123,
+			Procedure: testProcedureWC,
+			Options: wamp.Dict{
+				wamp.OptMatch: wamp.MatchWildcard,
+			},
+		})
+	rsp := <-callee.Recv()
+	_, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// Test calling valid procedure with full name.  Widlcard should match.
+	dealer.Call(callerSession,
+		&wamp.Call{Request: 125, Procedure: testProcedure})
+
+	// Test that callee received an INVOCATION message.
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	details, ok := wamp.AsDict(inv.Details)
+	if !ok {
+		t.Fatal("INVOCATION missing details")
+	}
+	proc, _ := wamp.AsURI(details[wamp.OptProcedure])
+	if proc != testProcedure {
+		t.Error("INVOCATION has missing or incorrect procedure detail")
+	}
+
+	// Callee responds with a YIELD message
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	// Check that caller received a RESULT message.
+	rsp = <-caller.Recv()
+	rslt, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if rslt.Request != 125 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+}
+
+func TestCallFailover(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register two callees for a shared registration with failover.
+	opts := wamp.Dict{
+		wamp.OptInvoke:   wamp.InvokeRoundRobin,
+		wamp.OptFailover: true,
+	}
+	callee1 := newTestPeer()
+	calleeSess1 := newSession(callee1, 0, nil)
+	dealer.Register(calleeSess1,
+		&wamp.Register{Request: 123, Procedure: testProcedure, Options: opts})
+	rsp := <-callee1.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2,
+		&wamp.Register{Request: 124, Procedure: testProcedure, Options: opts})
+	rsp = <-callee2.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// Block the first callee so that the INVOCATION cannot be sent to it.
+	callee1.Send(&wamp.Goodbye{})
+
+	// The call must fail over to the second callee.
+	dealer.Call(callerSession, &wamp.Call{Request: 125, Procedure: testProcedure})
+	rsp = <-callee2.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.Yield(calleeSess2, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if _, ok = rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+
+	// Unblock the first callee.
+	<-callee1.Recv()
+
+	// Call is sent to the second callee, which then leaves.  The call must
+	// fail over to the first callee, with the same invocation ID.
+	dealer.Call(callerSession, &wamp.Call{Request: 126, Procedure: testProcedure})
+	rsp = <-callee2.Recv()
+	if inv, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.RemoveSession(calleeSess2)
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	rsp = <-callee1.Recv()
+	inv1, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if inv1.Request != inv.Request {
+		t.Fatal("failover INVOCATION has different request ID")
+	}
+	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv1.Request})
+	rsp = <-caller.Recv()
+	result, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if result.Request != 126 {
+		t.Fatal("wrong request ID in RESULT")
+	}
+
+	// The caller can disable failover.  When the callee leaves, the caller
+	// gets an ERROR.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   127,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptFailover: false},
+	})
+	rsp = <-callee1.Recv()
+	if _, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	dealer.RemoveSession(calleeSess1)
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess1.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	rsp = <-caller.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 127 {
+		t.Fatal("wrong request ID in ERROR")
+	}
+	if errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("wrong error, want", wamp.ErrCanceled, "got", errMsg.Error)
+	}
+
+	// Failover is not allowed for a sharded registration.
+	dealer.Register(calleeSess1, &wamp.Register{
+		Request:   128,
+		Procedure: "nexus.test.sharded",
+		Options: wamp.Dict{
+			wamp.OptInvoke:   wamp.InvokeSharded,
+			wamp.OptFailover: true,
+		},
+	})
+	rsp = <-callee1.Recv()
+	if errMsg, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong error, want", wamp.ErrInvalidArgument, "got",
+			errMsg.Error)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register a procedure that handles one call at a time, and queues at
+	// most one call.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	opts := wamp.Dict{
+		wamp.OptConcurrency: 1,
+		wamp.OptQueueLimit:  1,
+	}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure, Options: opts})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	recvInvocation := func(req int) *wamp.Invocation {
+		select {
+		case rsp = <-callee.Recv():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for INVOCATION")
+		}
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		if len(inv.Arguments) == 0 || inv.Arguments[0] != req {
+			t.Fatal("INVOCATION for wrong call:", inv.Arguments)
+		}
+		return inv
+	}
+	recvCaller := func(req wamp.ID) wamp.Message {
+		select {
+		case rsp = <-caller.Recv():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for response to caller")
+		}
+		switch msg := rsp.(type) {
+		case *wamp.Result:
+			if msg.Request != req {
+				t.Fatal("wrong request ID in RESULT")
+			}
+		case *wamp.Error:
+			if msg.Request != req {
+				t.Fatal("wrong request ID in ERROR")
+			}
+		}
+		return rsp
+	}
+
+	// First call is sent to the callee.
+	dealer.Call(callerSession, &wamp.Call{Request: 125,
+		Procedure: testProcedure, Arguments: wamp.List{125}})
+	inv := recvInvocation(125)
+
+	// Second call is queued, and third call is rejected since queue is full.
+	dealer.Call(callerSession, &wamp.Call{Request: 126,
+		Procedure: testProcedure, Arguments: wamp.List{126}})
+	dealer.Call(callerSession, &wamp.Call{Request: 127,
+		Procedure: testProcedure, Arguments: wamp.List{127}})
+	errMsg, ok := recvCaller(127).(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrCallQueueFull {
+		t.Fatal("wrong error, want", wamp.ErrCallQueueFull, "got",
+			errMsg.Error)
+	}
+
+	// Check that registration reports the queued call.
+	regID := inv.Registration
+	metaRsp := dealer.RegGet(&wamp.Invocation{
+		Request:   wamp.GlobalID(),
+		Arguments: wamp.List{regID},
+	})
+	yield, ok := metaRsp.(*wamp.Yield)
+	if !ok {
+		t.Fatal("expected YIELD from registration get, got:",
+			metaRsp.MessageType())
+	}
+	if dict := yield.Arguments[0].(wamp.Dict); dict["queued"] != 1 {
+		t.Fatal("expected 1 queued call, got", dict["queued"])
+	}
+
+	// When the first call finishes, the queued call is sent to the callee.
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if _, ok = recvCaller(125).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	inv = recvInvocation(126)
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if _, ok = recvCaller(126).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+
+	// Canceling a queued call removes it from the queue.
+	dealer.Call(callerSession, &wamp.Call{Request: 128,
+		Procedure: testProcedure, Arguments: wamp.List{128}})
+	inv = recvInvocation(128)
+	dealer.Call(callerSession, &wamp.Call{Request: 129,
+		Procedure: testProcedure, Arguments: wamp.List{129}})
+	dealer.Cancel(callerSession, &wamp.Cancel{Request: 129})
+	if errMsg, ok = recvCaller(129).(*wamp.Error); !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("wrong error, want", wamp.ErrCanceled, "got", errMsg.Error)
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if _, ok = recvCaller(128).(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	dealer.Call(callerSession, &wamp.Call{Request: 130,
+		Procedure: testProcedure, Arguments: wamp.List{130}})
+	recvInvocation(130)
+
+	// Progressive call is not queued, even if the queue is empty.
+	dealer.Call(callerSession, &wamp.Call{Request: 131,
+		Procedure: testProcedure, Options: wamp.Dict{wamp.OptProgress: true}})
+	if errMsg, ok = recvCaller(131).(*wamp.Error); !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrCalleesBusy {
+		t.Fatal("wrong error, want", wamp.ErrCalleesBusy, "got", errMsg.Error)
+	}
+
+	// Callee cannot join the registration with a different queue limit.
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2, &wamp.Register{Request: 200,
+		Procedure: testProcedure, Options: wamp.Dict{wamp.OptQueueLimit: 5}})
+	rsp = <-callee2.Recv()
+	if errMsg, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("wrong error, want", wamp.ErrProcedureAlreadyExists, "got",
+			errMsg.Error)
+	}
+}
+
+func TestCallSlowCallee(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	// Register a callee whose slow-consumer policy queues one message that
+	// does not fit in its peer's queue.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	calleeSess.out = newOutQueue(callee, SlowConsumerPolicy{
+		Policy:    SlowConsumerDropOldest,
+		QueueSize: 1,
+	}, nil, nil)
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	// Pretend the overflow queue is already draining, so that the callee's
+	// messages are held in it.  The first INVOCATION fills the overflow
+	// queue.  The second cannot be queued without dropping an INVOCATION, so
+	// its call fails.
+	q := calleeSess.out
+	q.mu.Lock()
+	q.drainDone = make(chan struct{})
+	q.mu.Unlock()
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+	for _, req := range []wamp.ID{125, 126} {
+		dealer.Call(callerSession, &wamp.Call{Request: req,
+			Procedure: testProcedure, Arguments: wamp.List{req}})
+	}
+	select {
+	case rsp = <-caller.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ERROR")
+	}
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 126 || errMsg.Error != wamp.ErrNetworkFailure {
+		t.Fatal("expected", wamp.ErrNetworkFailure, "for request 126, got",
+			errMsg.Error, "for", errMsg.Request)
+	}
+
+	// Check that the callee receives the INVOCATION of the first call.
+	done := make(chan struct{})
+	q.mu.Lock()
+	q.drainDone = done
+	q.mu.Unlock()
+	go q.drain(done)
+	select {
+	case rsp = <-callee.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for INVOCATION")
+	}
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if len(inv.Arguments) == 0 || inv.Arguments[0] != wamp.ID(125) {
+		t.Fatal("INVOCATION for wrong call:", inv.Arguments)
+	}
+	q.close()
+}
+
+func TestCancelQueuedCall(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	// Register a procedure that handles one call at a time.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	opts := wamp.Dict{wamp.OptConcurrency: 1}
+	dealer.Register(calleeSess,
+		&wamp.Register{Request: 123, Procedure: testProcedure, Options: opts})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// First call is sent to the callee, and the next two are queued.
+	for _, req := range []wamp.ID{125, 126, 127} {
+		dealer.Call(callerSession, &wamp.Call{Request: req,
+			Procedure: testProcedure, Arguments: wamp.List{req}})
+	}
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	// Cancel the second queued call.
+	dealer.Cancel(callerSession, &wamp.Cancel{Request: 127})
+	rsp = <-caller.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Request != 127 || errMsg.Error != wamp.ErrCanceled {
+		t.Fatal("expected", wamp.ErrCanceled, "for request 127")
+	}
+
+	// Check that the first queued call is still sent to the callee.
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if rslt, ok := rsp.(*wamp.Result); !ok || rslt.Request != 125 {
+		t.Fatal("expected RESULT for request 125")
+	}
+	select {
+	case rsp = <-callee.Recv():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for INVOCATION")
+	}
+	if inv, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if len(inv.Arguments) == 0 || inv.Arguments[0] != wamp.ID(126) {
+		t.Fatal("INVOCATION for wrong call:", inv.Arguments)
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if rslt, ok := rsp.(*wamp.Result); !ok || rslt.Request != 126 {
+		t.Fatal("expected RESULT for request 126")
+	}
+	select {
+	case rsp = <-callee.Recv():
+		t.Fatal("callee received unexpected message:", rsp.MessageType())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFanoutCall(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	calleeRoles := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"call_canceling": true,
+				},
+			},
+		},
+	}
+
+	// Register three callees for a shared registration.
+	opts := wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin}
+	callees := make([]*testPeer, 3)
+	calleeSessions := make([]*session, 3)
+	for i := range callees {
+		callees[i] = newTestPeer()
+		calleeSessions[i] = newSession(callees[i], 0, calleeRoles)
+		dealer.Register(calleeSessions[i], &wamp.Register{
+			Request:   wamp.ID(123 + i),
+			Procedure: testProcedure,
+			Options:   opts,
+		})
+		rsp := <-callees[i].Recv()
+		if _, ok := rsp.(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+		if i == 0 {
+			if err := checkMetaReg(metaClient, calleeSessions[i].ID); err != nil {
+				t.Fatal("Registration meta event fail:", err)
+			}
+		}
+		if err := checkMetaReg(metaClient, calleeSessions[i].ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	recvInvocations := func() []*wamp.Invocation {
+		invs := make([]*wamp.Invocation, len(callees))
+		for i := range callees {
+			rsp := <-callees[i].Recv()
+			inv, ok := rsp.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+			invs[i] = inv
+		}
+		return invs
+	}
+	recvResult := func(req wamp.ID) *wamp.Result {
+		var rsp wamp.Message
+		select {
+		case rsp = <-caller.Recv():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for RESULT")
+		}
+		result, ok := rsp.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got:", rsp.MessageType())
+		}
+		if result.Request != req {
+			t.Fatal("wrong request ID in RESULT")
+		}
+		return result
+	}
+	recvInterrupt := func(i int, invID wamp.ID) {
+		rsp := <-callees[i].Recv()
+		interrupt, ok := rsp.(*wamp.Interrupt)
+		if !ok {
+			t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+		}
+		if interrupt.Request != invID {
+			t.Fatal("INTERRUPT for wrong invocation")
+		}
+	}
+
+	// Call all callees and wait for all responses.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   130,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptFanout: true},
+	})
+	invs := recvInvocations()
+	dealer.Yield(calleeSessions[0],
+		&wamp.Yield{Request: invs[0].Request, Arguments: wamp.List{"zero"}})
+	dealer.Error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: invs[1].Request,
+		Error:   wamp.URI("nexus.test.error"),
+	})
+	dealer.Yield(calleeSessions[2],
+		&wamp.Yield{Request: invs[2].Request, Arguments: wamp.List{"two"}})
+	result := recvResult(130)
+	if len(result.ArgumentsKw) != 3 {
+		t.Fatal("expected 3 responses, got", len(result.ArgumentsKw))
+	}
+	resp, _ := wamp.AsDict(result.ArgumentsKw[calleeSessions[0].String()])
+	if args, _ := wamp.AsList(resp["args"]); len(args) == 0 || args[0] != "zero" {
+		t.Fatal("wrong response from first callee:", resp)
+	}
+	resp, _ = wamp.AsDict(result.ArgumentsKw[calleeSessions[1].String()])
+	if resp[wamp.OptError] != wamp.URI("nexus.test.error") {
+		t.Fatal("wrong response from second callee:", resp)
+	}
+
+	// Call all callees and wait for the first response.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   131,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptFanout: true, wamp.OptQuorum: 1},
+	})
+	invs = recvInvocations()
+	dealer.Yield(calleeSessions[1], &wamp.Yield{Request: invs[1].Request})
+	result = recvResult(131)
+	if len(result.ArgumentsKw) != 1 {
+		t.Fatal("expected 1 response, got", len(result.ArgumentsKw))
+	}
+	if _, ok := result.ArgumentsKw[calleeSessions[1].String()]; !ok {
+		t.Fatal("missing response from second callee")
+	}
+	recvInterrupt(0, invs[0].Request)
+	recvInterrupt(2, invs[2].Request)
+
+	// Call all callees and return responses received by the deadline.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   132,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptFanout: true, wamp.OptTimeout: 100},
+	})
+	invs = recvInvocations()
+	dealer.Yield(calleeSessions[2], &wamp.Yield{Request: invs[2].Request})
+	result = recvResult(132)
+	if len(result.ArgumentsKw) != 1 {
+		t.Fatal("expected 1 response, got", len(result.ArgumentsKw))
+	}
+	recvInterrupt(0, invs[0].Request)
+	recvInterrupt(1, invs[1].Request)
+}
+
+func TestCallTrustLevels(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register callee that requires a minimum trust level.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	dealer.Register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptInvoke:        wamp.InvokeRoundRobin,
+			wamp.OptMinTrustLevel: 2,
+		},
+	})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Callee requiring a different trust level cannot share registration.
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options:   wamp.Dict{wamp.OptInvoke: wamp.InvokeRoundRobin},
+	})
+	rsp = <-callee2.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR response, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Call from a session with a trust level below the minimum.
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+	callerSession.trustLevel, callerSession.hasTrustLevel = 1, true
+	dealer.Call(callerSession, &wamp.Call{Request: 125, Procedure: testProcedure})
+	rsp = <-caller.Recv()
+	if errMsg, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR response, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Call from a session with no trust level assigned.
+	noTrustSession := newSession(newTestPeer(), 0, nil)
+	dealer.Call(noTrustSession, &wamp.Call{Request: 126, Procedure: testProcedure})
+	rsp = <-noTrustSession.Recv()
+	if errMsg, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR response, got:", rsp.MessageType())
+	}
+	if errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("wrong error:", errMsg.Error)
+	}
+
+	// Call from a session with a trust level that meets the minimum.
+	callerSession.trustLevel = 3
+	dealer.Call(callerSession, &wamp.Call{Request: 127, Procedure: testProcedure})
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if level, _ := wamp.AsInt64(inv.Details["trustlevel"]); level != 3 {
+		t.Fatal("expected trustlevel 3, got:", inv.Details["trustlevel"])
+	}
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	if _, ok = rsp.(*wamp.Result); !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+}
+
+func TestCallTracing(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	recorder := newTestSpanRecorder()
+	dealer.SetSpanRecorder(recorder)
+
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	dealer.Register(calleeSess, &wamp.Register{Request: 123, Procedure: testProcedure})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Call with trace ID and span ID supplied by caller.
+	traceID := newTraceID()
+	parentSpanID := newSpanID()
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   124,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptTraceID: traceID,
+			wamp.OptSpanID:  parentSpanID,
+		},
+	})
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	if inv.Details[wamp.OptTraceID] != traceID {
+		t.Fatal("wrong trace_id in INVOCATION:", inv.Details[wamp.OptTraceID])
+	}
+	spanID, _ := wamp.AsString(inv.Details[wamp.OptSpanID])
+	if spanID == "" || spanID == parentSpanID {
+		t.Fatal("wrong span_id in INVOCATION:", spanID)
+	}
+
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	rsp = <-caller.Recv()
+	res, ok := rsp.(*wamp.Result)
+	if !ok {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
+	if res.Details[wamp.OptTraceID] != traceID || res.Details[wamp.OptSpanID] != spanID {
+		t.Fatal("wrong trace details in RESULT:", res.Details)
+	}
+
+	span := recorder.recv(t)
+	if span.TraceID != traceID || span.SpanID != spanID || span.ParentSpanID != parentSpanID {
+		t.Fatal("wrong span IDs:", span.TraceID, span.SpanID, span.ParentSpanID)
+	}
+	if span.Kind != SpanKindCall || span.Name != string(testProcedure) {
+		t.Fatal("wrong span kind or name:", span.Kind, span.Name)
+	}
+	if span.Error != "" {
+		t.Fatal("span should not have error:", span.Error)
+	}
+	if span.Attributes["caller"] != callerSession.ID || span.Attributes["callee"] != calleeSess.ID {
+		t.Fatal("wrong span attributes:", span.Attributes)
+	}
+	if span.End.Before(span.Start) {
+		t.Fatal("span ends before it starts")
+	}
+
+	// Call without trace ID is traced by the router, since there is a span
+	// recorder.
+	dealer.Call(callerSession, &wamp.Call{Request: 125, Procedure: testProcedure})
+	rsp = <-callee.Recv()
+	if inv, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	traceID, _ = wamp.AsString(inv.Details[wamp.OptTraceID])
+	if len(traceID) != 32 {
+		t.Fatal("router did not generate trace ID:", traceID)
+	}
+
+	dealer.Error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Error:   wamp.ErrInvalidArgument,
+	})
+	rsp = <-caller.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+	if errMsg.Details[wamp.OptTraceID] != traceID {
+		t.Fatal("wrong trace_id in ERROR:", errMsg.Details[wamp.OptTraceID])
+	}
+	span = recorder.recv(t)
+	if span.TraceID != traceID || span.ParentSpanID != "" {
+		t.Fatal("wrong span IDs:", span.TraceID, span.ParentSpanID)
+	}
+	if span.Error != wamp.ErrInvalidArgument {
+		t.Fatal("wrong span error:", span.Error)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	dealer.Register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptInvoke:   wamp.InvokeRoundRobin,
+			wamp.OptCacheTTL: 300,
+		},
+	})
+	rsp := <-callee.Recv()
+	regMsg, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	regID := regMsg.Registration
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// call makes a call and returns the result.  If invoked is true, then
+	// the callee is expected to be invoked, and yields the given result.
+	var reqID wamp.ID = 124
+	call := func(arg string, invoked bool, result string) *wamp.Result {
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   reqID,
+			Procedure: testProcedure,
+			Arguments: wamp.List{arg},
+		})
+		reqID++
+		if invoked {
+			rsp := <-callee.Recv()
+			inv, ok := rsp.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+			dealer.Yield(calleeSess, &wamp.Yield{
+				Request:   inv.Request,
+				Arguments: wamp.List{result},
+			})
+		}
+		rsp := <-caller.Recv()
+		res, ok := rsp.(*wamp.Result)
+		if !ok {
+			t.Fatal("expected RESULT, got:", rsp.MessageType())
+		}
+		select {
+		case rsp = <-callee.Recv():
+			t.Fatal("unexpected message to callee:", rsp.MessageType())
+		default:
+		}
+		return res
+	}
+
+	res := call("a", true, "result-1")
+	if res.Arguments[0] != "result-1" {
+		t.Fatal("wrong result:", res.Arguments)
+	}
+	// Identical call is answered from cache.
+	res = call("a", false, "")
+	if res.Arguments[0] != "result-1" {
+		t.Fatal("wrong cached result:", res.Arguments)
+	}
+	// Call with different arguments invokes callee.
+	res = call("b", true, "result-2")
+	if res.Arguments[0] != "result-2" {
+		t.Fatal("wrong result:", res.Arguments)
+	}
+
+	// Check cache statistics.
+	rsp = dealer.RegGet(&wamp.Invocation{Request: 1, Arguments: wamp.List{regID}})
+	dict, _ := wamp.AsDict(rsp.(*wamp.Yield).Arguments[0])
+	cache, _ := wamp.AsDict(dict["cache"])
+	if cache == nil {
+		t.Fatal("missing cache statistics")
+	}
+	if hits, _ := wamp.AsInt64(cache["hits"]); hits != 1 {
+		t.Fatal("expected 1 cache hit, got:", cache["hits"])
+	}
+	if misses, _ := wamp.AsInt64(cache["misses"]); misses != 2 {
+		t.Fatal("expected 2 cache misses, got:", cache["misses"])
+	}
+	if entries, _ := wamp.AsInt64(cache["entries"]); entries != 2 {
+		t.Fatal("expected 2 cache entries, got:", cache["entries"])
+	}
+
+	// Invalidate cache, and check that identical call invokes callee.
+	rsp = dealer.RegInvalidateCache(&wamp.Invocation{Request: 2, Arguments: wamp.List{regID}})
+	if count, _ := wamp.AsInt64(rsp.(*wamp.Yield).Arguments[0]); count != 2 {
+		t.Fatal("expected 2 results removed, got:", rsp.(*wamp.Yield).Arguments[0])
+	}
+	res = call("a", true, "result-3")
+	if res.Arguments[0] != "result-3" {
+		t.Fatal("wrong result:", res.Arguments)
+	}
+	res = call("a", false, "")
+	if res.Arguments[0] != "result-3" {
+		t.Fatal("wrong cached result:", res.Arguments)
+	}
+
+	// Check that expired result is not used.
+	time.Sleep(400 * time.Millisecond)
+	res = call("a", true, "result-4")
+	if res.Arguments[0] != "result-4" {
+		t.Fatal("wrong result:", res.Arguments)
+	}
+
+	// Callee that caches for a different time cannot share registration.
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   200,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptInvoke:   wamp.InvokeRoundRobin,
+			wamp.OptCacheTTL: 100,
+		},
+	})
+	rsp = <-callee2.Recv()
+	if _, ok = rsp.(*wamp.Error); !ok {
+		t.Fatal("expected ERROR response, got:", rsp.MessageType())
+	}
+}
+
+func TestResultCacheCaller(t *testing.T) {
+	dealer, _ := newTestDealer()
+
+	// Register a procedure that discloses the caller and allows only alice
+	// and carol.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	dealer.Register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptCacheTTL:       5000,
+			wamp.OptDiscloseCaller: true,
+			wamp.OptAllowAuthID:    wamp.List{"alice", "carol"},
+		},
+	})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+
+	newCaller := func(authid string) (*testPeer, *session) {
+		peer := newTestPeer()
+		return peer, newSession(peer, 0, wamp.Dict{"authid": authid})
+	}
+	alice, aliceSess := newCaller("alice")
+	carol, carolSess := newCaller("carol")
+	bob, bobSess := newCaller("bob")
+
+	// call makes a call and returns the response.  If invoked is true, then
+	// the callee is expected to be invoked, and yields the given result.
+	var reqID wamp.ID = 124
+	call := func(caller *testPeer, sess *session, invoked bool, result string) wamp.Message {
+		dealer.Call(sess, &wamp.Call{
+			Request:   reqID,
+			Procedure: testProcedure,
+			Arguments: wamp.List{"a"},
+		})
+		reqID++
+		if invoked {
+			var rsp wamp.Message
+			select {
+			case rsp = <-callee.Recv():
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for INVOCATION")
+			}
+			inv, ok := rsp.(*wamp.Invocation)
+			if !ok {
+				t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+			}
+			if inv.Details[roleCaller] != sess.ID {
+				t.Fatal("caller not disclosed to callee")
+			}
+			dealer.Yield(calleeSess, &wamp.Yield{
+				Request:   inv.Request,
+				Arguments: wamp.List{result},
+			})
+		}
+		rsp := <-caller.Recv()
+		select {
+		case rsp := <-callee.Recv():
+			t.Fatal("unexpected message to callee:", rsp.MessageType())
+		default:
+		}
+		return rsp
+	}
+
+	res, ok := call(alice, aliceSess, true, "alice-1").(*wamp.Result)
+	if !ok || res.Arguments[0] != "alice-1" {
+		t.Fatal("expected RESULT for alice")
+	}
+	res, ok = call(alice, aliceSess, false, "").(*wamp.Result)
+	if !ok || res.Arguments[0] != "alice-1" {
+		t.Fatal("expected cached RESULT for alice")
+	}
+
+	// Check that another caller does not get the result cached for alice.
+	res, ok = call(carol, carolSess, true, "carol-1").(*wamp.Result)
+	if !ok || res.Arguments[0] != "carol-1" {
+		t.Fatal("expected RESULT for carol")
+	}
+
+	// Check that a caller the callee does not allow is not sent a cached
+	// result.
+	errMsg, ok := call(bob, bobSess, false, "").(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrNotAuthorized {
+		t.Fatal("expected", wamp.ErrNotAuthorized, "for bob")
+	}
+
+	// Check that a result is not shared between trust levels.
+	aliceSess.trustLevel, aliceSess.hasTrustLevel = 1, true
+	res, ok = call(alice, aliceSess, true, "alice-2").(*wamp.Result)
+	if !ok || res.Arguments[0] != "alice-2" {
+		t.Fatal("expected RESULT for alice with trust level")
+	}
+}
+
+func TestProcedureReflection(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	// Register with a schema that is not valid.
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	dealer.Register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptSchema: wamp.Dict{"args": "array"},
+		},
+	})
+	rsp := <-callee.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+
+	schema := wamp.Dict{
+		"description": "test procedure",
+		"args":        wamp.Dict{"type": "array"},
+		"result":      wamp.Dict{"kwargs": wamp.Dict{"type": "object"}},
+	}
+	dealer.Register(calleeSess, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptInvoke: wamp.InvokeRoundRobin,
+			wamp.OptSchema: schema,
+		},
+	})
+	rsp = <-callee.Recv()
+	regMsg, ok := rsp.(*wamp.Registered)
+	if !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	regID := regMsg.Registration
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Second callee joining registration does not replace schema.
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   125,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptInvoke: wamp.InvokeRoundRobin,
+			wamp.OptSchema: wamp.Dict{"description": "other"},
+		},
+	})
+	rsp = <-callee2.Recv()
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Register a prefix procedure without a schema.
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   126,
+		Procedure: wamp.URI("nexus.aaa"),
+		Options:   wamp.Dict{wamp.OptMatch: wamp.MatchPrefix},
+	})
+	rsp = <-callee2.Recv()
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// List procedures.
+	rsp = dealer.ProcList(&wamp.Invocation{Request: 1})
+	list, _ := wamp.AsList(rsp.(*wamp.Yield).Arguments[0])
+	if len(list) != 2 || list[0] != wamp.URI("nexus.aaa") || list[1] != testProcedure {
+		t.Fatal("wrong procedure list:", list)
+	}
+
+	// Describe procedure with schema.
+	rsp = dealer.ProcDescribe(&wamp.Invocation{
+		Request:   2,
+		Arguments: wamp.List{testProcedure},
+	})
+	dict, _ := wamp.AsDict(rsp.(*wamp.Yield).Arguments[0])
+	if dict["registration"] != regID || dict["callees"] != 2 {
+		t.Fatal("wrong procedure description:", dict)
+	}
+	sch, _ := wamp.AsDict(dict[wamp.OptSchema])
+	if sch["description"] != "test procedure" {
+		t.Fatal("wrong procedure schema:", dict[wamp.OptSchema])
+	}
+
+	// Describe procedure that matches prefix registration.
+	rsp = dealer.ProcDescribe(&wamp.Invocation{
+		Request:   3,
+		Arguments: wamp.List{wamp.URI("nexus.aaa.bbb")},
+	})
+	dict, _ = wamp.AsDict(rsp.(*wamp.Yield).Arguments[0])
+	if dict["uri"] != wamp.URI("nexus.aaa") || dict[wamp.OptMatch] != wamp.MatchPrefix {
+		t.Fatal("wrong procedure description:", dict)
+	}
+	if _, ok = dict[wamp.OptSchema]; ok {
+		t.Fatal("procedure should not have schema")
+	}
+
+	// Describe procedure that is not registered.
+	rsp = dealer.ProcDescribe(&wamp.Invocation{
+		Request:   4,
+		Arguments: wamp.List{wamp.URI("nexus.zzz")},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchProcedure {
+		t.Fatal("expected", wamp.ErrNoSuchProcedure, "got:", rsp)
+	}
+}
+
+func TestCallPayloadValidation(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	dealer.SetValidatePayloads(true)
+	// Schema from configuration takes precedence over schema from callee.
+	otherProc := wamp.URI("nexus.test.other")
+	err := dealer.SetProcedureSchemas(map[wamp.URI]wamp.Dict{
+		otherProc: {"kwargs": wamp.Dict{"required": wamp.List{"name"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dealer.SetProcedureSchemas(map[wamp.URI]wamp.Dict{
+		otherProc: {"kwargs": wamp.Dict{"type": "text"}},
+	})
+	if err == nil {
+		t.Fatal("expected error setting invalid schema")
+	}
+
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+	schema := wamp.Dict{
+		"args": wamp.Dict{
+			"type":        "array",
+			"prefixItems": wamp.List{wamp.Dict{"type": "integer"}},
+		},
+	}
+	for i, proc := range []wamp.URI{testProcedure, otherProc} {
+		dealer.Register(calleeSess, &wamp.Register{
+			Request:   wamp.ID(123 + i),
+			Procedure: proc,
+			Options:   wamp.Dict{wamp.OptSchema: schema},
+		})
+		rsp := <-callee.Recv()
+		if _, ok := rsp.(*wamp.Registered); !ok {
+			t.Fatal("did not receive REGISTERED response")
+		}
+		if err = checkMetaReg(metaClient, calleeSess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
+		if err = checkMetaReg(metaClient, calleeSess.ID); err != nil {
+			t.Fatal("Registration meta event fail:", err)
+		}
 	}
 
-	// Callee responds with a YIELD message
-	dealer.Yield(calleeSess1, &wamp.Yield{Request: inv.Request})
-	// Check that caller received a RESULT message.
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+
+	// Call with arguments that do not match callee's schema.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   125,
+		Procedure: testProcedure,
+		Arguments: wamp.List{"one"},
+	})
+	rsp := <-caller.Recv()
+	errMsg, ok := rsp.(*wamp.Error)
+	if !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+	if len(errMsg.Arguments) == 0 || errMsg.Arguments[0] != "args[0]: expected integer, got string" {
+		t.Fatal("wrong validation message:", errMsg.Arguments)
+	}
+
+	// Call with matching arguments is routed to callee.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   126,
+		Procedure: testProcedure,
+		Arguments: wamp.List{1},
+	})
+	rsp = <-callee.Recv()
+	if _, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	// Call is validated against schema from configuration.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   127,
+		Procedure: otherProc,
+		Arguments: wamp.List{1},
+	})
 	rsp = <-caller.Recv()
-	rslt, ok = rsp.(*wamp.Result)
+	if errMsg, ok = rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+	rsp = dealer.ProcDescribe(&wamp.Invocation{
+		Request:   1,
+		Arguments: wamp.List{otherProc},
+	})
+	dict, _ := wamp.AsDict(rsp.(*wamp.Yield).Arguments[0])
+	sch, _ := wamp.AsDict(dict[wamp.OptSchema])
+	if _, ok = sch["kwargs"]; !ok {
+		t.Fatal("described schema is not from configuration:", sch)
+	}
+
+	// Calls are not validated when validation is disabled.
+	dealer.SetValidatePayloads(false)
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   128,
+		Procedure: otherProc,
+		Arguments: wamp.List{"one"},
+	})
+	rsp = <-callee.Recv()
+	if _, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+}
+
+func TestCallPayloadPassthru(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+	dealer.SetValidatePayloads(true)
+
+	callee := newTestPeer()
+	details := wamp.Dict{
+		"roles": wamp.Dict{
+			"callee": wamp.Dict{
+				"features": wamp.Dict{
+					"payload_passthru_mode": true,
+				},
+			},
+		},
+	}
+	calleeSess := newSession(callee, 0, details)
+	dealer.Register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{wamp.OptSchema: wamp.Dict{
+			"args": wamp.Dict{"maxItems": 0},
+		}},
+	})
+	rsp := <-callee.Recv()
+	if _, ok := rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, nil)
+	pptOpts := wamp.Dict{
+		wamp.OptPPTScheme:     wamp.PPTSchemeWAMP,
+		wamp.OptPPTSerializer: wamp.PPTSerializerCBOR,
+		wamp.OptPPTCipher:     wamp.PPTCipherXSalsa20Poly1305,
+		wamp.OptPPTKeyID:      "key1",
+	}
+
+	// Passthru call with invalid options or payload is rejected.
+	for i, opts := range []wamp.Dict{
+		{wamp.OptPPTSerializer: wamp.PPTSerializerCBOR},
+		{wamp.OptPPTScheme: "custom"},
+		{wamp.OptPPTScheme: wamp.PPTSchemeWAMP, wamp.OptPPTSerializer: "xml"},
+		{wamp.OptPPTScheme: wamp.PPTSchemeWAMP, wamp.OptPPTKeyID: 1},
+	} {
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   wamp.ID(124 + i),
+			Procedure: testProcedure,
+			Options:   opts,
+			Arguments: wamp.List{[]byte{1, 2, 3}},
+		})
+		rsp = <-caller.Recv()
+		if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+			t.Fatal("expected", wamp.ErrInvalidArgument, "for options", opts, "got:", rsp)
+		}
+	}
+	dealer.Call(callerSession, &wamp.Call{
+		Request:     130,
+		Procedure:   testProcedure,
+		Options:     pptOpts,
+		Arguments:   wamp.List{[]byte{1, 2, 3}},
+		ArgumentsKw: wamp.Dict{"a": 1},
+	})
+	rsp = <-caller.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+		t.Fatal("expected", wamp.ErrInvalidArgument, "got:", rsp)
+	}
+
+	// Passthru call is not validated against the schema, and the passthru
+	// options are given to the callee.
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   131,
+		Procedure: testProcedure,
+		Options:   pptOpts,
+		Arguments: wamp.List{[]byte{1, 2, 3}},
+	})
+	rsp = <-callee.Recv()
+	inv, ok := rsp.(*wamp.Invocation)
+	if !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+	for k, v := range pptOpts {
+		if inv.Details[k] != v {
+			t.Fatal("INVOCATION details missing", k, "got:", inv.Details)
+		}
+	}
+
+	// Passthru options of the result are given to the caller.
+	dealer.Yield(calleeSess, &wamp.Yield{
+		Request:   inv.Request,
+		Options:   pptOpts,
+		Arguments: wamp.List{[]byte{4, 5, 6}},
+	})
+	rsp = <-caller.Recv()
+	result, ok := rsp.(*wamp.Result)
 	if !ok {
 		t.Fatal("expected RESULT, got:", rsp.MessageType())
 	}
-	if rslt.Request != 127 {
-		t.Fatal("wrong request ID in RESULT")
+	if result.Details[wamp.OptPPTKeyID] != "key1" {
+		t.Fatal("RESULT details missing passthru options:", result.Details)
+	}
+
+	// Callee that does not support passthru mode cannot be called with it.
+	otherProc := wamp.URI("nexus.test.other")
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2, &wamp.Register{Request: 132, Procedure: otherProc})
+	rsp = <-callee2.Recv()
+	if _, ok = rsp.(*wamp.Registered); !ok {
+		t.Fatal("did not receive REGISTERED response")
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess2.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	dealer.Call(callerSession, &wamp.Call{
+		Request:   133,
+		Procedure: otherProc,
+		Options:   pptOpts,
+		Arguments: wamp.List{[]byte{1, 2, 3}},
+	})
+	rsp = <-caller.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrFeatureNotSupported {
+		t.Fatal("expected", wamp.ErrFeatureNotSupported, "got:", rsp)
 	}
 }
 
-func TestPatternBasedRegistration(t *testing.T) {
+func TestRegistrationStats(t *testing.T) {
 	dealer, metaClient := newTestDealer()
 
 	calleeRoles := wamp.Dict{
 		"roles": wamp.Dict{
 			"callee": wamp.Dict{
 				"features": wamp.Dict{
-					"shared_registration": true,
+					"call_canceling": true,
 				},
 			},
 		},
 	}
-
-	// Register a procedure with wildcard match.
 	callee := newTestPeer()
 	calleeSess := newSession(callee, 0, calleeRoles)
 	dealer.Register(calleeSess,
-		&wamp.Register{
-			Request:   123,
-			Procedure: testProcedureWC,
-			Options: wamp.Dict{
-				wamp.OptMatch: wamp.MatchWildcard,
-			},
-		})
+		&wamp.Register{Request: 123, Procedure: testProcedure})
 	rsp := <-callee.Recv()
-	_, ok := rsp.(*wamp.Registered)
+	regMsg, ok := rsp.(*wamp.Registered)
 	if !ok {
 		t.Fatal("did not receive REGISTERED response")
 	}
@@ -1006,36 +3306,218 @@ func TestPatternBasedRegistration(t *testing.T) {
 
 	caller := newTestPeer()
 	callerSession := newSession(caller, 0, nil)
+	invoke := func(req wamp.ID, opts wamp.Dict) *wamp.Invocation {
+		dealer.Call(callerSession,
+			&wamp.Call{Request: req, Procedure: testProcedure, Options: opts})
+		rsp := <-callee.Recv()
+		inv, ok := rsp.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+		}
+		return inv
+	}
 
-	// Test calling valid procedure with full name.  Widlcard should match.
-	dealer.Call(callerSession,
-		&wamp.Call{Request: 125, Procedure: testProcedure})
+	// Call that succeeds.
+	inv := invoke(124, nil)
+	time.Sleep(10 * time.Millisecond)
+	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
+	if rsp = <-caller.Recv(); rsp.MessageType() != wamp.RESULT {
+		t.Fatal("expected RESULT, got:", rsp.MessageType())
+	}
 
-	// Test that callee received an INVOCATION message.
-	rsp = <-callee.Recv()
-	inv, ok := rsp.(*wamp.Invocation)
-	if !ok {
-		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	// Calls that fail.
+	for _, req := range []wamp.ID{125, 126} {
+		inv = invoke(req, nil)
+		dealer.Error(&wamp.Error{
+			Type:    wamp.INVOCATION,
+			Request: inv.Request,
+			Details: wamp.Dict{},
+			Error:   wamp.URI("nexus.test.error"),
+		})
+		if rsp = <-caller.Recv(); rsp.MessageType() != wamp.ERROR {
+			t.Fatal("expected ERROR, got:", rsp.MessageType())
+		}
 	}
-	details, ok := wamp.AsDict(inv.Details)
+
+	// Call that is canceled.  The ERROR from the interrupted callee is not
+	// counted as an error.
+	inv = invoke(127, nil)
+	dealer.Cancel(callerSession, &wamp.Cancel{
+		Request: 127,
+		Options: wamp.Dict{wamp.OptMode: wamp.CancelModeKill},
+	})
+	if rsp = <-callee.Recv(); rsp.MessageType() != wamp.INTERRUPT {
+		t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+	}
+	dealer.Error(&wamp.Error{
+		Type:    wamp.INVOCATION,
+		Request: inv.Request,
+		Details: wamp.Dict{},
+		Error:   wamp.ErrCanceled,
+	})
+	if rsp = <-caller.Recv(); rsp.MessageType() != wamp.ERROR {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+
+	// Call that times out.
+	invoke(128, wamp.Dict{wamp.OptTimeout: 20})
+	if rsp = <-callee.Recv(); rsp.MessageType() != wamp.INTERRUPT {
+		t.Fatal("expected INTERRUPT, got:", rsp.MessageType())
+	}
+	if rsp = <-caller.Recv(); rsp.MessageType() != wamp.ERROR {
+		t.Fatal("expected ERROR, got:", rsp.MessageType())
+	}
+
+	// Call that is still pending.
+	invoke(129, nil)
+
+	rsp = dealer.RegGetStats(&wamp.Invocation{
+		Request:   1,
+		Arguments: wamp.List{regMsg.Registration},
+	})
+	yield, ok := rsp.(*wamp.Yield)
 	if !ok {
-		t.Fatal("INVOCATION missing details")
+		t.Fatal("expected YIELD, got:", rsp)
+	}
+	stats, _ := wamp.AsDict(yield.Arguments[0])
+	for key, want := range map[string]interface{}{
+		"uri":       testProcedure,
+		"calls":     uint64(6),
+		"successes": uint64(1),
+		"canceled":  uint64(1),
+		"timeouts":  uint64(1),
+		"pending":   1,
+	} {
+		if stats[key] != want {
+			t.Error("wrong", key, "want", want, "got", stats[key])
+		}
 	}
-	proc, _ := wamp.AsURI(details[wamp.OptProcedure])
-	if proc != testProcedure {
-		t.Error("INVOCATION has missing or incorrect procedure detail")
+	errs, _ := wamp.AsDict(stats["errors"])
+	if len(errs) != 1 || errs["nexus.test.error"] != uint64(2) {
+		t.Error("wrong errors:", errs)
+	}
+	latency, _ := wamp.AsDict(stats["latency"])
+	if latency["count"] != uint64(1) {
+		t.Fatal("wrong latency count:", latency)
+	}
+	if min, _ := latency["min"].(float64); min < 10 {
+		t.Error("latency too small:", min)
+	}
+	hist, _ := wamp.AsDict(latency["histogram"])
+	counts, _ := hist["counts"].([]uint64)
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if len(counts) != len(latencyBounds)+1 || total != 1 || counts[0] != 0 {
+		t.Error("wrong histogram counts:", counts)
 	}
 
-	// Callee responds with a YIELD message
-	dealer.Yield(calleeSess, &wamp.Yield{Request: inv.Request})
-	// Check that caller received a RESULT message.
-	rsp = <-caller.Recv()
-	rslt, ok := rsp.(*wamp.Result)
+	rsp = dealer.RegGetStats(&wamp.Invocation{
+		Request:   2,
+		Arguments: wamp.List{wamp.ID(1234)},
+	})
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrNoSuchRegistration {
+		t.Fatal("expected", wamp.ErrNoSuchRegistration, "got:", rsp)
+	}
+}
+
+func TestCallerAllowLists(t *testing.T) {
+	dealer, metaClient := newTestDealer()
+
+	callee := newTestPeer()
+	calleeSess := newSession(callee, 0, nil)
+
+	// Test that invalid allow-lists are rejected.
+	for i, opts := range []wamp.Dict{
+		{wamp.OptAllowAuthRole: "admin"},
+		{wamp.OptAllowAuthRole: wamp.List{}},
+		{wamp.OptAllowAuthID: wamp.List{"alice", 7}},
+	} {
+		dealer.Register(calleeSess, &wamp.Register{
+			Request:   wamp.ID(100 + i),
+			Procedure: testProcedure,
+			Options:   opts,
+		})
+		rsp := <-callee.Recv()
+		if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrInvalidArgument {
+			t.Fatal("expected", wamp.ErrInvalidArgument, "for options", opts, "got:", rsp)
+		}
+	}
+
+	dealer.Register(calleeSess, &wamp.Register{
+		Request:   123,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptInvoke:        wamp.InvokeRoundRobin,
+			wamp.OptAllowAuthRole: wamp.List{"service", "admin"},
+		},
+	})
+	rsp := <-callee.Recv()
+	regMsg, ok := rsp.(*wamp.Registered)
 	if !ok {
-		t.Fatal("expected RESULT, got:", rsp.MessageType())
+		t.Fatal("did not receive REGISTERED response")
 	}
-	if rslt.Request != 125 {
-		t.Fatal("wrong request ID in RESULT")
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+	if err := checkMetaReg(metaClient, calleeSess.ID); err != nil {
+		t.Fatal("Registration meta event fail:", err)
+	}
+
+	// Test that another callee cannot join the registration with different
+	// allow-lists.
+	callee2 := newTestPeer()
+	calleeSess2 := newSession(callee2, 0, nil)
+	dealer.Register(calleeSess2, &wamp.Register{
+		Request:   124,
+		Procedure: testProcedure,
+		Options: wamp.Dict{
+			wamp.OptInvoke:        wamp.InvokeRoundRobin,
+			wamp.OptAllowAuthRole: wamp.List{"admin"},
+		},
+	})
+	rsp = <-callee2.Recv()
+	if errMsg, ok := rsp.(*wamp.Error); !ok || errMsg.Error != wamp.ErrProcedureAlreadyExists {
+		t.Fatal("expected", wamp.ErrProcedureAlreadyExists, "got:", rsp)
+	}
+
+	// Test that callers without an allowed authrole are not authorized.
+	for i, details := range []wamp.Dict{
+		nil,
+		{"authrole": "user"},
+	} {
+		caller := newTestPeer()
+		callerSession := newSession(caller, 0, details)
+		dealer.Call(callerSession, &wamp.Call{
+			Request:   wamp.ID(125 + i),
+			Procedure: testProcedure,
+		})
+		rsp = <-caller.Recv()
+		errMsg, ok := rsp.(*wamp.Error)
+		if !ok || errMsg.Error != wamp.ErrNotAuthorized {
+			t.Fatal("expected", wamp.ErrNotAuthorized, "got:", rsp)
+		}
+	}
+
+	// Test that caller with an allowed authrole is routed to the callee.
+	caller := newTestPeer()
+	callerSession := newSession(caller, 0, wamp.Dict{"authrole": "admin"})
+	dealer.Call(callerSession, &wamp.Call{Request: 127, Procedure: testProcedure})
+	rsp = <-callee.Recv()
+	if _, ok = rsp.(*wamp.Invocation); !ok {
+		t.Fatal("expected INVOCATION, got:", rsp.MessageType())
+	}
+
+	// Test that the allow-lists are included in the registration info.
+	rsp = dealer.RegGet(&wamp.Invocation{
+		Request:   1,
+		Arguments: wamp.List{regMsg.Registration},
+	})
+	dict, _ := wamp.AsDict(rsp.(*wamp.Yield).Arguments[0])
+	allowed, _ := dict[wamp.OptAllowAuthRole].([]string)
+	if len(allowed) != 2 || allowed[0] != "admin" || allowed[1] != "service" {
+		t.Fatal("wrong", wamp.OptAllowAuthRole, "in registration info:", dict)
 	}
 }
 
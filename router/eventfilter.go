@@ -0,0 +1,500 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+const (
+	// maxFilterLength is the maximum length of a filter expression.
+	maxFilterLength = 1024
+
+	// maxFilterDepth is the maximum nesting depth of a filter expression.
+	maxFilterDepth = 32
+)
+
+// eventFilter is a compiled content filter that a subscriber sets, using the
+// "filter" SUBSCRIBE option, to receive only the events whose payload
+// matches the filter expression.  For example:
+//
+//	kwargs.temperature > 30 && kwargs.site == "A"
+//
+// An expression refers to the positional arguments of the event as args, and
+// to its keyword arguments as kwargs.  Items are selected using args[0],
+// kwargs.name, or kwargs["name"], and can be chained to select items of
+// nested lists and dictionaries.  A selected item that does not exist is
+// null.
+//
+// Literals are numbers, strings in double or single quotes, true, false, and
+// null.  The operators, from highest to lowest precedence, are !, the
+// comparisons ==, !=, <, <=, >, >=, then &&, then ||.  Parentheses group
+// expressions.  Numbers compare by value, regardless of their type, and
+// strings compare lexically.  An ordering comparison of values that are not
+// both numbers or both strings is false.  Only the value true is true; any
+// other value is false when used as a condition.
+//
+// The payload of an event published in payload passthru mode is opaque to the
+// router, so the filter is evaluated against the encrypted payload.
+//
+// The language has no loops or function calls, and the length and nesting
+// depth of expressions are limited, so evaluating a filter is always cheap.
+type eventFilter struct {
+	expr string
+	root filterNode
+}
+
+// filterNode is a node of the syntax tree of a filter expression.
+type filterNode interface {
+	eval(args wamp.List, kwargs wamp.Dict) interface{}
+}
+
+// newEventFilter compiles the filter expression.
+func newEventFilter(expr string) (*eventFilter, error) {
+	if len(expr) > maxFilterLength {
+		return nil, fmt.Errorf("filter longer than %d characters", maxFilterLength)
+	}
+	toks, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return &eventFilter{expr: expr, root: root}, nil
+}
+
+// getEventFilter gets the event filter from the SUBSCRIBE options.  If there
+// is no filter option, then nil is returned.
+func getEventFilter(options wamp.Dict) (*eventFilter, error) {
+	v, ok := options[wamp.OptFilter]
+	if !ok {
+		return nil, nil
+	}
+	expr, ok := wamp.AsString(v)
+	if !ok || strings.TrimSpace(expr) == "" {
+		return nil, fmt.Errorf("invalid %s %v (must be non-empty string)",
+			wamp.OptFilter, v)
+	}
+	filter, err := newEventFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", wamp.OptFilter, err)
+	}
+	return filter, nil
+}
+
+// matches returns true if the filter is nil, or the event payload matches the
+// filter expression.
+func (f *eventFilter) matches(args wamp.List, kwargs wamp.Dict) bool {
+	if f == nil {
+		return true
+	}
+	return isTrue(f.root.eval(args, kwargs))
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	val  interface{} // value of number or string
+	pos  int
+}
+
+// filterOps are the operators and punctuation, longest first.
+var filterOps = []string{
+	"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ".",
+}
+
+// lexFilter splits the filter expression into tokens, ending with tokEOF.
+func lexFilter(expr string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isIdentStart(c):
+			start := i
+			for i < len(expr) && (isIdentStart(expr[i]) || isDigit(expr[i])) {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: expr[start:i], pos: start})
+			continue
+		case isDigit(c) || (c == '-' && i+1 < len(expr) && isDigit(expr[i+1])):
+			start := i
+			i++
+			for i < len(expr) && (isDigit(expr[i]) || expr[i] == '.' || expr[i] == 'e' || expr[i] == 'E' ||
+				((expr[i] == '-' || expr[i] == '+') && (expr[i-1] == 'e' || expr[i-1] == 'E'))) {
+				i++
+			}
+			n, err := strconv.ParseFloat(expr[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at offset %d", expr[start:i], start)
+			}
+			toks = append(toks, token{kind: tokNumber, text: expr[start:i], val: n, pos: start})
+			continue
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(expr) && expr[i] != c; i++ {
+				if expr[i] == '\\' {
+					i++
+					if i == len(expr) {
+						break
+					}
+				}
+				sb.WriteByte(expr[i])
+			}
+			if i >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			toks = append(toks, token{kind: tokString, text: expr[start:i], val: sb.String(), pos: start})
+			continue
+		}
+		var op string
+		for _, o := range filterOps {
+			if strings.HasPrefix(expr[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+		toks = append(toks, token{kind: tokOp, text: op, pos: i})
+		i += len(op)
+	}
+	return append(toks, token{kind: tokEOF, text: "end of filter", pos: len(expr)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// filterParser is a recursive descent parser of filter expressions:
+//
+//	or      = and { "||" and }
+//	and     = compare { "&&" compare }
+//	compare = unary [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) unary ]
+//	unary   = "!" unary | operand
+//	operand = "(" or ")" | number | string | "true" | "false" | "null" | path
+//	path    = ( "args" | "kwargs" ) { "." ident | "[" ( number | string ) "]" }
+type filterParser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+func (p *filterParser) peek() token { return p.toks[p.pos] }
+
+func (p *filterParser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the operator.
+func (p *filterParser) accept(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(op string) error {
+	if !p.accept(op) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at offset %d, found %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFilterDepth {
+		return nil, errors.New("filter nested too deeply")
+	}
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseCompare() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return left, nil
+	}
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &compareNode{op: tok.text, left: left, right: right}, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("!") {
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxFilterDepth {
+			return nil, errors.New("filter nested too deeply")
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x}, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber, tokString:
+		return &literalNode{tok.val}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		case "args", "kwargs":
+			return p.parsePath(tok.text)
+		}
+		return nil, fmt.Errorf("unknown name %q at offset %d", tok.text, tok.pos)
+	case tokOp:
+		if tok.text == "(" {
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *filterParser) parsePath(root string) (filterNode, error) {
+	path := &pathNode{kwargs: root == "kwargs"}
+	for {
+		switch {
+		case p.accept("."):
+			tok := p.next()
+			if tok.kind != tokIdent {
+				return nil, fmt.Errorf("expected name at offset %d, found %q", tok.pos, tok.text)
+			}
+			path.keys = append(path.keys, tok.text)
+		case p.accept("["):
+			tok := p.next()
+			switch tok.kind {
+			case tokString:
+				path.keys = append(path.keys, tok.val)
+			case tokNumber:
+				n := tok.val.(float64)
+				if n < 0 || n != float64(int(n)) {
+					return nil, fmt.Errorf("invalid index %s at offset %d", tok.text, tok.pos)
+				}
+				path.keys = append(path.keys, int(n))
+			default:
+				return nil, fmt.Errorf("expected index at offset %d, found %q", tok.pos, tok.text)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return path, nil
+		}
+	}
+}
+
+type literalNode struct{ val interface{} }
+
+func (n *literalNode) eval(wamp.List, wamp.Dict) interface{} { return n.val }
+
+// pathNode selects an item of the event payload.  Each key is a string, to
+// select an item of a dictionary, or an int, to select an item of a list.
+type pathNode struct {
+	kwargs bool
+	keys   []interface{}
+}
+
+func (n *pathNode) eval(args wamp.List, kwargs wamp.Dict) interface{} {
+	var v interface{} = args
+	if n.kwargs {
+		v = kwargs
+	}
+	for _, key := range n.keys {
+		switch key := key.(type) {
+		case string:
+			d, ok := wamp.AsDict(v)
+			if !ok {
+				return nil
+			}
+			v = d[key]
+		case int:
+			l, ok := wamp.AsList(v)
+			if !ok || key >= len(l) {
+				return nil
+			}
+			v = l[key]
+		}
+	}
+	return v
+}
+
+type notNode struct{ x filterNode }
+
+func (n *notNode) eval(args wamp.List, kwargs wamp.Dict) interface{} {
+	return !isTrue(n.x.eval(args, kwargs))
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n *andNode) eval(args wamp.List, kwargs wamp.Dict) interface{} {
+	return isTrue(n.left.eval(args, kwargs)) && isTrue(n.right.eval(args, kwargs))
+}
+
+type orNode struct{ left, right filterNode }
+
+func (n *orNode) eval(args wamp.List, kwargs wamp.Dict) interface{} {
+	return isTrue(n.left.eval(args, kwargs)) || isTrue(n.right.eval(args, kwargs))
+}
+
+type compareNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (n *compareNode) eval(args wamp.List, kwargs wamp.Dict) interface{} {
+	a := n.left.eval(args, kwargs)
+	b := n.right.eval(args, kwargs)
+	switch n.op {
+	case "==":
+		return valuesEqual(a, b)
+	case "!=":
+		return !valuesEqual(a, b)
+	}
+	cmp, ok := compareValues(a, b)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// isTrue returns true only if the value is the bool true.
+func isTrue(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+// valuesEqual returns true if the values are equal numbers, strings, or bools,
+// or are both null.
+func valuesEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if cmp, ok := compareValues(a, b); ok {
+		return cmp == 0
+	}
+	ab, aok := a.(bool)
+	bb, bok := b.(bool)
+	return aok && bok && ab == bb
+}
+
+// compareValues compares two numbers or two strings.  Returns false if the
+// values are not comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	af, aok := wamp.AsFloat64(a)
+	bf, bok := wamp.AsFloat64(b)
+	if aok && bok {
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		case af == bf:
+			return 0, true
+		}
+		return 0, false // NaN
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(as, bs), true
+	}
+	return 0, false
+}
@@ -0,0 +1,149 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// historyEvent is a published event kept in an event history.  It keeps what
+// is needed to create the event for a subscriber, the same as it would have
+// been sent to the subscriber when it was published.
+type historyEvent struct {
+	published   time.Time
+	pub         *session
+	msg         *wamp.Publish
+	publication wamp.ID
+	excludePub  bool
+	disclose    bool
+}
+
+// dict returns the event as returned by wamp.subscription.get_events, given
+// the EVENT created for the subscriber that gets it.
+func (evt *historyEvent) dict(event *wamp.Event) wamp.Dict {
+	dict := make(wamp.Dict, len(event.Details)+6)
+	for k, v := range event.Details {
+		dict[k] = v
+	}
+	dict["timestamp"] = wamp.ISO8601(evt.published)
+	dict["publication"] = event.Publication
+	dict["subscription"] = event.Subscription
+	dict["topic"] = evt.msg.Topic
+	if len(event.Arguments) != 0 {
+		dict["args"] = event.Arguments
+	}
+	if len(event.ArgumentsKw) != 0 {
+		dict["kwargs"] = event.ArgumentsKw
+	}
+	return dict
+}
+
+// eventHistory keeps the most recent events published to a topic, or to the
+// topics matching a pattern, up to a maximum number of events and, if there
+// is a maximum age, for up to that age.
+type eventHistory struct {
+	topic  wamp.URI
+	match  string
+	limit  int
+	maxAge time.Duration
+	events []*historyEvent // oldest first
+}
+
+func newEventHistory(cfg EventHistoryConfig) (*eventHistory, error) {
+	match := cfg.Match
+	switch match {
+	case "":
+		match = wamp.MatchExact
+	case wamp.MatchExact, wamp.MatchPrefix, wamp.MatchWildcard:
+	default:
+		return nil, fmt.Errorf("invalid event history match %q for %s",
+			cfg.Match, cfg.Topic)
+	}
+	if !cfg.Topic.ValidURI(false, match) {
+		return nil, fmt.Errorf("invalid event history topic %q", cfg.Topic)
+	}
+	if cfg.Limit < 1 {
+		return nil, fmt.Errorf(
+			"invalid event history limit %d for %s (must be positive)",
+			cfg.Limit, cfg.Topic)
+	}
+	if cfg.MaxAge < 0 {
+		return nil, fmt.Errorf(
+			"invalid event history max_age %d for %s (must not be negative)",
+			cfg.MaxAge, cfg.Topic)
+	}
+	return &eventHistory{
+		topic:  cfg.Topic,
+		match:  match,
+		limit:  cfg.Limit,
+		maxAge: time.Duration(cfg.MaxAge) * time.Millisecond,
+	}, nil
+}
+
+// add adds an event to the history, removing the oldest events if the
+// history is over its limit.
+func (h *eventHistory) add(evt *historyEvent) {
+	h.events = append(h.events, evt)
+	if len(h.events) > h.limit {
+		n := len(h.events) - h.limit
+		for i := 0; i < n; i++ {
+			h.events[i] = nil
+		}
+		h.events = h.events[n:]
+	}
+	h.expire(evt.published)
+}
+
+// expire removes events that are older than the maximum age.
+func (h *eventHistory) expire(now time.Time) {
+	if h.maxAge == 0 {
+		return
+	}
+	cutoff := now.Add(-h.maxAge)
+	var n int
+	for n < len(h.events) && h.events[n].published.Before(cutoff) {
+		h.events[n] = nil
+		n++
+	}
+	h.events = h.events[n:]
+}
+
+// topicMatches returns true if the topic matches the subscription topic or
+// pattern, according to the match policy.
+func topicMatches(topic, subTopic wamp.URI, match string) bool {
+	switch match {
+	case wamp.MatchPrefix:
+		return topic.PrefixMatch(subTopic)
+	case wamp.MatchWildcard:
+		return topic.WildcardMatch(subTopic)
+	}
+	return topic == subTopic
+}
+
+// historyEvents returns the events, from all event histories, that were
+// published to topics matching the subscription, oldest first.  Every kept
+// event is matched against the subscription, since this is only done for
+// wamp.subscription.get_events, and a wamp.URIMatcher finds the patterns that
+// match a topic, not the topics that match a pattern.
+func historyEvents(histories []*eventHistory, sub *subscription, now time.Time) []*historyEvent {
+	var events []*historyEvent
+	seen := map[wamp.ID]struct{}{}
+	for _, h := range histories {
+		h.expire(now)
+		for _, evt := range h.events {
+			if _, ok := seen[evt.publication]; ok {
+				continue
+			}
+			if topicMatches(evt.msg.Topic, sub.topic, sub.match) {
+				seen[evt.publication] = struct{}{}
+				events = append(events, evt)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].published.Before(events[j].published)
+	})
+	return events
+}
@@ -0,0 +1,533 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// multipleOfTolerance is the relative tolerance, a few float64 epsilons,
+// within which the quotient of a non-integer number and its multipleOf must be
+// an integer.
+const multipleOfTolerance = 4 * 0x1p-52
+
+// jsonSchema is a compiled JSON Schema, used to validate the payloads of
+// calls and publications.
+//
+// The validation keywords commonly used to describe message payloads are
+// supported: type, enum, const, the numeric, string, array, and object
+// keywords, and the allOf, anyOf, oneOf, and not combinators.  Annotations
+// such as title and description are ignored.  A schema that uses references
+// ($ref) or any other validation keyword, such as patternProperties or
+// if/then/else, is rejected when compiled, instead of that keyword being
+// silently ignored.
+type jsonSchema struct {
+	// Result of validating any value, for a boolean schema.
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	items       *jsonSchema
+	prefixItems []*jsonSchema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	minProperties        *int
+	maxProperties        *int
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+}
+
+// compileJSONSchema compiles a JSON Schema, which is either an object or a
+// boolean.
+func compileJSONSchema(v interface{}) (*jsonSchema, error) {
+	if b, ok := v.(bool); ok {
+		return &jsonSchema{always: &b}, nil
+	}
+	def, ok := wamp.AsDict(v)
+	if !ok {
+		return nil, errors.New("schema must be an object or boolean")
+	}
+	s := &jsonSchema{}
+	var err error
+	for key, val := range def {
+		switch key {
+		case "type":
+			err = s.compileType(val)
+		case "enum":
+			if s.enum, ok = wamp.AsList(val); !ok {
+				err = errors.New("must be an array")
+			}
+		case "const":
+			s.constant, s.hasConst = val, true
+		case "minimum":
+			s.minimum, err = schemaNumber(val)
+		case "maximum":
+			s.maximum, err = schemaNumber(val)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = schemaNumber(val)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = schemaNumber(val)
+		case "multipleOf":
+			if s.multipleOf, err = schemaNumber(val); err == nil && *s.multipleOf <= 0 {
+				err = errors.New("must be greater than 0")
+			}
+		case "minLength":
+			s.minLength, err = schemaCount(val)
+		case "maxLength":
+			s.maxLength, err = schemaCount(val)
+		case "pattern":
+			p, ok := wamp.AsString(val)
+			if !ok {
+				err = errors.New("must be a string")
+				break
+			}
+			s.pattern, err = regexp.Compile(p)
+		case "items":
+			// Before draft 2020-12, an array of schemas for items meant
+			// what prefixItems now means.
+			if list, ok := wamp.AsList(val); ok {
+				s.prefixItems, err = compileSchemaList(list)
+				break
+			}
+			s.items, err = compileJSONSchema(val)
+		case "prefixItems":
+			list, ok := wamp.AsList(val)
+			if !ok {
+				err = errors.New("must be an array")
+				break
+			}
+			s.prefixItems, err = compileSchemaList(list)
+		case "minItems":
+			s.minItems, err = schemaCount(val)
+		case "maxItems":
+			s.maxItems, err = schemaCount(val)
+		case "uniqueItems":
+			s.uniqueItems, _ = val.(bool)
+		case "properties":
+			props, ok := wamp.AsDict(val)
+			if !ok {
+				err = errors.New("must be an object")
+				break
+			}
+			s.properties = make(map[string]*jsonSchema, len(props))
+			for name, prop := range props {
+				if s.properties[name], err = compileJSONSchema(prop); err != nil {
+					err = fmt.Errorf("%s: %s", name, err)
+					break
+				}
+			}
+		case "required":
+			list, ok := wamp.AsList(val)
+			if !ok {
+				err = errors.New("must be an array")
+				break
+			}
+			for i := range list {
+				name, ok := wamp.AsString(list[i])
+				if !ok {
+					err = errors.New("must be an array of strings")
+					break
+				}
+				s.required = append(s.required, name)
+			}
+		case "additionalProperties":
+			s.additionalProperties, err = compileJSONSchema(val)
+		case "minProperties":
+			s.minProperties, err = schemaCount(val)
+		case "maxProperties":
+			s.maxProperties, err = schemaCount(val)
+		case "allOf", "anyOf", "oneOf":
+			list, ok := wamp.AsList(val)
+			if !ok || len(list) == 0 {
+				err = errors.New("must be a non-empty array")
+				break
+			}
+			var schemas []*jsonSchema
+			if schemas, err = compileSchemaList(list); err != nil {
+				break
+			}
+			switch key {
+			case "allOf":
+				s.allOf = schemas
+			case "anyOf":
+				s.anyOf = schemas
+			default:
+				s.oneOf = schemas
+			}
+		case "not":
+			s.not, err = compileJSONSchema(val)
+		case "$ref", "$dynamicRef", "$recursiveRef":
+			err = errors.New("references are not supported")
+		case "additionalItems", "contains", "minContains", "maxContains",
+			"unevaluatedItems", "patternProperties", "propertyNames",
+			"dependencies", "dependentRequired", "dependentSchemas",
+			"unevaluatedProperties", "if", "then", "else":
+			err = errors.New("keyword is not supported")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *jsonSchema) compileType(v interface{}) error {
+	if t, ok := wamp.AsString(v); ok {
+		v = wamp.List{t}
+	}
+	list, ok := wamp.AsList(v)
+	if !ok {
+		return errors.New("must be a string or array of strings")
+	}
+	for i := range list {
+		t, _ := wamp.AsString(list[i])
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+			s.types = append(s.types, t)
+		default:
+			return fmt.Errorf("unknown type: %v", list[i])
+		}
+	}
+	return nil
+}
+
+func compileSchemaList(list wamp.List) ([]*jsonSchema, error) {
+	schemas := make([]*jsonSchema, len(list))
+	for i := range list {
+		var err error
+		if schemas[i], err = compileJSONSchema(list[i]); err != nil {
+			return nil, fmt.Errorf("%d: %s", i, err)
+		}
+	}
+	return schemas, nil
+}
+
+func schemaNumber(v interface{}) (*float64, error) {
+	n, ok := wamp.AsFloat64(v)
+	if !ok {
+		return nil, errors.New("must be a number")
+	}
+	return &n, nil
+}
+
+func schemaCount(v interface{}) (*int, error) {
+	n, ok := wamp.AsInt64(v)
+	if !ok || n < 0 {
+		return nil, errors.New("must be a non-negative integer")
+	}
+	i := int(n)
+	return &i, nil
+}
+
+// validate returns an error describing the first way in which the value does
+// not match the schema.  The path names the value in the error.
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	if s.always != nil {
+		if !*s.always {
+			return fmt.Errorf("%s: not allowed", path)
+		}
+		return nil
+	}
+
+	t := jsonType(v)
+	if len(s.types) != 0 {
+		var ok bool
+		for _, want := range s.types {
+			if want == t || (want == "number" && t == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: expected %s, got %s", path, typeList(s.types), t)
+		}
+	}
+	if s.enum != nil {
+		var ok bool
+		for i := range s.enum {
+			if jsonEqual(v, s.enum[i]) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: value %v is not one of %v", path, v, s.enum)
+		}
+	}
+	if s.hasConst && !jsonEqual(v, s.constant) {
+		return fmt.Errorf("%s: value must be %v", path, s.constant)
+	}
+
+	var err error
+	switch t {
+	case "number", "integer":
+		n, _ := wamp.AsFloat64(v)
+		err = s.validateNumber(n, path)
+	case "string":
+		str, _ := wamp.AsString(v)
+		err = s.validateString(str, path)
+	case "array":
+		list, _ := wamp.AsList(v)
+		err = s.validateArray(list, path)
+	case "object":
+		dict, _ := wamp.AsDict(v)
+		err = s.validateObject(dict, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range s.allOf {
+		if err = sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil {
+		var ok bool
+		for _, sub := range s.anyOf {
+			if sub.validate(v, path) == nil {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: does not match any allowed schema", path)
+		}
+	}
+	if s.oneOf != nil {
+		var n int
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("%s: matches %d schemas instead of exactly one", path, n)
+		}
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return fmt.Errorf("%s: matches disallowed schema", path)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateNumber(n float64, path string) error {
+	if s.minimum != nil && n < *s.minimum {
+		return fmt.Errorf("%s: %v is less than minimum %v", path, n, *s.minimum)
+	}
+	if s.maximum != nil && n > *s.maximum {
+		return fmt.Errorf("%s: %v is greater than maximum %v", path, n, *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum {
+		return fmt.Errorf("%s: %v is not greater than %v", path, n, *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum {
+		return fmt.Errorf("%s: %v is not less than %v", path, n, *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil && !isMultipleOf(n, *s.multipleOf) {
+		return fmt.Errorf("%s: %v is not a multiple of %v", path, n, *s.multipleOf)
+	}
+	return nil
+}
+
+// isMultipleOf reports whether n is a multiple of m, which is positive.
+func isMultipleOf(n, m float64) bool {
+	if n == math.Trunc(n) && m == math.Trunc(m) {
+		// Integers are checked exactly.  Float64 values outside the int64
+		// range are still integers, and math.Mod is exact for them.
+		if math.Abs(n) < 1<<63 && m < 1<<63 {
+			return int64(n)%int64(m) == 0
+		}
+		return math.Mod(n, m) == 0
+	}
+	// The quotient of decimal values is not exact in floating point, as with
+	// 0.3 / 0.1, so it need only be within a relative tolerance of an
+	// integer.
+	q := n / m
+	return math.Abs(q-math.Round(q)) <= multipleOfTolerance*math.Abs(q)
+}
+
+func (s *jsonSchema) validateString(str, path string) error {
+	length := utf8.RuneCountInString(str)
+	if s.minLength != nil && length < *s.minLength {
+		return fmt.Errorf("%s: length %d is less than minLength %d", path, length, *s.minLength)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		return fmt.Errorf("%s: length %d is greater than maxLength %d", path, length, *s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		return fmt.Errorf("%s: does not match pattern %q", path, s.pattern)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(list wamp.List, path string) error {
+	if s.minItems != nil && len(list) < *s.minItems {
+		return fmt.Errorf("%s: has %d items, less than minItems %d", path, len(list), *s.minItems)
+	}
+	if s.maxItems != nil && len(list) > *s.maxItems {
+		return fmt.Errorf("%s: has %d items, more than maxItems %d", path, len(list), *s.maxItems)
+	}
+	for i := range list {
+		itemPath := path + "[" + strconv.Itoa(i) + "]"
+		var err error
+		if i < len(s.prefixItems) {
+			err = s.prefixItems[i].validate(list[i], itemPath)
+		} else if s.items != nil {
+			err = s.items.validate(list[i], itemPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s.uniqueItems {
+		for i := range list {
+			for j := i + 1; j < len(list); j++ {
+				if jsonEqual(list[i], list[j]) {
+					return fmt.Errorf("%s: items %d and %d are equal", path, i, j)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(dict wamp.Dict, path string) error {
+	if s.minProperties != nil && len(dict) < *s.minProperties {
+		return fmt.Errorf("%s: has %d properties, less than minProperties %d", path, len(dict), *s.minProperties)
+	}
+	if s.maxProperties != nil && len(dict) > *s.maxProperties {
+		return fmt.Errorf("%s: has %d properties, more than maxProperties %d", path, len(dict), *s.maxProperties)
+	}
+	for _, name := range s.required {
+		if _, ok := dict[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", path, name)
+		}
+	}
+	for name, val := range dict {
+		if prop, ok := s.properties[name]; ok {
+			if err := prop.validate(val, path+"."+name); err != nil {
+				return err
+			}
+		} else if s.additionalProperties != nil {
+			if s.additionalProperties.always != nil && !*s.additionalProperties.always {
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			}
+			if err := s.additionalProperties.validate(val, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonType returns the JSON type of a value decoded by any serializer.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string, []byte, wamp.URI:
+		return "string"
+	case float32, float64:
+		n, _ := wamp.AsFloat64(v)
+		if n == math.Trunc(n) && !math.IsInf(n, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	if _, ok := wamp.AsInt64(v); ok {
+		return "integer"
+	}
+	if _, ok := wamp.AsDict(v); ok {
+		return "object"
+	}
+	if _, ok := wamp.AsList(v); ok {
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEqual returns true if two values are equal as JSON values, so that
+// numbers of different Go types with the same value are equal.
+func jsonEqual(a, b interface{}) bool {
+	ta, tb := jsonType(a), jsonType(b)
+	if ta == "integer" || ta == "number" {
+		if tb != "integer" && tb != "number" {
+			return false
+		}
+		na, _ := wamp.AsFloat64(a)
+		nb, _ := wamp.AsFloat64(b)
+		return na == nb
+	}
+	if ta != tb {
+		return false
+	}
+	switch ta {
+	case "string":
+		sa, _ := wamp.AsString(a)
+		sb, _ := wamp.AsString(b)
+		return sa == sb
+	case "array":
+		la, _ := wamp.AsList(a)
+		lb, _ := wamp.AsList(b)
+		if len(la) != len(lb) {
+			return false
+		}
+		for i := range la {
+			if !jsonEqual(la[i], lb[i]) {
+				return false
+			}
+		}
+		return true
+	case "object":
+		da, _ := wamp.AsDict(a)
+		db, _ := wamp.AsDict(b)
+		if len(da) != len(db) {
+			return false
+		}
+		for k, va := range da {
+			vb, ok := db[k]
+			if !ok || !jsonEqual(va, vb) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func typeList(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprint(types)
+}
@@ -0,0 +1,137 @@
+package router
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+func TestJSONSchemaValidate(t *testing.T) {
+	tests := []struct {
+		schema string
+		value  interface{}
+		errMsg string // expected error substring, empty if valid
+	}{
+		{`true`, "anything", ""},
+		{`false`, "anything", "not allowed"},
+		{`{"type": "string"}`, "abc", ""},
+		{`{"type": "string"}`, []byte("abc"), ""},
+		{`{"type": "string"}`, 12, "expected string, got integer"},
+		{`{"type": ["string", "null"]}`, nil, ""},
+		{`{"type": "integer"}`, int64(3), ""},
+		{`{"type": "integer"}`, 3.0, ""},
+		{`{"type": "integer"}`, 3.5, "expected integer, got number"},
+		{`{"type": "number"}`, uint64(3), ""},
+		{`{"enum": ["a", 1]}`, 1.0, ""},
+		{`{"enum": ["a", 1]}`, "b", "not one of"},
+		{`{"const": {"a": [1]}}`, map[string]interface{}{"a": []int{1}}, ""},
+		{`{"minimum": 1, "exclusiveMaximum": 10}`, 10, "not less than 10"},
+		{`{"minimum": 1}`, 0, "less than minimum"},
+		{`{"multipleOf": 5}`, 12, "not a multiple of 5"},
+		{`{"multipleOf": 0.1}`, 0.3, ""},
+		{`{"multipleOf": 0.01}`, 1.15, ""},
+		{`{"multipleOf": 0.1}`, 0.35, "not a multiple of 0.1"},
+		{`{"multipleOf": 2}`, 4000000000, ""},
+		{`{"multipleOf": 2}`, 4000000001, "not a multiple of 2"},
+		{`{"multipleOf": 7}`, 10000000001, "not a multiple of 7"},
+		{`{"multipleOf": 10}`, 1000000000003, "not a multiple of 10"},
+		{`{"multipleOf": 0.5}`, 4000000000.5, ""},
+		{`{"multipleOf": 0.1}`, 0.0000001, "not a multiple of 0.1"},
+		{`{"minLength": 2, "maxLength": 3}`, "ab", ""},
+		{`{"maxLength": 3}`, "abcd", "greater than maxLength"},
+		{`{"pattern": "^[a-z]+$"}`, "ab1", "does not match pattern"},
+		{`{"items": {"type": "string"}}`, wamp.List{"a", 1}, "[1]: expected string"},
+		{`{"prefixItems": [{"type": "integer"}], "items": {"type": "string"}}`, wamp.List{1, "a"}, ""},
+		{`{"items": [{"type": "integer"}]}`, wamp.List{"a"}, "[0]: expected integer"},
+		{`{"minItems": 2}`, wamp.List{1}, "less than minItems"},
+		{`{"uniqueItems": true}`, wamp.List{1, 2.0, 2}, "items 1 and 2 are equal"},
+		{`{"required": ["name"]}`, wamp.Dict{}, `missing required property "name"`},
+		{`{"properties": {"age": {"type": "integer", "minimum": 0}}}`,
+			wamp.Dict{"age": -1}, ".age: -1 is less than minimum"},
+		{`{"properties": {"a": true}, "additionalProperties": false}`,
+			wamp.Dict{"a": 1, "b": 2}, `unexpected property "b"`},
+		{`{"additionalProperties": {"type": "string"}}`, wamp.Dict{"b": 2}, ".b: expected string"},
+		{`{"maxProperties": 1}`, wamp.Dict{"a": 1, "b": 2}, "more than maxProperties"},
+		{`{"allOf": [{"type": "integer"}, {"minimum": 5}]}`, 4, "less than minimum"},
+		{`{"anyOf": [{"type": "integer"}, {"type": "string"}]}`, "a", ""},
+		{`{"anyOf": [{"type": "integer"}, {"type": "string"}]}`, true, "does not match any"},
+		{`{"oneOf": [{"type": "integer"}, {"type": "number"}]}`, 1, "matches 2 schemas"},
+		{`{"not": {"type": "null"}}`, nil, "matches disallowed schema"},
+		{`{"title": "ignored", "format": "ignored"}`, 1, ""},
+	}
+	for _, test := range tests {
+		var def interface{}
+		if err := json.Unmarshal([]byte(test.schema), &def); err != nil {
+			t.Fatal("bad test schema:", test.schema)
+		}
+		s, err := compileJSONSchema(def)
+		if err != nil {
+			t.Fatal("failed to compile", test.schema, "error:", err)
+		}
+		err = s.validate(test.value, "args")
+		if test.errMsg == "" {
+			if err != nil {
+				t.Error("schema", test.schema, "value", test.value, "unexpected error:", err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Error("schema", test.schema, "value", test.value, "expected error")
+		} else if !strings.Contains(err.Error(), test.errMsg) {
+			t.Error("schema", test.schema, "value", test.value, "wrong error:", err)
+		}
+	}
+}
+
+func TestJSONSchemaCompileErrors(t *testing.T) {
+	for _, schema := range []interface{}{
+		"string",
+		wamp.Dict{"type": "text"},
+		wamp.Dict{"minLength": -1},
+		wamp.Dict{"pattern": "("},
+		wamp.Dict{"properties": wamp.Dict{"a": 1}},
+		wamp.Dict{"anyOf": wamp.List{}},
+		wamp.Dict{"$ref": "#/definitions/a"},
+		wamp.Dict{"patternProperties": wamp.Dict{"^a": wamp.Dict{}}},
+		wamp.Dict{"if": wamp.Dict{}, "then": wamp.Dict{}},
+		wamp.Dict{"dependentRequired": wamp.Dict{"a": wamp.List{"b"}}},
+		wamp.Dict{"contains": wamp.Dict{"type": "string"}},
+		wamp.Dict{"propertyNames": wamp.Dict{"maxLength": 3}},
+		wamp.Dict{"items": wamp.Dict{"unevaluatedProperties": false}},
+	} {
+		if _, err := compileJSONSchema(schema); err == nil {
+			t.Error("expected error compiling schema:", schema)
+		}
+	}
+}
+
+func TestPayloadSchemaValidate(t *testing.T) {
+	schema, err := newPayloadSchema(wamp.Dict{
+		"args":   wamp.Dict{"type": "array", "minItems": 1},
+		"kwargs": wamp.Dict{"required": wamp.List{"name"}},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = schema.validate(wamp.List{1}, wamp.Dict{"name": "x"}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// Missing arguments are validated as empty.
+	err = schema.validate(nil, wamp.Dict{"name": "x"})
+	if err == nil || !strings.HasPrefix(err.Error(), "args:") {
+		t.Fatal("expected args error, got:", err)
+	}
+	err = schema.validate(wamp.List{1}, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "kwargs:") {
+		t.Fatal("expected kwargs error, got:", err)
+	}
+
+	if _, err = newPayloadSchema(wamp.Dict{"result": wamp.Dict{}}, false); err == nil {
+		t.Fatal("expected error for topic schema with result")
+	}
+	if _, err = newPayloadSchema(wamp.Dict{"args": wamp.Dict{"type": 1}}, true); err == nil {
+		t.Fatal("expected error for invalid JSON Schema")
+	}
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// pptOptions are the options of a PUBLISH, CALL, YIELD, or ERROR that uses
+// payload passthru mode.  The broker and dealer copy these into the details
+// of the EVENT, INVOCATION, RESULT, or ERROR that they route, without looking
+// at the payload.
+var pptOptions = []string{
+	wamp.OptPPTScheme,
+	wamp.OptPPTSerializer,
+	wamp.OptPPTCipher,
+	wamp.OptPPTKeyID,
+}
+
+// isPassthru returns true if the options have any payload passthru option.
+func isPassthru(options wamp.Dict) bool {
+	for _, opt := range pptOptions {
+		if _, ok := options[opt]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassthru checks the payload passthru options and payload of a PUBLISH
+// or CALL.  The scheme is required, and is "wamp" for end-to-end encryption,
+// "mqtt", or a custom scheme starting with "x_".  The serializer and cipher,
+// if given, must be known for the "wamp" scheme.  The payload is opaque, and
+// must be the only positional argument.
+func checkPassthru(options wamp.Dict, args wamp.List, kwargs wamp.Dict) error {
+	for _, opt := range pptOptions {
+		if v, ok := options[opt]; ok {
+			if _, ok = wamp.AsString(v); !ok {
+				return fmt.Errorf("%s must be a string", opt)
+			}
+		}
+	}
+	scheme, _ := wamp.AsString(options[wamp.OptPPTScheme])
+	switch {
+	case scheme == "":
+		return fmt.Errorf("payload passthru mode requires %s", wamp.OptPPTScheme)
+	case scheme == wamp.PPTSchemeWAMP:
+		if ser, ok := wamp.AsString(options[wamp.OptPPTSerializer]); ok {
+			switch ser {
+			case wamp.PPTSerializerJSON, wamp.PPTSerializerMsgpack,
+				wamp.PPTSerializerCBOR, wamp.PPTSerializerUBJSON,
+				wamp.PPTSerializerFlatbuffers:
+			default:
+				return fmt.Errorf("invalid %s %q for %s scheme",
+					wamp.OptPPTSerializer, ser, scheme)
+			}
+		}
+		if cipher, ok := wamp.AsString(options[wamp.OptPPTCipher]); ok {
+			switch cipher {
+			case wamp.PPTCipherXSalsa20Poly1305, wamp.PPTCipherAES256GCM:
+			default:
+				return fmt.Errorf("invalid %s %q", wamp.OptPPTCipher, cipher)
+			}
+		}
+	case scheme == wamp.PPTSchemeMQTT, strings.HasPrefix(scheme, "x_"):
+	default:
+		return fmt.Errorf("invalid %s %q", wamp.OptPPTScheme, scheme)
+	}
+	if len(args) != 1 || len(kwargs) != 0 {
+		return errors.New("payload passthru mode requires payload as only argument")
+	}
+	return nil
+}
+
+// addPassthruDetails copies the payload passthru options to the details of
+// the message being routed.
+func addPassthruDetails(options, details wamp.Dict) {
+	for _, opt := range pptOptions {
+		if v, ok := options[opt]; ok {
+			details[opt] = v
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -55,6 +56,77 @@ type RealmConfig struct {
 	// logic when it may not be needed otherwise.
 	EnableMetaModify bool `json:"enable_meta_modify"`
 
+	// WaitCalleeTimeout is the default number of milliseconds that the dealer
+	// holds a CALL, for a procedure that has no registered callee, waiting
+	// for a callee to register the procedure.  If no callee registers the
+	// procedure in time, the call fails with wamp.error.timeout.
+	// A caller can specify a different time using the "wait_callee" CALL
+	// option.  A value of 0 (the default) means that calls do not wait.
+	WaitCalleeTimeout int `json:"wait_callee_timeout"`
+	// MaxWaitCallee is the maximum number of milliseconds that a call waits
+	// for a callee, whether the wait is the default or requested by the
+	// caller.  The default is 60000 (one minute).
+	MaxWaitCallee int `json:"max_wait_callee"`
+	// MaxWaitingCalls is the maximum number of calls that wait for callees at
+	// once.  A call that arrives when this many calls are waiting fails with
+	// wamp.error.no_such_procedure.  The default is 1000.
+	MaxWaitingCalls int `json:"max_waiting_calls"`
+
+	// TrustLevels assigns a trust level to each session that joins the
+	// realm, according to the session's authrole or authmethod.  The trust
+	// level of the caller or publisher is supplied to callees and subscribers
+	// in INVOCATION and EVENT details, and callees and subscribers can
+	// require a minimum trust level using the "min_trustlevel" REGISTER and
+	// SUBSCRIBE option.  A nil value (the default) disables trust levels.
+	TrustLevels *TrustLevelConfig `json:"trust_levels"`
+
+	// ProcedureSchemas and TopicSchemas describe the payloads of calls to
+	// procedures and events published to topics, keyed by procedure or topic
+	// URI.  Each schema is a dictionary with "args" and "kwargs" JSON Schemas
+	// for the positional and keyword arguments, an optional "description",
+	// and, for a procedure, a "result" dictionary with "args" and "kwargs"
+	// JSON Schemas.  These are available through the wamp.reflection meta
+	// procedures, and take precedence over schemas supplied by callees or
+	// defined using wamp.reflection.topic.define.
+	ProcedureSchemas map[wamp.URI]wamp.Dict `json:"procedure_schemas"`
+	TopicSchemas     map[wamp.URI]wamp.Dict `json:"topic_schemas"`
+
+	// ValidatePayloads enables validation of the arguments of calls and
+	// publications against the schemas of their procedures and topics.  A
+	// call or publication that does not match is not routed, and is answered
+	// with wamp.error.invalid_argument and a message describing the mismatch.
+	ValidatePayloads bool `json:"validate_payloads"`
+
+	// EventHistory configures the topics, or topic patterns, for which the
+	// broker keeps a history of the most recent events.  Subscribers, such
+	// as clients that reconnect, can fetch the events that they missed using
+	// the wamp.subscription.get_events meta procedure.  Events that the
+	// publisher restricted to some recipients are not kept.  A nil value (the
+	// default) keeps no event history.
+	EventHistory []EventHistoryConfig `json:"event_history"`
+
+	// ReliableDelivery sets the limits of reliable delivery to subscribers
+	// that subscribe with the "reliable" option.  These subscribers
+	// acknowledge events using the wamp.subscription.ack meta procedure, and
+	// unacknowledged events are sent again.  Zero values use the defaults.
+	ReliableDelivery ReliableDeliveryConfig `json:"reliable_delivery"`
+
+	// RetainedLimit is the maximum number of topics whose most recent event,
+	// published with the "retain" option, the broker keeps for new
+	// subscribers.  When it is reached, events to other topics are not
+	// retained until a retained event is cleared, by publishing to its topic
+	// with the "retain" option and no arguments.  The default is 1000.
+	RetainedLimit int `json:"retained_limit"`
+
+	// SlowConsumer configures what the router does with messages to a
+	// session whose outbound message queue is full, by authrole: drop the
+	// newest message or the oldest event, coalesce events by topic, block
+	// until there is room, or disconnect the session.  A
+	// wamp.session.on_lagging meta event is published when a session's queue
+	// becomes full, at most once every 10 seconds per session.  A nil value (the default) drops the newest message,
+	// without meta events.
+	SlowConsumer *SlowConsumerConfig `json:"slow_consumer"`
+
 	// PublishFilterFactory is a function used to create a
 	// PublishFilter to check which sessions a publication should be
 	// sent to.
@@ -64,6 +136,64 @@ type RealmConfig struct {
 	PublishFilterFactory FilterFactory
 }
 
+// TrustLevelConfig specifies the trust levels that a realm assigns to the
+// sessions that join it.
+type TrustLevelConfig struct {
+	// AuthRoles maps authrole to trust level.  A session whose authrole is
+	// present is assigned that trust level, regardless of its authmethod.
+	AuthRoles map[string]int `json:"authroles"`
+	// AuthMethods maps authmethod to trust level, for sessions whose authrole
+	// is not present in AuthRoles.
+	AuthMethods map[string]int `json:"authmethods"`
+	// Default is the trust level of sessions that match neither an authrole
+	// nor an authmethod.
+	Default int `json:"default"`
+}
+
+// trustLevel returns the trust level for a session with the given details.
+func (c *TrustLevelConfig) trustLevel(details wamp.Dict) int {
+	authrole, _ := wamp.AsString(details["authrole"])
+	if level, ok := c.AuthRoles[authrole]; ok {
+		return level
+	}
+	authmethod, _ := wamp.AsString(details["authmethod"])
+	if level, ok := c.AuthMethods[authmethod]; ok {
+		return level
+	}
+	return c.Default
+}
+
+// EventHistoryConfig specifies a topic, or topic pattern, for which the broker
+// keeps a history of published events.
+type EventHistoryConfig struct {
+	// Topic is the topic URI, or the topic pattern if Match is "prefix" or
+	// "wildcard".
+	Topic wamp.URI `json:"topic"`
+	// Match is how Topic is matched to the topics of published events:
+	// "exact" (the default), "prefix", or "wildcard".
+	Match string `json:"match"`
+	// Limit is the maximum number of events kept.  It must be positive.
+	Limit int `json:"limit"`
+	// MaxAge is the number of milliseconds that events are kept.  A value of
+	// 0 (the default) keeps events until they are over the limit.
+	MaxAge int `json:"max_age"`
+}
+
+// ReliableDeliveryConfig configures reliable delivery of events.
+type ReliableDeliveryConfig struct {
+	// BufferSize is the maximum number of unacknowledged events kept for each
+	// reliable subscriber.  When it is exceeded, the oldest event is
+	// discarded.  The default is 1000.
+	BufferSize int `json:"buffer_size"`
+	// AckTimeout is the number of milliseconds to wait for a subscriber to
+	// acknowledge events before sending them again.  The default is 10000.
+	AckTimeout int `json:"ack_timeout"`
+	// ResumeTimeout is the number of milliseconds that the unacknowledged
+	// events of a subscriber whose session ended are kept, for a new session
+	// with the same authid to resume receiving.  The default is 60000.
+	ResumeTimeout int `json:"resume_timeout"`
+}
+
 // Special ID for meta session.
 const metaID = wamp.ID(1)
 
@@ -110,7 +240,7 @@ type realm struct {
 	metaDone    chan struct{}
 
 	closed    bool
-	closeLock sync.Mutex
+	closeLock sync.RWMutex
 
 	log   stdlog.StdLog
 	debug bool
@@ -123,6 +253,10 @@ type realm struct {
 
 	enableMetaKill   bool
 	enableMetaModify bool
+
+	trustLevels *TrustLevelConfig
+
+	slowConsumer *SlowConsumerConfig
 }
 
 // newRealm creates a new realm with the given RealmConfig, broker and dealer.
@@ -131,6 +265,11 @@ func newRealm(config *RealmConfig, broker *Broker, dealer *Dealer, logger stdlog
 		return nil, fmt.Errorf(
 			"invalid realm URI %v (URI strict checking %v)", config.URI, config.StrictURI)
 	}
+	if config.SlowConsumer != nil {
+		if err := config.SlowConsumer.validate(); err != nil {
+			return nil, err
+		}
+	}
 
 	r := &realm{
 		broker:      broker,
@@ -151,6 +290,10 @@ func newRealm(config *RealmConfig, broker *Broker, dealer *Dealer, logger stdlog
 
 		enableMetaKill:   config.EnableMetaKill,
 		enableMetaModify: config.EnableMetaModify,
+
+		trustLevels: config.TrustLevels,
+
+		slowConsumer: config.SlowConsumer,
 	}
 
 	if debug {
@@ -282,6 +425,8 @@ func (r *realm) run() {
 	r.registerMetaProcedure(wamp.MetaProcRegGet, r.dealer.RegGet)
 	r.registerMetaProcedure(wamp.MetaProcRegListCallees, r.dealer.RegListCallees)
 	r.registerMetaProcedure(wamp.MetaProcRegCountCallees, r.dealer.RegCountCallees)
+	r.registerMetaProcedure(wamp.MetaProcRegInvalidateCache, r.dealer.RegInvalidateCache)
+	r.registerMetaProcedure(wamp.MetaProcRegGetStats, r.dealer.RegGetStats)
 
 	// Register to handle subscription meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSubList, r.broker.SubList)
@@ -290,6 +435,15 @@ func (r *realm) run() {
 	r.registerMetaProcedure(wamp.MetaProcSubGet, r.broker.SubGet)
 	r.registerMetaProcedure(wamp.MetaProcSubListSubscribers, r.broker.SubListSubscribers)
 	r.registerMetaProcedure(wamp.MetaProcSubCountSubscribers, r.broker.SubCountSubscribers)
+	r.registerMetaProcedure(wamp.MetaProcSubGetEvents, r.broker.SubGetEvents)
+	r.registerMetaProcedure(wamp.MetaProcSubAck, r.broker.SubAck)
+
+	// Register to handle reflection meta procedures.
+	r.registerMetaProcedure(wamp.MetaProcReflectProcList, r.dealer.ProcList)
+	r.registerMetaProcedure(wamp.MetaProcReflectProcDescribe, r.dealer.ProcDescribe)
+	r.registerMetaProcedure(wamp.MetaProcReflectTopicList, r.broker.TopicList)
+	r.registerMetaProcedure(wamp.MetaProcReflectTopicDescribe, r.broker.TopicDescribe)
+	r.registerMetaProcedure(wamp.MetaProcReflectTopicDefine, r.broker.TopicDefine)
 
 	// Register to handle testament meta procedures.
 	r.registerMetaProcedure(wamp.MetaProcSessionAddTestament, r.testamentAdd)
@@ -316,6 +470,7 @@ func (r *realm) createMetaSession() {
 
 	// This session is the local leg of the router uplink.
 	r.metaSess = newSession(rtr, metaID, wamp.Dict{"authrole": "trusted"})
+	r.assignTrustLevel(r.metaSess)
 
 	// Run the handler for messages from the meta session.
 	go r.handleInboundMessages(r.metaSess, nil)
@@ -433,6 +588,9 @@ func (r *realm) handleSession(sess *session) error {
 		return err
 	}
 
+	r.assignTrustLevel(sess)
+	r.assignSlowConsumerPolicy(sess)
+
 	// Ensure session is capable of receiving exit signal before releasing lock
 	r.onJoin(sess)
 	r.closeLock.Unlock()
@@ -451,12 +609,73 @@ func (r *realm) handleSession(sess *session) error {
 			sess.TrySend(&abortMsg)
 		}
 		r.onLeave(sess, shutdown, killAll)
+		sess.closeOut()
 		sess.Close()
 	}()
 
 	return nil
 }
 
+// assignTrustLevel sets the session's trust level, if the realm is configured
+// with trust levels.  This is done before the session is made available to
+// the broker and dealer, so the trust level never changes while in use.
+func (r *realm) assignTrustLevel(sess *session) {
+	if r.trustLevels == nil {
+		return
+	}
+	sess.trustLevel = r.trustLevels.trustLevel(sess.Details)
+	sess.hasTrustLevel = true
+}
+
+// assignSlowConsumerPolicy sets the session's slow-consumer policy, if the
+// realm is configured with one.  Like the trust level, this is done before
+// the session is made available to the broker and dealer.
+func (r *realm) assignSlowConsumerPolicy(sess *session) {
+	if r.slowConsumer == nil {
+		return
+	}
+	policy := r.slowConsumer.policy(sess.Details)
+	// The callbacks are called by the broker and dealer, so must not wait for
+	// the realm.
+	sess.out = newOutQueue(sess.Peer, policy,
+		func() { go r.onLagging(sess, policy.Policy) },
+		func() { go r.killSlowConsumer(sess, policy.Reason) })
+}
+
+// onLagging publishes a meta event announcing that the session's outbound
+// message queue is full.
+func (r *realm) onLagging(sess *session, policy string) {
+	r.closeLock.RLock()
+	defer r.closeLock.RUnlock()
+	if r.closed {
+		return
+	}
+	if r.debug {
+		r.log.Printf("Session %s is lagging, applying %s policy", sess, policy)
+	}
+	sess.rLock()
+	authid, authrole := sess.Details["authid"], sess.Details["authrole"]
+	sess.rUnlock()
+	r.metaPeer.Send(&wamp.Publish{
+		Request:     wamp.GlobalID(),
+		Topic:       wamp.MetaEventSessionOnLagging,
+		Arguments:   wamp.List{sess.ID, authid, authrole},
+		ArgumentsKw: wamp.Dict{"policy": policy},
+	})
+}
+
+// killSlowConsumer closes a session whose slow-consumer policy is to
+// disconnect.
+func (r *realm) killSlowConsumer(sess *session, reason wamp.URI) {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return
+	}
+	r.log.Println("Disconnecting slow consumer", sess)
+	r.killSession(sess.ID, reason, "slow consumer")
+}
+
 // handleInboundMessages handles the messages sent from a client session to
 // the router.
 func (r *realm) handleInboundMessages(sess *session, stopChan <-chan struct{}) (bool, bool, error) {
@@ -501,7 +720,11 @@ func (r *realm) handleInboundMessages(sess *session, stopChan <-chan struct{}) (
 			if _, ok := goodbye.Details["all"]; ok {
 				killAll = true
 			}
-			sess.TrySend(goodbye)
+			// Wait briefly for room to send the GOODBYE, in case the session
+			// is killed for not keeping up with the messages sent to it.
+			ctx, cancel := context.WithTimeout(context.Background(), goodbyeTimeout)
+			sess.SendCtx(ctx, goodbye)
+			cancel()
 			return false, killAll, nil
 		}
 
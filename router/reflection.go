@@ -0,0 +1,131 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Keys of a schema, which describes the payload of the calls to a procedure
+// or the events published to a topic.
+//
+// The args and kwargs keys hold JSON Schemas for the positional and keyword
+// arguments of a call or event.  The result key, which is only used for
+// procedures, holds a dictionary with args and kwargs JSON Schemas for the
+// call result.  A schema may also have a human-readable description.
+//
+// When payload validation is enabled for a realm, the args and kwargs of
+// calls and publications are validated against their schemas.  Results are
+// not validated.
+const (
+	schemaArgs        = "args"
+	schemaKwargs      = "kwargs"
+	schemaResult      = "result"
+	schemaDescription = "description"
+)
+
+// payloadSchema is a schema, supplied by a callee or defined for a topic,
+// with its JSON Schemas compiled to validate payloads.
+type payloadSchema struct {
+	desc   wamp.Dict // schema as supplied
+	args   *jsonSchema
+	kwargs *jsonSchema
+}
+
+// newPayloadSchema checks that a schema has the structure described above,
+// and compiles its JSON Schemas.  A result schema is only allowed if
+// forProcedure is true.
+func newPayloadSchema(v interface{}, forProcedure bool) (*payloadSchema, error) {
+	desc, ok := wamp.AsDict(v)
+	if !ok {
+		return nil, fmt.Errorf("schema must be a dictionary, got %T", v)
+	}
+	s := &payloadSchema{desc: desc}
+	for key, val := range desc {
+		var err error
+		switch key {
+		case schemaArgs:
+			s.args, err = compileJSONSchema(val)
+		case schemaKwargs:
+			s.kwargs, err = compileJSONSchema(val)
+		case schemaResult:
+			if !forProcedure {
+				return nil, fmt.Errorf("%s schema only allowed for procedure", key)
+			}
+			result, ok := wamp.AsDict(val)
+			if !ok {
+				return nil, fmt.Errorf("%s schema must be a dictionary", key)
+			}
+			for rkey, rval := range result {
+				if rkey != schemaArgs && rkey != schemaKwargs {
+					return nil, fmt.Errorf("unknown %s schema key: %s", key, rkey)
+				}
+				if _, err = compileJSONSchema(rval); err != nil {
+					key += "." + rkey
+					break
+				}
+			}
+		case schemaDescription:
+			if _, ok := wamp.AsString(val); !ok {
+				return nil, fmt.Errorf("%s must be a string", key)
+			}
+		default:
+			return nil, fmt.Errorf("unknown schema key: %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s schema: %s", key, err)
+		}
+	}
+	return s, nil
+}
+
+// validate checks that the positional and keyword arguments of a message
+// match the schema.  Missing arguments are validated as an empty list or
+// dictionary.  Returns an error describing the first mismatch found.
+func (s *payloadSchema) validate(args wamp.List, kwargs wamp.Dict) error {
+	if s.args != nil {
+		if args == nil {
+			args = wamp.List{}
+		}
+		if err := s.args.validate(args, schemaArgs); err != nil {
+			return err
+		}
+	}
+	if s.kwargs != nil {
+		if kwargs == nil {
+			kwargs = wamp.Dict{}
+		}
+		if err := s.kwargs.validate(kwargs, schemaKwargs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSchemas compiles the schemas in a realm configuration, keyed by URI.
+func loadSchemas(schemas map[wamp.URI]wamp.Dict, forProcedure bool) (map[wamp.URI]*payloadSchema, error) {
+	compiled := make(map[wamp.URI]*payloadSchema, len(schemas))
+	for uri, desc := range schemas {
+		s, err := newPayloadSchema(desc, forProcedure)
+		if err != nil {
+			return nil, fmt.Errorf("schema for %v: %s", uri, err)
+		}
+		compiled[uri] = s
+	}
+	return compiled, nil
+}
+
+// sortedURIs returns the URIs in the set, in sorted order.
+func sortedURIs(set map[wamp.URI]struct{}) wamp.List {
+	uris := make([]string, 0, len(set))
+	for uri := range set {
+		uris = append(uris, string(uri))
+	}
+	sort.Strings(uris)
+	list := make(wamp.List, len(uris))
+	for i := range uris {
+		list[i] = wamp.URI(uris[i])
+	}
+	return list
+}
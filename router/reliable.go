@@ -0,0 +1,108 @@
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+const (
+	defaultReliableBufferSize    = 1000
+	defaultReliableAckTimeout    = 10 * time.Second
+	defaultReliableResumeTimeout = time.Minute
+
+	detailRedelivered = "redelivered"
+	detailSeq         = "seq"
+)
+
+// pendingEvent is an event sent to a reliable subscriber that the subscriber
+// has not yet acknowledged.
+type pendingEvent struct {
+	seq uint64
+	evt *wamp.Event
+}
+
+// reliableDelivery is the delivery state of a subscriber that subscribed
+// using the "reliable" option.  Each event sent to the subscriber has the
+// next sequence number in its "seq" detail, and is kept until the subscriber
+// acknowledges it using the wamp.subscription.ack meta procedure.  Events
+// that are not acknowledged within the ack timeout are sent again, with the
+// "redelivered" detail set.
+//
+// When the subscriber's session ends with events still unacknowledged, the
+// state is kept for a while, so that a new session with the same authid that
+// subscribes reliably to the same topic, with the same match policy, is sent
+// the unacknowledged events and continues the sequence.
+type reliableDelivery struct {
+	key     string // key to resume delivery, or "" if it cannot be resumed
+	seq     uint64 // sequence number of the last event sent
+	pending []pendingEvent
+
+	// Runs the ack timeout while the subscriber is subscribed, and the
+	// resume timeout after the subscriber's session ends.
+	timer *time.Timer
+}
+
+// reliableKey returns the key used to resume reliable delivery to a new
+// session of the subscriber.  Returns "" if the subscriber has no authid.
+func reliableKey(subscriber *session, sub *subscription) string {
+	subscriber.rLock()
+	authid, _ := wamp.AsString(subscriber.Details["authid"])
+	subscriber.rUnlock()
+	if authid == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %s %s", authid, sub.match, sub.topic)
+}
+
+// add gives the event the next sequence number and keeps it until it is
+// acknowledged.  If more than limit events are unacknowledged, the oldest is
+// discarded, and add returns false.
+func (r *reliableDelivery) add(evt *wamp.Event, limit int) bool {
+	r.seq++
+	evt.Details[detailSeq] = r.seq
+	r.pending = append(r.pending, pendingEvent{seq: r.seq, evt: evt})
+	if len(r.pending) <= limit {
+		return true
+	}
+	r.pending[0] = pendingEvent{}
+	r.pending = r.pending[1:]
+	return false
+}
+
+// ack removes the events with sequence numbers up to and including seq.
+func (r *reliableDelivery) ack(seq uint64) {
+	var n int
+	for n < len(r.pending) && r.pending[n].seq <= seq {
+		r.pending[n] = pendingEvent{}
+		n++
+	}
+	r.pending = r.pending[n:]
+}
+
+// stopTimer stops the ack or resume timer, if running.
+func (r *reliableDelivery) stopTimer() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// redeliveredEvent returns a copy of the pending event, for the subscription,
+// with the redelivered detail set.  The original is not modified, since it
+// may still be queued for sending.
+func (p pendingEvent) redeliveredEvent(subID wamp.ID) *wamp.Event {
+	details := make(wamp.Dict, len(p.evt.Details)+1)
+	for k, v := range p.evt.Details {
+		details[k] = v
+	}
+	details[detailRedelivered] = true
+	return &wamp.Event{
+		Publication:  p.evt.Publication,
+		Subscription: subID,
+		Details:      details,
+		Arguments:    p.evt.Arguments,
+		ArgumentsKw:  p.evt.ArgumentsKw,
+	}
+}
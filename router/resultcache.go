@@ -0,0 +1,120 @@
+package router
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// cachedResult is the result of a call, held in a result cache until it
+// expires.
+type cachedResult struct {
+	args    wamp.List
+	kwargs  wamp.Dict
+	ppt     wamp.Dict // payload passthru options of the result, if any
+	expires time.Time
+}
+
+// details returns the details of a RESULT that sends the cached result.
+func (res *cachedResult) details() wamp.Dict {
+	details := wamp.Dict{}
+	addPassthruDetails(res.ppt, details)
+	return details
+}
+
+// resultCache holds the results of calls to a cacheable registration, so that
+// the dealer can answer repeated calls with identical arguments without
+// invoking a callee.
+//
+// Expired results are removed when looked up, and all expired results are
+// removed at most once per TTL when a new result is stored.  This keeps the
+// cache from holding results stored more than about two TTLs ago.
+type resultCache struct {
+	ttl     time.Duration
+	entries map[string]*cachedResult
+	swept   time.Time
+
+	hits   uint64
+	misses uint64
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:     ttl,
+		entries: map[string]*cachedResult{},
+		swept:   time.Now(),
+	}
+}
+
+// resultCacheKey returns the key identifying calls that have the same result.
+// The callee is given the caller's trust level, and the caller's identity if
+// disclose is true, so a result is only reused for calls from callers that the
+// callee sees the same.  Returns false if the call cannot be cached because its
+// arguments cannot be encoded.
+func resultCacheKey(caller *session, msg *wamp.Call, disclose bool) (string, bool) {
+	var level interface{}
+	if l, ok := caller.TrustLevel(); ok {
+		level = l
+	}
+	var ident wamp.List
+	if disclose {
+		caller.rLock()
+		ident = wamp.List{caller.ID, caller.Details["authid"],
+			caller.Details["authrole"]}
+		caller.rUnlock()
+	}
+	key, err := json.Marshal([]interface{}{
+		msg.Procedure, msg.Options[wamp.OptRKey], level, ident, msg.Arguments,
+		msg.ArgumentsKw})
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// get returns the unexpired result for the key, and counts the cache hit or
+// miss.
+func (c *resultCache) get(key string, now time.Time) (*cachedResult, bool) {
+	res, ok := c.entries[key]
+	if ok && now.Before(res.expires) {
+		c.hits++
+		return res, true
+	}
+	if ok {
+		delete(c.entries, key)
+	}
+	c.misses++
+	return nil, false
+}
+
+// put stores the result for the key, replacing any existing result.  The
+// options are those of the YIELD that sent the result.
+func (c *resultCache) put(key string, args wamp.List, kwargs, options wamp.Dict, now time.Time) {
+	if now.Sub(c.swept) >= c.ttl {
+		for k, res := range c.entries {
+			if !now.Before(res.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+	res := &cachedResult{
+		args:    args,
+		kwargs:  kwargs,
+		expires: now.Add(c.ttl),
+	}
+	if isPassthru(options) {
+		res.ppt = wamp.Dict{}
+		addPassthruDetails(options, res.ppt)
+	}
+	c.entries[key] = res
+}
+
+// invalidate removes all results from the cache, and returns the number of
+// results removed.
+func (c *resultCache) invalidate() int {
+	n := len(c.entries)
+	c.entries = map[string]*cachedResult{}
+	return n
+}
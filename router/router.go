@@ -43,6 +43,14 @@ type Config struct {
 
 	// Enable debug logging for router, realm, broker, dealer
 	Debug bool
+
+	// SpanRecorder, if not nil, records a span for each call and publication
+	// routed by the router, in all realms.  See JSONLExporter and
+	// OTLPExporter for exporters provided by nexus.
+	//
+	// This value is not set via json config, but is configured when
+	// embedding nexus.
+	SpanRecorder SpanRecorder `json:"-"`
 }
 
 // A Router handles new Peers and routes requests to the requested Realm.
@@ -77,6 +85,8 @@ type router struct {
 	realmTemplate *RealmConfig
 	closed        bool
 
+	spanRecorder SpanRecorder
+
 	log   stdlog.StdLog
 	debug bool
 }
@@ -95,6 +105,7 @@ func NewRouter(config *Config, logger stdlog.StdLog) (Router, error) {
 		realmTemplate: config.RealmTemplate,
 		log:           logger,
 		debug:         config.Debug,
+		spanRecorder:  config.SpanRecorder,
 	}
 
 	for _, realmConfig := range config.RealmConfigs {
@@ -364,11 +375,49 @@ func (r *router) addRealm(config *RealmConfig) (*realm, error) {
 		return nil, errors.New("realm already exists: " + string(config.URI))
 	}
 
-	realm, err := newRealm(
-		config,
-		NewBroker(r.log, config.StrictURI, config.AllowDisclose, r.debug, config.PublishFilterFactory),
-		NewDealer(r.log, config.StrictURI, config.AllowDisclose, r.debug),
-		r.log, r.debug)
+	dealer := NewDealer(r.log, config.StrictURI, config.AllowDisclose, r.debug)
+	if config.WaitCalleeTimeout > 0 {
+		dealer.SetWaitCallee(time.Duration(config.WaitCalleeTimeout) * time.Millisecond)
+	}
+	if config.MaxWaitCallee > 0 || config.MaxWaitingCalls > 0 {
+		dealer.SetWaitCalleeLimits(
+			time.Duration(config.MaxWaitCallee)*time.Millisecond,
+			config.MaxWaitingCalls)
+	}
+	broker := NewBroker(r.log, config.StrictURI, config.AllowDisclose, r.debug, config.PublishFilterFactory)
+	if r.spanRecorder != nil {
+		dealer.SetSpanRecorder(r.spanRecorder)
+		broker.SetSpanRecorder(r.spanRecorder)
+	}
+	if err := dealer.SetProcedureSchemas(config.ProcedureSchemas); err != nil {
+		dealer.Close()
+		broker.Close()
+		return nil, err
+	}
+	if err := broker.SetTopicSchemas(config.TopicSchemas); err != nil {
+		dealer.Close()
+		broker.Close()
+		return nil, err
+	}
+	if err := broker.SetEventHistory(config.EventHistory); err != nil {
+		dealer.Close()
+		broker.Close()
+		return nil, err
+	}
+	if err := broker.SetReliableDelivery(config.ReliableDelivery); err != nil {
+		dealer.Close()
+		broker.Close()
+		return nil, err
+	}
+	if err := broker.SetRetainedLimit(config.RetainedLimit); err != nil {
+		dealer.Close()
+		broker.Close()
+		return nil, err
+	}
+	dealer.SetValidatePayloads(config.ValidatePayloads)
+	broker.SetValidatePayloads(config.ValidatePayloads)
+
+	realm, err := newRealm(config, broker, dealer, r.log, r.debug)
 	if err != nil {
 		return nil, err
 	}
@@ -250,6 +250,320 @@ func TestRouterSubscribe(t *testing.T) {
 	}
 }
 
+func TestRouterTrustLevels(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	err = r.AddRealm(&RealmConfig{
+		URI:           testRealm2,
+		AnonymousAuth: true,
+		TrustLevels: &TrustLevelConfig{
+			AuthRoles:   map[string]int{"trusted": 5},
+			AuthMethods: map[string]int{"local": 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := testClientInRealm(r, testRealm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: testTopic})
+	msg, err := wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for SUBSCRIBED")
+	}
+	if _, ok := msg.(*wamp.Subscribed); !ok {
+		t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+	}
+
+	pub, err := testClientInRealm(r, testRealm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.Send(&wamp.Publish{Request: wamp.GlobalID(), Topic: testTopic})
+
+	msg, err = wamp.RecvTimeout(sub, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for EVENT")
+	}
+	event, ok := msg.(*wamp.Event)
+	if !ok {
+		t.Fatal("Expected EVENT, got:", msg.MessageType())
+	}
+	// Trust level for authrole takes precedence over trust level for
+	// authmethod.
+	if level, _ := wamp.AsInt64(event.Details["trustlevel"]); level != 5 {
+		t.Fatal("expected trustlevel 5, got:", event.Details["trustlevel"])
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	evt := func(sub wamp.ID, topic string, n int) *wamp.Event {
+		details := wamp.Dict{}
+		if topic != "" {
+			details[detailTopic] = topic
+		}
+		return &wamp.Event{Subscription: sub, Details: details, Arguments: wamp.List{n}}
+	}
+	recvArgs := func(peer wamp.Peer, n int) string {
+		var got []interface{}
+		for i := 0; i < n; i++ {
+			msg, err := wamp.RecvTimeout(peer, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, msg.(*wamp.Event).Arguments[0])
+		}
+		return fmt.Sprint(got)
+	}
+	cfg := &SlowConsumerConfig{
+		AuthRoles: map[string]SlowConsumerPolicy{
+			"sensor": {Policy: SlowConsumerCoalesce, QueueSize: 3},
+		},
+	}
+	if p := cfg.policy(wamp.Dict{"authrole": "user"}); p.Policy != SlowConsumerDropNewest ||
+		p.QueueSize != defaultSlowConsumerQueueSize || p.Reason != wamp.CloseSlowConsumer {
+		t.Fatal("wrong default policy:", p)
+	}
+	if p := cfg.policy(wamp.Dict{"authrole": "sensor"}); p.Policy != SlowConsumerCoalesce || p.QueueSize != 3 {
+		t.Fatal("wrong authrole policy:", p)
+	}
+	for _, bad := range []SlowConsumerConfig{
+		{Default: SlowConsumerPolicy{Policy: "drop_all"}},
+		{Default: SlowConsumerPolicy{QueueSize: -1}},
+		{AuthRoles: map[string]SlowConsumerPolicy{"x": {Reason: "bad..reason"}}},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Fatal("expected error for config:", bad)
+		}
+	}
+
+	// Drop newest: the message that does not fit is dropped, and the session
+	// is announced as lagging once.
+	var lagging, disconnects int
+	onLagging := func() { lagging++ }
+	onDisconnect := func() { disconnects++ }
+	peer := newTestPeer()
+	q := newOutQueue(peer, cfg.policy(nil), onLagging, onDisconnect)
+	if err := q.send(evt(1, "", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if q.send(evt(1, "", 2)) == nil || q.send(evt(1, "", 3)) == nil {
+		t.Fatal("expected message to be dropped")
+	}
+	if lagging != 1 {
+		t.Fatal("expected one lagging announcement, got", lagging)
+	}
+	if got := recvArgs(peer, 1); got != "[1]" {
+		t.Fatal("wrong messages:", got)
+	}
+	// A session that recovers and lags again soon after is not announced
+	// again, until the report interval has passed.
+	q.send(evt(1, "", 4))
+	q.send(evt(1, "", 5))
+	if lagging != 1 {
+		t.Fatal("expected no lagging announcement after recovering, got", lagging)
+	}
+	recvArgs(peer, 1)
+	q.lagReported = q.lagReported.Add(-lagReportInterval)
+	q.send(evt(1, "", 6))
+	q.send(evt(1, "", 7))
+	if lagging != 2 {
+		t.Fatal("expected lagging announcement after report interval, got", lagging)
+	}
+	recvArgs(peer, 1)
+	q.close()
+	if q.send(evt(1, "", 8)) == nil {
+		t.Fatal("expected error sending after close")
+	}
+
+	// Drop oldest and coalesce: overflowing messages are queued.  Pretend the
+	// overflow queue is already draining, to inspect it.
+	peer = newTestPeer()
+	q = newOutQueue(peer, SlowConsumerPolicy{Policy: SlowConsumerDropOldest, QueueSize: 2}, nil, nil)
+	q.send(evt(1, "", 1))
+	q.drainDone = make(chan struct{})
+	for i := 2; i <= 4; i++ {
+		if err := q.send(evt(1, "", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	q.drainDone = done
+	go q.drain(done)
+	if got := recvArgs(peer, 3); got != "[1 3 4]" {
+		t.Fatal("wrong messages:", got)
+	}
+	<-done
+
+	// Drop oldest drops only events from the overflow queue.  A message that
+	// does not fit, when there is no event to drop, is dropped with an error.
+	peer = newTestPeer()
+	q = newOutQueue(peer, SlowConsumerPolicy{Policy: SlowConsumerDropOldest, QueueSize: 2}, nil, nil)
+	q.send(&wamp.Invocation{Request: 1})
+	q.drainDone = make(chan struct{})
+	q.send(&wamp.Invocation{Request: 2})
+	q.send(evt(1, "", 3))
+	if err := q.send(&wamp.Invocation{Request: 4}); err != nil {
+		t.Fatal("expected event to be dropped in place of INVOCATION:", err)
+	}
+	if q.send(&wamp.Invocation{Request: 5}) == nil {
+		t.Fatal("expected INVOCATION to be dropped")
+	}
+	done = make(chan struct{})
+	q.drainDone = done
+	go q.drain(done)
+	var got []wamp.ID
+	for i := 0; i < 3; i++ {
+		msg, err := wamp.RecvTimeout(peer, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inv, ok := msg.(*wamp.Invocation)
+		if !ok {
+			t.Fatal("expected INVOCATION, got:", msg.MessageType())
+		}
+		got = append(got, inv.Request)
+	}
+	if fmt.Sprint(got) != "[1 2 4]" {
+		t.Fatal("wrong messages:", got)
+	}
+	<-done
+
+	peer = newTestPeer()
+	q = newOutQueue(peer, cfg.policy(wamp.Dict{"authrole": "sensor"}), nil, nil)
+	q.send(evt(1, "a", 1))
+	q.drainDone = make(chan struct{})
+	q.send(evt(1, "a", 2))
+	q.send(evt(1, "b", 3))
+	q.send(evt(1, "a", 4)) // replaces 2
+	q.send(evt(2, "a", 5))
+	done = make(chan struct{})
+	q.drainDone = done
+	go q.drain(done)
+	if got := recvArgs(peer, 4); got != "[1 4 3 5]" {
+		t.Fatal("wrong messages:", got)
+	}
+	<-done
+	q.close()
+
+	// Block: waits for room, up to the timeout.
+	peer = newTestPeer()
+	q = newOutQueue(peer, SlowConsumerPolicy{Policy: SlowConsumerBlock, BlockTimeout: 50}, nil, nil)
+	q.send(evt(1, "", 1))
+	if q.send(evt(1, "", 2)) == nil {
+		t.Fatal("expected block to time out")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-peer.Recv()
+	}()
+	if err := q.send(evt(1, "", 3)); err != nil {
+		t.Fatal("expected send after waiting for room:", err)
+	}
+	// Sending without waiting drops the message instead of blocking.
+	start := time.Now()
+	if q.sendNoWait(evt(1, "", 4)) == nil || time.Since(start) >= 50*time.Millisecond {
+		t.Fatal("expected message to be dropped without waiting")
+	}
+
+	// Disconnect: the session is disconnected once.
+	peer = newTestPeer()
+	q = newOutQueue(peer, SlowConsumerPolicy{Policy: SlowConsumerDisconnect}, onLagging, onDisconnect)
+	q.send(evt(1, "", 1))
+	q.send(evt(1, "", 2))
+	q.send(evt(1, "", 3))
+	if disconnects != 1 {
+		t.Fatal("expected one disconnect, got", disconnects)
+	}
+}
+
+func TestRouterSlowConsumer(t *testing.T) {
+	defer leaktest.Check(t)()
+	r, err := newTestRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	err = r.AddRealm(&RealmConfig{
+		URI:           testRealm2,
+		AnonymousAuth: true,
+		SlowConsumer: &SlowConsumerConfig{
+			Default: SlowConsumerPolicy{Policy: SlowConsumerDisconnect},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(topic wamp.URI) *wamp.Session {
+		sess, err := testClientInRealm(r, testRealm2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Send(&wamp.Subscribe{Request: wamp.GlobalID(), Topic: topic})
+		msg, err := wamp.RecvTimeout(sess, time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for SUBSCRIBED")
+		}
+		if _, ok := msg.(*wamp.Subscribed); !ok {
+			t.Fatal("Expected SUBSCRIBED, got:", msg.MessageType())
+		}
+		return sess
+	}
+	monitor := subscribe(wamp.MetaEventSessionOnLagging)
+	defer monitor.Close()
+	slow := subscribe(testTopic)
+	defer slow.Close()
+
+	pub, err := testClientInRealm(r, testRealm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	// Publish more events than fit in the slow subscriber's queue.
+	for i := 0; i < 20; i++ {
+		pub.Send(&wamp.Publish{Request: wamp.GlobalID(), Topic: testTopic})
+	}
+
+	msg, err := wamp.RecvTimeout(monitor, time.Second)
+	if err != nil {
+		t.Fatal("Timed out waiting for on_lagging meta event")
+	}
+	event, ok := msg.(*wamp.Event)
+	if !ok {
+		t.Fatal("Expected EVENT, got:", msg.MessageType())
+	}
+	if id, _ := wamp.AsID(event.Arguments[0]); id != slow.ID {
+		t.Fatal("wrong session in on_lagging event:", event.Arguments)
+	}
+	if event.ArgumentsKw["policy"] != SlowConsumerDisconnect {
+		t.Fatal("wrong policy in on_lagging event:", event.ArgumentsKw)
+	}
+
+	// The slow subscriber is disconnected with the slow consumer reason.
+	for {
+		msg, err = wamp.RecvTimeout(slow, 2*time.Second)
+		if err != nil {
+			t.Fatal("Timed out waiting for GOODBYE")
+		}
+		if goodbye, ok := msg.(*wamp.Goodbye); ok {
+			if goodbye.Reason != wamp.CloseSlowConsumer {
+				t.Fatal("wrong GOODBYE reason:", goodbye.Reason)
+			}
+			break
+		}
+	}
+}
+
 func TestPublishAcknowledge(t *testing.T) {
 	defer leaktest.Check(t)()
 	r, err := newTestRouter()
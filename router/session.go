@@ -13,6 +13,16 @@ type session struct {
 
 	killChan chan *wamp.Goodbye
 	rwlock   sync.RWMutex
+
+	// Trust level assigned to the session by the realm.  This is only set
+	// when the realm is configured with trust levels.
+	trustLevel    int
+	hasTrustLevel bool
+
+	// Applies the realm's slow-consumer policy to messages sent by the
+	// broker and dealer.  This is only set when the realm is configured with
+	// a slow-consumer policy.
+	out *outQueue
 }
 
 // newSession creates a new lockable session.
@@ -31,6 +41,29 @@ func newSession(peer wamp.Peer, sid wamp.ID, details wamp.Dict) *session {
 	}
 }
 
+// detachedSession returns a copy of the session that has only its ID, trust
+// level, and the string-valued details, such as authid and authrole, that
+// identify it.  The copy has no peer, so it does not keep the session's
+// connection or outbound queue after the session ends.
+func detachedSession(s *session) *session {
+	s.rLock()
+	details := make(wamp.Dict, len(s.Details))
+	for k, v := range s.Details {
+		if str, ok := wamp.AsString(v); ok {
+			details[k] = str
+		}
+	}
+	s.rUnlock()
+	return &session{
+		Session: wamp.Session{
+			ID:      s.ID,
+			Details: details,
+		},
+		trustLevel:    s.trustLevel,
+		hasTrustLevel: s.hasTrustLevel,
+	}
+}
+
 func (s *session) rLock()   { s.rwlock.RLock() }
 func (s *session) rUnlock() { s.rwlock.RUnlock() }
 func (s *session) lock()    { s.rwlock.Lock() }
@@ -49,6 +82,44 @@ func (s *session) kill(goodbye *wamp.Goodbye) bool {
 	return true
 }
 
+// send sends a message from the broker or dealer to the session, without
+// blocking unless the session's slow-consumer policy is to block.  Returns an
+// error if the message is dropped.
+func (s *session) send(msg wamp.Message) error {
+	if s.out == nil {
+		return s.TrySend(msg)
+	}
+	return s.out.send(msg)
+}
+
+// sendNoWait is the same as send, except that it never blocks, even if the
+// session's slow-consumer policy is to block.
+func (s *session) sendNoWait(msg wamp.Message) error {
+	if s.out == nil {
+		return s.TrySend(msg)
+	}
+	return s.out.sendNoWait(msg)
+}
+
+// encodesEvents returns true if the session's peer can be sent a
+// wamp.EncodedEvent in place of an EVENT.
+func (s *session) encodesEvents() bool {
+	p, ok := s.Peer.(wamp.EncodedEventPeer)
+	return ok && p.EncodesEvents()
+}
+
+// closeOut stops sending messages queued by the slow-consumer policy.  This
+// must be called before closing the session's peer.
+func (s *session) closeOut() {
+	if s.out != nil {
+		s.out.close()
+	}
+}
+
+// TrustLevel returns the trust level assigned to the session, and false if
+// the session was not assigned a trust level.
+func (s *session) TrustLevel() (int, bool) { return s.trustLevel, s.hasTrustLevel }
+
 // String returns the session ID as a string.
 func (s *session) String() string { return s.Session.String() }
 
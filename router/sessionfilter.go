@@ -0,0 +1,155 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+const (
+	// allowPrefix is the prefix of the REGISTER options that list the
+	// sessions that are allowed to call the registration.
+	allowPrefix = "allow_"
+
+	// fromPrefix is the prefix of the SUBSCRIBE options that list the
+	// sessions that the subscriber receives events from.
+	fromPrefix = "from_"
+
+	// filterSession is the name, after the prefix, of the option that lists
+	// allowed session IDs.
+	filterSession = "session"
+)
+
+// sessionFilter restricts the sessions that are allowed to call a
+// registration, or that a subscriber receives events from.  This is the same
+// as the "eligible" and "eligible_" filters of a PUBLISH, except that the
+// callee or subscriber sets the filter.
+//
+// A session is allowed if it has one of the allowed session IDs, if any, and
+// has an allowed value of each attribute, such as "authrole" or "authid".
+type sessionFilter struct {
+	ids   []wamp.ID           // allowed session IDs, nil if any
+	attrs map[string][]string // attribute -> sorted allowed values
+}
+
+// newSessionFilter gets a session filter from the options that have the
+// prefix.  The option named prefix+"session" lists the allowed session IDs,
+// and each other option named prefix+"<attribute>" lists the allowed values
+// of the session attribute.  If there are no such options, then nil is
+// returned.
+func newSessionFilter(options wamp.Dict, prefix string) (*sessionFilter, error) {
+	var filter *sessionFilter
+	for k, values := range options {
+		if !strings.HasPrefix(k, prefix) || len(k) == len(prefix) {
+			continue
+		}
+		vals, ok := wamp.AsList(values)
+		if !ok || len(vals) == 0 {
+			return nil, fmt.Errorf("invalid %s %v (must be non-empty list)",
+				k, values)
+		}
+		if filter == nil {
+			filter = &sessionFilter{}
+		}
+		attr := k[len(prefix):]
+		if attr == filterSession {
+			ids := make([]wamp.ID, len(vals))
+			for i := range vals {
+				id, ok := wamp.AsID(vals[i])
+				if !ok {
+					return nil, fmt.Errorf("invalid %s value: %v", k, vals[i])
+				}
+				ids[i] = id
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			filter.ids = ids
+			continue
+		}
+		vallist := make([]string, len(vals))
+		for i := range vals {
+			val, ok := wamp.AsString(vals[i])
+			if !ok || val == "" {
+				return nil, fmt.Errorf("invalid %s value: %v", k, vals[i])
+			}
+			vallist[i] = val
+		}
+		sort.Strings(vallist)
+		if filter.attrs == nil {
+			filter.attrs = map[string][]string{}
+		}
+		filter.attrs[attr] = vallist
+	}
+	return filter, nil
+}
+
+// allowed returns true if the filter is nil, or the session has an allowed ID
+// and an allowed value of each attribute.
+func (f *sessionFilter) allowed(sess *session) bool {
+	if f == nil {
+		return true
+	}
+	if f.ids != nil {
+		i := sort.Search(len(f.ids), func(i int) bool { return f.ids[i] >= sess.ID })
+		if i == len(f.ids) || f.ids[i] != sess.ID {
+			return false
+		}
+	}
+	if len(f.attrs) == 0 {
+		return true
+	}
+	sess.rLock()
+	defer sess.rUnlock()
+	for attr, vals := range f.attrs {
+		sessAttr, _ := wamp.AsString(sess.Details[attr])
+		if sessAttr == "" {
+			return false
+		}
+		i := sort.SearchStrings(vals, sessAttr)
+		if i == len(vals) || vals[i] != sessAttr {
+			return false
+		}
+	}
+	return true
+}
+
+// equal returns true if the filters allow the same sessions.
+func (f *sessionFilter) equal(other *sessionFilter) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+	if len(f.ids) != len(other.ids) || len(f.attrs) != len(other.attrs) {
+		return false
+	}
+	for i := range f.ids {
+		if f.ids[i] != other.ids[i] {
+			return false
+		}
+	}
+	for attr, vals := range f.attrs {
+		otherVals, ok := other.attrs[attr]
+		if !ok || len(vals) != len(otherVals) {
+			return false
+		}
+		for i := range vals {
+			if vals[i] != otherVals[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addOptions adds the filter, as the options with the prefix, to the dict.
+func (f *sessionFilter) addOptions(dict wamp.Dict, prefix string) {
+	if f == nil {
+		return
+	}
+	if f.ids != nil {
+		dict[prefix+filterSession] = f.ids
+	}
+	for attr, vals := range f.attrs {
+		dict[prefix+attr] = vals
+	}
+}
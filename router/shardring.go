@@ -0,0 +1,111 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// shardReplicas is the number of points each shard key occupies on the hash
+// ring.  Using multiple points per key spreads routing keys more evenly among
+// callees.
+const shardReplicas = 32
+
+type ringPoint struct {
+	hash uint64
+	key  string
+}
+
+// shardRing maps routing keys to the callees of a sharded registration.
+//
+// Each callee owns a set of shard keys.  A routing key that is the same as a
+// shard key is routed to the callee owning that shard key.  Any other routing
+// key is routed to a shard key using consistent hashing, so that adding or
+// removing a callee only moves the routing keys of the shards that callee
+// owns.
+type shardRing struct {
+	owners map[string]*session
+	points []ringPoint
+}
+
+func newShardRing() *shardRing {
+	return &shardRing{
+		owners: map[string]*session{},
+	}
+}
+
+// add gives the callee ownership of the shard keys.  An error is returned, and
+// the ring is not modified, if any of the keys is already owned.
+func (r *shardRing) add(callee *session, keys []string) error {
+	for _, key := range keys {
+		if _, ok := r.owners[key]; ok {
+			return fmt.Errorf("shard key %q already registered", key)
+		}
+	}
+	for _, key := range keys {
+		r.owners[key] = callee
+		for i := 0; i < shardReplicas; i++ {
+			r.points = append(r.points, ringPoint{
+				hash: shardHash(fmt.Sprintf("%s#%d", key, i)),
+				key:  key,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return nil
+}
+
+// remove removes all shard keys owned by the callee.
+func (r *shardRing) remove(callee *session) {
+	for key, owner := range r.owners {
+		if owner == callee {
+			delete(r.owners, key)
+		}
+	}
+	points := r.points[:0]
+	for _, p := range r.points {
+		if _, ok := r.owners[p.key]; ok {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// keys returns the shard keys owned by the callee.
+func (r *shardRing) keys(callee *session) []string {
+	var keys []string
+	for key, owner := range r.owners {
+		if owner == callee {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lookup returns the callee that owns the routing key, or nil if there are no
+// callees.
+func (r *shardRing) lookup(rkey string) *session {
+	if owner, ok := r.owners[rkey]; ok {
+		return owner
+	}
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := shardHash(rkey)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i].key]
+}
+
+func shardHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
@@ -0,0 +1,330 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Slow-consumer policies, for when a session's outbound message queue is
+// full.
+const (
+	// SlowConsumerDropNewest drops the message that does not fit in the
+	// queue.  This is the default.
+	SlowConsumerDropNewest = "drop_newest"
+	// SlowConsumerDropOldest holds messages that do not fit in the queue in
+	// an overflow queue, and drops the oldest EVENT in the overflow queue
+	// when it is full.  Other messages are not dropped from the overflow
+	// queue, since that would leave calls unanswered; if the overflow queue
+	// has no EVENT, then the new message is dropped, the same as
+	// SlowConsumerDropNewest.
+	SlowConsumerDropOldest = "drop_oldest"
+	// SlowConsumerCoalesce is the same as SlowConsumerDropOldest, except that
+	// an EVENT in the overflow queue is replaced by a newer EVENT for the same
+	// subscription and topic, so that the session gets the latest event of
+	// each topic.
+	SlowConsumerCoalesce = "coalesce"
+	// SlowConsumerBlock waits for room in the queue, up to the block timeout,
+	// before dropping the message.  This holds up the dealer, or publications
+	// to the topic, while waiting.  Events to reliable subscribers are not
+	// waited for, since they are sent again until acknowledged.
+	SlowConsumerBlock = "block"
+	// SlowConsumerDisconnect closes the session, with a GOODBYE that has the
+	// configured reason.
+	SlowConsumerDisconnect = "disconnect"
+)
+
+const (
+	defaultSlowConsumerQueueSize    = 100
+	defaultSlowConsumerBlockTimeout = time.Second
+
+	// goodbyeTimeout is how long to wait for room in a killed session's
+	// outbound queue to send the GOODBYE.
+	goodbyeTimeout = time.Second
+
+	// lagReportInterval is the minimum time between announcements that a
+	// session is lagging, so that a session whose queue keeps filling and
+	// emptying is not announced for every message.
+	lagReportInterval = 10 * time.Second
+)
+
+var errSlowConsumer = errors.New("slow consumer")
+
+// SlowConsumerConfig configures what the router does when the outbound
+// message queue of a session is full, because the client is not reading
+// messages as fast as they are sent to it.
+type SlowConsumerConfig struct {
+	// AuthRoles maps authrole to the policy of sessions with that authrole.
+	AuthRoles map[string]SlowConsumerPolicy `json:"authroles"`
+	// Default is the policy of sessions whose authrole is not in AuthRoles.
+	Default SlowConsumerPolicy `json:"default"`
+}
+
+// SlowConsumerPolicy is a slow-consumer policy and its limits.
+type SlowConsumerPolicy struct {
+	// Policy is one of "drop_newest" (the default), "drop_oldest",
+	// "coalesce", "block", or "disconnect".
+	Policy string `json:"policy"`
+	// QueueSize is the maximum number of messages in the overflow queue of
+	// the "drop_oldest" and "coalesce" policies.  The default is 100.
+	QueueSize int `json:"queue_size"`
+	// BlockTimeout is the number of milliseconds that the "block" policy
+	// waits for room in the queue.  The default is 1000.
+	BlockTimeout int `json:"block_timeout"`
+	// Reason is the GOODBYE reason used by the "disconnect" policy.  The
+	// default is wamp.close.slow_consumer.
+	Reason wamp.URI `json:"reason"`
+}
+
+// validate checks the policies of the config.
+func (c *SlowConsumerConfig) validate() error {
+	if err := c.Default.validate(); err != nil {
+		return err
+	}
+	for authrole, p := range c.AuthRoles {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("%s for authrole %s", err, authrole)
+		}
+	}
+	return nil
+}
+
+func (p *SlowConsumerPolicy) validate() error {
+	switch p.Policy {
+	case "", SlowConsumerDropNewest, SlowConsumerDropOldest,
+		SlowConsumerCoalesce, SlowConsumerBlock, SlowConsumerDisconnect:
+	default:
+		return fmt.Errorf("invalid slow consumer policy %q", p.Policy)
+	}
+	if p.QueueSize < 0 || p.BlockTimeout < 0 {
+		return fmt.Errorf("invalid slow consumer policy %+v (values must not be negative)", *p)
+	}
+	if p.Reason != "" && !p.Reason.ValidURI(false, "") {
+		return fmt.Errorf("invalid slow consumer reason %q", p.Reason)
+	}
+	return nil
+}
+
+// policy returns the policy of the session with the details, with defaults
+// applied.
+func (c *SlowConsumerConfig) policy(details wamp.Dict) SlowConsumerPolicy {
+	authrole, _ := wamp.AsString(details["authrole"])
+	p, ok := c.AuthRoles[authrole]
+	if !ok {
+		p = c.Default
+	}
+	if p.Policy == "" {
+		p.Policy = SlowConsumerDropNewest
+	}
+	if p.QueueSize == 0 {
+		p.QueueSize = defaultSlowConsumerQueueSize
+	}
+	if p.BlockTimeout == 0 {
+		p.BlockTimeout = int(defaultSlowConsumerBlockTimeout / time.Millisecond)
+	}
+	if p.Reason == "" {
+		p.Reason = wamp.CloseSlowConsumer
+	}
+	return p
+}
+
+// outQueue applies a slow-consumer policy to the messages sent to a session.
+// Messages are sent to the session's peer without blocking while its queue
+// has room.  When the queue is full, the session is lagging, and the policy
+// decides what happens to the message.
+//
+// The "drop_oldest" and "coalesce" policies hold messages in an overflow
+// queue, which a goroutine drains into the peer as room becomes available.
+// While the overflow queue has messages, new messages are added to it, so
+// that messages are delivered in order.
+type outQueue struct {
+	peer   wamp.Peer
+	policy SlowConsumerPolicy
+
+	// Called, without the lock held, when the session starts lagging and
+	// when the "disconnect" policy closes the session.  onLagging is called
+	// at most once every lagReportInterval.
+	onLagging    func()
+	onDisconnect func()
+
+	mu           sync.Mutex
+	overflow     []wamp.Message
+	lagging      bool
+	lagReported  time.Time
+	disconnected bool
+	closed       bool
+	drainDone    chan struct{} // nil if not draining
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+func newOutQueue(peer wamp.Peer, policy SlowConsumerPolicy, onLagging, onDisconnect func()) *outQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &outQueue{
+		peer:         peer,
+		policy:       policy,
+		onLagging:    onLagging,
+		onDisconnect: onDisconnect,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// send sends the message according to the policy.  Returns an error if the
+// message is dropped.
+func (q *outQueue) send(msg wamp.Message) error {
+	return q.sendMsg(msg, true)
+}
+
+// sendNoWait is the same as send, except that the "block" policy drops the
+// message instead of waiting for room in the queue.
+func (q *outQueue) sendNoWait(msg wamp.Message) error {
+	return q.sendMsg(msg, false)
+}
+
+func (q *outQueue) sendMsg(msg wamp.Message, wait bool) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errors.New("session closed")
+	}
+	if q.drainDone == nil {
+		if err := q.peer.TrySend(msg); err == nil {
+			q.lagging = false
+			q.mu.Unlock()
+			return nil
+		}
+	}
+	var report bool
+	if !q.lagging {
+		q.lagging = true
+		if now := time.Now(); now.Sub(q.lagReported) >= lagReportInterval {
+			q.lagReported = now
+			report = true
+		}
+	}
+
+	var err error
+	var disconnect bool
+	switch q.policy.Policy {
+	case SlowConsumerDropOldest, SlowConsumerCoalesce:
+		err = q.enqueue(msg)
+	case SlowConsumerBlock:
+		if !wait {
+			err = errors.New("blocked")
+			break
+		}
+		timeout := time.Duration(q.policy.BlockTimeout) * time.Millisecond
+		ctx, cancel := context.WithTimeout(q.ctx, timeout)
+		err = q.peer.SendCtx(ctx, msg)
+		cancel()
+	case SlowConsumerDisconnect:
+		disconnect = !q.disconnected
+		q.disconnected = true
+		err = errSlowConsumer
+	default:
+		err = errors.New("blocked")
+	}
+	q.mu.Unlock()
+
+	if report && q.onLagging != nil {
+		q.onLagging()
+	}
+	if disconnect && q.onDisconnect != nil {
+		q.onDisconnect()
+	}
+	return err
+}
+
+// enqueue adds the message to the overflow queue, and starts draining the
+// queue if not already draining.  Returns an error if the message is dropped
+// because the overflow queue is full and has no EVENT to drop in its place.
+// Must be called with the lock held.
+func (q *outQueue) enqueue(msg wamp.Message) error {
+	if evt, ok := wamp.AsEvent(msg); ok && q.policy.Policy == SlowConsumerCoalesce {
+		for i := range q.overflow {
+			if queued, ok := wamp.AsEvent(q.overflow[i]); ok && sameTopic(queued, evt) {
+				q.overflow[i] = msg
+				return nil
+			}
+		}
+	}
+	if len(q.overflow) >= q.policy.QueueSize && !q.dropOldestEvent() {
+		return errors.New("overflow queue full")
+	}
+	q.overflow = append(q.overflow, msg)
+	if q.drainDone == nil {
+		q.drainDone = make(chan struct{})
+		go q.drain(q.drainDone)
+	}
+	return nil
+}
+
+// dropOldestEvent removes the oldest EVENT from the overflow queue.  Returns
+// false if the overflow queue has no EVENT.  Must be called with the lock
+// held.
+func (q *outQueue) dropOldestEvent() bool {
+	for i := range q.overflow {
+		if _, ok := wamp.AsEvent(q.overflow[i]); ok {
+			last := len(q.overflow) - 1
+			copy(q.overflow[i:], q.overflow[i+1:])
+			q.overflow[last] = nil
+			q.overflow = q.overflow[:last]
+			return true
+		}
+	}
+	return false
+}
+
+// sameTopic returns true if the events are for the same subscription and, for
+// a pattern-based subscription, the same topic.
+func sameTopic(a, b *wamp.Event) bool {
+	return a.Subscription == b.Subscription &&
+		a.Details[detailTopic] == b.Details[detailTopic]
+}
+
+// drain sends the messages in the overflow queue to the peer, waiting for
+// room in the peer's queue, until the overflow queue is empty or the queue is
+// closed.
+func (q *outQueue) drain(done chan struct{}) {
+	defer close(done)
+	for {
+		q.mu.Lock()
+		if len(q.overflow) == 0 || q.closed {
+			q.overflow = nil
+			q.drainDone = nil
+			q.lagging = false
+			q.mu.Unlock()
+			return
+		}
+		msg := q.overflow[0]
+		q.overflow[0] = nil
+		q.overflow = q.overflow[1:]
+		q.mu.Unlock()
+
+		if err := q.peer.SendCtx(q.ctx, msg); err != nil {
+			q.mu.Lock()
+			q.overflow = nil
+			q.drainDone = nil
+			q.mu.Unlock()
+			return
+		}
+	}
+}
+
+// close stops sending messages, and waits for the overflow queue to stop
+// draining, so that nothing is sent to the peer after it is closed.
+func (q *outQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cancel()
+	done := q.drainDone
+	q.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
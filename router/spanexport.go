@@ -0,0 +1,330 @@
+package router
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/stdlog"
+	"github.com/gammazero/nexus/wamp"
+)
+
+const (
+	// DefaultOTLPEndpoint is the URL of the traces endpoint of an
+	// OpenTelemetry collector, running locally, that receives OTLP/HTTP.
+	DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+	// spanQueueSize is the number of spans an exporter holds while waiting to
+	// export them.  Spans recorded while the queue is full are dropped.
+	spanQueueSize = 4096
+
+	// otlpBatchSize is the maximum number of spans sent in one export
+	// request, and otlpBatchInterval is the longest time spans wait to be
+	// sent.
+	otlpBatchSize     = 512
+	otlpBatchInterval = 5 * time.Second
+)
+
+// spanQueue hands off spans, recorded by the broker and dealer, to an
+// exporter goroutine.  Recording a span never blocks.
+type spanQueue struct {
+	spans   chan *Span
+	done    chan struct{}
+	mutex   sync.Mutex
+	closed  bool
+	dropped int
+}
+
+func newSpanQueue(export func(spans <-chan *Span)) *spanQueue {
+	q := &spanQueue{
+		spans: make(chan *Span, spanQueueSize),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		export(q.spans)
+		close(q.done)
+	}()
+	return q
+}
+
+func (q *spanQueue) record(span *Span) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	select {
+	case q.spans <- span:
+	default:
+		q.dropped++
+	}
+}
+
+// close stops accepting spans and waits for the queued spans to be exported.
+func (q *spanQueue) close() {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.spans)
+	q.mutex.Unlock()
+	<-q.done
+}
+
+// Dropped returns the number of spans dropped because the exporter could not
+// keep up with the spans being recorded.
+func (q *spanQueue) Dropped() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
+// JSONLExporter is a SpanRecorder that writes each span as a line of JSON.
+type JSONLExporter struct {
+	*spanQueue
+	closer io.Closer
+}
+
+// NewJSONLExporter creates a JSONLExporter that writes spans to w.
+func NewJSONLExporter(w io.Writer) *JSONLExporter {
+	enc := json.NewEncoder(w)
+	return &JSONLExporter{
+		spanQueue: newSpanQueue(func(spans <-chan *Span) {
+			for span := range spans {
+				enc.Encode(span)
+			}
+		}),
+	}
+}
+
+// NewJSONLFileExporter creates a JSONLExporter that appends spans to the
+// named file, creating the file if it does not exist.
+func NewJSONLFileExporter(path string) (*JSONLExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJSONLExporter(f)
+	e.closer = f
+	return e, nil
+}
+
+// RecordSpan queues the span to be written.
+func (e *JSONLExporter) RecordSpan(span *Span) { e.record(span) }
+
+// Close writes any queued spans and closes the file, if the exporter was
+// created by NewJSONLFileExporter.  Close must be called after the router is
+// closed.
+func (e *JSONLExporter) Close() error {
+	e.close()
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+// OTLPExporter is a SpanRecorder that sends spans to an OpenTelemetry
+// collector, or other OTLP-compatible receiver, using OTLP/HTTP with JSON
+// encoding.  Spans are sent in batches.
+type OTLPExporter struct {
+	*spanQueue
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	log         stdlog.StdLog
+}
+
+// NewOTLPExporter creates an OTLPExporter that sends spans to the endpoint
+// URL, which is DefaultOTLPEndpoint if empty.  The spans are sent as coming
+// from the named service, which is "nexus" if empty.  Errors sending spans
+// are written to the logger, if not nil.
+func NewOTLPExporter(endpoint, serviceName string, logger stdlog.StdLog) *OTLPExporter {
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	if serviceName == "" {
+		serviceName = "nexus"
+	}
+	e := &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		log:         logger,
+	}
+	e.spanQueue = newSpanQueue(e.export)
+	return e
+}
+
+// RecordSpan queues the span to be sent.
+func (e *OTLPExporter) RecordSpan(span *Span) { e.record(span) }
+
+// Close sends any queued spans.  Close must be called after the router is
+// closed.
+func (e *OTLPExporter) Close() error {
+	e.close()
+	return nil
+}
+
+// export sends batches of spans until the span channel is closed.
+func (e *OTLPExporter) export(spans <-chan *Span) {
+	ticker := time.NewTicker(otlpBatchInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, otlpBatchSize)
+	for {
+		select {
+		case span, ok := <-spans:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		e.logf("cannot encode spans: %s", err)
+		return
+	}
+	rsp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.logf("cannot send spans: %s", err)
+		return
+	}
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		e.logf("cannot send spans: %s", rsp.Status)
+	}
+}
+
+func (e *OTLPExporter) logf(format string, args ...interface{}) {
+	if e.log != nil {
+		e.log.Printf("OTLP exporter "+format, args...)
+	}
+}
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindServer   = 2
+	otlpKindProducer = 4
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+// request creates an OTLP ExportTraceServiceRequest containing the spans.
+//
+// Spans with a trace ID, supplied by a caller or publisher, that is not a
+// valid OTLP trace ID are left out, since the receiver would reject the
+// whole request.
+func (e *OTLPExporter) request(batch []*Span) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		if !isHexID(s.TraceID, 16) {
+			continue
+		}
+		kind := otlpKindServer
+		if s.Kind == SpanKindPublish {
+			kind = otlpKindProducer
+		}
+		status := map[string]interface{}{"code": otlpStatusOK}
+		if s.Error != "" {
+			status = map[string]interface{}{
+				"code":    otlpStatusError,
+				"message": string(s.Error),
+			}
+		}
+		attrs := []map[string]interface{}{
+			otlpAttribute("wamp.kind", s.Kind),
+		}
+		for k, v := range s.Attributes {
+			attrs = append(attrs, otlpAttribute("wamp."+k, v))
+		}
+		span := map[string]interface{}{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		}
+		if isHexID(s.ParentSpanID, 8) {
+			span["parentSpanId"] = s.ParentSpanID
+		}
+		spans = append(spans, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{
+						otlpAttribute("service.name", e.serviceName),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{
+							"name": "github.com/gammazero/nexus/router",
+						},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// isHexID returns true if id is the hex encoding of a non-zero ID of n bytes.
+func isHexID(id string, n int) bool {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != n {
+		return false
+	}
+	for i := range b {
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// otlpAttribute creates an OTLP KeyValue from a span attribute.
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int, int64, uint64, wamp.ID:
+		// OTLP/JSON encodes 64-bit integers as strings.
+		v = map[string]interface{}{"intValue": fmt.Sprint(value)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]interface{}{"key": key, "value": v}
+}
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// testSpanRecorder is a SpanRecorder that makes recorded spans available on
+// a channel.
+type testSpanRecorder struct {
+	spans chan *Span
+}
+
+func newTestSpanRecorder() *testSpanRecorder {
+	return &testSpanRecorder{spans: make(chan *Span, 16)}
+}
+
+func (r *testSpanRecorder) RecordSpan(span *Span) { r.spans <- span }
+
+func (r *testSpanRecorder) recv(t *testing.T) *Span {
+	select {
+	case span := <-r.spans:
+		return span
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for span")
+	}
+	return nil
+}
+
+func testSpan(name string) *Span {
+	start := time.Now()
+	return &Span{
+		TraceID:      newTraceID(),
+		SpanID:       newSpanID(),
+		ParentSpanID: newSpanID(),
+		Name:         name,
+		Kind:         SpanKindCall,
+		Start:        start,
+		End:          start.Add(time.Millisecond),
+		Attributes:   map[string]interface{}{"caller": wamp.ID(1234)},
+	}
+}
+
+func TestJSONLExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter := NewJSONLExporter(&buf)
+	spans := []*Span{testSpan("nexus.test.one"), testSpan("nexus.test.two")}
+	spans[1].Error = wamp.ErrCanceled
+	for _, span := range spans {
+		exporter.RecordSpan(span)
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Spans recorded after close are ignored.
+	exporter.RecordSpan(testSpan("nexus.test.three"))
+
+	scanner := bufio.NewScanner(&buf)
+	var i int
+	for ; scanner.Scan(); i++ {
+		if i >= len(spans) {
+			t.Fatal("too many spans written")
+		}
+		var span Span
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatal("bad span JSON:", err)
+		}
+		if span.TraceID != spans[i].TraceID || span.SpanID != spans[i].SpanID ||
+			span.ParentSpanID != spans[i].ParentSpanID {
+			t.Fatal("wrong span IDs:", scanner.Text())
+		}
+		if span.Name != spans[i].Name || span.Error != spans[i].Error {
+			t.Fatal("wrong span:", scanner.Text())
+		}
+		if !span.End.Equal(spans[i].End) {
+			t.Fatal("wrong span end time:", span.End)
+		}
+	}
+	if i != len(spans) {
+		t.Fatal("expected", len(spans), "spans, got", i)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Error("wrong content type:", r.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req map[string]interface{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Error("bad request JSON:", err)
+		}
+		requests <- req
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL, "nexus-test", logger)
+	span := testSpan("nexus.test.procedure")
+	span.Error = wamp.ErrCanceled
+	exporter.RecordSpan(span)
+	// Span with a trace ID that is not valid for OTLP is not sent.
+	badSpan := testSpan("nexus.test.bad")
+	badSpan.TraceID = "not-hex"
+	exporter.RecordSpan(badSpan)
+	exporter.Close()
+
+	var req map[string]interface{}
+	select {
+	case req = <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("exporter did not send spans")
+	}
+
+	// Pull the resource and spans out of the request.
+	resourceSpans := req["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := resourceSpans["resource"].(map[string]interface{})
+	attr := resource["attributes"].([]interface{})[0].(map[string]interface{})
+	if attr["key"] != "service.name" ||
+		attr["value"].(map[string]interface{})["stringValue"] != "nexus-test" {
+		t.Fatal("wrong service name attribute:", attr)
+	}
+	scopeSpans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	spans := scopeSpans["spans"].([]interface{})
+	if len(spans) != 1 {
+		t.Fatal("expected 1 span, got", len(spans))
+	}
+
+	s := spans[0].(map[string]interface{})
+	if s["traceId"] != span.TraceID || s["spanId"] != span.SpanID ||
+		s["parentSpanId"] != span.ParentSpanID {
+		t.Fatal("wrong span IDs:", s)
+	}
+	if s["name"] != "nexus.test.procedure" {
+		t.Fatal("wrong span name:", s["name"])
+	}
+	if s["kind"] != float64(otlpKindServer) {
+		t.Fatal("wrong span kind:", s["kind"])
+	}
+	status := s["status"].(map[string]interface{})
+	if status["code"] != float64(otlpStatusError) ||
+		status["message"] != string(wamp.ErrCanceled) {
+		t.Fatal("wrong span status:", status)
+	}
+	var foundCaller bool
+	for _, a := range s["attributes"].([]interface{}) {
+		attr := a.(map[string]interface{})
+		if attr["key"] == "wamp.caller" {
+			if attr["value"].(map[string]interface{})["intValue"] != "1234" {
+				t.Fatal("wrong caller attribute:", attr)
+			}
+			foundCaller = true
+		}
+	}
+	if !foundCaller {
+		t.Fatal("missing caller attribute")
+	}
+}
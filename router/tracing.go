@@ -0,0 +1,100 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gammazero/nexus/wamp"
+)
+
+// Kinds of spans recorded by the router.
+const (
+	// SpanKindCall is the kind of span for a call routed by the dealer, from
+	// CALL until RESULT or ERROR is sent to the caller.
+	SpanKindCall = "call"
+	// SpanKindPublish is the kind of span for a publication routed by the
+	// broker, from PUBLISH until EVENTs are sent to all subscribers.
+	SpanKindPublish = "publish"
+)
+
+// Span describes the routing of a single call or publication through the
+// router.
+//
+// The TraceID is supplied by the caller or publisher in the "trace_id" CALL
+// or PUBLISH option, or is generated by the router if not supplied.  The
+// SpanID is generated by the router for each span, and the ParentSpanID is
+// the "span_id" CALL or PUBLISH option, if supplied.  The router puts the
+// trace_id and span_id into the details of the INVOCATION or EVENT, and the
+// RESULT or ERROR, so that callees, subscribers, and callers can correlate
+// their own spans with the router's.
+type Span struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Error        wamp.URI               `json:"error,omitempty"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// SpanRecorder is the interface implemented by an object that records the
+// spans of calls and publications routed by the router.
+//
+// RecordSpan is called by the broker and dealer as they route messages, so it
+// must not block.  A SpanRecorder that exports spans should hand them off to
+// another goroutine.  The recorder must not modify the span.
+type SpanRecorder interface {
+	RecordSpan(span *Span)
+}
+
+// newSpan starts a span for the message with the given options.  Returns nil
+// if there is no span recorder and the options do not have a trace ID, since
+// there is then nothing to trace.
+func newSpan(kind string, name wamp.URI, options wamp.Dict, recorder SpanRecorder) *Span {
+	traceID, _ := wamp.AsString(options[wamp.OptTraceID])
+	if traceID == "" {
+		if recorder == nil {
+			return nil
+		}
+		traceID = newTraceID()
+	}
+	parentSpanID, _ := wamp.AsString(options[wamp.OptSpanID])
+	return &Span{
+		TraceID:      traceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: parentSpanID,
+		Name:         string(name),
+		Kind:         kind,
+		Start:        time.Now(),
+		Attributes:   map[string]interface{}{},
+	}
+}
+
+// addDetails puts the span's trace ID and span ID into message details.  Does
+// nothing if the span is nil.
+func (s *Span) addDetails(details wamp.Dict) {
+	if s == nil {
+		return
+	}
+	details[wamp.OptTraceID] = s.TraceID
+	details[wamp.OptSpanID] = s.SpanID
+}
+
+// newTraceID generates a random 16-byte trace ID, hex encoded as is done by
+// OpenTelemetry.
+func newTraceID() string { return randomHex(16) }
+
+// newSpanID generates a random 8-byte span ID, hex encoded as is done by
+// OpenTelemetry.
+func newSpanID() string { return randomHex(8) }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("cannot read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
@@ -222,6 +222,13 @@ func (rs *rawSocketPeer) Send(msg wamp.Message) error {
 	return wamp.SendCtx(rs.ctxSender, rs.wr, msg)
 }
 
+// EncodesEvents returns true if the peer's serializer encodes
+// wamp.EncodedEvent messages, which share the encoding of their payload.
+func (rs *rawSocketPeer) EncodesEvents() bool {
+	_, ok := rs.serializer.(serialize.EventEncoder)
+	return ok
+}
+
 // Close closes the rawsocket peer.  This closes the local send channel, and
 // sends a close control message to the socket to tell the other side to
 // close.
@@ -21,10 +21,19 @@ type CBORSerializer struct{}
 
 // Serialize encodes a Message into a cbor payload.
 func (s *CBORSerializer) Serialize(msg wamp.Message) ([]byte, error) {
+	if evt, ok := msg.(*wamp.EncodedEvent); ok {
+		return s.EncodeEvent(evt)
+	}
 	var b []byte
 	return b, codec.NewEncoderBytes(&b, ch).Encode(msgToList(msg))
 }
 
+// EncodeEvent encodes an EncodedEvent into a cbor payload, encoding its
+// shared payload only once.
+func (s *CBORSerializer) EncodeEvent(msg *wamp.EncodedEvent) ([]byte, error) {
+	return encodeEvent(msg, CBOR, ch)
+}
+
 // Deserialize decodes a cbor payload into a Message.
 func (s *CBORSerializer) Deserialize(data []byte) (wamp.Message, error) {
 	var v []interface{}
@@ -0,0 +1,60 @@
+package serialize
+
+import (
+	"github.com/gammazero/nexus/wamp"
+	"github.com/ugorji/go/codec"
+)
+
+// EventEncoder is implemented by the serializers that encode a
+// wamp.EncodedEvent by encoding its shared payload once for all of the
+// events that share it.
+type EventEncoder interface {
+	EncodeEvent(*wamp.EncodedEvent) ([]byte, error)
+}
+
+// encodeEvent encodes the event, splicing its payload, encoded once for the
+// serialization, into the encoding of the event's other fields.  The result is
+// the same as the encoding of the event's Event.
+func encodeEvent(msg *wamp.EncodedEvent, serialization Serialization, h codec.Handle) ([]byte, error) {
+	payload, err := msg.Payload.Encoded(int(serialization), func(args wamp.List, kwargs wamp.Dict) ([]byte, error) {
+		var b []byte
+		return b, codec.NewEncoderBytes(&b, h).Encode(payloadList(args, kwargs))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	evt := msg.Event
+	var b []byte
+	err = codec.NewEncoderBytes(&b, h).Encode([]interface{}{
+		int(wamp.EVENT), evt.Subscription, evt.Publication, evt.Details})
+	if err != nil {
+		return nil, err
+	}
+	n := len(payloadList(msg.Payload.Arguments, msg.Payload.ArgumentsKw))
+	if n == 0 {
+		return b, nil
+	}
+	if serialization == JSON {
+		// Join "[36,sub,pub,details]" and "[args,kwargs]" into one list.
+		b[len(b)-1] = ','
+		return append(b, payload[1:]...), nil
+	}
+	// The msgpack and CBOR encodings of a list of less than 16 items start
+	// with a byte that has the number of items in its low bits, followed by
+	// the items.
+	b[0] += byte(n)
+	return append(b, payload[1:]...), nil
+}
+
+// payloadList returns the payload items of an EVENT.  The same as for other
+// messages, empty items at the end are omitted.
+func payloadList(args wamp.List, kwargs wamp.Dict) []interface{} {
+	if len(kwargs) != 0 {
+		return []interface{}{args, kwargs}
+	}
+	if len(args) != 0 {
+		return []interface{}{args}
+	}
+	return nil
+}
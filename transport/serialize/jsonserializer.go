@@ -22,10 +22,19 @@ type JSONSerializer struct{}
 
 // Serialize encodes a Message into a json payload.
 func (s *JSONSerializer) Serialize(msg wamp.Message) ([]byte, error) {
+	if evt, ok := msg.(*wamp.EncodedEvent); ok {
+		return s.EncodeEvent(evt)
+	}
 	var b []byte
 	return b, codec.NewEncoderBytes(&b, jh).Encode(msgToList(msg))
 }
 
+// EncodeEvent encodes an EncodedEvent into a json payload, encoding its
+// shared payload only once.
+func (s *JSONSerializer) EncodeEvent(msg *wamp.EncodedEvent) ([]byte, error) {
+	return encodeEvent(msg, JSON, jh)
+}
+
 // Deserialize decodes a json payload into a Message.
 func (s *JSONSerializer) Deserialize(data []byte) (wamp.Message, error) {
 	var v []interface{}
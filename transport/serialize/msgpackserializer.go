@@ -28,11 +28,20 @@ type MessagePackSerializer struct{}
 
 // Serialize encodes a Message into a msgpack payload.
 func (s *MessagePackSerializer) Serialize(msg wamp.Message) ([]byte, error) {
+	if evt, ok := msg.(*wamp.EncodedEvent); ok {
+		return s.EncodeEvent(evt)
+	}
 	var b []byte
 	return b, codec.NewEncoderBytes(&b, mh).Encode(
 		msgToList(msg))
 }
 
+// EncodeEvent encodes an EncodedEvent into a msgpack payload, encoding its
+// shared payload only once.
+func (s *MessagePackSerializer) EncodeEvent(msg *wamp.EncodedEvent) ([]byte, error) {
+	return encodeEvent(msg, MSGPACK, mh)
+}
+
 // Deserialize decodes a msgpack payload into a Message.
 func (s *MessagePackSerializer) Deserialize(data []byte) (wamp.Message, error) {
 	var v []interface{}
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/gammazero/nexus/wamp"
+	"github.com/ugorji/go/codec"
 )
 
 const (
@@ -178,3 +179,38 @@ func msgToList(msg wamp.Message) []interface{} {
 	}
 	return ret
 }
+
+// EncodeValue encodes a single value, instead of a message, using the
+// serialization.  This is used to encode a payload that is sent as an opaque
+// binary argument, such as an encrypted payload in payload passthru mode.
+func EncodeValue(serialization Serialization, v interface{}) ([]byte, error) {
+	h, err := valueHandle(serialization)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	return b, codec.NewEncoderBytes(&b, h).Encode(v)
+}
+
+// DecodeValue decodes a single value that was encoded using the
+// serialization.
+func DecodeValue(serialization Serialization, data []byte) (interface{}, error) {
+	h, err := valueHandle(serialization)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	return v, codec.NewDecoderBytes(data, h).Decode(&v)
+}
+
+func valueHandle(serialization Serialization) (codec.Handle, error) {
+	switch serialization {
+	case JSON:
+		return jh, nil
+	case MSGPACK:
+		return mh, nil
+	case CBOR:
+		return ch, nil
+	}
+	return nil, fmt.Errorf("unsupported serialization: %v", serialization)
+}
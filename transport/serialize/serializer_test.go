@@ -436,6 +436,90 @@ func TestMsgPackToJSON(t *testing.T) {
 	}
 }
 
+func TestEncodeValue(t *testing.T) {
+	value := map[string]interface{}{"args": []interface{}{"hello", 7}}
+	for _, s := range []Serialization{JSON, MSGPACK, CBOR} {
+		b, err := EncodeValue(s, value)
+		if err != nil {
+			t.Fatal("failed to encode value:", err)
+		}
+		v, err := DecodeValue(s, b)
+		if err != nil {
+			t.Fatal("failed to decode value:", err)
+		}
+		dict, ok := wamp.AsDict(v)
+		if !ok {
+			t.Fatalf("decoded value is not dict: %#v", v)
+		}
+		args, ok := wamp.AsList(dict["args"])
+		if !ok || len(args) != 2 {
+			t.Fatalf("wrong decoded args: %#v", dict["args"])
+		}
+		if arg, _ := wamp.AsString(args[0]); arg != "hello" {
+			t.Fatalf("wrong decoded string: %#v", args[0])
+		}
+		if arg, _ := wamp.AsInt64(args[1]); arg != 7 {
+			t.Fatalf("wrong decoded integer: %#v", args[1])
+		}
+	}
+	if _, err := EncodeValue(Serialization(99), value); err == nil {
+		t.Fatal("expected error for unsupported serialization")
+	}
+}
+
+func TestEncodedEvent(t *testing.T) {
+	serializers := map[Serialization]Serializer{
+		JSON:    &JSONSerializer{},
+		MSGPACK: &MessagePackSerializer{},
+		CBOR:    &CBORSerializer{},
+	}
+	payloads := []struct {
+		args   wamp.List
+		kwargs wamp.Dict
+	}{
+		{nil, nil},
+		{wamp.List{"hello", 7}, nil},
+		{nil, wamp.Dict{"count": 3}},
+		{wamp.List{"hello"}, wamp.Dict{"count": 3}},
+	}
+	for _, p := range payloads {
+		payload := wamp.NewSharedPayload(p.args, p.kwargs)
+		for i, subID := range []wamp.ID{1, 123456789} {
+			evt := &wamp.Event{
+				Subscription: subID,
+				Publication:  987654321,
+				Details:      wamp.Dict{"topic": "nexus.test.topic"},
+				Arguments:    p.args,
+				ArgumentsKw:  p.kwargs,
+			}
+			for serialization, s := range serializers {
+				want, err := s.Serialize(evt)
+				if err != nil {
+					t.Fatal("serialization error:", err)
+				}
+				got, err := s.Serialize(&wamp.EncodedEvent{Event: evt, Payload: payload})
+				if err != nil {
+					t.Fatal("serialization error:", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("serialization %d of encoded event differs from event\nexpected: %q\ngot:      %q",
+						serialization, want, got)
+				}
+				// The payload is encoded by the first event.
+				encoded, _ := payload.Encoded(int(serialization), func(wamp.List, wamp.Dict) ([]byte, error) {
+					if i != 0 {
+						t.Fatal("payload encoded again")
+					}
+					return nil, nil
+				})
+				if i != 0 && encoded == nil {
+					t.Fatal("payload not kept")
+				}
+			}
+		}
+	}
+}
+
 func BenchmarkJSON(b *testing.B) {
 	details := detailRolesFeatures()
 	hello := &wamp.Hello{Realm: "nexus.realm", Details: details}
@@ -454,3 +538,29 @@ func BenchmarkJSON(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkEncodedEvent(b *testing.B) {
+	args := make(wamp.List, 100)
+	for i := range args {
+		args[i] = wamp.Dict{"name": fmt.Sprint("item", i), "value": i}
+	}
+	payload := wamp.NewSharedPayload(args, nil)
+	s := &MessagePackSerializer{}
+
+	b.Run("Event", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			evt := &wamp.Event{Subscription: wamp.ID(i), Publication: 1, Details: wamp.Dict{}, Arguments: args}
+			if _, err := s.Serialize(evt); err != nil {
+				b.Fatal("serialization error:", err)
+			}
+		}
+	})
+	b.Run("EncodedEvent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			evt := &wamp.Event{Subscription: wamp.ID(i), Publication: 1, Details: wamp.Dict{}, Arguments: args}
+			if _, err := s.Serialize(&wamp.EncodedEvent{Event: evt, Payload: payload}); err != nil {
+				b.Fatal("serialization error:", err)
+			}
+		}
+	})
+}
@@ -201,6 +201,13 @@ func (w *websocketPeer) Send(msg wamp.Message) error {
 	return wamp.SendCtx(w.ctxSender, w.wr, msg)
 }
 
+// EncodesEvents returns true if the peer's serializer encodes
+// wamp.EncodedEvent messages, which share the encoding of their payload.
+func (w *websocketPeer) EncodesEvents() bool {
+	_, ok := w.serializer.(serialize.EventEncoder)
+	return ok
+}
+
 // Close closes the websocket peer.  This closes the local send channel, and
 // sends a close control message to the websocket to tell the other side to
 // close.
@@ -0,0 +1,82 @@
+package wamp
+
+import "sync"
+
+// SharedPayload is the payload of a publication, shared by the EVENTs that
+// send the publication to its subscribers.  It keeps the payload encoded by
+// each serialization, so that a publication sent to many subscribers has its
+// payload encoded once for each serialization, instead of once for each
+// subscriber.
+type SharedPayload struct {
+	Arguments   List
+	ArgumentsKw Dict
+
+	mu      sync.Mutex
+	encoded map[int][]byte
+}
+
+// NewSharedPayload returns a SharedPayload with the arguments of a
+// publication.
+func NewSharedPayload(args List, kwargs Dict) *SharedPayload {
+	return &SharedPayload{
+		Arguments:   args,
+		ArgumentsKw: kwargs,
+	}
+}
+
+// Encoded returns the payload encoded using the serialization, such as
+// serialize.JSON.  The first call for a serialization calls encode to encode
+// the payload, and later calls return the same bytes, which must not be
+// modified.  It is safe to call Encoded concurrently.
+func (p *SharedPayload) Encoded(serialization int, encode func(List, Dict) ([]byte, error)) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.encoded[serialization]; ok {
+		return b, nil
+	}
+	b, err := encode(p.Arguments, p.ArgumentsKw)
+	if err != nil {
+		return nil, err
+	}
+	if p.encoded == nil {
+		p.encoded = map[int][]byte{}
+	}
+	p.encoded[serialization] = b
+	return b, nil
+}
+
+// EncodedEvent is an EVENT whose payload is shared by the events sent to all
+// the subscribers of a publication.  A serializer encodes an EncodedEvent by
+// splicing the shared payload, encoded once, into the encoding of the rest of
+// the event, which is all that differs between subscribers.
+//
+// The Arguments and ArgumentsKw of the Event are the same as the shared
+// payload's.  An EncodedEvent is only sent to an EncodedEventPeer.
+type EncodedEvent struct {
+	Event   *Event
+	Payload *SharedPayload
+}
+
+func (msg *EncodedEvent) MessageType() MessageType { return EVENT }
+
+// EncodedEventPeer is implemented by a Peer that can be sent an EncodedEvent
+// in place of an Event.
+type EncodedEventPeer interface {
+	Peer
+
+	// EncodesEvents returns true if the peer's serializer encodes
+	// EncodedEvents.
+	EncodesEvents() bool
+}
+
+// AsEvent returns the Event of an EVENT message, which is either an Event or
+// an EncodedEvent.  Returns false if the message is not an EVENT.
+func AsEvent(msg Message) (*Event, bool) {
+	switch m := msg.(type) {
+	case *Event:
+		return m, true
+	case *EncodedEvent:
+		return m.Event, true
+	}
+	return nil, false
+}
@@ -4,18 +4,47 @@ package wamp
 const (
 	// Message option keywords.
 	OptAcknowledge     = "acknowledge"
+	OptAllowAuthID     = "allow_authid"
+	OptAllowAuthRole   = "allow_authrole"
+	OptAllowSession    = "allow_session"
+	OptCacheTTL        = "cache_ttl"
+	OptConcurrency     = "concurrency"
 	OptDiscloseCaller  = "disclose_caller"
 	OptDiscloseMe      = "disclose_me"
 	OptError           = "error"
 	OptExcludeMe       = "exclude_me"
+	OptFailover        = "failover"
+	OptFanout          = "fanout"
+	OptFilter          = "filter"
+	OptFromAuthID      = "from_authid"
+	OptFromAuthRole    = "from_authrole"
+	OptFromSession     = "from_session"
+	OptGetRetained     = "get_retained"
 	OptInvoke          = "invoke"
 	OptMatch           = "match"
+	OptMaxAttempts     = "max_attempts"
+	OptMinTrustLevel   = "min_trustlevel"
 	OptMode            = "mode"
 	OptProcedure       = "procedure"
+	OptPPTCipher       = "ppt_cipher"
+	OptPPTKeyID        = "ppt_keyid"
+	OptPPTScheme       = "ppt_scheme"
+	OptPPTSerializer   = "ppt_serializer"
 	OptProgress        = "progress"
+	OptQueueLimit      = "queue_limit"
+	OptQuorum          = "quorum"
 	OptReason          = "reason"
 	OptReceiveProgress = "receive_progress"
+	OptReliable        = "reliable"
+	OptRetain          = "retain"
+	OptRKey            = "rkey"
+	OptSchema          = "schema"
+	OptShards          = "shards"
+	OptSpanID          = "span_id"
 	OptTimeout         = "timeout"
+	OptTraceID         = "trace_id"
+	OptWaitCallee      = "wait_callee"
+	OptWeight          = "weight"
 
 	// Values for URI matching mode.
 	MatchExact    = "exact"
@@ -33,6 +62,21 @@ const (
 	InvokeRandom     = "random"
 	InvokeFirst      = "first"
 	InvokeLast       = "last"
+	InvokeLeastBusy  = "leastbusy"
+	InvokeWeighted   = "weighted"
+	InvokeSharded    = "sharded"
+
+	// Values for payload passthru mode scheme, serializer, and cipher.
+	PPTSchemeWAMP             = "wamp"
+	PPTSchemeMQTT             = "mqtt"
+	PPTSerializerNative       = "native"
+	PPTSerializerJSON         = "json"
+	PPTSerializerMsgpack      = "msgpack"
+	PPTSerializerCBOR         = "cbor"
+	PPTSerializerUBJSON       = "ubjson"
+	PPTSerializerFlatbuffers  = "flatbuffers"
+	PPTCipherXSalsa20Poly1305 = "xsalsa20poly1305"
+	PPTCipherAES256GCM        = "aes256gcm"
 
 	// Options for subscriber filtering.
 	BlacklistKey = "exclude"
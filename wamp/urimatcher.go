@@ -0,0 +1,300 @@
+package wamp
+
+import (
+	"sort"
+	"strings"
+)
+
+// URIMatch is a pattern, added to a URIMatcher, that matches a URI.
+type URIMatch struct {
+	Pattern URI
+	Match   string // MatchExact, MatchPrefix, or MatchWildcard
+	Value   interface{}
+}
+
+// URIMatcher finds the exact, prefix, and wildcard patterns that match a URI,
+// such as the subscriptions that match a topic or the registrations that
+// match a procedure.
+//
+// Prefix and wildcard patterns are kept in a trie of URI components, so the
+// time to match a URI depends on the number of components in the URI, and
+// not on the number of patterns.  A prefix pattern matches a URI that starts
+// with the pattern, even if the last component of the pattern is only part of
+// a component of the URI, as specified by WAMP.  A wildcard pattern matches a
+// URI with the same number of components, where each empty component of the
+// pattern matches any component.
+//
+// A URIMatcher is not safe for concurrent use.
+type URIMatcher struct {
+	exact map[URI]interface{}
+	root  *uriNode
+	count int // number of prefix and wildcard patterns
+}
+
+// uriNode is a node of the component trie.  The path from the root to the
+// node is the components that precede the node.
+type uriNode struct {
+	// component -> next node.  The empty component is the wildcard in
+	// wildcard patterns.
+	children map[string]*uriNode
+
+	// last component, which may be part of a URI component -> prefix pattern
+	// that ends with the component.
+	prefixes map[string]*URIMatch
+
+	// Wildcard pattern that ends at this node, if any.
+	wildcard *URIMatch
+}
+
+// NewURIMatcher returns a new, empty, URIMatcher.
+func NewURIMatcher() *URIMatcher {
+	return &URIMatcher{
+		exact: map[URI]interface{}{},
+		root:  &uriNode{},
+	}
+}
+
+// Add adds the pattern, with the match policy, and the value returned when
+// the pattern matches a URI.  An empty match policy is the same as
+// MatchExact.  If the pattern is already added, its value is replaced.
+func (m *URIMatcher) Add(pattern URI, match string, value interface{}) {
+	switch match {
+	case MatchPrefix:
+		parts := strings.Split(string(pattern), ".")
+		node := m.root.walk(parts[:len(parts)-1], true)
+		last := parts[len(parts)-1]
+		if node.prefixes == nil {
+			node.prefixes = map[string]*URIMatch{}
+		}
+		if _, ok := node.prefixes[last]; !ok {
+			m.count++
+		}
+		node.prefixes[last] = &URIMatch{Pattern: pattern, Match: match, Value: value}
+	case MatchWildcard:
+		node := m.root.walk(strings.Split(string(pattern), "."), true)
+		if node.wildcard == nil {
+			m.count++
+		}
+		node.wildcard = &URIMatch{Pattern: pattern, Match: match, Value: value}
+	default:
+		m.exact[pattern] = value
+	}
+}
+
+// Remove removes the pattern with the match policy.
+func (m *URIMatcher) Remove(pattern URI, match string) {
+	switch match {
+	case MatchPrefix:
+		parts := strings.Split(string(pattern), ".")
+		path := m.root.path(parts[:len(parts)-1])
+		if path == nil {
+			return
+		}
+		node := path[len(path)-1]
+		last := parts[len(parts)-1]
+		if _, ok := node.prefixes[last]; !ok {
+			return
+		}
+		delete(node.prefixes, last)
+		m.count--
+		prune(path, parts)
+	case MatchWildcard:
+		parts := strings.Split(string(pattern), ".")
+		path := m.root.path(parts)
+		if path == nil || path[len(path)-1].wildcard == nil {
+			return
+		}
+		path[len(path)-1].wildcard = nil
+		m.count--
+		prune(path, parts)
+	default:
+		delete(m.exact, pattern)
+	}
+}
+
+// Get returns the value of the pattern with the match policy, and false if
+// the pattern was not added.
+func (m *URIMatcher) Get(pattern URI, match string) (interface{}, bool) {
+	switch match {
+	case MatchPrefix:
+		parts := strings.Split(string(pattern), ".")
+		path := m.root.path(parts[:len(parts)-1])
+		if path == nil {
+			return nil, false
+		}
+		if pm, ok := path[len(path)-1].prefixes[parts[len(parts)-1]]; ok {
+			return pm.Value, true
+		}
+	case MatchWildcard:
+		path := m.root.path(strings.Split(string(pattern), "."))
+		if path != nil && path[len(path)-1].wildcard != nil {
+			return path[len(path)-1].wildcard.Value, true
+		}
+	default:
+		v, ok := m.exact[pattern]
+		return v, ok
+	}
+	return nil, false
+}
+
+// Matches returns all the patterns that match the URI, in order of WAMP
+// precedence: the exact match, then prefix matches from longest to shortest,
+// then wildcard matches from most to least specific.
+func (m *URIMatcher) Matches(uri URI) []URIMatch {
+	var matches []URIMatch
+	if v, ok := m.exact[uri]; ok {
+		matches = append(matches, URIMatch{Pattern: uri, Match: MatchExact, Value: v})
+	}
+	if m.count == 0 {
+		return matches
+	}
+	parts := strings.Split(string(uri), ".")
+
+	// Prefix matches are found from shortest to longest, so reverse them.
+	start := len(matches)
+	m.root.matchPrefix(parts, func(pm *URIMatch) {
+		matches = append(matches, *pm)
+	})
+	for i, j := start, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+
+	start = len(matches)
+	m.root.matchWildcard(parts, func(wm *URIMatch) {
+		matches = append(matches, *wm)
+	})
+	wcMatches := matches[start:]
+	sort.Slice(wcMatches, func(i, j int) bool {
+		return moreSpecific(wcMatches[i].Pattern, wcMatches[j].Pattern)
+	})
+	return matches
+}
+
+// Best returns the pattern that matches the URI with the highest WAMP
+// precedence, and false if no pattern matches.  An exact match is preferred
+// over a prefix match, which is preferred over a wildcard match.  Among
+// prefix matches, the longest is preferred, and among wildcard matches, the
+// most specific.
+func (m *URIMatcher) Best(uri URI) (URIMatch, bool) {
+	if v, ok := m.exact[uri]; ok {
+		return URIMatch{Pattern: uri, Match: MatchExact, Value: v}, true
+	}
+	if m.count == 0 {
+		return URIMatch{}, false
+	}
+	parts := strings.Split(string(uri), ".")
+	var best *URIMatch
+	m.root.matchPrefix(parts, func(pm *URIMatch) { best = pm })
+	if best == nil {
+		m.root.matchWildcard(parts, func(wm *URIMatch) {
+			if best == nil || moreSpecific(wm.Pattern, best.Pattern) {
+				best = wm
+			}
+		})
+	}
+	if best == nil {
+		return URIMatch{}, false
+	}
+	return *best, true
+}
+
+// moreSpecific returns true if wildcard pattern a takes precedence over b.
+// The longer pattern, having more non-wildcard characters, is more specific.
+// Patterns of the same length are ordered lexically, so that the choice is
+// always the same.
+func moreSpecific(a, b URI) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a < b
+}
+
+// walk returns the node at the end of the path of components, creating nodes
+// if create is true.  Returns nil if a node does not exist and create is
+// false.
+func (n *uriNode) walk(parts []string, create bool) *uriNode {
+	for _, part := range parts {
+		child, ok := n.children[part]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = map[string]*uriNode{}
+			}
+			child = &uriNode{}
+			n.children[part] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// path returns the nodes from this node to the end of the path of
+// components, or nil if a node does not exist.
+func (n *uriNode) path(parts []string) []*uriNode {
+	path := make([]*uriNode, 1, len(parts)+1)
+	path[0] = n
+	for _, part := range parts {
+		child, ok := n.children[part]
+		if !ok {
+			return nil
+		}
+		path = append(path, child)
+		n = child
+	}
+	return path
+}
+
+// prune removes the empty nodes at the end of the path.  The components are
+// the keys of the nodes after the first.
+func prune(path []*uriNode, parts []string) {
+	for i := len(path) - 1; i > 0; i-- {
+		node := path[i]
+		if len(node.children) != 0 || len(node.prefixes) != 0 || node.wildcard != nil {
+			return
+		}
+		delete(path[i-1].children, parts[i-1])
+	}
+}
+
+// matchPrefix calls fn for each prefix pattern that matches the URI
+// components, from shortest to longest.
+func (n *uriNode) matchPrefix(parts []string, fn func(*URIMatch)) {
+	for i, part := range parts {
+		if len(n.prefixes) != 0 {
+			// The last component of a prefix pattern matches any URI
+			// component that starts with it.  A pattern that ends with a
+			// "." has an empty last component that matches any component.
+			for j := 0; j <= len(part); j++ {
+				if pm, ok := n.prefixes[part[:j]]; ok {
+					fn(pm)
+				}
+			}
+		}
+		child, ok := n.children[part]
+		if !ok || i == len(parts)-1 {
+			return
+		}
+		n = child
+	}
+}
+
+// matchWildcard calls fn for each wildcard pattern that matches the URI
+// components.
+func (n *uriNode) matchWildcard(parts []string, fn func(*URIMatch)) {
+	if len(parts) == 0 {
+		if n.wildcard != nil {
+			fn(n.wildcard)
+		}
+		return
+	}
+	if child, ok := n.children[parts[0]]; ok {
+		child.matchWildcard(parts[1:], fn)
+	}
+	if parts[0] != "" {
+		if child, ok := n.children[""]; ok {
+			child.matchWildcard(parts[1:], fn)
+		}
+	}
+}
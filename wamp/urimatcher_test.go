@@ -0,0 +1,128 @@
+package wamp
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestURIMatcher(t *testing.T) {
+	m := NewURIMatcher()
+	patterns := []struct {
+		pattern URI
+		match   string
+	}{
+		{"this.is.a.test", MatchExact},
+		{"this.is.a", MatchPrefix},
+		{"this.is.", MatchPrefix},
+		{"this.i", MatchPrefix},
+		{"this.is.a.test.ok", MatchPrefix},
+		{"not.a.test", MatchPrefix},
+		{"this.is..test", MatchWildcard},
+		{"this...test", MatchWildcard},
+		{".is.a.test", MatchWildcard},
+		{"...", MatchWildcard},
+		{"this.is.a", MatchWildcard},
+		{"....", MatchWildcard},
+	}
+	for _, p := range patterns {
+		m.Add(p.pattern, p.match, fmt.Sprint(p.match, ":", p.pattern))
+	}
+	if n := len(m.exact) + m.count; n != len(patterns) {
+		t.Fatal("wrong number of patterns:", n)
+	}
+
+	// Compare with the URI methods that match a single pattern.
+	for _, uri := range []URI{"this.is.a.test", "this.is.another.test", "this.isnt", "not.a.test.at.all", "a.b.c.d"} {
+		var want []string
+		for _, p := range patterns {
+			var ok bool
+			switch p.match {
+			case MatchPrefix:
+				ok = uri.PrefixMatch(p.pattern)
+			case MatchWildcard:
+				ok = uri.WildcardMatch(p.pattern)
+			default:
+				ok = uri == p.pattern
+			}
+			if ok {
+				want = append(want, fmt.Sprint(p.match, ":", p.pattern))
+			}
+		}
+		var got []string
+		for _, match := range m.Matches(uri) {
+			got = append(got, match.Value.(string))
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("wrong matches for %s\nexpected: %v\ngot:      %v", uri, want, got)
+		}
+	}
+
+	// Matches are in order of precedence.
+	var got []URI
+	for _, match := range m.Matches("this.is.a.test") {
+		got = append(got, match.Pattern)
+	}
+	want := "[this.is.a.test this.is.a this.is. this.i this.is..test this...test .is.a.test ...]"
+	if fmt.Sprint(got) != want {
+		t.Fatal("wrong order of matches:", got)
+	}
+
+	for uri, want := range map[URI]string{
+		"this.is.a.test":       "exact:this.is.a.test",
+		"this.is.another.test": "prefix:this.is.a",
+		"this.isnt.a.test":     "prefix:this.i",
+		"that.is.a.test":       "wildcard:.is.a.test",
+		"that.was.a.test":      "wildcard:...",
+	} {
+		best, ok := m.Best(uri)
+		if !ok || best.Value != want {
+			t.Errorf("expected best match for %s to be %s, got %v", uri, want, best.Value)
+		}
+	}
+	if _, ok := m.Best("that.is.it"); ok {
+		t.Fatal("expected no match")
+	}
+
+	if v, ok := m.Get("this.is.", MatchPrefix); !ok || v != "prefix:this.is." {
+		t.Fatal("wrong value for prefix pattern:", v)
+	}
+	if _, ok := m.Get("this.is", MatchPrefix); ok {
+		t.Fatal("expected no prefix pattern")
+	}
+	if v, ok := m.Get("...", MatchWildcard); !ok || v != "wildcard:..." {
+		t.Fatal("wrong value for wildcard pattern:", v)
+	}
+
+	// Removing all patterns leaves an empty trie.
+	m.Remove("this.is", MatchPrefix) // not added
+	for _, p := range patterns {
+		m.Remove(p.pattern, p.match)
+	}
+	if n := len(m.exact) + m.count; n != 0 {
+		t.Fatal("expected no patterns, got", n)
+	}
+	if len(m.root.children) != 0 || len(m.root.prefixes) != 0 {
+		t.Fatal("expected empty trie after removing all patterns")
+	}
+	if matches := m.Matches("this.is.a.test"); len(matches) != 0 {
+		t.Fatal("expected no matches, got", matches)
+	}
+}
+
+func BenchmarkURIMatcher(b *testing.B) {
+	m := NewURIMatcher()
+	for i := 0; i < 10000; i++ {
+		m.Add(URI(fmt.Sprintf("com.example.device%d.", i)), MatchPrefix, i)
+		m.Add(URI(fmt.Sprintf("com.example..sensor%d", i)), MatchWildcard, i)
+	}
+	uri := URI("com.example.device5000.sensor5000")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(m.Matches(uri)) != 2 {
+			b.Fatal("expected 2 matches")
+		}
+	}
+}
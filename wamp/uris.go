@@ -52,6 +52,10 @@ const (
 	CloseGoodbyeAndOut = URI("wamp.close.goodbye_and_out")
 	ErrGoodbyeAndOut   = CloseGoodbyeAndOut
 
+	// The router closed the session because the Peer did not receive
+	// messages as fast as they were sent to it - used as a GOODBYE reason.
+	CloseSlowConsumer = URI("wamp.close.slow_consumer")
+
 	// -- Authorization --
 
 	// A join, call, register, publish or subscribe failed, since the Peer is
@@ -86,10 +90,18 @@ const (
 	// A Dealer or Callee canceled a call previously issued.
 	ErrCanceled = URI("wamp.error.canceled")
 
+	// A Dealer could not perform a call, since no callee registered the
+	// procedure within the time that the call waited for a callee.
+	ErrTimeout = URI("wamp.error.timeout")
+
 	// A Peer requested an interaction with an option that was disallowed by
 	// the Router.
 	ErrOptionNotAllowed = URI("wamp.error.option_not_allowed")
 
+	// A Peer requested an interaction using a feature that is not supported
+	// by the Peer handling the request.
+	ErrFeatureNotSupported = URI("wamp.error.feature_not_supported")
+
 	// A Dealer could not perform a call, since a procedure with the given URI
 	// is registered, but Callee Black- and Whitelisting and/or Caller
 	// Exclusion lead to the exclusion of (any) Callee providing the procedure.
@@ -104,6 +116,18 @@ const (
 	// A Peer received invalid WAMP protocol message.
 	ErrProtocolViolation = URI("wamp.error.protocol_violation")
 
+	// -- Nexus Errors --
+
+	// A Dealer could not perform a call, since all callees of the
+	// registration are at their concurrency limit and the registration's
+	// queue of waiting calls is full.
+	ErrCallQueueFull = URI("nexus.error.call_queue_full")
+
+	// A Dealer could not perform a progressive call, since all callees of
+	// the registration are at their concurrency limit.  Progressive calls
+	// are not queued.
+	ErrCalleesBusy = URI("nexus.error.callees_busy")
+
 	// -- Session Meta Events --
 
 	// Fired when a session joins a realm on the router.
@@ -112,6 +136,10 @@ const (
 	// Fired when a session leaves a realm on the router or is disconnected.
 	MetaEventSessionOnLeave = URI("wamp.session.on_leave")
 
+	// Fired when a session's outbound message queue is full, and the router
+	// applies the realm's slow-consumer policy to messages sent to it.
+	MetaEventSessionOnLagging = URI("wamp.session.on_lagging")
+
 	// -- Session Meta Procedures --
 
 	// Obtains the number of sessions currently attached to the realm.
@@ -180,6 +208,12 @@ const (
 	// Obtains the number of sessions currently attached to the registration.
 	MetaProcRegCountCallees = URI("wamp.registration.count_callees")
 
+	// Removes all cached call results for a registration (non-standard).
+	MetaProcRegInvalidateCache = URI("wamp.registration.invalidate_cache")
+
+	// Retrieves the call statistics of a registration (non-standard).
+	MetaProcRegGetStats = URI("wamp.registration.get_stats")
+
 	// -- Subscription Meta Events --
 
 	// Fired when a subscription is created through a subscription request for
@@ -219,6 +253,15 @@ const (
 	// Obtains the number of sessions currently attached to the subscription.
 	MetaProcSubCountSubscribers = URI("wamp.subscription.count_suscribers")
 
+	// Retrieves the events, kept in the event history, that were published
+	// to topics matching the subscription and that the caller, a subscriber
+	// of the subscription, is allowed to receive.
+	MetaProcSubGetEvents = URI("wamp.subscription.get_events")
+
+	// Acknowledges the events, sent using a reliable subscription, up to and
+	// including a sequence number.
+	MetaProcSubAck = URI("wamp.subscription.ack")
+
 	// -- Testament Meta Procedures --
 
 	// Add a Testament which will be published on a particular topic when the
@@ -228,4 +271,22 @@ const (
 	// Remove the Testaments for that Session, either for when it is detached
 	// or destroyed.
 	MetaProcSessionFlushTestaments = URI("wamp.session.flush_testaments")
+
+	// -- Reflection Meta Procedures --
+
+	// Retrieves a list of the URIs of registered procedures.
+	MetaProcReflectProcList = URI("wamp.reflection.procedure.list")
+
+	// Retrieves the registration and schema of a procedure.
+	MetaProcReflectProcDescribe = URI("wamp.reflection.procedure.describe")
+
+	// Retrieves a list of the URIs of topics that have subscribers or a
+	// defined schema.
+	MetaProcReflectTopicList = URI("wamp.reflection.topic.list")
+
+	// Retrieves the subscriptions and schema of a topic.
+	MetaProcReflectTopicDescribe = URI("wamp.reflection.topic.describe")
+
+	// Defines the schema of the events published to a topic (non-standard).
+	MetaProcReflectTopicDefine = URI("wamp.reflection.topic.define")
 )